@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// defaultRedactedFields - поля, значения которых по умолчанию не попадают в журнал запросов.
+const defaultRedactedFields = "password,token,access_token,secret"
+
+// requestIDHeader - заголовок с ID запроса. Переданный клиентом ID сохраняется,
+// иначе генерируется новый; ID возвращается в ответе.
+const requestIDHeader = "X-Request-ID"
+
+// redacted - значение, которым заменяются скрытые поля.
+const redacted = "[redacted]"
+
+// accessRecord - строка журнала запросов.
+type accessRecord struct {
+	Time       time.Time           `json:"time"`
+	RequestID  string              `json:"request_id"`
+	Method     string              `json:"method"`
+	Path       string              `json:"path"`
+	Route      string              `json:"route"`
+	Query      map[string][]string `json:"query,omitempty"`
+	Status     int                 `json:"status"`
+	Bytes      int64               `json:"bytes"`
+	DurationMs float64             `json:"duration_ms"`
+	RemoteAddr string              `json:"remote_addr"`
+	UserAgent  string              `json:"user_agent,omitempty"`
+}
+
+// AccessLogger пишет журнал запросов: по одной строке JSON на запрос,
+// после того как обработчик отработал. Значения параметров запроса из списка
+// скрытых полей заменяются на [redacted]. Если задан Metrics, туда же
+// записываются счётчики и длительность запросов (независимо от уровня журнала).
+type AccessLogger struct {
+	mu      sync.Mutex
+	out     io.Writer
+	level   LogLevel
+	redact  map[string]bool
+	metrics *Metrics
+	// now - источник текущего времени (подменяется в тестах).
+	now func() time.Time
+}
+
+// NewAccessLogger создаёт журнал запросов, пишущий в out. Имена скрытых полей
+// сравниваются без учёта регистра.
+func NewAccessLogger(out io.Writer, redactFields []string, metrics *Metrics) *AccessLogger {
+	l := &AccessLogger{out: out, metrics: metrics, now: time.Now}
+	l.Configure(LevelInfo, redactFields)
+	return l
+}
+
+// Configure меняет уровень журнала и список скрытых полей (при перезагрузке настроек).
+func (l *AccessLogger) Configure(level LogLevel, redactFields []string) {
+	redact := make(map[string]bool, len(redactFields))
+	for _, f := range redactFields {
+		if f = strings.TrimSpace(f); f != "" {
+			redact[strings.ToLower(f)] = true
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.level = level
+	l.redact = redact
+}
+
+// Middleware оборачивает обработчик маршрута route: присваивает запросу ID,
+// замеряет статус, размер ответа и длительность и пишет строку журнала.
+func (l *AccessLogger) Middleware(route string, next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := l.now()
+		requestID := r.Header.Get(requestIDHeader)
+		if !validRequestID(requestID) {
+			requestID = uuid.NewString()
+		}
+		w.Header().Set(requestIDHeader, requestID)
+		rec := &statusRecorder{ResponseWriter: w}
+		next(rec, r)
+
+		elapsed := l.now().Sub(start)
+		status := rec.statusCode()
+		if l.metrics != nil {
+			l.metrics.Observe(route, r.Method, status, elapsed)
+		}
+		l.write(accessRecord{
+			Time:       start.UTC(),
+			RequestID:  requestID,
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Route:      route,
+			Query:      l.redactValues(r.URL.Query()),
+			Status:     status,
+			Bytes:      rec.bytes,
+			DurationMs: float64(elapsed.Microseconds()) / 1000,
+			RemoteAddr: r.RemoteAddr,
+			UserAgent:  r.UserAgent(),
+		})
+	})
+}
+
+// redactValues возвращает копию параметров со скрытыми значениями.
+func (l *AccessLogger) redactValues(values map[string][]string) map[string][]string {
+	if len(values) == 0 {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	result := make(map[string][]string, len(values))
+	for k, v := range values {
+		if l.redact[strings.ToLower(k)] {
+			v = []string{redacted}
+		}
+		result[k] = v
+	}
+	return result
+}
+
+// write записывает строку журнала одним вызовом Write, если уровень записи
+// (по статусу ответа) не ниже уровня журнала.
+func (l *AccessLogger) write(rec accessRecord) {
+	level := LevelInfo
+	switch {
+	case rec.Status >= 500:
+		level = LevelError
+	case rec.Status >= 400:
+		level = LevelWarn
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if level < l.level {
+		return
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		log.Printf("accessLogger: %v", err)
+		return
+	}
+	if _, err := l.out.Write(append(line, '\n')); err != nil {
+		log.Printf("accessLogger: %v", err)
+	}
+}
+
+// validRequestID проверяет, что ID запроса от клиента можно безопасно вывести в журнал.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// statusRecorder - http.ResponseWriter, запоминающий статус-код и размер ответа.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Flush передаёт буферизованные данные клиенту, если это поддерживает исходный ResponseWriter.
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack передаёт управление соединением, если это поддерживает исходный ResponseWriter.
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking is not supported")
+	}
+	return h.Hijack()
+}
+
+// Unwrap возвращает исходный ResponseWriter (для http.ResponseController).
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// statusCode возвращает статус ответа; если обработчик ничего не записал - 200.
+func (r *statusRecorder) statusCode() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccessLogger(t *testing.T) {
+	out := &bytes.Buffer{}
+	metrics := NewMetrics()
+	l := NewAccessLogger(out, strings.Split(defaultRedactedFields, ","), metrics)
+	now := time.Date(2022, 1, 3, 10, 0, 0, 0, time.UTC)
+	l.now = func() time.Time {
+		now = now.Add(1500 * time.Microsecond)
+		return now
+	}
+	h := l.Middleware("/events_for_day", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("hello"))
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/events_for_day?user_id=42&Password=secret&date=03.01.2022", nil)
+	req.Header.Set(requestIDHeader, "req-1")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, "req-1", rec.Header().Get(requestIDHeader))
+
+	// запрос без ID и без записи в ответ
+	h = l.Middleware("/noop", func(w http.ResponseWriter, r *http.Request) {})
+	req = httptest.NewRequest(http.MethodPost, "/noop", nil)
+	req.Header.Set(requestIDHeader, "bad id\n")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	generated := rec.Header().Get(requestIDHeader)
+	assert.NotEqual(t, "bad id\n", generated)
+	assert.NotEmpty(t, generated)
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	require.Equal(t, 2, len(lines))
+	assert.NotContains(t, out.String(), "secret")
+
+	var first accessRecord
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &first))
+	assert.Equal(t, "req-1", first.RequestID)
+	assert.Equal(t, http.MethodGet, first.Method)
+	assert.Equal(t, "/events_for_day", first.Path)
+	assert.Equal(t, http.StatusTeapot, first.Status)
+	assert.Equal(t, int64(5), first.Bytes)
+	assert.Equal(t, 1.5, first.DurationMs)
+	assert.Equal(t, []string{redacted}, first.Query["Password"])
+	assert.Equal(t, []string{"03.01.2022"}, first.Query["date"])
+
+	var second accessRecord
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &second))
+	assert.Equal(t, generated, second.RequestID)
+	assert.Equal(t, http.StatusOK, second.Status)
+	assert.Nil(t, second.Query)
+
+	buf := &bytes.Buffer{}
+	w := bufio.NewWriter(buf)
+	metrics.write(w)
+	w.Flush()
+	assert.Contains(t, buf.String(), `calendar_http_requests_total{route="/events_for_day",method="GET",status="418"} 1`)
+	assert.Contains(t, buf.String(), `calendar_http_requests_total{route="/noop",method="POST",status="200"} 1`)
+}
+
+func TestAccessLoggerLevel(t *testing.T) {
+	out := &bytes.Buffer{}
+	l := NewAccessLogger(out, nil, nil)
+	statuses := []int{http.StatusOK, http.StatusNotFound, http.StatusInternalServerError}
+	tests := []struct {
+		level    LogLevel
+		expected int
+	}{
+		{LevelDebug, 3},
+		{LevelInfo, 3},
+		{LevelWarn, 2},
+		{LevelError, 1},
+	}
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("#%d", i), func(t *testing.T) {
+			out.Reset()
+			l.Configure(test.level, nil)
+			for _, status := range statuses {
+				status := status
+				h := l.Middleware("/", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(status) })
+				h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+			}
+			assert.Equal(t, test.expected, strings.Count(out.String(), "\n"))
+		})
+	}
+}
+
+func TestStatusRecorderFlush(t *testing.T) {
+	l := NewAccessLogger(&bytes.Buffer{}, nil, nil)
+	flushed := false
+	h := l.Middleware("/stream", func(w http.ResponseWriter, r *http.Request) {
+		f, ok := w.(http.Flusher)
+		require.True(t, ok)
+		w.Write([]byte("data"))
+		f.Flush()
+		flushed = true
+	})
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stream", nil))
+	assert.True(t, flushed)
+	assert.True(t, rec.Flushed)
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// apiV2Prefix - префикс маршрутов REST API второй версии.
+const apiV2Prefix = "/api/v2/users/"
+
+// maxJSONBody - максимальный размер JSON-тела запроса к API v2.
+const maxJSONBody = 1 << 20
+
+// localLayout - формат момента без смещения, трактуемого в часовом поясе события.
+const localLayout = "2006-01-02T15:04"
+
+// eventV2 - представление события в API v2. Моменты времени передаются в формате
+// RFC 3339; в ответах они выводятся в часовом поясе события. Момент без смещения
+// (2006-01-02T15:04) трактуется в поясе tz. Поля end и version только для чтения.
+type eventV2 struct {
+	ID       uuid.UUID `json:"id"`
+	UserID   uuid.UUID `json:"user_id"`
+	When     string    `json:"when"`
+	End      string    `json:"end,omitempty"`
+	TZ       string    `json:"tz,omitempty"`
+	Where    string    `json:"where,omitempty"`
+	What     string    `json:"what,omitempty"`
+	Duration string    `json:"duration,omitempty"`
+	RRule    string    `json:"rrule,omitempty"`
+	ExDates  []string  `json:"exdates,omitempty"`
+	// Reminders - напоминания: за сколько до начала (15m, 1h, 1d).
+	Reminders []string `json:"reminders,omitempty"`
+	// Attendees - участники. Ответы (status) только для чтения: новые участники
+	// получают needs-action, ответы остающихся участников сохраняются.
+	Attendees []attendeeV2 `json:"attendees,omitempty"`
+	Version   uint64       `json:"version,omitempty"`
+}
+
+// attendeeV2 - представление участника события в API v2.
+type attendeeV2 struct {
+	UserID uuid.UUID  `json:"user_id"`
+	Status RSVPStatus `json:"status,omitempty"`
+}
+
+// newEventV2 переводит событие в представление API v2.
+func newEventV2(e Event) eventV2 {
+	loc := e.Location()
+	v := eventV2{
+		ID:      e.ID,
+		UserID:  e.UserID,
+		When:    e.When.In(loc).Format(time.RFC3339),
+		TZ:      e.TZ,
+		Where:   e.Where,
+		What:    e.What,
+		Version: e.Version,
+	}
+	if e.Duration > 0 {
+		v.End = e.End().In(loc).Format(time.RFC3339)
+		v.Duration = e.Duration.String()
+	}
+	if e.Recurrence != nil {
+		v.RRule = e.Recurrence.String()
+	}
+	for _, ex := range e.ExDates {
+		v.ExDates = append(v.ExDates, ex.In(loc).Format(time.RFC3339))
+	}
+	for _, d := range e.Reminders {
+		v.Reminders = append(v.Reminders, formatReminderOffset(d))
+	}
+	for _, a := range e.Attendees {
+		v.Attendees = append(v.Attendees, attendeeV2{UserID: a.UserID, Status: a.Status})
+	}
+	return v
+}
+
+// event проверяет представление и собирает из него событие. Проверки те же,
+// что и у параметров /create_event и /update_event.
+func (v eventV2) event() (Event, error) {
+	loc, err := loadLocation(v.TZ)
+	if err != nil {
+		return Event{}, fmt.Errorf("incorrect time zone: %w", err)
+	}
+	e := Event{
+		ID:     v.ID,
+		UserID: v.UserID,
+		Where:  v.Where,
+		What:   v.What,
+		TZ:     loc.String(),
+	}
+	if v.When == "" {
+		return Event{}, errors.New("missing field: when")
+	}
+	if e.When, err = parseMoment(v.When, loc); err != nil {
+		return Event{}, fmt.Errorf("incorrect when: %w", err)
+	}
+	if v.Duration != "" {
+		if e.Duration, err = parseDuration(v.Duration); err != nil {
+			return Event{}, fmt.Errorf("incorrect duration: %w", err)
+		}
+	}
+	if v.RRule != "" {
+		if e.Recurrence, err = ParseEventRRule(v.RRule, e.When); err != nil {
+			return Event{}, err
+		}
+	}
+	for _, s := range v.ExDates {
+		ex, err := parseMoment(s, loc)
+		if err != nil {
+			return Event{}, fmt.Errorf("incorrect exdate: %w", err)
+		}
+		e.ExDates = append(e.ExDates, ex)
+	}
+	if len(v.Reminders) > 0 {
+		if e.Reminders, err = parseReminders(strings.Join(v.Reminders, ",")); err != nil {
+			return Event{}, fmt.Errorf("incorrect reminders: %w", err)
+		}
+	}
+	ids := make([]uuid.UUID, 0, len(v.Attendees))
+	for _, a := range v.Attendees {
+		ids = append(ids, a.UserID)
+	}
+	if err := validateAttendees(ids, e.UserID); err != nil {
+		return Event{}, fmt.Errorf("incorrect attendees: %w", err)
+	}
+	e.Attendees = mergeAttendees(nil, ids)
+	return e, nil
+}
+
+// parseMoment разбирает момент в формате RFC 3339 либо без смещения (localLayout) в поясе loc.
+func parseMoment(s string, loc *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation(localLayout, s, loc)
+}
+
+// mergePatch применяет к документу target изменения patch по правилам
+// JSON Merge Patch (RFC 7396): null удаляет поле, объекты сливаются рекурсивно,
+// остальные значения заменяются целиком.
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{}, len(p))
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+			continue
+		}
+		t[k] = mergePatch(t[k], v)
+	}
+	return t
+}
+
+// EventsV2 обрабатывает REST API второй версии. Тела запросов и ответов - JSON.
+//
+//	POST   /api/v2/users/{user_id}/events 				создать событие (201, 409 - событие с таким id уже есть)
+//	GET    /api/v2/users/{user_id}/events[?from&to] 	события пользователя; с from и to (RFC 3339) - вхождения в отрезке
+//	GET    /api/v2/users/{user_id}/events/{event_id} 	событие (404 - нет события)
+//	PATCH  /api/v2/users/{user_id}/events/{event_id} 	изменить событие (JSON Merge Patch)
+//	DELETE /api/v2/users/{user_id}/events/{event_id} 	удалить событие (204)
+//
+// POST и PATCH принимают параметр allow_overlap=false: пересечение с другими
+// событиями пользователя отклоняется с кодом 409. Ответы с событием содержат
+// заголовок ETag с его версией; PATCH и DELETE с заголовком If-Match, не
+// совпадающим с текущей версией, отклоняются с кодом 412.
+func (c CalendarAPI) EventsV2(w http.ResponseWriter, r *http.Request) {
+	const logHeader = "eventsV2"
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, apiV2Prefix), "/"), "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[1] != "events" {
+		returnError(w, logHeader, "", http.StatusNotFound)
+		return
+	}
+	userID, err := uuid.Parse(parts[0])
+	if err != nil {
+		returnError(w, logHeader, fmt.Sprintf("incorrect user ID: %v", err), http.StatusBadRequest)
+		return
+	}
+	if !authorized(r, userID) {
+		returnError(w, logHeader, "access denied", http.StatusForbidden)
+		return
+	}
+	if len(parts) == 2 {
+		switch r.Method {
+		case http.MethodPost:
+			c.createEventV2(w, r, userID)
+		case http.MethodGet:
+			c.listEventsV2(w, r, userID)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			returnError(w, logHeader, "", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	eventID, err := uuid.Parse(parts[2])
+	if err != nil {
+		returnError(w, logHeader, fmt.Sprintf("incorrect event ID: %v", err), http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		event, ok := c.userEventV2(w, userID, eventID)
+		if ok {
+			w.Header().Set("ETag", versionETag(event.Version))
+			returnJSON(w, logHeader, newEventV2(event), http.StatusOK)
+		}
+	case http.MethodPatch:
+		c.patchEventV2(w, r, userID, eventID)
+	case http.MethodDelete:
+		c.deleteEventV2(w, r, userID, eventID)
+	default:
+		w.Header().Set("Allow", "GET, PATCH, DELETE")
+		returnError(w, logHeader, "", http.StatusMethodNotAllowed)
+	}
+}
+
+func (c CalendarAPI) createEventV2(w http.ResponseWriter, r *http.Request, userID uuid.UUID) {
+	const logHeader = "createEventV2"
+	var v eventV2
+	if !decodeJSONBody(w, r, logHeader, &v) {
+		return // ошибки уже обработаны
+	}
+	if v.UserID != uuid.Nil && v.UserID != userID {
+		returnError(w, logHeader, "user_id does not match the URL", http.StatusBadRequest)
+		return
+	}
+	v.UserID = userID
+	if v.ID == uuid.Nil {
+		v.ID = uuid.New()
+	}
+	event, err := v.event()
+	if err != nil {
+		returnError(w, logHeader, err.Error(), http.StatusBadRequest)
+		return
+	}
+	event.Version = 1
+	event.ModifiedBy = modifiedBy(r, userID)
+	checkOverlap, ok := checkOverlapV2(w, r, logHeader)
+	if !ok {
+		return
+	}
+	if err := saveEvent(c.storage, event, checkOverlap, EventStorage.Add); err != nil {
+		returnStorageErrorV2(w, logHeader, err)
+		return
+	}
+	w.Header().Set("Location", eventURLV2(event))
+	w.Header().Set("ETag", versionETag(event.Version))
+	returnJSON(w, logHeader, newEventV2(event), http.StatusCreated)
+	log.Printf("%s: created event %+v", logHeader, event)
+}
+
+func (c CalendarAPI) listEventsV2(w http.ResponseWriter, r *http.Request, userID uuid.UUID) {
+	const logHeader = "listEventsV2"
+	var (
+		events []Event
+		err    error
+	)
+	queryFrom, queryTo := r.URL.Query().Get("from"), r.URL.Query().Get("to")
+	switch {
+	case queryFrom == "" && queryTo == "":
+		events, err = c.storage.GetByUser(userID)
+	case queryFrom == "" || queryTo == "":
+		returnError(w, logHeader, "from and to must be given together", http.StatusBadRequest)
+		return
+	default:
+		from, errFrom := time.Parse(time.RFC3339, queryFrom)
+		to, errTo := time.Parse(time.RFC3339, queryTo)
+		if errFrom != nil || errTo != nil {
+			returnError(w, logHeader, "from and to must be in RFC 3339 format", http.StatusBadRequest)
+			return
+		}
+		events, err = c.storage.GetRange(userID, from, to)
+	}
+	if err != nil {
+		returnError(w, logHeader, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	result := make([]eventV2, 0, len(events))
+	for _, e := range events {
+		result = append(result, newEventV2(e))
+	}
+	returnJSON(w, logHeader, result, http.StatusOK)
+}
+
+func (c CalendarAPI) patchEventV2(w http.ResponseWriter, r *http.Request, userID, eventID uuid.UUID) {
+	const logHeader = "patchEventV2"
+	var patch interface{}
+	if !decodeJSONBody(w, r, logHeader, &patch) {
+		return // ошибки уже обработаны
+	}
+	if _, ok := patch.(map[string]interface{}); !ok {
+		returnError(w, logHeader, "merge patch must be a JSON object", http.StatusBadRequest)
+		return
+	}
+	event, ok := c.userEventV2(w, userID, eventID)
+	if !ok || !checkIfMatchV2(w, r, logHeader, event) {
+		return
+	}
+	updated, err := mergeEventV2(event, patch)
+	if err != nil {
+		returnError(w, logHeader, err.Error(), http.StatusBadRequest)
+		return
+	}
+	updated.Version = event.Version + 1
+	updated.ModifiedBy = modifiedBy(r, userID)
+	checkOverlap, ok := checkOverlapV2(w, r, logHeader)
+	if !ok {
+		return
+	}
+	if err := saveEvent(c.storage, updated, checkOverlap, EventStorage.Update); err != nil {
+		returnStorageErrorV2(w, logHeader, err)
+		return
+	}
+	w.Header().Set("ETag", versionETag(updated.Version))
+	returnJSON(w, logHeader, newEventV2(updated), http.StatusOK)
+	log.Printf("%s: updated event %+v", logHeader, updated)
+}
+
+// mergeEventV2 применяет к событию изменения patch в формате JSON Merge Patch
+// над его представлением в API v2. id и user_id изменять нельзя; ответы
+// остающихся участников сохраняются.
+func mergeEventV2(event Event, patch interface{}) (Event, error) {
+	// документ события -> слияние с патчем -> обратно в представление
+	doc, err := json.Marshal(newEventV2(event))
+	if err != nil {
+		return Event{}, err
+	}
+	var target interface{}
+	if err := json.Unmarshal(doc, &target); err != nil {
+		return Event{}, err
+	}
+	if doc, err = json.Marshal(mergePatch(target, patch)); err != nil {
+		return Event{}, err
+	}
+	var v eventV2
+	if err := decodeStrict(bytes.NewReader(doc), &v); err != nil {
+		return Event{}, err
+	}
+	if v.ID != event.ID || v.UserID != event.UserID {
+		return Event{}, errors.New("id and user_id cannot be changed")
+	}
+	updated, err := v.event()
+	if err != nil {
+		return Event{}, err
+	}
+	updated.Attendees = mergeAttendees(event.Attendees, attendeeIDs(updated.Attendees))
+	return updated, nil
+}
+
+func (c CalendarAPI) deleteEventV2(w http.ResponseWriter, r *http.Request, userID, eventID uuid.UUID) {
+	const logHeader = "deleteEventV2"
+	event, ok := c.userEventV2(w, userID, eventID)
+	if !ok || !checkIfMatchV2(w, r, logHeader, event) {
+		return
+	}
+	if err := c.storage.Delete(eventID); err != nil {
+		returnStorageErrorV2(w, logHeader, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+	log.Printf("%s: deleted event %v", logHeader, eventID)
+}
+
+// userEventV2 возвращает событие, организатор которого - пользователь userID.
+// Событие другого пользователя считается отсутствующим (404). Функция обрабатывает и логирует возникшие ошибки.
+func (c CalendarAPI) userEventV2(w http.ResponseWriter, userID, eventID uuid.UUID) (Event, bool) {
+	const logHeader = "userEventV2"
+	event, err := c.storage.Get(eventID)
+	if err == nil && event.UserID != userID {
+		err = ErrEventNotFound
+	}
+	if err != nil {
+		returnStorageErrorV2(w, logHeader, err)
+		return Event{}, false
+	}
+	return event, true
+}
+
+// checkOverlapV2 сообщает, нужно ли проверять пересечения события (в запросе
+// allow_overlap=false). Функция обрабатывает и логирует возникшие ошибки.
+func checkOverlapV2(w http.ResponseWriter, r *http.Request, logHeader string) (check bool, ok bool) {
+	allowOverlap, err := parseAllowOverlap(r.URL.Query().Get("allow_overlap"))
+	if err != nil {
+		returnError(w, logHeader, fmt.Sprintf("incorrect allow_overlap: %v", err), http.StatusBadRequest)
+		return false, false
+	}
+	return !allowOverlap, true
+}
+
+// checkIfMatchV2 проверяет заголовок If-Match (если он есть) по версии события
+// и отвечает 412, если событие уже изменено. Функция обрабатывает и логирует возникшие ошибки.
+func checkIfMatchV2(w http.ResponseWriter, r *http.Request, logHeader string, e Event) bool {
+	match := r.Header.Get("If-Match")
+	if match == "" || etagMatches(match, versionETag(e.Version)) {
+		return true
+	}
+	returnError(w, logHeader, fmt.Sprintf("event has been modified, current version %d", e.Version),
+		http.StatusPreconditionFailed)
+	return false
+}
+
+// eventURLV2 возвращает адрес события в API v2.
+func eventURLV2(e Event) string {
+	return fmt.Sprintf("%s%s/events/%s", apiV2Prefix, e.UserID, e.ID)
+}
+
+// decodeJSONBody проверяет Content-Type (application/json или
+// application/merge-patch+json) и декодирует тело запроса в v.
+// Функция обрабатывает и логирует возникшие ошибки.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, logHeader string, v interface{}) bool {
+	defer r.Body.Close()
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || (mediaType != "application/json" && mediaType != "application/merge-patch+json") {
+		returnError(w, logHeader, fmt.Sprintf("unsupported content type %q", r.Header.Get("Content-Type")),
+			http.StatusUnsupportedMediaType)
+		return false
+	}
+	if err := decodeStrict(http.MaxBytesReader(w, r.Body, maxJSONBody), v); err != nil {
+		returnError(w, logHeader, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// decodeStrict декодирует единственное JSON-значение, запрещая неизвестные поля.
+func decodeStrict(r io.Reader, v interface{}) error {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("incorrect JSON: %w", err)
+	}
+	if dec.More() {
+		return errors.New("incorrect JSON: unexpected data after the value")
+	}
+	return nil
+}
+
+// storageStatusV2 возвращает код ответа API v2 для ошибки хранилища:
+// нет события - 404, конфликт (в том числе версий) - 409, остальные - 500.
+func storageStatusV2(err error) int {
+	switch {
+	case errors.Is(err, ErrEventNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrEventAlreadyExists), errors.Is(err, ErrEventOverlap), errors.Is(err, ErrVersionConflict):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// returnStorageErrorV2 записывает ошибку хранилища с кодом API v2 (см. storageStatusV2).
+func returnStorageErrorV2(w http.ResponseWriter, logHeader string, err error) {
+	returnError(w, logHeader, err.Error(), storageStatusV2(err))
+}
+
+// returnJSON записывает в тело ответа v в формате JSON с требуемым статус-кодом.
+func returnJSON(w http.ResponseWriter, logHeader string, v interface{}, status int) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		returnError(w, logHeader, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
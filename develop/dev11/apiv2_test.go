@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// doJSON выполняет запрос к API v2 с JSON-телом (пустая строка - без тела).
+func doJSON(h http.HandlerFunc, method, path, contentType, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	rec := httptest.NewRecorder()
+	h(rec, req)
+	return rec
+}
+
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		target, patch, expected string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("#%d", i), func(t *testing.T) {
+			var target, patch interface{}
+			require.NoError(t, json.Unmarshal([]byte(test.target), &target))
+			require.NoError(t, json.Unmarshal([]byte(test.patch), &patch))
+			got, err := json.Marshal(mergePatch(target, patch))
+			require.NoError(t, err)
+			assert.JSONEq(t, test.expected, string(got))
+		})
+	}
+}
+
+func TestEventsV2(t *testing.T) {
+	storage := newTestStorage()
+	api := NewCalendar(storage)
+	userID := uuid.New()
+	base := fmt.Sprintf("/api/v2/users/%s/events", userID)
+	const ct = "application/json"
+
+	rec := doJSON(api.EventsV2, http.MethodPost, base, ct, `{
+		"when": "2022-01-03T10:00", "tz": "Europe/Moscow", "duration": "1h",
+		"what": "Стендап", "where": "Переговорная", "rrule": "FREQ=DAILY;COUNT=5",
+		"exdates": ["2022-01-04T10:00:00+03:00"]
+	}`)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	var created eventV2
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&created))
+	assert.Equal(t, userID, created.UserID)
+	assert.Equal(t, "2022-01-03T10:00:00+03:00", created.When)
+	assert.Equal(t, "2022-01-03T11:00:00+03:00", created.End)
+	assert.Equal(t, base+"/"+created.ID.String(), rec.Header().Get("Location"))
+	item := base + "/" + created.ID.String()
+
+	// событие с тем же id - конфликт
+	rec = doJSON(api.EventsV2, http.MethodPost, base, ct,
+		fmt.Sprintf(`{"id": %q, "when": "2022-01-05T10:00:00Z"}`, created.ID))
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	// пересечение с запретом allow_overlap
+	rec = doJSON(api.EventsV2, http.MethodPost, base+"?allow_overlap=false", ct,
+		`{"when": "2022-01-05T07:30:00Z", "duration": "1h"}`)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+
+	rec = doJSON(api.EventsV2, http.MethodGet, item, "", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var got eventV2
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&got))
+	assert.Equal(t, created, got)
+
+	rec = doJSON(api.EventsV2, http.MethodGet, base+"?from=2022-01-03T00:00:00Z&to=2022-01-06T00:00:00Z", "", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var list []eventV2
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&list))
+	// 03, 05 (04 исключено)
+	assert.Equal(t, 2, len(list))
+
+	// merge patch: изменение описания, удаление места и правила повторения
+	rec = doJSON(api.EventsV2, http.MethodPatch, item, "application/merge-patch+json",
+		`{"what": "Ретро", "where": null, "rrule": null, "exdates": null}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	event, err := storage.Get(created.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "Ретро", event.What)
+	assert.Equal(t, "", event.Where)
+	assert.Nil(t, event.Recurrence)
+	assert.Equal(t, "Europe/Moscow", event.TZ)
+	assert.Equal(t, "2022-01-03T10:00:00+03:00", newEventV2(event).When)
+
+	// смена часового пояса сохраняет момент начала
+	rec = doJSON(api.EventsV2, http.MethodPatch, item, "application/merge-patch+json", `{"tz": "UTC"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&got))
+	assert.Equal(t, "2022-01-03T07:00:00Z", got.When)
+	assert.Equal(t, uint64(3), got.Version)
+	assert.Equal(t, `"3"`, rec.Header().Get("ETag"))
+
+	// изменение с устаревшим If-Match отклоняется
+	for _, method := range []string{http.MethodPatch, http.MethodDelete} {
+		req := httptest.NewRequest(method, item, strings.NewReader(`{"what": "x"}`))
+		req.Header.Set("Content-Type", ct)
+		req.Header.Set("If-Match", `"2"`)
+		rec = httptest.NewRecorder()
+		api.EventsV2(rec, req)
+		assert.Equal(t, http.StatusPreconditionFailed, rec.Code, method)
+	}
+
+	// чужое событие не видно
+	other := fmt.Sprintf("/api/v2/users/%s/events/%s", uuid.New(), created.ID)
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		rec = doJSON(api.EventsV2, method, other, "", "")
+		assert.Equal(t, http.StatusNotFound, rec.Code, method)
+	}
+	rec = doJSON(api.EventsV2, http.MethodPatch, other, ct, `{"what": "x"}`)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = doJSON(api.EventsV2, http.MethodDelete, item, "", "")
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Empty(t, rec.Body.String())
+	rec = doJSON(api.EventsV2, http.MethodDelete, item, "", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestEventsV2Errors(t *testing.T) {
+	storage := newTestStorage()
+	api := NewCalendar(storage)
+	userID := uuid.New()
+	event := Event{ID: uuid.New(), UserID: userID, When: mustTime(t, "03.01.2022 10:00")}
+	require.NoError(t, storage.Add(event))
+	base := fmt.Sprintf("/api/v2/users/%s/events", userID)
+	item := base + "/" + event.ID.String()
+	const ct = "application/json"
+
+	tests := []struct {
+		method, path, contentType, body string
+		status                          int
+	}{
+		{http.MethodGet, "/api/v2/users/" + userID.String(), "", "", http.StatusNotFound},
+		{http.MethodGet, "/api/v2/users/42/events", "", "", http.StatusBadRequest},
+		{http.MethodGet, base + "/42", "", "", http.StatusBadRequest},
+		{http.MethodPut, item, ct, `{}`, http.StatusMethodNotAllowed},
+		{http.MethodDelete, base, "", "", http.StatusMethodNotAllowed},
+		{http.MethodGet, base + "?from=2022-01-03T00:00:00Z", "", "", http.StatusBadRequest},
+		{http.MethodPost, base, "text/plain", `{"when": "2022-01-03T10:00:00Z"}`, http.StatusUnsupportedMediaType},
+		{http.MethodPost, base, ct, `{"when": "2022-01-03T10:00:00Z"`, http.StatusBadRequest},
+		{http.MethodPost, base, ct, `{"when": "2022-01-03T10:00:00Z", "color": "red"}`, http.StatusBadRequest},
+		{http.MethodPost, base, ct, `{"what": "без даты"}`, http.StatusBadRequest},
+		{http.MethodPost, base, ct, `{"when": "завтра"}`, http.StatusBadRequest},
+		{http.MethodPost, base, ct, `{"when": "2022-01-03T10:00:00Z", "tz": "Mars/Olympus"}`, http.StatusBadRequest},
+		{http.MethodPost, base, ct, `{"when": "2022-01-03T10:00:00Z", "rrule": "FREQ=HOURLY"}`, http.StatusBadRequest},
+		{http.MethodPost, base, ct, `{"when": "2022-01-03T10:00:00Z", "duration": "-1h"}`, http.StatusBadRequest},
+		{http.MethodPost, base, ct, fmt.Sprintf(`{"when": "2022-01-03T10:00:00Z", "user_id": %q}`, uuid.New()), http.StatusBadRequest},
+		{http.MethodPatch, item, ct, `["what"]`, http.StatusBadRequest},
+		{http.MethodPatch, item, ct, `{"when": null}`, http.StatusBadRequest},
+		{http.MethodPatch, item, ct, fmt.Sprintf(`{"id": %q}`, uuid.New()), http.StatusBadRequest},
+		{http.MethodPatch, base + "/" + uuid.New().String(), ct, `{"what": "x"}`, http.StatusNotFound},
+	}
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("#%d", i), func(t *testing.T) {
+			rec := doJSON(api.EventsV2, test.method, test.path, test.contentType, test.body)
+			assert.Equal(t, test.status, rec.Code, rec.Body.String())
+			var res struct {
+				Error string `json:"error"`
+			}
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&res))
+			assert.NotEmpty(t, res.Error)
+		})
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// maxAttendees - максимальное количество участников события.
+const maxAttendees = 100
+
+// RSVPStatus - ответ участника на приглашение (PARTSTAT из RFC 5545).
+type RSVPStatus string
+
+// Ответы на приглашение. Новый участник получает статус needs-action.
+const (
+	RSVPNeedsAction RSVPStatus = "needs-action"
+	RSVPAccepted    RSVPStatus = "accepted"
+	RSVPDeclined    RSVPStatus = "declined"
+	RSVPTentative   RSVPStatus = "tentative"
+)
+
+// ErrNotInvited - пользователь не приглашён на событие.
+var ErrNotInvited = errors.New("user is not invited to the event")
+
+// Attendee - участник события, приглашённый организатором (владельцем события).
+type Attendee struct {
+	UserID uuid.UUID
+	Status RSVPStatus
+}
+
+// ParseRSVPStatus разбирает ответ участника на приглашение.
+// Вернуть приглашение в состояние needs-action нельзя.
+func ParseRSVPStatus(s string) (RSVPStatus, error) {
+	switch status := RSVPStatus(strings.ToLower(s)); status {
+	case RSVPAccepted, RSVPDeclined, RSVPTentative:
+		return status, nil
+	default:
+		return "", fmt.Errorf("unknown status %q (want accepted, declined or tentative)", s)
+	}
+}
+
+// parseAttendees разбирает список ID участников, разделённых запятыми,
+// и проверяет его (см. validateAttendees).
+func parseAttendees(list string, organizer uuid.UUID) ([]uuid.UUID, error) {
+	result := make([]uuid.UUID, 0)
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		id, err := uuid.Parse(item)
+		if err != nil {
+			return nil, fmt.Errorf("incorrect user ID %q: %w", item, err)
+		}
+		result = append(result, id)
+	}
+	return result, validateAttendees(result, organizer)
+}
+
+// validateAttendees проверяет список участников: без повторов, без организатора
+// и не длиннее maxAttendees.
+func validateAttendees(ids []uuid.UUID, organizer uuid.UUID) error {
+	if len(ids) > maxAttendees {
+		return fmt.Errorf("too many attendees (max %d)", maxAttendees)
+	}
+	seen := make(map[uuid.UUID]bool, len(ids))
+	for _, id := range ids {
+		switch {
+		case id == organizer:
+			return errors.New("organizer cannot be invited to own event")
+		case seen[id]:
+			return fmt.Errorf("duplicate attendee %v", id)
+		}
+		seen[id] = true
+	}
+	return nil
+}
+
+// mergeAttendees возвращает участников с ID из ids: ответы уже приглашённых
+// участников сохраняются, новые получают статус needs-action.
+func mergeAttendees(current []Attendee, ids []uuid.UUID) []Attendee {
+	if len(ids) == 0 {
+		return nil
+	}
+	statuses := make(map[uuid.UUID]RSVPStatus, len(current))
+	for _, a := range current {
+		statuses[a.UserID] = a.Status
+	}
+	result := make([]Attendee, 0, len(ids))
+	for _, id := range ids {
+		status, ok := statuses[id]
+		if !ok {
+			status = RSVPNeedsAction
+		}
+		result = append(result, Attendee{UserID: id, Status: status})
+	}
+	return result
+}
+
+// attendeeIDs возвращает ID участников события.
+func attendeeIDs(attendees []Attendee) []uuid.UUID {
+	result := make([]uuid.UUID, 0, len(attendees))
+	for _, a := range attendees {
+		result = append(result, a.UserID)
+	}
+	return result
+}
+
+// attendee возвращает индекс участника userID в e.Attendees (-1, если он не приглашён).
+func (e Event) attendee(userID uuid.UUID) int {
+	for i, a := range e.Attendees {
+		if a.UserID == userID {
+			return i
+		}
+	}
+	return -1
+}
+
+// involves проверяет, что пользователь - организатор или участник события.
+func (e Event) involves(userID uuid.UUID) bool {
+	return e.UserID == userID || e.attendee(userID) >= 0
+}
+
+// busyFor проверяет, занимает ли событие время пользователя: организатора - всегда,
+// участника - если он не отклонил приглашение.
+func (e Event) busyFor(userID uuid.UUID) bool {
+	if e.UserID == userID {
+		return true
+	}
+	i := e.attendee(userID)
+	return i >= 0 && e.Attendees[i].Status != RSVPDeclined
+}
+
+// Invite добавляет к событию участников ids (уже приглашённые пропускаются).
+func (e *Event) Invite(ids []uuid.UUID) error {
+	all := attendeeIDs(e.Attendees)
+	for _, id := range ids {
+		if e.attendee(id) < 0 {
+			all = append(all, id)
+		}
+	}
+	if err := validateAttendees(all, e.UserID); err != nil {
+		return err
+	}
+	e.Attendees = mergeAttendees(e.Attendees, all)
+	return nil
+}
+
+// Respond записывает ответ участника userID на приглашение.
+// Если пользователь не приглашён, возвращается ErrNotInvited.
+func (e *Event) Respond(userID uuid.UUID, status RSVPStatus) error {
+	i := e.attendee(userID)
+	if i < 0 {
+		return ErrNotInvited
+	}
+	// срез может разделяться с копиями события
+	attendees := append([]Attendee(nil), e.Attendees...)
+	attendees[i].Status = status
+	e.Attendees = attendees
+	return nil
+}
+
+// Invite приглашает пользователей на событие. Приглашать может только организатор.
+//
+// POST /invite
+// параметры (* = обязательный):
+//	- *event_id		ID события
+//	- *attendees	ID приглашаемых пользователей через запятую
+func (c CalendarAPI) Invite(w http.ResponseWriter, r *http.Request) {
+	const logHeader = "invite"
+	if r.Method != http.MethodPost {
+		returnError(w, logHeader, "", http.StatusMethodNotAllowed)
+		return
+	}
+	defer r.Body.Close()
+
+	event, ok := c.getEvent(w, r, logHeader)
+	if !ok {
+		return // ошибки уже обработаны
+	}
+	if !authorized(r, event.UserID) {
+		returnError(w, logHeader, "access denied", http.StatusForbidden)
+		return
+	}
+	queryAttendees := r.FormValue("attendees")
+	if queryAttendees == "" {
+		returnError(w, logHeader, "missing parameter: attendees", http.StatusBadRequest)
+		return
+	}
+	ids, err := parseAttendees(queryAttendees, event.UserID)
+	if err != nil {
+		returnError(w, logHeader, fmt.Sprintf("incorrect attendees: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := event.Invite(ids); err != nil {
+		returnError(w, logHeader, fmt.Sprintf("incorrect attendees: %v", err), http.StatusBadRequest)
+		return
+	}
+	event.Version++
+	event.ModifiedBy = modifiedBy(r, event.UserID)
+	if err := c.storage.Update(event); err != nil {
+		returnStorageError(w, logHeader, err)
+		return
+	}
+	returnJSONResult(w, logHeader, event.Attendees, http.StatusOK)
+	log.Printf("%s: event %v attendees %+v", logHeader, event.ID, event.Attendees)
+}
+
+// RSVP записывает ответ участника на приглашение.
+//
+// POST /rsvp
+// параметры (* = обязательный):
+//	- *event_id		ID события
+//	- *user_id		ID приглашённого пользователя
+//	- *status		ответ: accepted, declined или tentative
+func (c CalendarAPI) RSVP(w http.ResponseWriter, r *http.Request) {
+	const logHeader = "rsvp"
+	if r.Method != http.MethodPost {
+		returnError(w, logHeader, "", http.StatusMethodNotAllowed)
+		return
+	}
+	defer r.Body.Close()
+
+	userID, ok := getUserID(w, r, logHeader)
+	if !ok {
+		return // ошибки уже обработаны
+	}
+	queryStatus := r.FormValue("status")
+	if queryStatus == "" {
+		returnError(w, logHeader, "missing parameter: status", http.StatusBadRequest)
+		return
+	}
+	status, err := ParseRSVPStatus(queryStatus)
+	if err != nil {
+		returnError(w, logHeader, err.Error(), http.StatusBadRequest)
+		return
+	}
+	event, ok := c.getEvent(w, r, logHeader)
+	if !ok {
+		return // ошибки уже обработаны
+	}
+	if err := event.Respond(userID, status); err != nil {
+		returnStorageError(w, logHeader, err)
+		return
+	}
+	event.Version++
+	event.ModifiedBy = userID
+	if err := c.storage.Update(event); err != nil {
+		returnStorageError(w, logHeader, err)
+		return
+	}
+	returnJSONResult(w, logHeader, "invitation "+string(status), http.StatusOK)
+	log.Printf("%s: user %v %s event %v", logHeader, userID, status, event.ID)
+}
+
+// GetInvitations возвращает события, на приглашение к которым пользователь ещё не ответил.
+//
+// GET /invitations
+// параметр:
+// *user_id
+func (c CalendarAPI) GetInvitations(w http.ResponseWriter, r *http.Request) {
+	const logHeader = "getInvitations"
+	if r.Method != http.MethodGet {
+		returnError(w, logHeader, "", http.StatusMethodNotAllowed)
+		return
+	}
+	userID, ok := getUserID(w, r, logHeader)
+	if !ok {
+		return // ошибки уже обработаны
+	}
+	events, err := c.storage.GetByAttendee(userID)
+	if err != nil {
+		returnError(w, logHeader, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	pending := make([]Event, 0, len(events))
+	for _, e := range events {
+		if e.Attendees[e.attendee(userID)].Status == RSVPNeedsAction {
+			pending = append(pending, e)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].When.Before(pending[j].When)
+	})
+	returnEvents(w, logHeader, pending)
+}
+
+// getEvent извлекает из запроса обязательный параметр event_id и возвращает событие.
+// Функция обрабатывает и логирует возникшие ошибки.
+func (c CalendarAPI) getEvent(w http.ResponseWriter, r *http.Request, logHeader string) (Event, bool) {
+	queryEventID := r.FormValue("event_id")
+	if queryEventID == "" {
+		returnError(w, logHeader, "missing parameter: event_id", http.StatusBadRequest)
+		return Event{}, false
+	}
+	eventID, err := uuid.Parse(queryEventID)
+	if err != nil {
+		returnError(w, logHeader, fmt.Sprintf("incorrect event ID: %v", err), http.StatusBadRequest)
+		return Event{}, false
+	}
+	event, err := c.storage.Get(eventID)
+	if err != nil {
+		returnStorageError(w, logHeader, err)
+		return Event{}, false
+	}
+	return event, true
+}
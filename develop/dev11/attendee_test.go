@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventInviteRespond(t *testing.T) {
+	organizer, alice, bob := uuid.New(), uuid.New(), uuid.New()
+	e := Event{ID: uuid.New(), UserID: organizer}
+
+	require.NoError(t, e.Invite([]uuid.UUID{alice}))
+	require.NoError(t, e.Respond(alice, RSVPAccepted))
+	// повторное приглашение не сбрасывает ответ
+	require.NoError(t, e.Invite([]uuid.UUID{alice, bob}))
+	assert.Equal(t, []Attendee{{alice, RSVPAccepted}, {bob, RSVPNeedsAction}}, e.Attendees)
+
+	assert.Error(t, e.Invite([]uuid.UUID{organizer}))
+	assert.ErrorIs(t, e.Respond(organizer, RSVPDeclined), ErrNotInvited)
+
+	// ответ не меняет копии события
+	copied := e
+	require.NoError(t, e.Respond(bob, RSVPDeclined))
+	assert.Equal(t, RSVPNeedsAction, copied.Attendees[1].Status)
+
+	assert.True(t, e.busyFor(organizer))
+	assert.True(t, e.busyFor(alice))
+	assert.False(t, e.busyFor(bob))
+	assert.True(t, e.involves(bob))
+	assert.False(t, e.involves(uuid.New()))
+
+	_, err := ParseRSVPStatus("needs-action")
+	assert.Error(t, err)
+	status, err := ParseRSVPStatus("Tentative")
+	require.NoError(t, err)
+	assert.Equal(t, RSVPTentative, status)
+
+	_, err = parseAttendees(alice.String()+","+alice.String(), organizer)
+	assert.Error(t, err)
+	_, err = parseAttendees("nobody", organizer)
+	assert.Error(t, err)
+}
+
+func TestInvitationHandlers(t *testing.T) {
+	storage := newTestStorage()
+	api := NewCalendar(storage)
+	organizer, alice, bob := uuid.New().String(), uuid.New().String(), uuid.New().String()
+
+	rec := doForm(api.CreateEvent, http.MethodPost, "/create_event", url.Values{
+		"user_id": {organizer}, "date": {"03.01.2022"}, "time": {"10:00"}, "duration": {"1h"}, "attendees": {alice},
+	})
+	require.Equal(t, http.StatusCreated, rec.Code)
+	events, err := storage.GetByAttendee(uuid.MustParse(alice))
+	require.NoError(t, err)
+	require.Equal(t, 1, len(events))
+	eventID := events[0].ID.String()
+
+	// приглашённые видят событие в events_for_*
+	rec = doForm(api.GetDayEvents, http.MethodGet, "/events_for_day", url.Values{"user_id": {alice}, "date": {"03.01.2022"}})
+	require.Equal(t, http.StatusOK, rec.Code)
+	var res respBody
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&res))
+	assert.Equal(t, 1, len(res.Result))
+
+	rec = doForm(api.Invite, http.MethodPost, "/invite", url.Values{"event_id": {eventID}, "attendees": {bob}})
+	require.Equal(t, http.StatusOK, rec.Code)
+	for _, bad := range []url.Values{
+		{"event_id": {eventID}},
+		{"event_id": {eventID}, "attendees": {organizer}},
+		{"event_id": {eventID}, "attendees": {"nobody"}},
+	} {
+		rec = doForm(api.Invite, http.MethodPost, "/invite", bad)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, bad)
+	}
+
+	// приглашения без ответа
+	pending := func(userID string) int {
+		rec := doForm(api.GetInvitations, http.MethodGet, "/invitations", url.Values{"user_id": {userID}})
+		require.Equal(t, http.StatusOK, rec.Code)
+		var res respBody
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&res))
+		return len(res.Result)
+	}
+	assert.Equal(t, 1, pending(alice))
+	assert.Equal(t, 1, pending(bob))
+	assert.Equal(t, 0, pending(organizer))
+
+	rec = doForm(api.RSVP, http.MethodPost, "/rsvp", url.Values{"event_id": {eventID}, "user_id": {alice}, "status": {"accepted"}})
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec = doForm(api.RSVP, http.MethodPost, "/rsvp", url.Values{"event_id": {eventID}, "user_id": {bob}, "status": {"declined"}})
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec = doForm(api.RSVP, http.MethodPost, "/rsvp", url.Values{"event_id": {eventID}, "user_id": {bob}, "status": {"maybe"}})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = doForm(api.RSVP, http.MethodPost, "/rsvp", url.Values{"event_id": {eventID}, "user_id": {organizer}, "status": {"accepted"}})
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Equal(t, 0, pending(alice))
+	assert.Equal(t, 0, pending(bob))
+
+	// отклонённое приглашение не занимает время
+	busy, err := FreeBusy(storage, uuid.MustParse(alice), mustTime(t, "03.01.2022 00:00"), mustTime(t, "04.01.2022 00:00"))
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(busy))
+	busy, err = FreeBusy(storage, uuid.MustParse(bob), mustTime(t, "03.01.2022 00:00"), mustTime(t, "04.01.2022 00:00"))
+	require.NoError(t, err)
+	assert.Empty(t, busy)
+
+	// замена участников сохраняет ответы остающихся, пустое значение удаляет всех
+	rec = doForm(api.UpdateEvent, http.MethodPost, "/update_event", url.Values{"event_id": {eventID}, "attendees": {alice}})
+	require.Equal(t, http.StatusOK, rec.Code)
+	event, err := storage.Get(uuid.MustParse(eventID))
+	require.NoError(t, err)
+	assert.Equal(t, []Attendee{{uuid.MustParse(alice), RSVPAccepted}}, event.Attendees)
+	rec = doForm(api.UpdateEvent, http.MethodPost, "/update_event", url.Values{"event_id": {eventID}, "attendees": {""}})
+	require.Equal(t, http.StatusOK, rec.Code)
+	event, err = storage.Get(uuid.MustParse(eventID))
+	require.NoError(t, err)
+	assert.Empty(t, event.Attendees)
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Ошибки аутентификации.
+var (
+	ErrInvalidToken       = errors.New("invalid token")
+	ErrTokenExpired       = errors.New("token expired")
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	ErrUserAlreadyExists  = errors.New("user already exists")
+)
+
+// defaultTokenTTL - срок действия токена по умолчанию.
+const defaultTokenTTL = time.Hour
+
+// jwtHeader - заголовок JWT; поддерживается только HS256.
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// tokenClaims - полезная нагрузка JWT: sub - ID пользователя, iat и exp - секунды Unix.
+type tokenClaims struct {
+	Subject   uuid.UUID `json:"sub"`
+	IssuedAt  int64     `json:"iat"`
+	ExpiresAt int64     `json:"exp"`
+}
+
+// Authenticator выпускает и проверяет токены доступа (JWT, подпись HMAC-SHA256).
+type Authenticator struct {
+	secret []byte
+	ttl    time.Duration
+	// now - источник текущего времени (подменяется в тестах).
+	now func() time.Time
+}
+
+// NewAuthenticator создаёт Authenticator с секретом secret и сроком действия токенов ttl.
+func NewAuthenticator(secret []byte, ttl time.Duration) *Authenticator {
+	if ttl <= 0 {
+		ttl = defaultTokenTTL
+	}
+	return &Authenticator{secret: secret, ttl: ttl, now: time.Now}
+}
+
+// IssueToken выпускает токен для пользователя userID и возвращает его вместе со сроком действия.
+func (a *Authenticator) IssueToken(userID uuid.UUID) (string, time.Time, error) {
+	now := a.now()
+	expires := now.Add(a.ttl)
+	claims, err := json.Marshal(tokenClaims{Subject: userID, IssuedAt: now.Unix(), ExpiresAt: expires.Unix()})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	signed := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(claims)
+	return signed + "." + a.sign(signed), expires, nil
+}
+
+// ParseToken проверяет подпись и срок действия токена и возвращает ID пользователя.
+func (a *Authenticator) ParseToken(token string) (uuid.UUID, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return uuid.Nil, fmt.Errorf("%w: malformed token", ErrInvalidToken)
+	}
+	// заголовок сравнивается целиком: это исключает подмену алгоритма (alg=none и т.п.)
+	if parts[0] != jwtHeader {
+		return uuid.Nil, fmt.Errorf("%w: unsupported header", ErrInvalidToken)
+	}
+	signed := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(a.sign(signed))) {
+		return uuid.Nil, fmt.Errorf("%w: bad signature", ErrInvalidToken)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	var claims tokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return uuid.Nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if claims.Subject == uuid.Nil {
+		return uuid.Nil, fmt.Errorf("%w: missing subject", ErrInvalidToken)
+	}
+	if !a.now().Before(time.Unix(claims.ExpiresAt, 0)) {
+		return uuid.Nil, ErrTokenExpired
+	}
+	return claims.Subject, nil
+}
+
+// sign возвращает подпись HMAC-SHA256 строки s в кодировке base64url.
+func (a *Authenticator) sign(s string) string {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(s))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// subjectKey - ключ контекста запроса, под которым хранится ID аутентифицированного пользователя.
+type subjectKey struct{}
+
+// Middleware пропускает к next только запросы с действительным токеном в заголовке
+// Authorization: Bearer <token> и кладёт ID пользователя в контекст запроса.
+// Для nil Authenticator (аутентификация выключена) запросы пропускаются без проверки.
+func (a *Authenticator) Middleware(next http.HandlerFunc) http.HandlerFunc {
+	if a == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		const logHeader = "auth"
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="calendar"`)
+			returnError(w, logHeader, "missing bearer token", http.StatusUnauthorized)
+			return
+		}
+		subject, err := a.ParseToken(token)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="calendar", error="invalid_token"`)
+			returnError(w, logHeader, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), subjectKey{}, subject)))
+	}
+}
+
+// BasicMiddleware работает как Middleware, но принимает и заголовок
+// Authorization: Basic с именем и паролем из users - для клиентов CalDAV,
+// которые не умеют получать токены. Запрос без заголовка получает запрос
+// Basic-аутентификации.
+func (a *Authenticator) BasicMiddleware(users UserStore, next http.HandlerFunc) http.HandlerFunc {
+	if a == nil {
+		return next
+	}
+	bearer := a.Middleware(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		const logHeader = "auth"
+		if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+			bearer(w, r)
+			return
+		}
+		username, password, ok := r.BasicAuth()
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="calendar", charset="UTF-8"`)
+			returnError(w, logHeader, "missing credentials", http.StatusUnauthorized)
+			return
+		}
+		subject, err := users.Authenticate(username, password)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="calendar", charset="UTF-8"`)
+			returnError(w, logHeader, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), subjectKey{}, subject)))
+	}
+}
+
+// requestSubject возвращает ID аутентифицированного пользователя запроса
+// (false, если аутентификация выключена).
+func requestSubject(r *http.Request) (uuid.UUID, bool) {
+	subject, ok := r.Context().Value(subjectKey{}).(uuid.UUID)
+	return subject, ok
+}
+
+// modifiedBy возвращает автора изменения, сделанного запросом: аутентифицированного
+// пользователя, а если аутентификация выключена - userID, от имени которого сделан запрос.
+func modifiedBy(r *http.Request, userID uuid.UUID) uuid.UUID {
+	if subject, ok := requestSubject(r); ok {
+		return subject
+	}
+	return userID
+}
+
+// authorized проверяет, что аутентифицированный пользователь запроса - userID.
+// Если аутентификация явно выключена (auth.insecure_no_auth, в контексте нет
+// пользователя), доступ разрешён.
+func authorized(r *http.Request, userID uuid.UUID) bool {
+	subject, ok := requestSubject(r)
+	return !ok || subject == userID
+}
+
+// UserStore - хранилище учётных записей для входа в сервис.
+type UserStore interface {
+	// Authenticate проверяет имя и пароль и возвращает ID пользователя.
+	// При неверных данных возвращается ErrInvalidCredentials.
+	Authenticate(username, password string) (uuid.UUID, error)
+}
+
+var _ UserStore = (*FileUserStore)(nil)
+
+// storedUser - учётная запись: ID пользователя и bcrypt-хэш пароля.
+type storedUser struct {
+	ID           uuid.UUID `json:"id"`
+	PasswordHash string    `json:"password_hash"`
+}
+
+// FileUserStore - имплементация UserStore, хранящая учётные записи в JSON-файле.
+// Пароли хранятся только в виде bcrypt-хэшей.
+type FileUserStore struct {
+	mu    sync.RWMutex
+	path  string
+	users map[string]storedUser
+	cost  int
+}
+
+// dummyHash используется для сравнения пароля несуществующего пользователя,
+// чтобы время ответа не выдавало, есть ли такой пользователь.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+// OpenFileUserStore загружает учётные записи из файла path (отсутствующий файл - пустое хранилище).
+func OpenFileUserStore(path string) (*FileUserStore, error) {
+	s := &FileUserStore{path: path, users: make(map[string]storedUser), cost: bcrypt.DefaultCost}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.users); err != nil {
+		return nil, fmt.Errorf("fileUserStore: could not parse %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// AddUser создаёт учётную запись с новым ID пользователя и сохраняет файл.
+func (s *FileUserStore) AddUser(username, password string) (uuid.UUID, error) {
+	if username == "" || password == "" {
+		return uuid.Nil, errors.New("username and password must not be empty")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), s.cost)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[username]; ok {
+		return uuid.Nil, ErrUserAlreadyExists
+	}
+	user := storedUser{ID: uuid.New(), PasswordHash: string(hash)}
+	s.users[username] = user
+	err = writeFileAtomic(s.path, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(s.users)
+	})
+	if err != nil {
+		delete(s.users, username)
+		return uuid.Nil, err
+	}
+	return user.ID, nil
+}
+
+func (s *FileUserStore) Authenticate(username, password string) (uuid.UUID, error) {
+	s.mu.RLock()
+	user, ok := s.users[username]
+	s.mu.RUnlock()
+	hash := []byte(user.PasswordHash)
+	if !ok {
+		hash = dummyHash
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil || !ok {
+		return uuid.Nil, ErrInvalidCredentials
+	}
+	return user.ID, nil
+}
+
+// LoginAPI - обработчик входа в сервис.
+type LoginAPI struct {
+	users UserStore
+	auth  *Authenticator
+}
+
+// NewLoginAPI создаёт обработчик входа.
+func NewLoginAPI(users UserStore, auth *Authenticator) *LoginAPI {
+	return &LoginAPI{users: users, auth: auth}
+}
+
+// Login проверяет имя и пароль и выдаёт токен доступа.
+//
+// POST /login
+// параметры:
+//   - *username		имя пользователя
+//   - *password		пароль
+func (l LoginAPI) Login(w http.ResponseWriter, r *http.Request) {
+	const logHeader = "login"
+	if r.Method != http.MethodPost {
+		returnError(w, logHeader, "", http.StatusMethodNotAllowed)
+		return
+	}
+	defer r.Body.Close()
+	username := r.PostFormValue("username")
+	password := r.PostFormValue("password")
+	if username == "" || password == "" {
+		returnError(w, logHeader, "missing parameter: username or password", http.StatusBadRequest)
+		return
+	}
+	userID, err := l.users.Authenticate(username, password)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrInvalidCredentials) {
+			status = http.StatusUnauthorized
+		}
+		returnError(w, logHeader, err.Error(), status)
+		return
+	}
+	token, expires, err := l.auth.IssueToken(userID)
+	if err != nil {
+		returnError(w, logHeader, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res := struct {
+		Token     string    `json:"token"`
+		UserID    uuid.UUID `json:"user_id"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}{token, userID, expires.UTC()}
+	returnJSONResult(w, logHeader, res, http.StatusOK)
+	log.Printf("%s: user %q logged in", logHeader, username)
+}
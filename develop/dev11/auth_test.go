@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestTokens(t *testing.T) {
+	auth := NewAuthenticator([]byte("secret"), time.Hour)
+	now := time.Date(2022, 1, 3, 10, 0, 0, 0, time.UTC)
+	auth.now = func() time.Time { return now }
+	userID := uuid.New()
+
+	token, expires, err := auth.IssueToken(userID)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(time.Hour), expires)
+	got, err := auth.ParseToken(token)
+	require.NoError(t, err)
+	assert.Equal(t, userID, got)
+
+	parts := strings.Split(token, ".")
+	foreignClaims, _ := json.Marshal(tokenClaims{Subject: uuid.New(), ExpiresAt: now.Add(time.Hour).Unix()})
+	noneHeader := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+	other, _, err := NewAuthenticator([]byte("other secret"), time.Hour).IssueToken(userID)
+	require.NoError(t, err)
+	tests := []string{
+		"",
+		"abc",
+		parts[0] + "." + parts[1],
+		// подменённый субъект
+		parts[0] + "." + base64.RawURLEncoding.EncodeToString(foreignClaims) + "." + parts[2],
+		// alg=none без подписи
+		noneHeader + "." + parts[1] + ".",
+		// чужой секрет
+		other,
+	}
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("#%d", i), func(t *testing.T) {
+			_, err := auth.ParseToken(test)
+			assert.ErrorIs(t, err, ErrInvalidToken)
+		})
+	}
+
+	now = now.Add(time.Hour)
+	_, err = auth.ParseToken(token)
+	assert.ErrorIs(t, err, ErrTokenExpired)
+}
+
+func TestFileUserStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	users, err := OpenFileUserStore(path)
+	require.NoError(t, err)
+	users.cost = bcrypt.MinCost
+	aliceID, err := users.AddUser("alice", "wonderland")
+	require.NoError(t, err)
+	_, err = users.AddUser("alice", "again")
+	assert.ErrorIs(t, err, ErrUserAlreadyExists)
+
+	// учётные записи сохраняются в файл, пароль - только в виде хэша
+	users, err = OpenFileUserStore(path)
+	require.NoError(t, err)
+	assert.NotContains(t, users.users["alice"].PasswordHash, "wonderland")
+	got, err := users.Authenticate("alice", "wonderland")
+	require.NoError(t, err)
+	assert.Equal(t, aliceID, got)
+	_, err = users.Authenticate("alice", "looking-glass")
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+	_, err = users.Authenticate("bob", "wonderland")
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+}
+
+func TestAuthHandlers(t *testing.T) {
+	users, err := OpenFileUserStore(filepath.Join(t.TempDir(), "users.json"))
+	require.NoError(t, err)
+	users.cost = bcrypt.MinCost
+	aliceID, err := users.AddUser("alice", "wonderland")
+	require.NoError(t, err)
+	bobID, err := users.AddUser("bob", "builder")
+	require.NoError(t, err)
+
+	auth := NewAuthenticator([]byte("secret"), time.Hour)
+	storage := newTestStorage()
+	api := NewCalendar(storage)
+	login := NewLoginAPI(users, auth).Login
+	bobEvent := Event{ID: uuid.New(), UserID: bobID, When: mustTime(t, "03.01.2022 10:00")}
+	require.NoError(t, storage.Add(bobEvent))
+
+	rec := doForm(login, http.MethodPost, "/login", url.Values{"username": {"alice"}, "password": {"builder"}})
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	rec = doForm(login, http.MethodPost, "/login", url.Values{"username": {"alice"}, "password": {"wonderland"}})
+	require.Equal(t, http.StatusOK, rec.Code)
+	var res struct {
+		Result struct {
+			Token  string    `json:"token"`
+			UserID uuid.UUID `json:"user_id"`
+		}
+	}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&res))
+	assert.Equal(t, aliceID, res.Result.UserID)
+
+	// do выполняет запрос через middleware с токеном token (пустой - без заголовка)
+	do := func(h http.HandlerFunc, method, path string, form url.Values, token string) int {
+		var req *http.Request
+		if method == http.MethodGet {
+			req = httptest.NewRequest(method, path+"?"+form.Encode(), nil)
+		} else {
+			req = httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		auth.Middleware(h)(rec, req)
+		return rec.Code
+	}
+	token := res.Result.Token
+	alice, bob := aliceID.String(), bobID.String()
+
+	tests := []struct {
+		h      http.HandlerFunc
+		method string
+		path   string
+		form   url.Values
+		token  string
+		status int
+	}{
+		{api.GetDayEvents, http.MethodGet, "/events_for_day", url.Values{"user_id": {alice}, "date": {"03.01.2022"}}, "", http.StatusUnauthorized},
+		{api.GetDayEvents, http.MethodGet, "/events_for_day", url.Values{"user_id": {alice}, "date": {"03.01.2022"}}, "garbage", http.StatusUnauthorized},
+		{api.GetDayEvents, http.MethodGet, "/events_for_day", url.Values{"user_id": {alice}, "date": {"03.01.2022"}}, token, http.StatusOK},
+		{api.GetDayEvents, http.MethodGet, "/events_for_day", url.Values{"user_id": {bob}, "date": {"03.01.2022"}}, token, http.StatusForbidden},
+		{api.ExportICS, http.MethodGet, "/export.ics", url.Values{"user_id": {bob}}, token, http.StatusForbidden},
+		{api.FreeBusy, http.MethodGet, "/free_busy", url.Values{"user_id": {bob}, "from": {"03.01.2022"}, "to": {"04.01.2022"}}, token, http.StatusForbidden},
+		{api.CreateEvent, http.MethodPost, "/create_event", url.Values{"user_id": {bob}, "date": {"03.01.2022"}}, token, http.StatusForbidden},
+		{api.CreateEvent, http.MethodPost, "/create_event", url.Values{"user_id": {alice}, "date": {"03.01.2022"}}, token, http.StatusCreated},
+		{api.UpdateEvent, http.MethodPost, "/update_event", url.Values{"event_id": {bobEvent.ID.String()}, "place": {"у Алисы"}}, token, http.StatusForbidden},
+		{api.DeleteEvent, http.MethodPost, "/delete_event", url.Values{"event_id": {bobEvent.ID.String()}}, token, http.StatusForbidden},
+		{api.EventsV2, http.MethodGet, "/api/v2/users/" + bob + "/events", nil, token, http.StatusForbidden},
+		{api.EventsV2, http.MethodGet, "/api/v2/users/" + alice + "/events", nil, token, http.StatusOK},
+	}
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("#%d", i), func(t *testing.T) {
+			assert.Equal(t, test.status, do(test.h, test.method, test.path, test.form, test.token))
+		})
+	}
+
+	// событие Боба не изменено и не удалено
+	got, err := storage.Get(bobEvent.ID)
+	require.NoError(t, err)
+	assert.Equal(t, bobEvent.Where, got.Where)
+
+	// нельзя передать своё событие другому пользователю
+	events, err := storage.GetByUser(aliceID)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(events))
+	status := do(api.UpdateEvent, http.MethodPost, "/update_event",
+		url.Values{"event_id": {events[0].ID.String()}, "user_id": {bob}}, token)
+	assert.Equal(t, http.StatusForbidden, status)
+	status = do(api.DeleteEvent, http.MethodPost, "/delete_event", url.Values{"event_id": {events[0].ID.String()}}, token)
+	assert.Equal(t, http.StatusNoContent, status)
+}
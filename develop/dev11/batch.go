@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+// maxBatchOps - наибольшее число операций в одном запросе /batch.
+const maxBatchOps = 1000
+
+// Операции запроса /batch.
+const (
+	batchCreate = "create"
+	batchUpdate = "update"
+	batchDelete = "delete"
+)
+
+// TxStorage - хранилище, поддерживающее транзакции: несколько изменений
+// применяются либо все вместе, либо ни одно.
+type TxStorage interface {
+	EventStorage
+	// Tx выполняет fn в транзакции. Изменения, сделанные через переданное в fn
+	// хранилище, видны в нём сразу, а остальным - после фиксации. Если fn вернула
+	// ошибку, транзакция откатывается и Tx возвращает эту ошибку. Хранилище
+	// транзакции нельзя использовать после возврата из fn. Tx внутри транзакции
+	// выполняет fn в ней же.
+	Tx(fn func(EventStorage) error) error
+}
+
+// ErrTxNotSupported - хранилище не поддерживает транзакции.
+var ErrTxNotSupported = errors.New("transactions are not supported by the storage")
+
+// runTx выполняет fn в транзакции хранилища s, если оно реализует TxStorage,
+// иначе возвращает ErrTxNotSupported.
+func runTx(s EventStorage, fn func(EventStorage) error) error {
+	ts, ok := s.(TxStorage)
+	if !ok {
+		return ErrTxNotSupported
+	}
+	return ts.Tx(fn)
+}
+
+// txEffects - побочные эффекты изменений в транзакции (публикация в ленту,
+// запись истории, индексация), которые выполняются только после её фиксации.
+// Нулевой указатель означает работу вне транзакции: эффект выполняется сразу.
+type txEffects struct {
+	fns []func()
+}
+
+// after выполняет f сразу либо, в транзакции, после её фиксации.
+func (e *txEffects) after(f func()) {
+	if e == nil {
+		f()
+		return
+	}
+	e.fns = append(e.fns, f)
+}
+
+// txWithEffects выполняет fn в транзакции хранилища s. Хранилище транзакции
+// оборачивается декоратором view, откладывающим эффекты в effects; после
+// фиксации эффекты выполняются в порядке изменений.
+func txWithEffects(s EventStorage, view func(tx EventStorage, effects *txEffects) EventStorage, fn func(EventStorage) error) error {
+	effects := &txEffects{}
+	if err := runTx(s, func(tx EventStorage) error { return fn(view(tx, effects)) }); err != nil {
+		return err
+	}
+	for _, f := range effects.fns {
+		f()
+	}
+	return nil
+}
+
+// batchOp - операция запроса /batch.
+type batchOp struct {
+	// Op - create, update или delete.
+	Op string `json:"op"`
+	// ID - изменяемое или удаляемое событие; для create - ID нового события
+	// (если не задан ни он, ни event.id, создаётся новый).
+	ID uuid.UUID `json:"id"`
+	// Version - ожидаемая версия события для update и delete (0 - не проверяется).
+	Version uint64 `json:"version,omitempty"`
+	// Event - для create событие в представлении API v2, для update - изменения
+	// в формате JSON Merge Patch, как в PATCH /api/v2/users/{user_id}/events/{event_id}.
+	Event json.RawMessage `json:"event,omitempty"`
+}
+
+// batchResult - результат операции запроса /batch.
+type batchResult struct {
+	Op string    `json:"op"`
+	ID uuid.UUID `json:"id"`
+	// Status - код операции, как у соответствующего запроса API v2;
+	// 424 - операция не выполнена из-за ошибки в другой операции пакета.
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Event - событие после create и update.
+	Event *eventV2 `json:"event,omitempty"`
+}
+
+// errBatchFailed прерывает транзакцию пакета после неудавшейся операции.
+var errBatchFailed = errors.New("batch operation failed")
+
+// Batch выполняет пакет операций над событиями в одной транзакции хранилища:
+// либо выполняются все операции, либо ни одна. Права и версии проверяются
+// для каждой операции так же, как в API v2.
+//
+// POST /batch
+// тело - JSON-массив операций (Content-Type: application/json, не больше 1000 операций):
+//	{"op": "create", "event": {...}} 								событие в представлении API v2
+//	{"op": "update", "id": "...", "version": 3, "event": {...}} 	изменения (JSON Merge Patch)
+//	{"op": "delete", "id": "...", "version": 3}
+// параметры (в query string):
+//	- allow_overlap 	false - отклонить пересечения событий (в том числе с созданными в этом же пакете)
+//
+// Ответ содержит результат каждой операции (op, id, status, error, event). Если все
+// операции выполнены - 200 и {"result": [...]}. Иначе изменения откатываются, код
+// ответа - код неудавшейся операции, тело - {"error": "...", "result": [...]},
+// а остальные операции получают статус 424.
+func (c CalendarAPI) Batch(w http.ResponseWriter, r *http.Request) {
+	const logHeader = "batch"
+	if r.Method != http.MethodPost {
+		returnError(w, logHeader, "", http.StatusMethodNotAllowed)
+		return
+	}
+	ts, ok := c.storage.(TxStorage)
+	if !ok {
+		returnError(w, logHeader, ErrTxNotSupported.Error(), http.StatusNotImplemented)
+		return
+	}
+	allowOverlap, err := parseAllowOverlap(r.URL.Query().Get("allow_overlap"))
+	if err != nil {
+		returnError(w, logHeader, fmt.Sprintf("incorrect allow_overlap: %v", err), http.StatusBadRequest)
+		return
+	}
+	var ops []batchOp
+	if !decodeJSONBody(w, r, logHeader, &ops) {
+		return // ошибки уже обработаны
+	}
+	if len(ops) == 0 {
+		returnError(w, logHeader, "empty batch", http.StatusBadRequest)
+		return
+	}
+	if len(ops) > maxBatchOps {
+		returnError(w, logHeader, fmt.Sprintf("too many operations: %d (max %d)", len(ops), maxBatchOps), http.StatusBadRequest)
+		return
+	}
+
+	results := make([]batchResult, len(ops))
+	failed := -1
+	err = ts.Tx(func(tx EventStorage) error {
+		for i, op := range ops {
+			results[i] = op.apply(tx, r, allowOverlap)
+			if results[i].Error != "" {
+				failed = i
+				return errBatchFailed
+			}
+		}
+		return nil
+	})
+	switch {
+	case failed >= 0:
+		for i := range results {
+			if i == failed {
+				continue
+			}
+			// у выполненных операций create остаётся ID созданного (и откаченного) события
+			id := ops[i].ID
+			if i < failed {
+				id = results[i].ID
+			}
+			results[i] = batchResult{Op: ops[i].Op, ID: id, Status: http.StatusFailedDependency,
+				Error: fmt.Sprintf("not applied: operation %d failed", failed)}
+		}
+		returnBatchError(w, logHeader, fmt.Sprintf("operation %d (%s): %s", failed, ops[failed].Op, results[failed].Error),
+			results, results[failed].Status)
+		return
+	case errors.Is(err, ErrTxNotSupported):
+		returnError(w, logHeader, err.Error(), http.StatusNotImplemented)
+		return
+	case err != nil:
+		returnError(w, logHeader, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	returnJSONResult(w, logHeader, results, http.StatusOK)
+	log.Printf("%s: %d operation(s) applied", logHeader, len(ops))
+}
+
+// apply выполняет операцию в транзакции tx и возвращает её результат.
+func (op batchOp) apply(tx EventStorage, r *http.Request, allowOverlap bool) batchResult {
+	res := batchResult{Op: op.Op, ID: op.ID}
+	var (
+		event *Event
+		err   error
+	)
+	switch op.Op {
+	case batchCreate:
+		event, err = op.create(tx, r)
+		res.Status = http.StatusCreated
+	case batchUpdate:
+		event, err = op.update(tx, r)
+		res.Status = http.StatusOK
+	case batchDelete:
+		err = op.delete(tx, r)
+		res.Status = http.StatusNoContent
+	default:
+		err = batchError{fmt.Errorf("unknown op %q (want create, update or delete)", op.Op), http.StatusBadRequest}
+	}
+	if err == nil && event != nil {
+		res.ID = event.ID
+		// пересечения проверяются после записи: при ошибке пакет всё равно откатывается
+		if !allowOverlap {
+			err = FindOverlap(tx, *event)
+		}
+	}
+	if err != nil {
+		res.Status = storageStatusV2(err)
+		var be batchError
+		if errors.As(err, &be) {
+			res.Status = be.status
+		}
+		res.Error = err.Error()
+		return res
+	}
+	if event != nil {
+		v := newEventV2(*event)
+		res.Event = &v
+	}
+	return res
+}
+
+// batchError - ошибка операции пакета с кодом, отличным от кода ошибки хранилища.
+type batchError struct {
+	err    error
+	status int
+}
+
+func (e batchError) Error() string {
+	return e.err.Error()
+}
+
+// create добавляет событие из op.Event.
+func (op batchOp) create(tx EventStorage, r *http.Request) (*Event, error) {
+	if len(op.Event) == 0 {
+		return nil, batchError{errors.New("missing field: event"), http.StatusBadRequest}
+	}
+	var v eventV2
+	if err := decodeStrict(bytes.NewReader(op.Event), &v); err != nil {
+		return nil, batchError{err, http.StatusBadRequest}
+	}
+	switch {
+	case v.ID == uuid.Nil && op.ID == uuid.Nil:
+		v.ID = uuid.New()
+	case v.ID == uuid.Nil:
+		v.ID = op.ID
+	case op.ID != uuid.Nil && op.ID != v.ID:
+		return nil, batchError{errors.New("id does not match event.id"), http.StatusBadRequest}
+	}
+	if v.UserID == uuid.Nil {
+		return nil, batchError{errors.New("missing field: event.user_id"), http.StatusBadRequest}
+	}
+	if !authorized(r, v.UserID) {
+		return nil, batchError{errors.New("access denied"), http.StatusForbidden}
+	}
+	event, err := v.event()
+	if err != nil {
+		return nil, batchError{err, http.StatusBadRequest}
+	}
+	event.Version = 1
+	event.ModifiedBy = modifiedBy(r, event.UserID)
+	if err := tx.Add(event); err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
+
+// update применяет к событию op.ID изменения из op.Event.
+func (op batchOp) update(tx EventStorage, r *http.Request) (*Event, error) {
+	if len(op.Event) == 0 {
+		return nil, batchError{errors.New("missing field: event"), http.StatusBadRequest}
+	}
+	var patch interface{}
+	if err := decodeStrict(bytes.NewReader(op.Event), &patch); err != nil {
+		return nil, batchError{err, http.StatusBadRequest}
+	}
+	if _, ok := patch.(map[string]interface{}); !ok {
+		return nil, batchError{errors.New("merge patch must be a JSON object"), http.StatusBadRequest}
+	}
+	event, err := op.current(tx, r)
+	if err != nil {
+		return nil, err
+	}
+	updated, err := mergeEventV2(event, patch)
+	if err != nil {
+		return nil, batchError{err, http.StatusBadRequest}
+	}
+	updated.Version = event.Version + 1
+	updated.ModifiedBy = modifiedBy(r, event.UserID)
+	if err := tx.Update(updated); err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+// delete перемещает событие op.ID в корзину.
+func (op batchOp) delete(tx EventStorage, r *http.Request) error {
+	if _, err := op.current(tx, r); err != nil {
+		return err
+	}
+	return tx.Delete(op.ID)
+}
+
+// current возвращает событие op.ID, проверив права на его изменение и ожидаемую версию.
+func (op batchOp) current(tx EventStorage, r *http.Request) (Event, error) {
+	if op.ID == uuid.Nil {
+		return Event{}, batchError{errors.New("missing field: id"), http.StatusBadRequest}
+	}
+	event, err := tx.Get(op.ID)
+	if err != nil {
+		return Event{}, err
+	}
+	if !authorized(r, event.UserID) {
+		return Event{}, batchError{errors.New("access denied"), http.StatusForbidden}
+	}
+	if op.Version != 0 && op.Version != event.Version {
+		return Event{}, fmt.Errorf("%w: current version %d", ErrVersionConflict, event.Version)
+	}
+	return event, nil
+}
+
+// returnBatchError логирует ошибку пакета и записывает в тело ответа
+// {"error": "...", "result": [...]} с результатами операций.
+func returnBatchError(w http.ResponseWriter, logHeader, err string, results []batchResult, status int) {
+	log.Printf("%s: %s", logHeader, err)
+	body, _ := json.Marshal(struct {
+		Error  string        `json:"error"`
+		Result []batchResult `json:"result"`
+	}{Error: http.StatusText(status) + ": " + err, Result: results})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testTxStorage проверяет общие для всех реализаций TxStorage свойства.
+func testTxStorage(t *testing.T, s TxStorage) {
+	trash, ok := s.(TrashStorage)
+	require.True(t, ok)
+	userID := uuid.New()
+	e1 := Event{ID: uuid.New(), UserID: userID, When: mustTime(t, "03.01.2022 10:00"), What: "первое", Version: 1}
+	e2 := Event{ID: uuid.New(), UserID: userID, When: mustTime(t, "04.01.2022 10:00"), What: "второе", Version: 1}
+	require.NoError(t, s.Add(e1))
+
+	// откат: изменения видны внутри транзакции и исчезают после ошибки
+	errAbort := errors.New("abort")
+	err := s.Tx(func(tx EventStorage) error {
+		require.NoError(t, tx.Add(e2))
+		updated := e1
+		updated.What = "изменено"
+		updated.Version++
+		require.NoError(t, tx.Update(updated))
+		got, err := tx.Get(e1.ID)
+		require.NoError(t, err)
+		assert.Equal(t, "изменено", got.What)
+		events, err := tx.GetByUser(userID)
+		require.NoError(t, err)
+		assert.Equal(t, 2, len(events))
+		return errAbort
+	})
+	assert.ErrorIs(t, err, errAbort)
+	got, err := s.Get(e1.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "первое", got.What)
+	_, err = s.Get(e2.ID)
+	assert.ErrorIs(t, err, ErrEventNotFound)
+
+	// фиксация; вложенная транзакция - часть внешней
+	err = s.Tx(func(tx EventStorage) error {
+		if err := tx.Add(e2); err != nil {
+			return err
+		}
+		return runTx(tx, func(nested EventStorage) error {
+			return nested.Delete(e1.ID)
+		})
+	})
+	require.NoError(t, err)
+	_, err = s.Get(e1.ID)
+	assert.ErrorIs(t, err, ErrEventNotFound)
+	_, err = trash.GetDeleted(e1.ID)
+	require.NoError(t, err)
+	events, err := s.GetByUser(userID)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(events))
+	assert.Equal(t, e2.ID, events[0].ID)
+
+	// ошибка хранилища внутри транзакции откатывает и предыдущие изменения
+	err = s.Tx(func(tx EventStorage) error {
+		if err := tx.(TrashStorage).Restore(e1.ID); err != nil {
+			return err
+		}
+		return tx.Add(e2)
+	})
+	assert.ErrorIs(t, err, ErrEventAlreadyExists)
+	_, err = trash.GetDeleted(e1.ID)
+	assert.NoError(t, err)
+}
+
+func TestTxStorage(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		testTxStorage(t, newTestStorage())
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		s, err := NewSQLEventStorage(filepath.Join(t.TempDir(), "events.db"))
+		require.NoError(t, err)
+		defer s.Close()
+		testTxStorage(t, s)
+	})
+}
+
+func TestWALBatch(t *testing.T) {
+	dir := t.TempDir()
+	userID := uuid.New()
+	s := openTestInmem(t, dir)
+	e1 := Event{ID: uuid.New(), UserID: userID, When: mustTime(t, "03.01.2022 10:00")}
+	e2 := Event{ID: uuid.New(), UserID: userID, When: mustTime(t, "04.01.2022 10:00")}
+	require.NoError(t, s.Add(e1))
+	require.NoError(t, s.Tx(func(tx EventStorage) error {
+		if err := tx.Add(e2); err != nil {
+			return err
+		}
+		return tx.Delete(e1.ID)
+	}))
+	// откаченная транзакция в журнал не попадает
+	assert.Error(t, s.Tx(func(tx EventStorage) error {
+		if err := tx.(TrashStorage).Restore(e1.ID); err != nil {
+			return err
+		}
+		return tx.Add(e2)
+	}))
+	crash(s)
+
+	s = openTestInmem(t, dir)
+	defer s.Close()
+	events, err := s.GetByUser(userID)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(events))
+	assert.Equal(t, e2.ID, events[0].ID)
+	_, err = s.GetDeleted(e1.ID)
+	assert.NoError(t, err)
+}
+
+// batchResponse - тело ответа /batch.
+type batchResponse struct {
+	Error  string        `json:"error"`
+	Result []batchResult `json:"result"`
+}
+
+func TestBatch(t *testing.T) {
+	history, err := OpenEventHistory("")
+	require.NoError(t, err)
+	feed := NewChangeFeed(16)
+	storage, err := NewIndexedEventStorage(NewFeedEventStorage(NewHistoryEventStorage(newTestStorage(), history), feed))
+	require.NoError(t, err)
+	api := NewCalendar(storage)
+	userID := uuid.New()
+	changes, cancel := feed.Subscribe(userID, 0)
+	defer cancel()
+
+	existing := Event{ID: uuid.New(), UserID: userID, When: mustTime(t, "03.01.2022 10:00"), What: "Планёрка", Version: 1}
+	doomed := Event{ID: uuid.New(), UserID: userID, When: mustTime(t, "03.01.2022 15:00"), What: "Отменено", Version: 1}
+	require.NoError(t, storage.Add(existing))
+	require.NoError(t, storage.Add(doomed))
+	receive(t, changes)
+	receive(t, changes)
+
+	batch := func(query, body string) (int, batchResponse) {
+		rec := doJSON(api.Batch, http.MethodPost, "/batch"+query, "application/json", body)
+		var res batchResponse
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&res), rec.Body.String())
+		return rec.Code, res
+	}
+
+	// событие, созданное в пакете, можно изменить в нём же
+	created := uuid.New()
+	status, res := batch("", fmt.Sprintf(`[
+		{"op": "create", "event": {"id": %q, "user_id": %q, "when": "2022-01-04T09:00:00Z", "what": "Ретро"}},
+		{"op": "update", "id": %q, "event": {"where": "Переговорная"}},
+		{"op": "update", "id": %q, "version": 1, "event": {"what": "Планёрка команды"}},
+		{"op": "delete", "id": %q},
+		{"op": "create", "event": {"user_id": %q, "when": "2022-01-05T09:00:00Z", "what": "Демо"}}
+	]`, created, userID, created, existing.ID, doomed.ID, userID))
+	require.Equal(t, http.StatusOK, status, res.Error)
+	require.Equal(t, 5, len(res.Result))
+	for i, expected := range []int{http.StatusCreated, http.StatusOK, http.StatusOK, http.StatusNoContent, http.StatusCreated} {
+		assert.Equal(t, expected, res.Result[i].Status, i)
+		assert.Empty(t, res.Result[i].Error)
+	}
+	assert.Equal(t, created, res.Result[0].ID)
+	require.NotNil(t, res.Result[1].Event)
+	assert.Equal(t, "Переговорная", res.Result[1].Event.Where)
+	assert.Equal(t, uint64(2), res.Result[1].Event.Version)
+	assert.Nil(t, res.Result[3].Event)
+	assert.NotEqual(t, uuid.Nil, res.Result[4].ID)
+
+	got, err := storage.Get(existing.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "Планёрка команды", got.What)
+	_, err = storage.GetDeleted(doomed.ID)
+	assert.NoError(t, err)
+	found, err := storage.Search(userID, SearchQuery{Text: "переговорная"})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(found.Events))
+	assert.Equal(t, created, found.Events[0].ID)
+	found, err = storage.Search(userID, SearchQuery{Text: "отменено"})
+	require.NoError(t, err)
+	assert.Empty(t, found.Events)
+	// изменения публикуются и попадают в историю в порядке операций
+	for _, expected := range []ChangeType{ChangeCreated, ChangeUpdated, ChangeUpdated, ChangeDeleted, ChangeCreated} {
+		assert.Equal(t, expected, receive(t, changes).Type)
+	}
+	entries, err := history.Get(created)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(entries))
+	assert.Equal(t, ChangeUpdated, entries[1].Action)
+
+	// устаревшая версия откатывает весь пакет
+	status, res = batch("", fmt.Sprintf(`[
+		{"op": "create", "event": {"user_id": %q, "when": "2022-01-06T09:00:00Z", "what": "Лишнее"}},
+		{"op": "update", "id": %q, "version": 1, "event": {"what": "Устарело"}},
+		{"op": "delete", "id": %q}
+	]`, userID, existing.ID, created))
+	assert.Equal(t, http.StatusConflict, status)
+	assert.Contains(t, res.Error, "operation 1 (update)")
+	require.Equal(t, 3, len(res.Result))
+	assert.Equal(t, http.StatusFailedDependency, res.Result[0].Status)
+	assert.NotEqual(t, uuid.Nil, res.Result[0].ID)
+	assert.Equal(t, http.StatusConflict, res.Result[1].Status)
+	assert.Contains(t, res.Result[1].Error, "current version 2")
+	assert.Equal(t, http.StatusFailedDependency, res.Result[2].Status)
+	assert.Equal(t, created, res.Result[2].ID)
+	_, err = storage.Get(res.Result[0].ID)
+	assert.ErrorIs(t, err, ErrEventNotFound)
+	_, err = storage.Get(created)
+	assert.NoError(t, err)
+	found, err = storage.Search(userID, SearchQuery{Text: "лишнее"})
+	require.NoError(t, err)
+	assert.Empty(t, found.Events)
+	assert.Empty(t, changes)
+
+	// пересечение с событием, созданным раньше в том же пакете
+	status, res = batch("?allow_overlap=false", fmt.Sprintf(`[
+		{"op": "create", "event": {"user_id": %q, "when": "2022-02-01T10:00:00Z", "duration": "1h"}},
+		{"op": "create", "event": {"user_id": %q, "when": "2022-02-01T10:30:00Z", "duration": "1h"}}
+	]`, userID, userID))
+	assert.Equal(t, http.StatusConflict, status)
+	assert.Equal(t, http.StatusConflict, res.Result[1].Status)
+	events, err := storage.GetByDay(userID, mustTime(t, "01.02.2022 00:00"))
+	require.NoError(t, err)
+	assert.Empty(t, events)
+	status, _ = batch("", fmt.Sprintf(`[
+		{"op": "create", "event": {"user_id": %q, "when": "2022-02-01T10:00:00Z", "duration": "1h"}},
+		{"op": "create", "event": {"user_id": %q, "when": "2022-02-01T10:30:00Z", "duration": "1h"}}
+	]`, userID, userID))
+	assert.Equal(t, http.StatusOK, status)
+}
+
+func TestBatchErrors(t *testing.T) {
+	storage := newTestStorage()
+	api := NewCalendar(storage)
+	userID := uuid.New()
+	e := Event{ID: uuid.New(), UserID: userID, When: mustTime(t, "03.01.2022 10:00"), Version: 1}
+	require.NoError(t, storage.Add(e))
+	tooMany := "[" + strings.Repeat(`{"op": "delete"},`, maxBatchOps) + `{"op": "delete"}]`
+
+	tests := []struct {
+		name        string
+		body        string
+		status      int
+		errContains string
+	}{
+		{"empty", `[]`, http.StatusBadRequest, "empty batch"},
+		{"not an array", `{"op": "create"}`, http.StatusBadRequest, "incorrect JSON"},
+		{"unknown field", `[{"op": "delete", "event_id": "x"}]`, http.StatusBadRequest, "unknown field"},
+		{"too many", tooMany, http.StatusBadRequest, "too many operations"},
+		{"unknown op", `[{"op": "upsert"}]`, http.StatusBadRequest, `unknown op \"upsert\"`},
+		{"missing id", `[{"op": "delete"}]`, http.StatusBadRequest, "missing field: id"},
+		{"missing event", fmt.Sprintf(`[{"op": "update", "id": %q}]`, e.ID), http.StatusBadRequest, "missing field: event"},
+		{"missing user", `[{"op": "create", "event": {"when": "2022-01-04T09:00:00Z"}}]`, http.StatusBadRequest, "event.user_id"},
+		{"bad event", fmt.Sprintf(`[{"op": "create", "event": {"user_id": %q, "when": "завтра"}}]`, userID),
+			http.StatusBadRequest, "incorrect when"},
+		{"id mismatch", fmt.Sprintf(`[{"op": "create", "id": %q, "event": {"id": %q, "user_id": %q, "when": "2022-01-04T09:00:00Z"}}]`,
+			uuid.New(), uuid.New(), userID), http.StatusBadRequest, "id does not match"},
+		{"duplicate", fmt.Sprintf(`[{"op": "create", "event": {"id": %q, "user_id": %q, "when": "2022-01-04T09:00:00Z"}}]`,
+			e.ID, userID), http.StatusConflict, "already exists"},
+		{"change owner", fmt.Sprintf(`[{"op": "update", "id": %q, "event": {"user_id": %q}}]`, e.ID, uuid.New()),
+			http.StatusBadRequest, "cannot be changed"},
+		{"not found", fmt.Sprintf(`[{"op": "delete", "id": %q}]`, uuid.New()), http.StatusNotFound, "event not found"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rec := doJSON(api.Batch, http.MethodPost, "/batch", "application/json", test.body)
+			assert.Equal(t, test.status, rec.Code)
+			assert.Contains(t, rec.Body.String(), test.errContains)
+		})
+	}
+
+	rec := doJSON(api.Batch, http.MethodPost, "/batch", "application/x-www-form-urlencoded", "op=delete")
+	assert.Equal(t, http.StatusUnsupportedMediaType, rec.Code)
+	rec = doJSON(api.Batch, http.MethodPost, "/batch?allow_overlap=maybe", "application/json", `[]`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = doJSON(api.Batch, http.MethodGet, "/batch", "", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	// хранилище без транзакций
+	rec = doJSON(NewCalendar(struct{ EventStorage }{storage}).Batch, http.MethodPost, "/batch", "application/json", `[]`)
+	assert.Equal(t, http.StatusNotImplemented, rec.Code)
+	rec = doJSON(NewCalendar(NewFeedEventStorage(struct{ EventStorage }{storage}, NewChangeFeed(0))).Batch,
+		http.MethodPost, "/batch", "application/json", fmt.Sprintf(`[{"op": "delete", "id": %q}]`, e.ID))
+	assert.Equal(t, http.StatusNotImplemented, rec.Code)
+	_, err := storage.Get(e.ID)
+	assert.NoError(t, err)
+}
+
+func TestBatchAccess(t *testing.T) {
+	storage := newTestStorage()
+	api := NewCalendar(storage)
+	auth := NewAuthenticator([]byte("secret"), time.Hour)
+	aliceID, bobID := uuid.New(), uuid.New()
+	bobEvent := Event{ID: uuid.New(), UserID: bobID, When: mustTime(t, "03.01.2022 10:00"), Version: 1}
+	require.NoError(t, storage.Add(bobEvent))
+	token, _, err := auth.IssueToken(aliceID)
+	require.NoError(t, err)
+
+	do := func(body string) int {
+		rec := doJSON(func(w http.ResponseWriter, r *http.Request) {
+			r.Header.Set("Authorization", "Bearer "+token)
+			auth.Middleware(api.Batch)(w, r)
+		}, http.MethodPost, "/batch", "application/json", body)
+		return rec.Code
+	}
+	assert.Equal(t, http.StatusForbidden, do(fmt.Sprintf(`[{"op": "delete", "id": %q}]`, bobEvent.ID)))
+	assert.Equal(t, http.StatusForbidden, do(fmt.Sprintf(`[{"op": "update", "id": %q, "event": {"what": "Алиса"}}]`, bobEvent.ID)))
+	assert.Equal(t, http.StatusForbidden, do(fmt.Sprintf(`[
+		{"op": "create", "event": {"user_id": %q, "when": "2022-01-04T09:00:00Z"}},
+		{"op": "create", "event": {"user_id": %q, "when": "2022-01-04T09:00:00Z"}}
+	]`, aliceID, bobID)))
+	assert.Equal(t, http.StatusOK, do(fmt.Sprintf(`[{"op": "create", "event": {"user_id": %q, "when": "2022-01-04T09:00:00Z"}}]`, aliceID)))
+
+	_, err = storage.Get(bobEvent.ID)
+	assert.NoError(t, err)
+	events, err := storage.GetByUser(aliceID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(events))
+}
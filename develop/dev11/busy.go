@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// maxEventDuration - максимальная длительность события. Ограничение позволяет
+	// находить события, начавшиеся раньше запрашиваемого отрезка, но ещё не закончившиеся.
+	maxEventDuration = 31 * 24 * time.Hour
+	// overlapHorizon - на сколько вперёд от начала проверяются на пересечения
+	// вхождения серии.
+	overlapHorizon = 366 * 24 * time.Hour
+)
+
+// ErrEventOverlap - событие пересекается с другим событием того же пользователя.
+var ErrEventOverlap = errors.New("event overlaps with another event")
+
+// Interval - полуоткрытый отрезок времени [Start, End).
+type Interval struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// overlaps проверяет пересечение отрезков. Событие без длительности считается
+// точкой: оно пересекается с отрезком, если попадает в него.
+func (i Interval) overlaps(other Interval) bool {
+	end, otherEnd := i.End, other.End
+	if !end.After(i.Start) {
+		end = i.Start.Add(time.Nanosecond)
+	}
+	if !otherEnd.After(other.Start) {
+		otherEnd = other.Start.Add(time.Nanosecond)
+	}
+	return i.Start.Before(otherEnd) && other.Start.Before(end)
+}
+
+// End возвращает момент окончания события (вхождения).
+func (e Event) End() time.Time {
+	return e.When.Add(e.Duration)
+}
+
+// interval возвращает отрезок времени, занятый событием (вхождением).
+func (e Event) interval() Interval {
+	return Interval{Start: e.When, End: e.End()}
+}
+
+// validateDuration проверяет допустимость длительности события.
+func validateDuration(d time.Duration) error {
+	if d < 0 || d > maxEventDuration {
+		return fmt.Errorf("duration must be between 0 and %v", maxEventDuration)
+	}
+	return nil
+}
+
+// FindOverlap ищет событие пользователя, пересекающееся с событием e (кроме самого e).
+// Учитываются и события, приглашение на которые пользователь не отклонил.
+// Вхождения повторяющегося события проверяются на overlapHorizon вперёд от начала,
+// в том числе при COUNT и UNTIL: иначе серия с далёким концом разворачивалась бы
+// целиком под блокировкой записи.
+// Возвращает ErrEventOverlap, обёрнутую с описанием найденного конфликта, либо nil.
+// Чтобы между проверкой и записью не появилось пересечение, используйте saveEvent.
+func FindOverlap(s EventStorage, e Event) error {
+	to := e.When
+	if e.Recurrence != nil {
+		to = e.When.Add(overlapHorizon)
+	}
+	// события, начавшиеся не раньше чем за maxEventDuration, и до конца последнего вхождения
+	others, err := s.GetRange(e.UserID, e.When.Add(-maxEventDuration), to.Add(e.Duration))
+	if err != nil {
+		return err
+	}
+	// вхождения e и others идут в хронологическом порядке, поэтому сравниваются
+	// за один проход: вхождение может пересечься только с событиями, начавшимися
+	// не раньше чем за maxEventDuration до него и не позже его конца
+	var conflict *Event
+	first := 0
+	e.eachOccurrence(e.When, to, func(t time.Time) bool {
+		occ := Interval{Start: t, End: t.Add(e.Duration)}
+		for first < len(others) && others[first].When.Before(t.Add(-maxEventDuration)) {
+			first++
+		}
+		for i := first; i < len(others) && !others[i].When.After(occ.End); i++ {
+			other := others[i]
+			if other.ID != e.ID && other.busyFor(e.UserID) && occ.overlaps(other.interval()) {
+				conflict = &others[i]
+				return false
+			}
+		}
+		return true
+	})
+	if conflict != nil {
+		return fmt.Errorf("%w: %q at %s", ErrEventOverlap, conflict.What, conflict.When.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// saveEvent сохраняет событие e функцией save (EventStorage.Add или EventStorage.Update).
+// Если checkOverlap, событие сохраняется, только если оно ни с чем не пересекается
+// (см. FindOverlap). Если хранилище поддерживает транзакции, проверка и запись
+// выполняются в одной транзакции: иначе два одновременных запроса могли бы оба
+// пройти проверку и сохранить пересекающиеся события.
+func saveEvent(s EventStorage, e Event, checkOverlap bool, save func(EventStorage, Event) error) error {
+	if !checkOverlap {
+		return save(s, e)
+	}
+	checked := func(s EventStorage) error {
+		if err := FindOverlap(s, e); err != nil {
+			return err
+		}
+		return save(s, e)
+	}
+	if ts, ok := s.(TxStorage); ok {
+		return ts.Tx(checked)
+	}
+	return checked(s)
+}
+
+// FreeBusy возвращает занятые отрезки времени пользователя в пределах [from, to):
+// отрезки вхождений событий, обрезанные по границам запроса и объединённые,
+// если они пересекаются или примыкают друг к другу. События без длительности
+// и события, приглашение на которые отклонено, времени не занимают.
+func FreeBusy(s EventStorage, userID uuid.UUID, from, to time.Time) ([]Interval, error) {
+	events, err := s.GetRange(userID, from.Add(-maxEventDuration), to)
+	if err != nil {
+		return nil, err
+	}
+	busy := make([]Interval, 0, len(events))
+	for _, e := range events {
+		if !e.busyFor(userID) {
+			continue
+		}
+		i := e.interval()
+		if i.Start.Before(from) {
+			i.Start = from
+		}
+		if i.End.After(to) {
+			i.End = to
+		}
+		if i.End.After(i.Start) {
+			busy = append(busy, Interval{Start: i.Start.UTC(), End: i.End.UTC()})
+		}
+	}
+	sort.Slice(busy, func(a, b int) bool {
+		return busy[a].Start.Before(busy[b].Start)
+	})
+	merged := make([]Interval, 0, len(busy))
+	for _, i := range busy {
+		if n := len(merged); n > 0 && !i.Start.After(merged[n-1].End) {
+			if i.End.After(merged[n-1].End) {
+				merged[n-1].End = i.End
+			}
+			continue
+		}
+		merged = append(merged, i)
+	}
+	return merged, nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindOverlap(t *testing.T) {
+	storage := newTestStorage()
+	userID := uuid.New()
+	weekly, err := ParseRRule("FREQ=WEEKLY;BYDAY=WE")
+	require.NoError(t, err)
+	existing := []Event{
+		{ID: uuid.New(), UserID: userID, When: mustTime(t, "03.01.2022 10:00"), Duration: time.Hour},
+		{ID: uuid.New(), UserID: userID, When: mustTime(t, "05.01.2022 15:00"), Duration: 30 * time.Minute, Recurrence: weekly},
+		{ID: uuid.New(), UserID: uuid.New(), When: mustTime(t, "04.01.2022 10:00"), Duration: time.Hour},
+	}
+	for _, e := range existing {
+		require.NoError(t, storage.Add(e))
+	}
+	daily, err := ParseRRule("FREQ=DAILY;COUNT=3")
+	require.NoError(t, err)
+	// с 04.01.2022 по вторникам, последнее вхождение - 20.12.2022 или 13.12.2022
+	longWeekly, err := ParseRRule("FREQ=DAILY;INTERVAL=7;COUNT=51")
+	require.NoError(t, err)
+	shortWeekly, err := ParseRRule("FREQ=DAILY;INTERVAL=7;COUNT=50")
+	require.NoError(t, err)
+	// серии, которые разворачивались бы до 9999 года
+	endless := []*Recurrence{
+		{Freq: Daily, Interval: 1, Count: 1 << 30},
+		{Freq: Daily, Interval: 1, Until: time.Date(9999, time.December, 31, 0, 0, 0, 0, time.UTC)},
+	}
+	late := Event{ID: uuid.New(), UserID: userID, When: mustTime(t, "20.12.2022 10:30"), Duration: time.Hour}
+	require.NoError(t, storage.Add(late))
+	beyond := Event{ID: uuid.New(), UserID: userID, When: mustTime(t, "02.04.2024 14:30"), Duration: time.Hour}
+	require.NoError(t, storage.Add(beyond))
+
+	tests := []struct {
+		event   Event
+		overlap bool
+	}{
+		// примыкает к концу события - не пересекается
+		{Event{When: mustTime(t, "03.01.2022 11:00"), Duration: time.Hour}, false},
+		{Event{When: mustTime(t, "03.01.2022 10:30"), Duration: time.Hour}, true},
+		// начинается раньше и накрывает событие целиком
+		{Event{When: mustTime(t, "03.01.2022 09:00"), Duration: 3 * time.Hour}, true},
+		// событие без длительности внутри другого события
+		{Event{When: mustTime(t, "03.01.2022 10:15")}, true},
+		// событие другого пользователя не учитывается
+		{Event{When: mustTime(t, "04.01.2022 10:00"), Duration: time.Hour}, false},
+		// вхождение еженедельной серии через месяц
+		{Event{When: mustTime(t, "02.02.2022 15:15"), Duration: time.Hour}, true},
+		// третье вхождение ежедневной серии попадает на серию по средам
+		{Event{When: mustTime(t, "03.01.2022 15:00"), Duration: time.Hour, Recurrence: daily}, true},
+		{Event{When: mustTime(t, "03.01.2022 12:00"), Duration: time.Hour, Recurrence: daily}, false},
+		// изменение самого события не конфликтует с его старой версией
+		{Event{ID: existing[0].ID, When: mustTime(t, "03.01.2022 10:30"), Duration: time.Hour}, false},
+		// вхождения серии с COUNT проверяются в пределах overlapHorizon
+		{Event{When: mustTime(t, "04.01.2022 10:00"), Duration: time.Hour, Recurrence: longWeekly}, true},
+		{Event{When: mustTime(t, "04.01.2022 10:00"), Duration: time.Hour, Recurrence: shortWeekly}, false},
+		// огромные COUNT и UNTIL не разворачиваются дальше overlapHorizon
+		{Event{When: mustTime(t, "04.01.2022 10:00"), Duration: time.Hour, Recurrence: endless[0]}, true},
+		{Event{When: mustTime(t, "04.01.2022 14:00"), Duration: time.Hour, Recurrence: endless[0]}, false},
+		{Event{When: mustTime(t, "04.01.2022 10:00"), Duration: time.Hour, Recurrence: endless[1]}, true},
+		{Event{When: mustTime(t, "04.01.2022 14:00"), Duration: time.Hour, Recurrence: endless[1]}, false},
+	}
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("#%d", i), func(t *testing.T) {
+			test.event.UserID = userID
+			if test.event.ID == uuid.Nil {
+				test.event.ID = uuid.New()
+			}
+			err := FindOverlap(storage, test.event)
+			if test.overlap {
+				assert.ErrorIs(t, err, ErrEventOverlap)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+// TestSaveEventConcurrent проверяет, что из одновременных запросов на создание
+// пересекающихся событий проходит только один, а непересекающиеся сохраняются все.
+func TestSaveEventConcurrent(t *testing.T) {
+	t.Run("inmem", func(t *testing.T) {
+		testSaveEventConcurrent(t, newTestStorage())
+	})
+	t.Run("sql", func(t *testing.T) {
+		s, err := NewSQLEventStorage(filepath.Join(t.TempDir(), "events.db"))
+		require.NoError(t, err)
+		defer s.Close()
+		testSaveEventConcurrent(t, s)
+	})
+}
+
+func testSaveEventConcurrent(t *testing.T, storage EventStorage) {
+	const n = 20
+	// step - сдвиг между событиями: минута (все пересекаются) или два часа (ни одно)
+	save := func(step time.Duration) (uuid.UUID, int) {
+		userID := uuid.New()
+		errs := make(chan error, n)
+		for i := 0; i < n; i++ {
+			go func(i int) {
+				e := Event{ID: uuid.New(), UserID: userID, When: mustTime(t, "03.01.2022 10:00").Add(time.Duration(i) * step), Duration: time.Hour}
+				errs <- saveEvent(storage, e, true, EventStorage.Add)
+			}(i)
+		}
+		saved := 0
+		for i := 0; i < n; i++ {
+			err := <-errs
+			if err == nil {
+				saved++
+				continue
+			}
+			assert.ErrorIs(t, err, ErrEventOverlap)
+		}
+		return userID, saved
+	}
+
+	userID, saved := save(time.Minute)
+	assert.Equal(t, 1, saved)
+	events, err := storage.GetByUser(userID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(events))
+
+	userID, saved = save(2 * time.Hour)
+	assert.Equal(t, n, saved)
+	events, err = storage.GetByUser(userID)
+	require.NoError(t, err)
+	assert.Equal(t, n, len(events))
+}
+
+func TestFreeBusy(t *testing.T) {
+	storage := newTestStorage()
+	userID := uuid.New()
+	events := []Event{
+		{ID: uuid.New(), UserID: userID, When: mustTime(t, "03.01.2022 09:00"), Duration: time.Hour},
+		{ID: uuid.New(), UserID: userID, When: mustTime(t, "03.01.2022 09:30"), Duration: time.Hour},
+		{ID: uuid.New(), UserID: userID, When: mustTime(t, "03.01.2022 10:30"), Duration: 30 * time.Minute},
+		{ID: uuid.New(), UserID: userID, When: mustTime(t, "03.01.2022 14:00")},
+		{ID: uuid.New(), UserID: userID, When: mustTime(t, "03.01.2022 23:00"), Duration: 2 * time.Hour},
+		// многодневное событие, начавшееся до запрашиваемого отрезка
+		{ID: uuid.New(), UserID: userID, When: mustTime(t, "01.01.2022 00:00"), Duration: 50 * time.Hour},
+	}
+	for _, e := range events {
+		require.NoError(t, storage.Add(e))
+	}
+
+	busy, err := FreeBusy(storage, userID, mustTime(t, "03.01.2022 00:00"), mustTime(t, "04.01.2022 00:00"))
+	require.NoError(t, err)
+	expected := []Interval{
+		{mustTime(t, "03.01.2022 00:00"), mustTime(t, "03.01.2022 02:00")},
+		{mustTime(t, "03.01.2022 09:00"), mustTime(t, "03.01.2022 11:00")},
+		{mustTime(t, "03.01.2022 23:00"), mustTime(t, "04.01.2022 00:00")},
+	}
+	require.Equal(t, len(expected), len(busy))
+	for i := range expected {
+		assert.True(t, expected[i].Start.Equal(busy[i].Start), "#%d start %v", i, busy[i].Start)
+		assert.True(t, expected[i].End.Equal(busy[i].End), "#%d end %v", i, busy[i].End)
+	}
+}
+
+func TestBusyHandlers(t *testing.T) {
+	api := NewCalendar(newTestStorage())
+	userID := uuid.New().String()
+
+	form := url.Values{
+		"user_id": {userID}, "date": {"03.01.2022"}, "time": {"10:00"}, "duration": {"1h"},
+	}
+	rec := doForm(api.CreateEvent, http.MethodPost, "/create_event", form)
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	// по умолчанию пересечения разрешены
+	form.Set("time", "10:30")
+	rec = doForm(api.CreateEvent, http.MethodPost, "/create_event", form)
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	form.Set("allow_overlap", "false")
+	rec = doForm(api.CreateEvent, http.MethodPost, "/create_event", form)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	form.Set("time", "12:00")
+	rec = doForm(api.CreateEvent, http.MethodPost, "/create_event", form)
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	for _, bad := range []url.Values{
+		{"duration": {"-1h"}},
+		{"duration": {"soon"}},
+		{"duration": {"1000h"}},
+		{"allow_overlap": {"maybe"}},
+	} {
+		f := url.Values{"user_id": {userID}, "date": {"05.01.2022"}}
+		for k, v := range bad {
+			f[k] = v
+		}
+		rec = doForm(api.CreateEvent, http.MethodPost, "/create_event", f)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, bad)
+	}
+
+	rec = doForm(api.FreeBusy, http.MethodGet, "/free_busy", url.Values{
+		"user_id": {userID}, "from": {"03.01.2022 12:00"}, "to": {"03.01.2022 18:00"}, "tz": {"Europe/Moscow"},
+	})
+	require.Equal(t, http.StatusOK, rec.Code)
+	var res struct {
+		Result []Interval
+	}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&res))
+	// 12:00-18:00 MSK = 09:00-15:00 UTC: отрезки 10:00-11:30 (объединены) и 12:00-13:00
+	require.Equal(t, 2, len(res.Result))
+	assert.True(t, mustTime(t, "03.01.2022 10:00").Equal(res.Result[0].Start))
+	assert.True(t, mustTime(t, "03.01.2022 11:30").Equal(res.Result[0].End))
+	assert.True(t, mustTime(t, "03.01.2022 13:00").Equal(res.Result[1].End))
+
+	for _, bad := range []url.Values{
+		{"user_id": {userID}, "from": {"03.01.2022"}},
+		{"user_id": {userID}, "from": {"04.01.2022"}, "to": {"03.01.2022"}},
+		{"user_id": {userID}, "from": {"03.01.2022"}, "to": {"tomorrow"}},
+	} {
+		rec = doForm(api.FreeBusy, http.MethodGet, "/free_busy", bad)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, bad)
+	}
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Коды завершения calctl.
+const (
+	calctlOK = 0
+	// calctlFailed - сервер вернул ошибку или запрос не удалось выполнить.
+	calctlFailed = 1
+	// calctlUsage - неверные аргументы командной строки.
+	calctlUsage = 2
+)
+
+const calctlUsageText = `usage: calctl [-server URL] [-token TOKEN] [-json] <command> [flags]
+
+commands:
+  create   create an event (-user, -date, ...)
+  update   change an event (-id, changed fields only; -rrule= etc. clear a field)
+  delete   delete an event (-id)
+  day      events for a day (-user, -date)
+  week     events for a week starting at -date
+  month    events for a month starting at -date
+  import   import events from an .ics file (-user FILE, "-" for stdin)
+  export   export events to an .ics file (-user [-o FILE])
+
+Run "calctl <command> -h" for the command flags.
+`
+
+// eventFlags - параметры /create_event и /update_event, задаваемые одноимёнными флагами.
+var eventFlags = []struct{ name, usage string }{
+	{"date", "date dd.mm.yyyy"},
+	{"time", "local time hh:mm"},
+	{"tz", "IANA time zone of date and time"},
+	{"duration", "duration, e.g. 45m or 1h30m"},
+	{"place", "place"},
+	{"description", "description"},
+	{"rrule", "recurrence rule, e.g. FREQ=WEEKLY;BYDAY=MO"},
+	{"exdate", "comma-separated excluded dates dd.mm.yyyy[ hh:mm]"},
+	{"remind", "comma-separated reminders before start, e.g. 15m,1d"},
+	{"attendees", "comma-separated attendee user IDs"},
+	{"allow_overlap", "false rejects events overlapping other events"},
+}
+
+// calctlArgs определяет, запущен ли исполняемый файл как клиент командной строки:
+// под именем calctl (например, через символическую ссылку) или с первым
+// аргументом calctl. Возвращает аргументы клиента.
+func calctlArgs(args []string) ([]string, bool) {
+	if len(args) == 0 {
+		return nil, false
+	}
+	if strings.TrimSuffix(filepath.Base(args[0]), ".exe") == "calctl" {
+		return args[1:], true
+	}
+	if len(args) > 1 && args[1] == "calctl" {
+		return args[2:], true
+	}
+	return nil, false
+}
+
+// apiError - ошибка, которую сервер вернул в теле ответа ({"error": "..."}).
+type apiError struct {
+	Status  int
+	Message string
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+// calctl - клиент командной строки для HTTP API календаря.
+type calctl struct {
+	server string
+	token  string
+	// json - выводить результат в JSON вместо таблицы.
+	json   bool
+	client *http.Client
+	stdout io.Writer
+	stderr io.Writer
+}
+
+// runCalctl выполняет команду клиента с аргументами args и возвращает код завершения:
+// calctlOK при успехе, calctlFailed при ошибке запроса (в том числе ответе
+// {"error": "..."}) и calctlUsage при неверных аргументах.
+func runCalctl(args []string, stdout, stderr io.Writer) int {
+	c := &calctl{client: &http.Client{Timeout: 30 * time.Second}, stdout: stdout, stderr: stderr}
+	fs := flag.NewFlagSet("calctl", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() { fmt.Fprint(stderr, calctlUsageText) }
+	fs.StringVar(&c.server, "server", envOr("CALCTL_SERVER", "http://localhost:8080"), "server URL (env CALCTL_SERVER)")
+	fs.StringVar(&c.token, "token", os.Getenv("CALCTL_TOKEN"), "access token from /login (env CALCTL_TOKEN)")
+	fs.BoolVar(&c.json, "json", false, "print results as JSON")
+	if err := fs.Parse(args); err != nil {
+		return calctlUsage
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return calctlUsage
+	}
+
+	commands := map[string]func([]string) error{
+		"create": c.create,
+		"update": c.update,
+		"delete": c.delete,
+		"day":    c.events("day", "/events_for_day"),
+		"week":   c.events("week", "/events_for_week"),
+		"month":  c.events("month", "/events_for_month"),
+		"import": c.importICS,
+		"export": c.exportICS,
+	}
+	command, ok := commands[fs.Arg(0)]
+	if !ok {
+		fmt.Fprintf(stderr, "calctl: unknown command %q\n", fs.Arg(0))
+		fs.Usage()
+		return calctlUsage
+	}
+	err := command(fs.Args()[1:])
+	var usage usageError
+	switch {
+	case err == nil:
+		return calctlOK
+	case errors.Is(err, flag.ErrHelp):
+		return calctlOK
+	case errors.As(err, &usage):
+		if usage != "" {
+			fmt.Fprintf(stderr, "calctl %s: %s\n", fs.Arg(0), string(usage))
+		}
+		return calctlUsage
+	default:
+		fmt.Fprintf(stderr, "calctl %s: %v\n", fs.Arg(0), err)
+		return calctlFailed
+	}
+}
+
+// usageError - ошибка в аргументах команды.
+type usageError string
+
+func (e usageError) Error() string {
+	return string(e)
+}
+
+// envOr возвращает значение переменной окружения name или def, если она не задана.
+func envOr(name, def string) string {
+	if v, ok := os.LookupEnv(name); ok {
+		return v
+	}
+	return def
+}
+
+// flagSet создаёт набор флагов команды name с выводом ошибок разбора в stderr.
+func (c *calctl) flagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet("calctl "+name, flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	return fs
+}
+
+// parse разбирает флаги команды; лишние позиционные аргументы - ошибка.
+func (c *calctl) parse(fs *flag.FlagSet, args []string, positional int) error {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return usageError("") // сообщение уже выведено пакетом flag
+	}
+	if fs.NArg() != positional {
+		return usageError(fmt.Sprintf("unexpected arguments: %s", strings.Join(fs.Args(), " ")))
+	}
+	return nil
+}
+
+// userFlag добавляет флаг -user (по умолчанию - переменная окружения CALCTL_USER).
+func userFlag(fs *flag.FlagSet) *string {
+	return fs.String("user", os.Getenv("CALCTL_USER"), "user ID (env CALCTL_USER)")
+}
+
+// required возвращает usageError, если обязательный флаг name не задан.
+func required(name, value string) error {
+	if value == "" {
+		return usageError("missing flag -" + name)
+	}
+	return nil
+}
+
+// do выполняет запрос к API и возвращает тело успешного ответа.
+// Ответ с кодом ошибки возвращается как *apiError.
+func (c *calctl) do(method, path string, query url.Values, body io.Reader, contentType string) ([]byte, error) {
+	u := strings.TrimSuffix(c.server, "/") + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		var res struct {
+			Error string `json:"error"`
+		}
+		if err := json.Unmarshal(data, &res); err != nil || res.Error == "" {
+			res.Error = strings.TrimSpace(string(data))
+			if res.Error == "" {
+				res.Error = http.StatusText(resp.StatusCode)
+			}
+		}
+		return nil, &apiError{Status: resp.StatusCode, Message: res.Error}
+	}
+	return data, nil
+}
+
+// call выполняет запрос к методу API и возвращает значение поля result ответа
+// (nil для ответа без тела). Параметры GET-запроса передаются в строке запроса,
+// POST-запроса - формой в теле.
+func (c *calctl) call(method, path string, params url.Values) (json.RawMessage, error) {
+	var data []byte
+	var err error
+	if method == http.MethodGet {
+		data, err = c.do(method, path, params, nil, "")
+	} else {
+		data, err = c.do(method, path, nil, strings.NewReader(params.Encode()), "application/x-www-form-urlencoded")
+	}
+	if err != nil || len(data) == 0 {
+		return nil, err
+	}
+	var res struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, fmt.Errorf("malformed response: %v", err)
+	}
+	return res.Result, nil
+}
+
+// printMessage выводит строку результата (в режиме -json - строкой JSON).
+func (c *calctl) printMessage(message string) error {
+	if c.json {
+		return c.printJSON(message)
+	}
+	_, err := fmt.Fprintln(c.stdout, message)
+	return err
+}
+
+// printJSON выводит v в виде JSON с отступами.
+func (c *calctl) printJSON(v interface{}) error {
+	enc := json.NewEncoder(c.stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// resultMessage извлекает строку результата ответа.
+func resultMessage(result json.RawMessage) string {
+	var message string
+	if err := json.Unmarshal(result, &message); err != nil {
+		return string(result)
+	}
+	return message
+}
+
+// eventForm добавляет в набор флагов параметры события и возвращает функцию,
+// собирающую форму запроса из явно заданных флагов.
+func eventForm(fs *flag.FlagSet) func() url.Values {
+	values := make(map[string]*string, len(eventFlags))
+	for _, f := range eventFlags {
+		values[f.name] = fs.String(f.name, "", f.usage)
+	}
+	return func() url.Values {
+		form := url.Values{}
+		fs.Visit(func(f *flag.Flag) {
+			if v, ok := values[f.Name]; ok {
+				form.Set(f.Name, *v)
+			}
+		})
+		return form
+	}
+}
+
+// create создаёт событие (POST /create_event).
+func (c *calctl) create(args []string) error {
+	fs := c.flagSet("create")
+	user := userFlag(fs)
+	form := eventForm(fs)
+	if err := c.parse(fs, args, 0); err != nil {
+		return err
+	}
+	params := form()
+	if err := required("user", *user); err != nil {
+		return err
+	}
+	if err := required("date", params.Get("date")); err != nil {
+		return err
+	}
+	params.Set("user_id", *user)
+	result, err := c.call(http.MethodPost, "/create_event", params)
+	if err != nil {
+		return err
+	}
+	return c.printMessage(resultMessage(result))
+}
+
+// update изменяет заданные флагами поля события (POST /update_event).
+func (c *calctl) update(args []string) error {
+	fs := c.flagSet("update")
+	id := fs.String("id", "", "event ID")
+	version := fs.String("version", "", "expected event version")
+	user := fs.String("user", "", "new organizer user ID")
+	form := eventForm(fs)
+	if err := c.parse(fs, args, 0); err != nil {
+		return err
+	}
+	if err := required("id", *id); err != nil {
+		return err
+	}
+	params := form()
+	params.Set("event_id", *id)
+	if *version != "" {
+		params.Set("version", *version)
+	}
+	if *user != "" {
+		params.Set("user_id", *user)
+	}
+	result, err := c.call(http.MethodPost, "/update_event", params)
+	if err != nil {
+		return err
+	}
+	return c.printMessage(resultMessage(result))
+}
+
+// delete удаляет событие (POST /delete_event).
+func (c *calctl) delete(args []string) error {
+	fs := c.flagSet("delete")
+	id := fs.String("id", "", "event ID")
+	version := fs.String("version", "", "expected event version")
+	if err := c.parse(fs, args, 0); err != nil {
+		return err
+	}
+	if err := required("id", *id); err != nil {
+		return err
+	}
+	params := url.Values{"event_id": {*id}}
+	if *version != "" {
+		params.Set("version", *version)
+	}
+	// успешный ответ - 204 без тела
+	if _, err := c.call(http.MethodPost, "/delete_event", params); err != nil {
+		return err
+	}
+	return c.printMessage(fmt.Sprintf("event %s deleted", *id))
+}
+
+// events возвращает команду name, выводящую события пользователя за период
+// методом API path.
+func (c *calctl) events(name, path string) func([]string) error {
+	return func(args []string) error {
+		fs := c.flagSet(name)
+		user := userFlag(fs)
+		date := fs.String("date", time.Now().Format("02.01.2006"), "first day dd.mm.yyyy")
+		tz := fs.String("tz", "", "IANA time zone the days are counted in")
+		align := fs.String("align", "", `"calendar" for Monday-based weeks and months from the 1st`)
+		if err := c.parse(fs, args, 0); err != nil {
+			return err
+		}
+		if err := required("user", *user); err != nil {
+			return err
+		}
+		params := url.Values{"user_id": {*user}, "date": {*date}}
+		if *tz != "" {
+			params.Set("tz", *tz)
+		}
+		if *align != "" {
+			params.Set("align", *align)
+		}
+		result, err := c.call(http.MethodGet, path, params)
+		if err != nil {
+			return err
+		}
+		var events []Event
+		if err := json.Unmarshal(result, &events); err != nil {
+			return fmt.Errorf("malformed response: %v", err)
+		}
+		if c.json {
+			return c.printJSON(events)
+		}
+		return printEvents(c.stdout, events)
+	}
+}
+
+// printEvents выводит события таблицей; время - в часовом поясе события.
+func printEvents(w io.Writer, events []Event) error {
+	if len(events) == 0 {
+		_, err := fmt.Fprintln(w, "no events")
+		return err
+	}
+	const layout = "02.01.2006 15:04"
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSTART\tEND\tTZ\tWHAT\tWHERE")
+	for _, e := range events {
+		loc := e.Location()
+		end := "-"
+		if e.Duration > 0 {
+			end = e.End().In(loc).Format(layout)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", e.ID, e.When.In(loc).Format(layout), end, loc, e.What, e.Where)
+	}
+	return tw.Flush()
+}
+
+// importICS импортирует события из файла iCalendar (POST /import_ics).
+// Если часть событий импортировать не удалось, команда завершается ошибкой.
+func (c *calctl) importICS(args []string) error {
+	fs := c.flagSet("import")
+	user := userFlag(fs)
+	if err := c.parse(fs, args, 1); err != nil {
+		return err
+	}
+	if err := required("user", *user); err != nil {
+		return err
+	}
+	var in io.Reader = os.Stdin
+	if name := fs.Arg(0); name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	data, err := c.do(http.MethodPost, "/import_ics", url.Values{"user_id": {*user}}, in, "text/calendar")
+	if err != nil {
+		return err
+	}
+	var res struct {
+		Result struct {
+			Imported int            `json:"imported"`
+			Errors   []ICSItemError `json:"errors"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(data, &res); err != nil {
+		return fmt.Errorf("malformed response: %v", err)
+	}
+	if c.json {
+		err = c.printJSON(res.Result)
+	} else {
+		_, err = fmt.Fprintf(c.stdout, "imported %d event(s)\n", res.Result.Imported)
+		for _, e := range res.Result.Errors {
+			fmt.Fprintf(c.stdout, "item %d %s: %s\n", e.Item, e.UID, e.Error)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if n := len(res.Result.Errors); n > 0 {
+		return fmt.Errorf("%d event(s) not imported", n)
+	}
+	return nil
+}
+
+// exportICS выгружает события пользователя в формате iCalendar (GET /export.ics)
+// в файл -o или в стандартный вывод.
+func (c *calctl) exportICS(args []string) error {
+	fs := c.flagSet("export")
+	user := userFlag(fs)
+	out := fs.String("o", "", "output file (default stdout)")
+	if err := c.parse(fs, args, 0); err != nil {
+		return err
+	}
+	if err := required("user", *user); err != nil {
+		return err
+	}
+	data, err := c.do(http.MethodGet, "/export.ics", url.Values{"user_id": {*user}}, nil, "")
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		_, err = c.stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(*out, data, 0o644)
+}
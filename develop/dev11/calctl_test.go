@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newCalctlServer запускает сервер календаря в процессе теста; auth == nil - без аутентификации.
+func newCalctlServer(t *testing.T, auth *Authenticator) (*httptest.Server, EventStorage) {
+	storage := newTestStorage()
+	api := NewCalendar(storage)
+	router := http.NewServeMux()
+	for route, h := range map[string]http.HandlerFunc{
+		"/create_event":     api.CreateEvent,
+		"/update_event":     api.UpdateEvent,
+		"/delete_event":     api.DeleteEvent,
+		"/events_for_day":   api.GetDayEvents,
+		"/events_for_week":  api.GetWeekEvents,
+		"/events_for_month": api.GetMonthEvents,
+		"/export.ics":       api.ExportICS,
+		"/import_ics":       api.ImportICS,
+	} {
+		router.Handle(route, auth.Middleware(h))
+	}
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return server, storage
+}
+
+// calctlRun запускает клиент и возвращает код завершения, stdout и stderr.
+func calctlRun(server *httptest.Server, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := runCalctl(append([]string{"-server", server.URL}, args...), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestCalctl(t *testing.T) {
+	server, storage := newCalctlServer(t, nil)
+	user := uuid.New().String()
+
+	code, out, errOut := calctlRun(server, "create", "-user", user, "-date", "03.01.2022", "-time", "10:00",
+		"-tz", "Europe/Moscow", "-duration", "1h30m", "-description", "Встреча", "-place", "Офис")
+	require.Equal(t, calctlOK, code, errOut)
+	assert.Contains(t, out, "successfully added")
+	events, err := storage.GetByUser(uuid.MustParse(user))
+	require.NoError(t, err)
+	require.Equal(t, 1, len(events))
+	id := events[0].ID.String()
+	assert.Contains(t, out, id)
+
+	// таблица - во времени события, JSON - массив событий
+	code, out, _ = calctlRun(server, "day", "-user", user, "-date", "03.01.2022", "-tz", "Europe/Moscow")
+	require.Equal(t, calctlOK, code)
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	require.Equal(t, 2, len(lines))
+	assert.Equal(t, []string{"ID", "START", "END", "TZ", "WHAT", "WHERE"}, strings.Fields(lines[0]))
+	assert.Equal(t, []string{id, "03.01.2022", "10:00", "03.01.2022", "11:30", "Europe/Moscow", "Встреча", "Офис"},
+		strings.Fields(lines[1]))
+	code, out, _ = calctlRun(server, "-json", "week", "-user", user, "-date", "01.01.2022")
+	require.Equal(t, calctlOK, code)
+	var found []Event
+	require.NoError(t, json.Unmarshal([]byte(out), &found))
+	require.Equal(t, 1, len(found))
+	assert.Equal(t, events[0].ID, found[0].ID)
+	assert.Equal(t, 90*time.Minute, found[0].Duration)
+	code, out, _ = calctlRun(server, "month", "-user", user, "-date", "01.02.2022")
+	require.Equal(t, calctlOK, code)
+	assert.Equal(t, "no events\n", out)
+
+	// изменяются только заданные поля; устаревшая версия - ошибка сервера и код 1
+	code, _, errOut = calctlRun(server, "update", "-id", id, "-place", "Дом", "-version", "1")
+	require.Equal(t, calctlOK, code, errOut)
+	updated, err := storage.Get(events[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, "Дом", updated.Where)
+	assert.Equal(t, "Встреча", updated.What)
+	code, _, errOut = calctlRun(server, "update", "-id", id, "-place", "Офис", "-version", "1")
+	assert.Equal(t, calctlFailed, code)
+	assert.Contains(t, errOut, "Conflict: event has been modified concurrently")
+
+	// экспорт и импорт в другой календарь
+	icsPath := filepath.Join(t.TempDir(), "calendar.ics")
+	code, _, _ = calctlRun(server, "export", "-user", user, "-o", icsPath)
+	require.Equal(t, calctlOK, code)
+	ics, err := os.ReadFile(icsPath)
+	require.NoError(t, err)
+	assert.Contains(t, string(ics), "SUMMARY:Встреча")
+	// повторный импорт перезаписывает событие, а другой пользователь получает свою копию
+	code, out, errOut = calctlRun(server, "import", "-user", user, icsPath)
+	require.Equal(t, calctlOK, code, errOut)
+	assert.Equal(t, "imported 1 event(s)\n", out)
+	other := uuid.New()
+	code, out, errOut = calctlRun(server, "import", "-user", other.String(), icsPath)
+	require.Equal(t, calctlOK, code, errOut)
+	assert.Equal(t, "imported 1 event(s)\n", out)
+	copies, err := storage.GetByUser(other)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(copies))
+	assert.NotEqual(t, events[0].ID, copies[0].ID)
+	// события, которые не удалось разобрать, - ошибка и код 1
+	brokenPath := filepath.Join(t.TempDir(), "broken.ics")
+	require.NoError(t, os.WriteFile(brokenPath, []byte("BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:broken\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"), 0o644))
+	code, out, errOut = calctlRun(server, "-json", "import", "-user", user, brokenPath)
+	assert.Equal(t, calctlFailed, code)
+	assert.Contains(t, out, `"imported": 0`)
+	assert.Contains(t, out, "missing DTSTART")
+	assert.Contains(t, errOut, "1 event(s) not imported")
+
+	code, out, _ = calctlRun(server, "delete", "-id", id)
+	require.Equal(t, calctlOK, code)
+	assert.Equal(t, "event "+id+" deleted\n", out)
+	code, _, errOut = calctlRun(server, "delete", "-id", id)
+	assert.Equal(t, calctlFailed, code)
+	assert.Contains(t, errOut, "Not Found: event not found")
+}
+
+func TestCalctlErrors(t *testing.T) {
+	server, _ := newCalctlServer(t, nil)
+	user := uuid.New().String()
+	tests := []struct {
+		name   string
+		args   []string
+		code   int
+		stderr string
+	}{
+		{"no command", nil, calctlUsage, "usage: calctl"},
+		{"unknown command", []string{"list"}, calctlUsage, `unknown command "list"`},
+		{"unknown flag", []string{"day", "-year", "2022"}, calctlUsage, "flag provided but not defined: -year"},
+		{"missing user", []string{"create", "-date", "03.01.2022"}, calctlUsage, "missing flag -user"},
+		{"missing id", []string{"delete"}, calctlUsage, "missing flag -id"},
+		{"extra argument", []string{"export", "-user", user, "calendar.ics"}, calctlUsage, "unexpected arguments: calendar.ics"},
+		{"bad date", []string{"create", "-user", user, "-date", "2022-01-03"}, calctlFailed, "Bad Request: "},
+		{"bad quoted value", []string{"day", "-user", user, "-date", `"03.01.2022"`}, calctlFailed, `incorrect date format: "03.01.2022"`},
+		{"bad user", []string{"export", "-user", "alice"}, calctlFailed, "incorrect user ID"},
+		{"missing file", []string{"import", "-user", user, filepath.Join(t.TempDir(), "missing.ics")}, calctlFailed, "no such file"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			code, _, errOut := calctlRun(server, test.args...)
+			assert.Equal(t, test.code, code)
+			assert.Contains(t, errOut, test.stderr)
+		})
+	}
+
+	// сервер недоступен
+	var stderr bytes.Buffer
+	code := runCalctl([]string{"-server", "http://127.0.0.1:1", "day", "-user", user}, &bytes.Buffer{}, &stderr)
+	assert.Equal(t, calctlFailed, code)
+	assert.NotEmpty(t, stderr.String())
+}
+
+func TestCalctlToken(t *testing.T) {
+	auth := NewAuthenticator([]byte("secret"), time.Hour)
+	server, _ := newCalctlServer(t, auth)
+	userID := uuid.New()
+	token, _, err := auth.IssueToken(userID)
+	require.NoError(t, err)
+
+	code, _, errOut := calctlRun(server, "day", "-user", userID.String(), "-date", "03.01.2022")
+	assert.Equal(t, calctlFailed, code)
+	assert.Contains(t, errOut, "Unauthorized")
+	code, out, _ := calctlRun(server, "-token", token, "day", "-user", userID.String(), "-date", "03.01.2022")
+	assert.Equal(t, calctlOK, code)
+	assert.Equal(t, "no events\n", out)
+	code, _, errOut = calctlRun(server, "-token", token, "day", "-user", uuid.New().String(), "-date", "03.01.2022")
+	assert.Equal(t, calctlFailed, code)
+	assert.Contains(t, errOut, "Forbidden: access denied")
+}
+
+func TestCalctlArgs(t *testing.T) {
+	args, ok := calctlArgs([]string{"/usr/local/bin/calctl", "day"})
+	assert.True(t, ok)
+	assert.Equal(t, []string{"day"}, args)
+	args, ok = calctlArgs([]string{"./myapp", "calctl", "-json", "day"})
+	assert.True(t, ok)
+	assert.Equal(t, []string{"-json", "day"}, args)
+	_, ok = calctlArgs([]string{"./myapp", "-p", "8081"})
+	assert.False(t, ok)
+}
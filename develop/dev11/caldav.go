@@ -0,0 +1,740 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Подмножество CalDAV (RFC 4791) поверх EventStorage. Пространство ресурсов:
+//
+//	/caldav/                                        корень (current-user-principal)
+//	/caldav/principals/{user_id}/                   принципал пользователя
+//	/caldav/calendars/{user_id}/                    calendar-home-set
+//	/caldav/calendars/{user_id}/default/            календарь - события, организатор которых пользователь
+//	/caldav/calendars/{user_id}/default/{uid}.ics   событие
+//
+// Поддерживаются OPTIONS, PROPFIND (Depth 0 и 1), REPORT calendar-query
+// (с фильтром time-range) и calendar-multiget, GET/PUT/DELETE событий
+// с условиями If-Match и If-None-Match по ETag.
+
+const (
+	// calDAVPrefix - префикс маршрутов CalDAV.
+	calDAVPrefix = "/caldav/"
+	// calDAVCalendar - имя единственного календаря пользователя.
+	calDAVCalendar = "default"
+	// maxCalDAVBody - максимальный размер тела запроса CalDAV.
+	maxCalDAVBody = 1 << 20
+
+	nsDAV    = "DAV:"
+	nsCalDAV = "urn:ietf:params:xml:ns:caldav"
+	nsCS     = "http://calendarserver.org/ns/"
+)
+
+// davResourceKind - вид ресурса CalDAV.
+type davResourceKind int
+
+const (
+	davRoot davResourceKind = iota
+	davPrincipal
+	davHome
+	davCalendar
+	davEvent
+)
+
+// davResource - ресурс, адресуемый путём запроса.
+type davResource struct {
+	kind   davResourceKind
+	userID uuid.UUID
+	// eventID - ID события (для davEvent).
+	eventID uuid.UUID
+	// event - событие (для davEvent, если оно загружено).
+	event Event
+}
+
+// href возвращает путь ресурса.
+func (res davResource) href() string {
+	switch res.kind {
+	case davPrincipal:
+		return fmt.Sprintf("%sprincipals/%s/", calDAVPrefix, res.userID)
+	case davHome:
+		return fmt.Sprintf("%scalendars/%s/", calDAVPrefix, res.userID)
+	case davCalendar:
+		return fmt.Sprintf("%scalendars/%s/%s/", calDAVPrefix, res.userID, calDAVCalendar)
+	case davEvent:
+		return fmt.Sprintf("%scalendars/%s/%s/%s.ics", calDAVPrefix, res.userID, calDAVCalendar, res.eventID)
+	default:
+		return calDAVPrefix
+	}
+}
+
+// parseDAVPath разбирает путь запроса. Имя ресурса события, не являющееся UUID,
+// отображается в UUID так же, как UID при импорте iCalendar.
+func parseDAVPath(p string) (davResource, bool) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(p, calDAVPrefix), "/"), "/")
+	if len(parts) == 1 && parts[0] == "" {
+		return davResource{kind: davRoot}, true
+	}
+	if len(parts) < 2 {
+		return davResource{}, false
+	}
+	userID, err := uuid.Parse(parts[1])
+	if err != nil {
+		return davResource{}, false
+	}
+	res := davResource{userID: userID}
+	switch {
+	case parts[0] == "principals" && len(parts) == 2:
+		res.kind = davPrincipal
+	case parts[0] != "calendars":
+		return davResource{}, false
+	case len(parts) == 2:
+		res.kind = davHome
+	case parts[2] != calDAVCalendar:
+		return davResource{}, false
+	case len(parts) == 3:
+		res.kind = davCalendar
+	case len(parts) == 4 && strings.HasSuffix(parts[3], ".ics"):
+		res.kind = davEvent
+		name := strings.TrimSuffix(parts[3], ".ics")
+		if res.eventID, err = uuid.Parse(name); err != nil {
+			res.eventID = icsEventID(userID, name)
+		}
+	default:
+		return davResource{}, false
+	}
+	return res, true
+}
+
+// eventETag возвращает ETag события - хэш его содержимого.
+func eventETag(e Event) string {
+	data, _ := json.Marshal(e)
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// calendarCTag возвращает метку состояния календаря, меняющуюся при любом
+// изменении его событий.
+func calendarCTag(events []Event) string {
+	tags := make([]string, 0, len(events))
+	for _, e := range events {
+		tags = append(tags, e.ID.String()+eventETag(e))
+	}
+	sort.Strings(tags)
+	sum := sha256.Sum256([]byte(strings.Join(tags, ",")))
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches проверяет значение заголовка If-Match/If-None-Match: "*" или
+// список ETag через запятую (слабые ETag сравниваются как сильные).
+func etagMatches(header, etag string) bool {
+	for _, v := range strings.Split(header, ",") {
+		v = strings.TrimPrefix(strings.TrimSpace(v), "W/")
+		if v == "*" || v == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// xml-документы запросов.
+type (
+	davPropNames struct {
+		Names []struct {
+			XMLName xml.Name
+		} `xml:",any"`
+	}
+	davPropfind struct {
+		XMLName xml.Name      `xml:"DAV: propfind"`
+		Prop    *davPropNames `xml:"DAV: prop"`
+	}
+	davTimeRange struct {
+		Start string `xml:"start,attr"`
+		End   string `xml:"end,attr"`
+	}
+	davCompFilter struct {
+		Name      string          `xml:"name,attr"`
+		TimeRange *davTimeRange   `xml:"urn:ietf:params:xml:ns:caldav time-range"`
+		Comps     []davCompFilter `xml:"urn:ietf:params:xml:ns:caldav comp-filter"`
+	}
+	davReport struct {
+		XMLName xml.Name
+		Prop    *davPropNames  `xml:"DAV: prop"`
+		Filter  *davCompFilter `xml:"urn:ietf:params:xml:ns:caldav filter>comp-filter"`
+		Hrefs   []string       `xml:"DAV: href"`
+	}
+)
+
+// xml-документ ответа multistatus. Элементы записываются с префиксами,
+// объявленными в корне документа.
+type (
+	davMultistatus struct {
+		XMLName   xml.Name      `xml:"D:multistatus"`
+		XMLNSD    string        `xml:"xmlns:D,attr"`
+		XMLNSC    string        `xml:"xmlns:C,attr"`
+		XMLNSCS   string        `xml:"xmlns:CS,attr"`
+		Responses []davResponse `xml:"D:response"`
+	}
+	davResponse struct {
+		Href     string        `xml:"D:href"`
+		Propstat []davPropstat `xml:"D:propstat,omitempty"`
+		Status   string        `xml:"D:status,omitempty"`
+	}
+	davPropstat struct {
+		Prop   davPropValues `xml:"D:prop"`
+		Status string        `xml:"D:status"`
+	}
+	davPropValues struct {
+		Values []davPropValue
+	}
+	davPropValue struct {
+		XMLName xml.Name
+		Inner   string `xml:",innerxml"`
+	}
+)
+
+// davPrefixes - префиксы пространств имён в ответах.
+var davPrefixes = map[string]string{nsDAV: "D", nsCalDAV: "C", nsCS: "CS"}
+
+// davStatus возвращает строку статуса для элемента status.
+func davStatus(code int) string {
+	return fmt.Sprintf("HTTP/1.1 %d %s", code, http.StatusText(code))
+}
+
+// escapeXML экранирует текст для вставки в XML.
+func escapeXML(s string) string {
+	buf := &bytes.Buffer{}
+	xml.EscapeText(buf, []byte(s))
+	return buf.String()
+}
+
+// defaultDAVProps - свойства, возвращаемые на allprop.
+var defaultDAVProps = []xml.Name{
+	{Space: nsDAV, Local: "resourcetype"},
+	{Space: nsDAV, Local: "displayname"},
+	{Space: nsDAV, Local: "current-user-principal"},
+	{Space: nsDAV, Local: "principal-URL"},
+	{Space: nsCalDAV, Local: "calendar-home-set"},
+	{Space: nsCalDAV, Local: "supported-calendar-component-set"},
+	{Space: nsDAV, Local: "supported-report-set"},
+	{Space: nsCS, Local: "getctag"},
+	{Space: nsDAV, Local: "getetag"},
+	{Space: nsDAV, Local: "getcontenttype"},
+}
+
+// CalDAVAPI обрабатывает запросы CalDAV.
+type CalDAVAPI struct {
+	storage EventStorage
+	// mu исключает изменение события между проверкой ETag и записью.
+	mu *sync.Mutex
+}
+
+// NewCalDAV создаёт обработчик CalDAV поверх хранилища s.
+func NewCalDAV(s EventStorage) *CalDAVAPI {
+	return &CalDAVAPI{storage: s, mu: &sync.Mutex{}}
+}
+
+// ServeHTTP обрабатывает запросы к ресурсам CalDAV (см. описание пространства ресурсов).
+func (c CalDAVAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	const logHeader = "calDAV"
+	res, ok := parseDAVPath(r.URL.Path)
+	if !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if res.kind != davRoot && !authorized(r, res.userID) {
+		http.Error(w, "access denied", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("DAV", "1, calendar-access")
+	switch {
+	case r.Method == http.MethodOptions:
+		w.Header().Set("Allow", "OPTIONS, PROPFIND, REPORT, GET, PUT, DELETE")
+		w.WriteHeader(http.StatusOK)
+	case r.Method == "PROPFIND":
+		c.propfind(w, r, res)
+	case r.Method == "REPORT" && res.kind == davCalendar:
+		c.report(w, r, res)
+	case r.Method == http.MethodGet && res.kind == davEvent:
+		c.getEvent(w, r, res)
+	case r.Method == http.MethodPut && res.kind == davEvent:
+		c.putEvent(w, r, res)
+	case r.Method == http.MethodDelete && res.kind == davEvent:
+		c.deleteEvent(w, r, res)
+	default:
+		log.Printf("%s: method %s is not allowed for %s", logHeader, r.Method, r.URL.Path)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// calendarEvents возвращает события календаря пользователя.
+func (c CalDAVAPI) calendarEvents(userID uuid.UUID) ([]Event, error) {
+	events, err := c.storage.GetByUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].When.Before(events[j].When)
+	})
+	return events, nil
+}
+
+// loadEvent загружает событие ресурса. Событие другого пользователя
+// считается отсутствующим.
+func (c CalDAVAPI) loadEvent(res davResource) (Event, error) {
+	e, err := c.storage.Get(res.eventID)
+	if err == nil && e.UserID != res.userID {
+		err = ErrEventNotFound
+	}
+	return e, err
+}
+
+// readDAVBody читает XML-тело запроса (пустое тело допустимо) в v.
+func readDAVBody(r *http.Request, v interface{}) (bool, error) {
+	defer r.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxCalDAVBody+1))
+	if err != nil {
+		return false, err
+	}
+	if len(body) > maxCalDAVBody {
+		return false, errors.New("request body is too large")
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return false, nil
+	}
+	return true, xml.Unmarshal(body, v)
+}
+
+func (c CalDAVAPI) propfind(w http.ResponseWriter, r *http.Request, res davResource) {
+	const logHeader = "calDAVPropfind"
+	var req davPropfind
+	hasBody, err := readDAVBody(r, &req)
+	if err != nil {
+		log.Printf("%s: %v", logHeader, err)
+		http.Error(w, fmt.Sprintf("incorrect PROPFIND body: %v", err), http.StatusBadRequest)
+		return
+	}
+	// на allprop (и пустое тело) возвращаются только имеющиеся у ресурса свойства
+	names, allProps := defaultDAVProps, true
+	if hasBody && req.Prop != nil {
+		allProps = false
+		names = make([]xml.Name, 0, len(req.Prop.Names))
+		for _, n := range req.Prop.Names {
+			names = append(names, n.XMLName)
+		}
+	}
+	depth := r.Header.Get("Depth")
+	if depth == "" || depth == "infinity" {
+		depth = "1"
+	}
+
+	resources := []davResource{res}
+	var events []Event
+	switch res.kind {
+	case davEvent:
+		if res.event, err = c.loadEvent(res); err != nil {
+			c.returnStorageError(w, logHeader, err)
+			return
+		}
+	case davHome, davCalendar:
+		// события нужны для getctag календаря
+		if events, err = c.calendarEvents(res.userID); err != nil {
+			c.returnStorageError(w, logHeader, err)
+			return
+		}
+		if depth != "1" {
+			break
+		}
+		if res.kind == davHome {
+			resources = append(resources, davResource{kind: davCalendar, userID: res.userID})
+			break
+		}
+		for _, e := range events {
+			resources = append(resources, davResource{kind: davEvent, userID: res.userID, eventID: e.ID, event: e})
+		}
+	}
+	ms := newMultistatus()
+	ctag := calendarCTag(events)
+	for _, item := range resources {
+		ms.Responses = append(ms.Responses, c.propResponse(r, item, names, ctag, !allProps))
+	}
+	writeMultistatus(w, logHeader, ms)
+}
+
+// propResponse собирает ответ со свойствами names ресурса res: найденные
+// свойства - со статусом 200, неизвестные - 404 (если reportMissing).
+func (c CalDAVAPI) propResponse(r *http.Request, res davResource, names []xml.Name, ctag string, reportMissing bool) davResponse {
+	found, missing := davPropValues{}, davPropValues{}
+	for _, name := range names {
+		prefix, known := davPrefixes[name.Space]
+		if !known {
+			prefix = ""
+		}
+		value, ok := c.propValue(r, res, name, ctag)
+		el := davPropValue{XMLName: xml.Name{Local: prefix + ":" + name.Local}, Inner: value}
+		if !known {
+			el.XMLName = xml.Name{Space: name.Space, Local: name.Local}
+		}
+		if ok {
+			found.Values = append(found.Values, el)
+		} else {
+			el.Inner = ""
+			missing.Values = append(missing.Values, el)
+		}
+	}
+	resp := davResponse{Href: res.href()}
+	if len(found.Values) > 0 {
+		resp.Propstat = append(resp.Propstat, davPropstat{Prop: found, Status: davStatus(http.StatusOK)})
+	}
+	if len(missing.Values) > 0 && reportMissing {
+		resp.Propstat = append(resp.Propstat, davPropstat{Prop: missing, Status: davStatus(http.StatusNotFound)})
+	}
+	return resp
+}
+
+// propValue возвращает значение свойства name ресурса res в виде XML.
+func (c CalDAVAPI) propValue(r *http.Request, res davResource, name xml.Name, ctag string) (string, bool) {
+	href := func(kind davResourceKind, userID uuid.UUID) string {
+		return "<D:href>" + escapeXML(davResource{kind: kind, userID: userID}.href()) + "</D:href>"
+	}
+	switch name {
+	case xml.Name{Space: nsDAV, Local: "resourcetype"}:
+		switch res.kind {
+		case davRoot, davHome:
+			return "<D:collection/>", true
+		case davPrincipal:
+			return "<D:principal/>", true
+		case davCalendar:
+			return "<D:collection/><C:calendar/>", true
+		default:
+			return "", true
+		}
+	case xml.Name{Space: nsDAV, Local: "current-user-principal"}:
+		userID, ok := requestSubject(r)
+		if !ok {
+			if res.kind == davRoot {
+				return "<D:unauthenticated/>", true
+			}
+			userID = res.userID
+		}
+		return href(davPrincipal, userID), true
+	case xml.Name{Space: nsDAV, Local: "principal-URL"}:
+		if res.kind == davPrincipal {
+			return href(davPrincipal, res.userID), true
+		}
+	case xml.Name{Space: nsCalDAV, Local: "calendar-home-set"}:
+		if res.kind == davPrincipal {
+			return href(davHome, res.userID), true
+		}
+	case xml.Name{Space: nsDAV, Local: "displayname"}:
+		switch res.kind {
+		case davPrincipal:
+			return escapeXML(res.userID.String()), true
+		case davCalendar:
+			return "Calendar", true
+		}
+	case xml.Name{Space: nsCalDAV, Local: "supported-calendar-component-set"}:
+		if res.kind == davCalendar {
+			return `<C:comp name="VEVENT"/>`, true
+		}
+	case xml.Name{Space: nsDAV, Local: "supported-report-set"}:
+		if res.kind == davCalendar {
+			return "<D:supported-report><D:report><C:calendar-query/></D:report></D:supported-report>" +
+				"<D:supported-report><D:report><C:calendar-multiget/></D:report></D:supported-report>", true
+		}
+	case xml.Name{Space: nsCS, Local: "getctag"}:
+		if res.kind == davCalendar {
+			return escapeXML(ctag), true
+		}
+	case xml.Name{Space: nsDAV, Local: "getetag"}:
+		switch res.kind {
+		case davEvent:
+			return escapeXML(eventETag(res.event)), true
+		case davCalendar:
+			return escapeXML(ctag), true
+		}
+	case xml.Name{Space: nsDAV, Local: "getcontenttype"}:
+		if res.kind == davEvent {
+			return "text/calendar; charset=utf-8; component=VEVENT", true
+		}
+	case xml.Name{Space: nsCalDAV, Local: "calendar-data"}:
+		if res.kind == davEvent {
+			buf := &bytes.Buffer{}
+			if err := EncodeICS(buf, []Event{res.event}); err != nil {
+				return "", false
+			}
+			return escapeXML(buf.String()), true
+		}
+	}
+	return "", false
+}
+
+func (c CalDAVAPI) report(w http.ResponseWriter, r *http.Request, res davResource) {
+	const logHeader = "calDAVReport"
+	var req davReport
+	if _, err := readDAVBody(r, &req); err != nil {
+		log.Printf("%s: %v", logHeader, err)
+		http.Error(w, fmt.Sprintf("incorrect REPORT body: %v", err), http.StatusBadRequest)
+		return
+	}
+	names := []xml.Name{{Space: nsDAV, Local: "getetag"}}
+	if req.Prop != nil {
+		names = names[:0]
+		for _, n := range req.Prop.Names {
+			names = append(names, n.XMLName)
+		}
+	}
+	ms := newMultistatus()
+	switch req.XMLName {
+	case xml.Name{Space: nsCalDAV, Local: "calendar-query"}:
+		var from, to time.Time
+		if req.Filter != nil {
+			var err error
+			if from, to, err = req.Filter.eventTimeRange(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		events, err := c.calendarEvents(res.userID)
+		if err != nil {
+			c.returnStorageError(w, logHeader, err)
+			return
+		}
+		for _, e := range events {
+			if !from.IsZero() && !occursIn(e, from, to) {
+				continue
+			}
+			item := davResource{kind: davEvent, userID: res.userID, eventID: e.ID, event: e}
+			ms.Responses = append(ms.Responses, c.propResponse(r, item, names, "", true))
+		}
+	case xml.Name{Space: nsCalDAV, Local: "calendar-multiget"}:
+		for _, h := range req.Hrefs {
+			item, ok := parseDAVPath(strings.TrimSpace(h))
+			if !ok || item.kind != davEvent || item.userID != res.userID {
+				ms.Responses = append(ms.Responses, davResponse{Href: h, Status: davStatus(http.StatusNotFound)})
+				continue
+			}
+			e, err := c.loadEvent(item)
+			if errors.Is(err, ErrEventNotFound) {
+				ms.Responses = append(ms.Responses, davResponse{Href: h, Status: davStatus(http.StatusNotFound)})
+				continue
+			}
+			if err != nil {
+				c.returnStorageError(w, logHeader, err)
+				return
+			}
+			item.event = e
+			ms.Responses = append(ms.Responses, c.propResponse(r, item, names, "", true))
+		}
+	default:
+		http.Error(w, fmt.Sprintf("unsupported report %s", req.XMLName.Local), http.StatusForbidden)
+		return
+	}
+	writeMultistatus(w, logHeader, ms)
+}
+
+// eventTimeRange находит в фильтре VCALENDAR фильтр time-range компонента VEVENT.
+// Если фильтра нет, возвращаются нулевые моменты. Открытые границы заменяются
+// далёкими датами.
+func (f davCompFilter) eventTimeRange() (time.Time, time.Time, error) {
+	for _, comp := range f.Comps {
+		if !strings.EqualFold(comp.Name, "VEVENT") || comp.TimeRange == nil {
+			continue
+		}
+		from, to := time.Unix(0, 0).UTC(), time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC)
+		var err error
+		if comp.TimeRange.Start != "" {
+			if from, err = time.Parse(icsDateTimeUTC, comp.TimeRange.Start); err != nil {
+				return time.Time{}, time.Time{}, fmt.Errorf("incorrect time-range start: %v", err)
+			}
+		}
+		if comp.TimeRange.End != "" {
+			if to, err = time.Parse(icsDateTimeUTC, comp.TimeRange.End); err != nil {
+				return time.Time{}, time.Time{}, fmt.Errorf("incorrect time-range end: %v", err)
+			}
+		}
+		return from, to, nil
+	}
+	return time.Time{}, time.Time{}, nil
+}
+
+// occursIn проверяет, пересекается ли какое-либо вхождение события с отрезком [from, to).
+// Вхождения перебираются до первого подходящего: при открытом конце отрезка
+// серия иначе разворачивалась бы до 9999 года.
+func occursIn(e Event, from, to time.Time) bool {
+	found := false
+	e.eachOccurrence(from.Add(-e.Duration), to, func(t time.Time) bool {
+		found = Interval{Start: t, End: t.Add(e.Duration)}.overlaps(Interval{Start: from, End: to})
+		return !found
+	})
+	return found
+}
+
+func (c CalDAVAPI) getEvent(w http.ResponseWriter, r *http.Request, res davResource) {
+	const logHeader = "calDAVGet"
+	e, err := c.loadEvent(res)
+	if err != nil {
+		c.returnStorageError(w, logHeader, err)
+		return
+	}
+	etag := eventETag(e)
+	w.Header().Set("ETag", etag)
+	if match := r.Header.Get("If-None-Match"); match != "" && etagMatches(match, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	if err := EncodeICS(w, []Event{e}); err != nil {
+		log.Printf("%s: %v", logHeader, err)
+	}
+}
+
+func (c CalDAVAPI) putEvent(w http.ResponseWriter, r *http.Request, res davResource) {
+	const logHeader = "calDAVPut"
+	defer r.Body.Close()
+	entries, itemErrors, err := DecodeICS(io.LimitReader(r.Body, maxCalDAVBody))
+	switch {
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case len(itemErrors) > 0:
+		http.Error(w, fmt.Sprintf("incorrect VEVENT: %s", itemErrors[0].Error), http.StatusBadRequest)
+		return
+	case len(entries) != 1:
+		http.Error(w, "resource must contain exactly one VEVENT", http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	existing, err := c.storage.Get(res.eventID)
+	exists := err == nil
+	switch {
+	case err != nil && !errors.Is(err, ErrEventNotFound):
+		c.returnStorageError(w, logHeader, err)
+		return
+	case exists && existing.UserID != res.userID:
+		http.Error(w, "resource belongs to another user", http.StatusForbidden)
+		return
+	}
+	if !checkPreconditions(w, r, exists, existing) {
+		return
+	}
+
+	e := entries[0].Event
+	e.ID = res.eventID
+	e.UserID = res.userID
+	e.ModifiedBy = modifiedBy(r, res.userID)
+	if exists {
+		// участники и напоминания в iCalendar не передаются
+		e.Attendees = existing.Attendees
+		e.Reminders = existing.Reminders
+		e.Version = existing.Version + 1
+		err = c.storage.Update(e)
+	} else {
+		e.Version = 1
+		err = c.storage.Add(e)
+	}
+	if err != nil {
+		c.returnStorageError(w, logHeader, err)
+		return
+	}
+	w.Header().Set("ETag", eventETag(e))
+	if exists {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+	log.Printf("%s: stored event %v", logHeader, e.ID)
+}
+
+func (c CalDAVAPI) deleteEvent(w http.ResponseWriter, r *http.Request, res davResource) {
+	const logHeader = "calDAVDelete"
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	existing, err := c.loadEvent(res)
+	if err != nil {
+		c.returnStorageError(w, logHeader, err)
+		return
+	}
+	if !checkPreconditions(w, r, true, existing) {
+		return
+	}
+	if err := c.storage.Delete(res.eventID); err != nil {
+		c.returnStorageError(w, logHeader, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+	log.Printf("%s: deleted event %v", logHeader, res.eventID)
+}
+
+// checkPreconditions проверяет заголовки If-Match и If-None-Match для изменения
+// ресурса и при их нарушении отвечает 412 Precondition Failed.
+func checkPreconditions(w http.ResponseWriter, r *http.Request, exists bool, existing Event) bool {
+	etag := ""
+	if exists {
+		etag = eventETag(existing)
+	}
+	if match := r.Header.Get("If-Match"); match != "" && (!exists || !etagMatches(match, etag)) {
+		http.Error(w, "resource has been modified", http.StatusPreconditionFailed)
+		return false
+	}
+	if match := r.Header.Get("If-None-Match"); match != "" && exists && etagMatches(match, etag) {
+		http.Error(w, "resource already exists", http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// returnStorageError отвечает на ошибку хранилища: нет события - 404, событие
+// изменено через другой API - 412, ID занят событием в корзине - 409, остальные - 500.
+func (c CalDAVAPI) returnStorageError(w http.ResponseWriter, logHeader string, err error) {
+	log.Printf("%s: %v", logHeader, err)
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrEventNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrVersionConflict):
+		status = http.StatusPreconditionFailed
+	case errors.Is(err, ErrEventAlreadyExists):
+		status = http.StatusConflict
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// newMultistatus создаёт пустой ответ multistatus с объявлениями пространств имён.
+func newMultistatus() davMultistatus {
+	return davMultistatus{XMLNSD: nsDAV, XMLNSC: nsCalDAV, XMLNSCS: nsCS, Responses: make([]davResponse, 0)}
+}
+
+// writeMultistatus записывает ответ 207 Multi-Status.
+func writeMultistatus(w http.ResponseWriter, logHeader string, ms davMultistatus) {
+	body, err := xml.Marshal(ms)
+	if err != nil {
+		log.Printf("%s: %v", logHeader, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusMultiStatus)
+	io.WriteString(w, xml.Header)
+	w.Write(body)
+}
+
+// wellKnownCalDAV перенаправляет /.well-known/caldav (RFC 6764) на корень CalDAV.
+func wellKnownCalDAV(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, calDAVPrefix, http.StatusMovedPermanently)
+}
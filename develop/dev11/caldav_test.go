@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// davResult - разобранный ответ multistatus для тестов.
+type davResult struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Status   string `xml:"status"`
+		Propstat []struct {
+			Status string `xml:"status"`
+			Prop   struct {
+				Inner string `xml:",innerxml"`
+			} `xml:"prop"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+// calDAVClient выполняет запросы к серверу CalDAV.
+type calDAVClient struct {
+	t      *testing.T
+	server *httptest.Server
+	// user и password - для Basic-аутентификации (если заданы).
+	user, password string
+}
+
+func (c calDAVClient) do(method, path, body string, headers map[string]string) *http.Response {
+	c.t.Helper()
+	req, err := http.NewRequest(method, c.server.URL+path, strings.NewReader(body))
+	require.NoError(c.t, err)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if c.user != "" {
+		req.SetBasicAuth(c.user, c.password)
+	}
+	resp, err := c.server.Client().Do(req)
+	require.NoError(c.t, err)
+	c.t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// multistatus выполняет запрос, ожидает 207 и разбирает ответ.
+func (c calDAVClient) multistatus(method, path, body, depth string) davResult {
+	c.t.Helper()
+	resp := c.do(method, path, body, map[string]string{"Depth": depth, "Content-Type": "application/xml"})
+	require.Equal(c.t, http.StatusMultiStatus, resp.StatusCode)
+	var res davResult
+	require.NoError(c.t, xml.NewDecoder(resp.Body).Decode(&res))
+	return res
+}
+
+const testVEvent = "BEGIN:VCALENDAR\r\nVERSION:2.0\r\nPRODID:-//test//EN\r\n" +
+	"BEGIN:VEVENT\r\nUID:%s\r\nDTSTART:%sT100000Z\r\nDTEND:%sT113000Z\r\n" +
+	"SUMMARY:%s\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"
+
+func TestCalDAV(t *testing.T) {
+	storage := newTestStorage()
+	server := httptest.NewServer(NewCalDAV(storage))
+	defer server.Close()
+	c := calDAVClient{t: t, server: server}
+	userID := uuid.New()
+	calendar := "/caldav/calendars/" + userID.String() + "/default/"
+
+	// обнаружение: принципал -> calendar-home-set -> календарь
+	res := c.multistatus("PROPFIND", "/caldav/principals/"+userID.String()+"/",
+		`<propfind xmlns="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav"><prop><C:calendar-home-set/><displayname/><getctag xmlns="http://calendarserver.org/ns/"/></prop></propfind>`, "0")
+	require.Equal(t, 1, len(res.Responses))
+	require.Equal(t, 2, len(res.Responses[0].Propstat))
+	assert.Contains(t, res.Responses[0].Propstat[0].Prop.Inner, "/caldav/calendars/"+userID.String()+"/")
+	assert.Contains(t, res.Responses[0].Propstat[1].Status, "404")
+
+	res = c.multistatus("PROPFIND", "/caldav/calendars/"+userID.String()+"/", "", "1")
+	require.Equal(t, 2, len(res.Responses))
+	assert.Equal(t, calendar, res.Responses[1].Href)
+	assert.Contains(t, res.Responses[1].Propstat[0].Prop.Inner, "<C:calendar/>")
+
+	// создание: If-None-Match: * не даёт перезаписать существующий ресурс
+	body := fmt.Sprintf(testVEvent, "meeting-1", "20220103", "20220103", "Встреча")
+	resp := c.do(http.MethodPut, calendar+"meeting-1.ics", body, map[string]string{"If-None-Match": "*"})
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	etag := resp.Header.Get("ETag")
+	require.NotEmpty(t, etag)
+	resp = c.do(http.MethodPut, calendar+"meeting-1.ics", body, map[string]string{"If-None-Match": "*"})
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+
+	eventID := icsEventID(userID, "meeting-1")
+	e, err := storage.Get(eventID)
+	require.NoError(t, err)
+	assert.Equal(t, userID, e.UserID)
+	assert.Equal(t, "Встреча", e.What)
+	assert.Equal(t, 90*time.Minute, e.Duration)
+
+	resp = c.do(http.MethodGet, calendar+"meeting-1.ics", "", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, etag, resp.Header.Get("ETag"))
+	ics, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(ics), "SUMMARY:Встреча")
+	assert.Contains(t, string(ics), "DURATION:PT1H30M")
+	resp = c.do(http.MethodGet, calendar+"meeting-1.ics", "", map[string]string{"If-None-Match": etag})
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+	// изменение с устаревшим ETag отклоняется
+	updated := strings.Replace(body, "SUMMARY:Встреча", "SUMMARY:Перенесённая встреча", 1)
+	resp = c.do(http.MethodPut, calendar+"meeting-1.ics", updated, map[string]string{"If-Match": `"stale"`})
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+	resp = c.do(http.MethodPut, calendar+"meeting-1.ics", updated, map[string]string{"If-Match": etag})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	newETag := resp.Header.Get("ETag")
+	assert.NotEqual(t, etag, newETag)
+
+	other := fmt.Sprintf(testVEvent, "meeting-2", "20220210", "20220210", "Встреча")
+	resp = c.do(http.MethodPut, calendar+"meeting-2.ics", other, nil)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	// список календаря с ETag
+	res = c.multistatus("PROPFIND", calendar, `<propfind xmlns="DAV:"><prop><getetag/></prop></propfind>`, "1")
+	require.Equal(t, 3, len(res.Responses))
+	assert.Equal(t, calendar+eventID.String()+".ics", res.Responses[1].Href)
+	assert.Contains(t, res.Responses[1].Propstat[0].Prop.Inner, strings.Trim(newETag, `"`))
+
+	// calendar-query с time-range: только январское событие
+	res = c.multistatus("REPORT", calendar, `<C:calendar-query xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav">
+		<D:prop><D:getetag/><C:calendar-data/></D:prop>
+		<C:filter><C:comp-filter name="VCALENDAR"><C:comp-filter name="VEVENT">
+			<C:time-range start="20220103T110000Z" end="20220104T000000Z"/>
+		</C:comp-filter></C:comp-filter></C:filter>
+	</C:calendar-query>`, "1")
+	require.Equal(t, 1, len(res.Responses))
+	assert.Contains(t, res.Responses[0].Propstat[0].Prop.Inner, "SUMMARY:Перенесённая встреча")
+
+	// calendar-multiget
+	res = c.multistatus("REPORT", calendar, `<C:calendar-multiget xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav">
+		<D:prop><D:getetag/></D:prop>
+		<D:href>`+calendar+`meeting-2.ics</D:href><D:href>`+calendar+`missing.ics</D:href>
+	</C:calendar-multiget>`, "1")
+	require.Equal(t, 2, len(res.Responses))
+	assert.Contains(t, res.Responses[0].Propstat[0].Status, "200")
+	assert.Contains(t, res.Responses[1].Status, "404")
+
+	// удаление
+	resp = c.do(http.MethodDelete, calendar+"meeting-1.ics", "", map[string]string{"If-Match": etag})
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+	resp = c.do(http.MethodDelete, calendar+"meeting-1.ics", "", map[string]string{"If-Match": newETag})
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp = c.do(http.MethodGet, calendar+"meeting-1.ics", "", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// ошибки
+	resp = c.do(http.MethodPut, calendar+"bad.ics", "not a calendar", nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp = c.do("PROPFIND", "/caldav/calendars/"+userID.String()+"/other/", "", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp = c.do(http.MethodPost, calendar, "", nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+// TestOccursIn проверяет фильтр time-range, в том числе с открытым концом:
+// бесконечная серия не должна разворачиваться до конца отрезка.
+func TestOccursIn(t *testing.T) {
+	daily, err := ParseRRule("FREQ=DAILY")
+	require.NoError(t, err)
+	short, err := ParseRRule("FREQ=DAILY;COUNT=3")
+	require.NoError(t, err)
+	start := mustTime(t, "03.01.2022 10:00")
+	openEnd := time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		event    Event
+		from, to time.Time
+		want     bool
+	}{
+		{Event{When: start, Duration: time.Hour, Recurrence: daily}, mustTime(t, "01.06.2022 00:00"), openEnd, true},
+		{Event{When: start, Duration: time.Hour, Recurrence: short}, mustTime(t, "01.06.2022 00:00"), openEnd, false},
+		{Event{When: start, Duration: time.Hour}, mustTime(t, "01.06.2022 00:00"), openEnd, false},
+		// вхождение началось до отрезка, но ещё идёт
+		{Event{When: start, Duration: time.Hour, Recurrence: daily}, mustTime(t, "04.01.2022 10:30"), mustTime(t, "04.01.2022 10:45"), true},
+		{Event{When: start, Duration: time.Hour, Recurrence: daily}, mustTime(t, "04.01.2022 11:00"), mustTime(t, "05.01.2022 10:00"), false},
+	}
+	for i, test := range tests {
+		assert.Equal(t, test.want, occursIn(test.event, test.from, test.to), "#%d", i)
+	}
+}
+
+func TestCalDAVBasicAuth(t *testing.T) {
+	users, err := OpenFileUserStore(filepath.Join(t.TempDir(), "users.json"))
+	require.NoError(t, err)
+	users.cost = bcrypt.MinCost
+	aliceID, err := users.AddUser("alice", "wonderland")
+	require.NoError(t, err)
+	auth := NewAuthenticator([]byte("secret"), time.Hour)
+	server := httptest.NewServer(auth.BasicMiddleware(users, NewCalDAV(newTestStorage()).ServeHTTP))
+	defer server.Close()
+
+	anonymous := calDAVClient{t: t, server: server}
+	resp := anonymous.do("PROPFIND", "/caldav/", "", nil)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("WWW-Authenticate"), "Basic")
+
+	wrong := calDAVClient{t: t, server: server, user: "alice", password: "builder"}
+	resp = wrong.do("PROPFIND", "/caldav/", "", nil)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	alice := calDAVClient{t: t, server: server, user: "alice", password: "wonderland"}
+	res := alice.multistatus("PROPFIND", "/caldav/",
+		`<propfind xmlns="DAV:"><prop><current-user-principal/></prop></propfind>`, "0")
+	require.Equal(t, 1, len(res.Responses))
+	assert.Contains(t, res.Responses[0].Propstat[0].Prop.Inner, "/caldav/principals/"+aliceID.String()+"/")
+
+	resp = alice.do("PROPFIND", "/caldav/calendars/"+uuid.New().String()+"/", "", nil)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// токен доступа тоже принимается
+	token, _, err := auth.IssueToken(aliceID)
+	require.NoError(t, err)
+	resp = anonymous.do("PROPFIND", "/caldav/calendars/"+aliceID.String()+"/", "",
+		map[string]string{"Authorization": "Bearer " + token, "Depth": "0"})
+	assert.Equal(t, http.StatusMultiStatus, resp.StatusCode)
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configEnvPrefix - префикс переменных окружения, переопределяющих настройки из файла.
+const configEnvPrefix = "CALENDAR_"
+
+// Duration - длительность в настройках, записывается строкой time.ParseDuration (5s, 1h30m).
+type Duration time.Duration
+
+// UnmarshalText разбирает длительность из строки (используется в YAML и JSON).
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// UnmarshalYAML разбирает длительность из YAML, указывая в ошибке номер строки.
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	if err := d.UnmarshalText([]byte(node.Value)); err != nil {
+		return fmt.Errorf("line %d: invalid duration %q", node.Line, node.Value)
+	}
+	return nil
+}
+
+// MarshalText выводит длительность строкой.
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// LogLevel - уровень журнала запросов.
+type LogLevel int
+
+// Уровни журнала: ответы 5xx пишутся с уровнем error, 4xx - warn, остальные - info.
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var logLevelNames = map[string]LogLevel{
+	"debug": LevelDebug,
+	"info":  LevelInfo,
+	"warn":  LevelWarn,
+	"error": LevelError,
+}
+
+// ParseLogLevel разбирает название уровня журнала.
+func ParseLogLevel(s string) (LogLevel, error) {
+	level, ok := logLevelNames[strings.ToLower(s)]
+	if !ok {
+		return 0, fmt.Errorf("unknown log level %q (want debug, info, warn or error)", s)
+	}
+	return level, nil
+}
+
+// Config - настройки сервера. Источники в порядке приоритета: флаги командной строки,
+// переменные окружения CALENDAR_*, файл настроек (YAML или JSON), значения по умолчанию.
+type Config struct {
+	// Listen - адрес, на котором сервер принимает соединения (host:port).
+	Listen string `yaml:"listen" json:"listen"`
+	TLS    struct {
+		// CertFile и KeyFile - сертификат и ключ; если заданы, сервер работает по HTTPS.
+		// При перезагрузке настроек файлы перечитываются.
+		CertFile string `yaml:"cert_file" json:"cert_file"`
+		KeyFile  string `yaml:"key_file" json:"key_file"`
+	} `yaml:"tls" json:"tls"`
+	Storage struct {
+		// Backend - тип хранилища: memory или sqlite.
+		Backend string `yaml:"backend" json:"backend"`
+		// Path - файл снимка (memory) или базы данных (sqlite).
+		Path string `yaml:"path" json:"path"`
+		// WALPath - файл журнала упреждающей записи (memory).
+		WALPath string `yaml:"wal_path" json:"wal_path"`
+		// FlushInterval - период сохранения снимка (memory).
+		FlushInterval Duration `yaml:"flush_interval" json:"flush_interval"`
+		// HistoryFile - журнал истории изменений событий.
+		HistoryFile string `yaml:"history_file" json:"history_file"`
+		// TrashRetention - сколько удалённые события хранятся в корзине
+		// (0 - не удалять окончательно).
+		TrashRetention Duration `yaml:"trash_retention" json:"trash_retention"`
+	} `yaml:"storage" json:"storage"`
+	ReadTimeout  Duration `yaml:"read_timeout" json:"read_timeout"`
+	WriteTimeout Duration `yaml:"write_timeout" json:"write_timeout"`
+	// IdleTimeout - сколько держать открытым простаивающее keep-alive соединение.
+	IdleTimeout Duration `yaml:"idle_timeout" json:"idle_timeout"`
+	// ShutdownTimeout - сколько при остановке ждать завершения начатых запросов
+	// (0 - без ограничения).
+	ShutdownTimeout Duration `yaml:"shutdown_timeout" json:"shutdown_timeout"`
+	// ShutdownDrainDelay - сколько при остановке после снятия готовности ещё
+	// принимать запросы, пока балансировщик не перестанет направлять трафик.
+	ShutdownDrainDelay Duration `yaml:"shutdown_drain_delay" json:"shutdown_drain_delay"`
+	// Limits - ограничения частоты и размера запросов; применяются при перезагрузке настроек.
+	Limits struct {
+		// IPRate - запросов в секунду с одного IP-адреса (0 - без ограничения),
+		// IPBurst - сколько запросов подряд допускается сверх этой скорости.
+		IPRate  float64 `yaml:"ip_rate" json:"ip_rate"`
+		IPBurst int     `yaml:"ip_burst" json:"ip_burst"`
+		// UserRate и UserBurst - то же для аутентифицированного пользователя.
+		UserRate  float64 `yaml:"user_rate" json:"user_rate"`
+		UserBurst int     `yaml:"user_burst" json:"user_burst"`
+		// MaxBodyBytes - максимальный размер тела запроса (0 - без ограничения).
+		MaxBodyBytes int `yaml:"max_body_bytes" json:"max_body_bytes"`
+	} `yaml:"limits" json:"limits"`
+	// LogLevel - минимальный уровень записей журнала запросов.
+	LogLevel string `yaml:"log_level" json:"log_level"`
+	// LogRedact - параметры запроса, значения которых скрываются в журнале.
+	LogRedact []string `yaml:"log_redact" json:"log_redact"`
+	Auth      struct {
+		// JWTSecret - секрет подписи токенов; обязателен, если не задан InsecureNoAuth.
+		JWTSecret string   `yaml:"jwt_secret" json:"jwt_secret"`
+		TokenTTL  Duration `yaml:"token_ttl" json:"token_ttl"`
+		UsersFile string   `yaml:"users_file" json:"users_file"`
+		// InsecureNoAuth - явно выключить аутентификацию (для разработки и тестов):
+		// любой клиент сможет читать и изменять события любого пользователя.
+		InsecureNoAuth bool `yaml:"insecure_no_auth" json:"insecure_no_auth"`
+	} `yaml:"auth" json:"auth"`
+	Reminders struct {
+		StateFile  string   `yaml:"state_file" json:"state_file"`
+		WebhookURL string   `yaml:"webhook_url" json:"webhook_url"`
+		Interval   Duration `yaml:"interval" json:"interval"`
+	} `yaml:"reminders" json:"reminders"`
+	// Replication - репликация хранилища memory между узлами (см. ReplicationLeader).
+	Replication struct {
+		// Role - роль узла: leader, follower или пусто (репликация выключена).
+		Role string `yaml:"role" json:"role"`
+		// LeaderURL - адрес ведущего узла для follower, например http://calendar-1:8080.
+		LeaderURL string `yaml:"leader_url" json:"leader_url"`
+		// Secret - общий секрет узлов для доступа к журналу репликации.
+		Secret string `yaml:"secret" json:"secret"`
+		// LogSize - сколько последних изменений ведущий хранит для отставших ведомых.
+		LogSize int `yaml:"log_size" json:"log_size"`
+	} `yaml:"replication" json:"replication"`
+}
+
+// DefaultConfig возвращает настройки по умолчанию.
+func DefaultConfig() Config {
+	var c Config
+	c.Listen = ":8080"
+	c.Storage.Backend = "memory"
+	c.Storage.FlushInterval = Duration(storageFlushInterval)
+	c.Storage.HistoryFile = "event_history.jsonl"
+	c.Storage.TrashRetention = Duration(defaultTrashRetention)
+	c.ReadTimeout = Duration(10 * time.Second)
+	c.WriteTimeout = Duration(30 * time.Second)
+	c.IdleTimeout = Duration(2 * time.Minute)
+	c.ShutdownTimeout = Duration(defaultShutdownTimeout)
+	c.ShutdownDrainDelay = Duration(defaultShutdownDrainDelay)
+	c.Limits.IPRate = 20
+	c.Limits.IPBurst = 40
+	c.Limits.UserRate = 10
+	c.Limits.UserBurst = 20
+	c.Limits.MaxBodyBytes = defaultMaxBodyBytes
+	c.LogLevel = "info"
+	c.LogRedact = strings.Split(defaultRedactedFields, ",")
+	c.Auth.TokenTTL = Duration(defaultTokenTTL)
+	c.Auth.UsersFile = "users.json"
+	c.Reminders.StateFile = "reminders.json"
+	c.Reminders.Interval = Duration(defaultReminderInterval)
+	c.Replication.LogSize = defaultReplicationLogSize
+	return c
+}
+
+// storagePaths возвращает пути файлов хранилища с учётом значений по умолчанию для backend.
+func (c Config) storagePaths() (path, walPath string) {
+	path, walPath = c.Storage.Path, c.Storage.WALPath
+	switch c.Storage.Backend {
+	case "memory":
+		if path == "" {
+			path = persistentStorageFile
+		}
+		if walPath == "" {
+			walPath = persistentLogFile
+		}
+	case "sqlite":
+		if path == "" {
+			path = "event_storage.db"
+		}
+	}
+	return path, walPath
+}
+
+// LoadConfig читает настройки из файла path (пустой путь - только значения по умолчанию)
+// и применяет переопределения из переменных окружения, полученных через lookupEnv.
+// Формат файла определяется расширением: .yaml, .yml или .json. Неизвестные поля
+// считаются ошибкой. Проверка значений выполняется отдельно методом Validate.
+func LoadConfig(path string, lookupEnv func(string) (string, bool)) (Config, error) {
+	c := DefaultConfig()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return Config{}, fmt.Errorf("config: %w", err)
+		}
+		if err := decodeConfig(path, data, &c); err != nil {
+			return Config{}, fmt.Errorf("config: %s: %w", path, err)
+		}
+	}
+	if err := c.applyEnv(lookupEnv); err != nil {
+		return Config{}, fmt.Errorf("config: %w", err)
+	}
+	return c, nil
+}
+
+// decodeConfig разбирает содержимое файла настроек в формате, заданном расширением файла.
+func decodeConfig(path string, data []byte, c *Config) error {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		return nil
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		return dec.Decode(c)
+	default:
+		return errors.New("unsupported file extension (want .yaml, .yml or .json)")
+	}
+}
+
+// configEnv - переменные окружения и поля настроек, которые они переопределяют.
+var configEnv = []struct {
+	name string
+	set  func(c *Config, value string) error
+}{
+	{"LISTEN", setString(func(c *Config) *string { return &c.Listen })},
+	{"TLS_CERT_FILE", setString(func(c *Config) *string { return &c.TLS.CertFile })},
+	{"TLS_KEY_FILE", setString(func(c *Config) *string { return &c.TLS.KeyFile })},
+	{"STORAGE_BACKEND", setString(func(c *Config) *string { return &c.Storage.Backend })},
+	{"STORAGE_PATH", setString(func(c *Config) *string { return &c.Storage.Path })},
+	{"STORAGE_WAL_PATH", setString(func(c *Config) *string { return &c.Storage.WALPath })},
+	{"STORAGE_FLUSH_INTERVAL", setDuration(func(c *Config) *Duration { return &c.Storage.FlushInterval })},
+	{"STORAGE_HISTORY_FILE", setString(func(c *Config) *string { return &c.Storage.HistoryFile })},
+	{"STORAGE_TRASH_RETENTION", setDuration(func(c *Config) *Duration { return &c.Storage.TrashRetention })},
+	{"READ_TIMEOUT", setDuration(func(c *Config) *Duration { return &c.ReadTimeout })},
+	{"WRITE_TIMEOUT", setDuration(func(c *Config) *Duration { return &c.WriteTimeout })},
+	{"IDLE_TIMEOUT", setDuration(func(c *Config) *Duration { return &c.IdleTimeout })},
+	{"SHUTDOWN_TIMEOUT", setDuration(func(c *Config) *Duration { return &c.ShutdownTimeout })},
+	{"SHUTDOWN_DRAIN_DELAY", setDuration(func(c *Config) *Duration { return &c.ShutdownDrainDelay })},
+	{"LIMITS_IP_RATE", setFloat(func(c *Config) *float64 { return &c.Limits.IPRate })},
+	{"LIMITS_IP_BURST", setInt(func(c *Config) *int { return &c.Limits.IPBurst })},
+	{"LIMITS_USER_RATE", setFloat(func(c *Config) *float64 { return &c.Limits.UserRate })},
+	{"LIMITS_USER_BURST", setInt(func(c *Config) *int { return &c.Limits.UserBurst })},
+	{"LIMITS_MAX_BODY_BYTES", setInt(func(c *Config) *int { return &c.Limits.MaxBodyBytes })},
+	{"LOG_LEVEL", setString(func(c *Config) *string { return &c.LogLevel })},
+	{"LOG_REDACT", func(c *Config, value string) error {
+		c.LogRedact = strings.Split(value, ",")
+		return nil
+	}},
+	{"JWT_SECRET", setString(func(c *Config) *string { return &c.Auth.JWTSecret })},
+	{"TOKEN_TTL", setDuration(func(c *Config) *Duration { return &c.Auth.TokenTTL })},
+	{"USERS_FILE", setString(func(c *Config) *string { return &c.Auth.UsersFile })},
+	{"INSECURE_NO_AUTH", setBool(func(c *Config) *bool { return &c.Auth.InsecureNoAuth })},
+	{"REMINDERS_STATE_FILE", setString(func(c *Config) *string { return &c.Reminders.StateFile })},
+	{"REMINDERS_WEBHOOK_URL", setString(func(c *Config) *string { return &c.Reminders.WebhookURL })},
+	{"REMINDERS_INTERVAL", setDuration(func(c *Config) *Duration { return &c.Reminders.Interval })},
+	{"REPLICATION_ROLE", setString(func(c *Config) *string { return &c.Replication.Role })},
+	{"REPLICATION_LEADER_URL", setString(func(c *Config) *string { return &c.Replication.LeaderURL })},
+	{"REPLICATION_SECRET", setString(func(c *Config) *string { return &c.Replication.Secret })},
+	{"REPLICATION_LOG_SIZE", setInt(func(c *Config) *int { return &c.Replication.LogSize })},
+}
+
+func setString(field func(*Config) *string) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}
+}
+
+func setDuration(field func(*Config) *Duration) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		return field(c).UnmarshalText([]byte(value))
+	}
+}
+
+func setFloat(field func(*Config) *float64) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		*field(c) = v
+		return nil
+	}
+}
+
+func setInt(field func(*Config) *int) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		*field(c) = v
+		return nil
+	}
+}
+
+func setBool(field func(*Config) *bool) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		v, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		*field(c) = v
+		return nil
+	}
+}
+
+// applyEnv применяет переопределения из переменных окружения CALENDAR_*.
+func (c *Config) applyEnv(lookupEnv func(string) (string, bool)) error {
+	for _, env := range configEnv {
+		value, ok := lookupEnv(configEnvPrefix + env.name)
+		if !ok {
+			continue
+		}
+		if err := env.set(c, value); err != nil {
+			return fmt.Errorf("%s%s: %w", configEnvPrefix, env.name, err)
+		}
+	}
+	return nil
+}
+
+// Validate проверяет настройки и возвращает все найденные ошибки.
+func (c Config) Validate() error {
+	var errs []error
+	fail := func(field, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s: %s", field, fmt.Sprintf(format, args...)))
+	}
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		fail("listen", "must be host:port, got %q", c.Listen)
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		fail("tls", "cert_file and key_file must be set together")
+	}
+	switch c.Storage.Backend {
+	case "memory":
+		if c.Storage.FlushInterval <= 0 {
+			fail("storage.flush_interval", "must be positive")
+		}
+	case "sqlite":
+	default:
+		fail("storage.backend", "must be memory or sqlite, got %q", c.Storage.Backend)
+	}
+	if c.Storage.TrashRetention < 0 {
+		fail("storage.trash_retention", "must not be negative")
+	}
+	if c.ReadTimeout < 0 {
+		fail("read_timeout", "must not be negative")
+	}
+	if c.WriteTimeout < 0 {
+		fail("write_timeout", "must not be negative")
+	}
+	if c.IdleTimeout < 0 {
+		fail("idle_timeout", "must not be negative")
+	}
+	if c.ShutdownTimeout < 0 {
+		fail("shutdown_timeout", "must not be negative")
+	}
+	if c.ShutdownDrainDelay < 0 {
+		fail("shutdown_drain_delay", "must not be negative")
+	}
+	if c.Limits.IPRate < 0 || c.Limits.UserRate < 0 {
+		fail("limits", "ip_rate and user_rate must not be negative")
+	}
+	if c.Limits.IPRate > 0 && c.Limits.IPBurst < 1 {
+		fail("limits.ip_burst", "must be at least 1 when ip_rate is set")
+	}
+	if c.Limits.UserRate > 0 && c.Limits.UserBurst < 1 {
+		fail("limits.user_burst", "must be at least 1 when user_rate is set")
+	}
+	if c.Limits.MaxBodyBytes < 0 {
+		fail("limits.max_body_bytes", "must not be negative")
+	}
+	if _, err := ParseLogLevel(c.LogLevel); err != nil {
+		fail("log_level", "%v", err)
+	}
+	if c.Auth.TokenTTL <= 0 {
+		fail("auth.token_ttl", "must be positive")
+	}
+	switch {
+	case c.Auth.JWTSecret == "" && !c.Auth.InsecureNoAuth:
+		fail("auth.jwt_secret", "is required; set auth.insecure_no_auth to run without authentication")
+	case c.Auth.JWTSecret != "" && c.Auth.InsecureNoAuth:
+		fail("auth.insecure_no_auth", "must not be set together with jwt_secret")
+	case c.Auth.JWTSecret != "" && len(c.Auth.JWTSecret) < 16:
+		fail("auth.jwt_secret", "must be at least 16 bytes long")
+	}
+	if c.Reminders.Interval <= 0 {
+		fail("reminders.interval", "must be positive")
+	}
+	if c.Reminders.WebhookURL != "" {
+		if u, err := url.Parse(c.Reminders.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fail("reminders.webhook_url", "must be an absolute http(s) URL")
+		}
+	}
+	switch c.Replication.Role {
+	case "":
+	case "leader", "follower":
+		if c.Storage.Backend != "memory" {
+			fail("replication.role", "requires the memory storage backend")
+		}
+		if len(c.Replication.Secret) < 16 {
+			fail("replication.secret", "must be at least 16 bytes long")
+		}
+		if c.Replication.LogSize < 1 {
+			fail("replication.log_size", "must be positive")
+		}
+		if c.Replication.Role == "follower" {
+			if u, err := url.Parse(c.Replication.LeaderURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				fail("replication.leader_url", "must be an absolute http(s) URL")
+			}
+		}
+	default:
+		fail("replication.role", "must be leader, follower or empty, got %q", c.Replication.Role)
+	}
+	return errors.Join(errs...)
+}
+
+// restartRequired возвращает настройки, изменение которых вступает в силу только
+// после перезапуска сервера. Уровень журнала, скрываемые поля, ограничения
+// запросов и файлы TLS применяются при перезагрузке настроек.
+func (c Config) restartRequired(old Config) []string {
+	var fields []string
+	check := func(name string, changed bool) {
+		if changed {
+			fields = append(fields, name)
+		}
+	}
+	check("listen", c.Listen != old.Listen)
+	check("tls", (c.TLS.CertFile == "") != (old.TLS.CertFile == ""))
+	check("storage", c.Storage != old.Storage)
+	check("read_timeout", c.ReadTimeout != old.ReadTimeout)
+	check("write_timeout", c.WriteTimeout != old.WriteTimeout)
+	check("idle_timeout", c.IdleTimeout != old.IdleTimeout)
+	check("shutdown_timeout", c.ShutdownTimeout != old.ShutdownTimeout)
+	check("shutdown_drain_delay", c.ShutdownDrainDelay != old.ShutdownDrainDelay)
+	check("auth", c.Auth != old.Auth)
+	check("reminders", c.Reminders != old.Reminders)
+	check("replication", c.Replication != old.Replication)
+	return fields
+}
+
+// certReloader хранит текущий сертификат TLS и перечитывает его по запросу.
+type certReloader struct {
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// load читает сертификат и ключ из файлов. При ошибке текущий сертификат сохраняется.
+func (r *certReloader) load(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.mu.Unlock()
+	return nil
+}
+
+// getCertificate используется в tls.Config.GetCertificate.
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
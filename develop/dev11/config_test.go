@@ -0,0 +1,174 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// env возвращает функцию поиска переменных окружения по словарю vars.
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+}
+
+// writeConfig записывает файл настроек name во временный каталог и возвращает путь.
+func writeConfig(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	yamlPath := writeConfig(t, "calendar.yaml", `
+listen: "127.0.0.1:9090"
+tls:
+  cert_file: server.crt
+  key_file: server.key
+storage:
+  backend: sqlite
+  path: /var/lib/calendar/events.db
+read_timeout: 5s
+log_level: warn
+log_redact: [password, api_key]
+reminders:
+  interval: 1m
+auth:
+  jwt_secret: 0123456789abcdef
+`)
+	cfg, err := LoadConfig(yamlPath, env(nil))
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	assert.Equal(t, "127.0.0.1:9090", cfg.Listen)
+	assert.Equal(t, "server.crt", cfg.TLS.CertFile)
+	assert.Equal(t, "sqlite", cfg.Storage.Backend)
+	assert.Equal(t, Duration(5*time.Second), cfg.ReadTimeout)
+	// не заданные в файле поля сохраняют значения по умолчанию
+	assert.Equal(t, DefaultConfig().WriteTimeout, cfg.WriteTimeout)
+	assert.Equal(t, []string{"password", "api_key"}, cfg.LogRedact)
+	assert.Equal(t, Duration(time.Minute), cfg.Reminders.Interval)
+	path, _ := cfg.storagePaths()
+	assert.Equal(t, "/var/lib/calendar/events.db", path)
+
+	jsonPath := writeConfig(t, "calendar.json", `{"listen": ":8443", "storage": {"flush_interval": "1s"}}`)
+	cfg, err = LoadConfig(jsonPath, env(map[string]string{
+		"CALENDAR_LISTEN":                  ":7070",
+		"CALENDAR_LOG_LEVEL":               "debug",
+		"CALENDAR_STORAGE_BACKEND":         "memory",
+		"CALENDAR_LIMITS_IP_RATE":          "2.5",
+		"CALENDAR_LIMITS_IP_BURST":         "5",
+		"CALENDAR_STORAGE_TRASH_RETENTION": "168h",
+		"CALENDAR_SHUTDOWN_TIMEOUT":        "45s",
+		"CALENDAR_SHUTDOWN_DRAIN_DELAY":    "10s",
+		"CALENDAR_REPLICATION_ROLE":        "follower",
+		"CALENDAR_REPLICATION_LEADER_URL":  "http://calendar-1:8080",
+		"CALENDAR_REPLICATION_SECRET":      "0123456789abcdef",
+		"CALENDAR_INSECURE_NO_AUTH":        "true",
+	}))
+	require.NoError(t, err)
+	require.NoError(t, cfg.Validate())
+	// переменные окружения важнее файла
+	assert.Equal(t, ":7070", cfg.Listen)
+	assert.Equal(t, "debug", cfg.LogLevel)
+	assert.Equal(t, Duration(time.Second), cfg.Storage.FlushInterval)
+	assert.Equal(t, 2.5, cfg.Limits.IPRate)
+	assert.Equal(t, 5, cfg.Limits.IPBurst)
+	assert.Equal(t, DefaultConfig().Limits.UserRate, cfg.Limits.UserRate)
+	assert.Equal(t, Duration(7*24*time.Hour), cfg.Storage.TrashRetention)
+	assert.Equal(t, Duration(45*time.Second), cfg.ShutdownTimeout)
+	assert.Equal(t, Duration(10*time.Second), cfg.ShutdownDrainDelay)
+	assert.Equal(t, "follower", cfg.Replication.Role)
+	assert.Equal(t, "http://calendar-1:8080", cfg.Replication.LeaderURL)
+	assert.Equal(t, defaultReplicationLogSize, cfg.Replication.LogSize)
+	path, walPath := cfg.storagePaths()
+	assert.Equal(t, persistentStorageFile, path)
+	assert.Equal(t, persistentLogFile, walPath)
+
+	assert.True(t, cfg.Auth.InsecureNoAuth)
+
+	// пустой путь - значения по умолчанию; без секрета сервер не запускается,
+	// если аутентификация не выключена явно
+	cfg, err = LoadConfig("", env(nil))
+	require.NoError(t, err)
+	err = cfg.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "auth.jwt_secret: is required")
+	cfg, err = LoadConfig("", env(map[string]string{"CALENDAR_INSECURE_NO_AUTH": "1"}))
+	require.NoError(t, err)
+	assert.NoError(t, cfg.Validate())
+	cfg.Auth.JWTSecret = "0123456789abcdef"
+	assert.ErrorContains(t, cfg.Validate(), "auth.insecure_no_auth")
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name, file, content string
+		env                 map[string]string
+		errContains         string
+	}{
+		{"unknown yaml field", "c.yaml", "listen: ':80'\nlisten_port: 80\n", nil, "field listen_port not found"},
+		{"bad yaml duration", "c.yaml", "read_timeout: soon\n", nil, "line 1"},
+		{"unknown json field", "c.json", `{"port": 80}`, nil, `unknown field "port"`},
+		{"bad extension", "c.toml", "listen = ':80'", nil, "unsupported file extension"},
+		{"bad env duration", "c.yaml", "", map[string]string{"CALENDAR_WRITE_TIMEOUT": "forever"}, "CALENDAR_WRITE_TIMEOUT"},
+		{"bad env rate", "c.yaml", "", map[string]string{"CALENDAR_LIMITS_USER_RATE": "fast"}, "CALENDAR_LIMITS_USER_RATE"},
+		{"bad env size", "c.yaml", "", map[string]string{"CALENDAR_LIMITS_MAX_BODY_BYTES": "1MB"}, "CALENDAR_LIMITS_MAX_BODY_BYTES"},
+		{"bad env bool", "c.yaml", "", map[string]string{"CALENDAR_INSECURE_NO_AUTH": "maybe"}, "CALENDAR_INSECURE_NO_AUTH"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := LoadConfig(writeConfig(t, test.file, test.content), env(test.env))
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), test.errContains)
+		})
+	}
+	_, err := LoadConfig(filepath.Join(t.TempDir(), "missing.yaml"), env(nil))
+	assert.Error(t, err)
+}
+
+func TestConfigValidate(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Listen = "8080"
+	cfg.TLS.CertFile = "server.crt"
+	cfg.Storage.Backend = "postgres"
+	cfg.ReadTimeout = Duration(-time.Second)
+	cfg.LogLevel = "verbose"
+	cfg.Auth.JWTSecret = "short"
+	cfg.Reminders.WebhookURL = "hooks.example.com/calendar"
+	cfg.Limits.IPBurst = 0
+	cfg.Limits.MaxBodyBytes = -1
+	cfg.Storage.TrashRetention = Duration(-time.Hour)
+	cfg.ShutdownTimeout = Duration(-time.Second)
+	cfg.ShutdownDrainDelay = Duration(-time.Second)
+	cfg.Replication.Role = "follower"
+	cfg.Replication.LeaderURL = "calendar-1:8080"
+	err := cfg.Validate()
+	require.Error(t, err)
+	for _, field := range []string{"listen:", "tls:", "storage.backend:", "read_timeout:", "log_level:",
+		"auth.jwt_secret:", "reminders.webhook_url:", "limits.ip_burst:", "limits.max_body_bytes:",
+		"storage.trash_retention:", "shutdown_timeout:", "shutdown_drain_delay:", "replication.role:", "replication.secret:",
+		"replication.leader_url:"} {
+		assert.Contains(t, err.Error(), field)
+	}
+	assert.NotContains(t, err.Error(), "write_timeout")
+}
+
+func TestConfigRestartRequired(t *testing.T) {
+	old := DefaultConfig()
+	cfg := DefaultConfig()
+	cfg.LogLevel = "error"
+	cfg.LogRedact = []string{"password"}
+	cfg.Limits.UserRate = 1
+	assert.Empty(t, cfg.restartRequired(old))
+
+	cfg.Listen = ":9090"
+	cfg.Storage.Backend = "sqlite"
+	cfg.IdleTimeout = Duration(time.Minute)
+	assert.Equal(t, []string{"listen", "storage", "idle_timeout"}, cfg.restartRequired(old))
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// defaultShutdownTimeout - сколько по умолчанию при остановке сервера ждать
+// завершения начатых запросов.
+const defaultShutdownTimeout = 30 * time.Second
+
+// defaultShutdownDrainDelay - сколько по умолчанию после снятия готовности
+// продолжать принимать запросы, чтобы оркестратор увидел 503 на /readyz
+// и перестал направлять трафик до закрытия порта.
+const defaultShutdownDrainDelay = 5 * time.Second
+
+// errShuttingDown - сервер останавливается и новых запросов не принимает.
+var errShuttingDown = errors.New("server is shutting down")
+
+// ReadyChecker - хранилище (или другая часть сервера), которое может сообщить,
+// готово ли оно обслуживать запросы (например, что фоновый воркер сохранения
+// данных работает).
+type ReadyChecker interface {
+	// Ready возвращает nil, если всё готово, иначе - причину неготовности.
+	Ready() error
+}
+
+// Health отвечает на проверки живости (/healthz) и готовности (/readyz)
+// сервера для оркестратора. Сервер жив, пока отвечает на запросы; готов - пока
+// хранилище (и прочие проверки, например ведомый узел репликации) готово
+// и остановка сервера не началась.
+type Health struct {
+	checks   []ReadyChecker
+	draining atomic.Bool
+}
+
+// NewHealth создаёт Health для хранилища s и дополнительных проверок checks.
+// Хранилище, не реализующее ReadyChecker, считается готовым всегда.
+func NewHealth(s EventStorage, checks ...ReadyChecker) *Health {
+	h := &Health{}
+	if rc, ok := s.(ReadyChecker); ok {
+		h.checks = append(h.checks, rc)
+	}
+	h.checks = append(h.checks, checks...)
+	return h
+}
+
+// Drain снимает готовность сервера перед остановкой, чтобы оркестратор
+// перестал направлять на него запросы.
+func (h *Health) Drain() {
+	h.draining.Store(true)
+}
+
+// Ready возвращает nil, если сервер готов принимать запросы.
+func (h *Health) Ready() error {
+	if h.draining.Load() {
+		return errShuttingDown
+	}
+	for _, c := range h.checks {
+		if err := c.Ready(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Live - обработчик проверки живости: отвечает, пока сервер обслуживает запросы.
+//
+// GET /healthz
+func (h *Health) Live(w http.ResponseWriter, r *http.Request) {
+	const logHeader = "healthz"
+	if r.Method != http.MethodGet {
+		returnError(w, logHeader, "", http.StatusMethodNotAllowed)
+		return
+	}
+	returnJSONResult(w, logHeader, "ok", http.StatusOK)
+}
+
+// Readiness - обработчик проверки готовности: 200, если хранилище загружено и
+// воркер сохранения работает, 503 - если нет или сервер останавливается.
+//
+// GET /readyz
+func (h *Health) Readiness(w http.ResponseWriter, r *http.Request) {
+	const logHeader = "readyz"
+	if r.Method != http.MethodGet {
+		returnError(w, logHeader, "", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := h.Ready(); err != nil {
+		returnError(w, logHeader, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	returnJSONResult(w, logHeader, "ready", http.StatusOK)
+}
+
+// gracefulShutdown останавливает сервер: снимает готовность, ещё drainDelay
+// принимает запросы (/readyz в это время отвечает 503), затем перестаёт принимать
+// соединения и ждёт завершения начатых запросов не дольше timeout (0 - без
+// ограничения), после чего закрывает оставшиеся соединения. Бессрочные ответы
+// (потоки /events/stream, репликация) закрываются функциями, зарегистрированными
+// в server.RegisterOnShutdown, и ожидания не задерживают. Затем по порядку
+// вызываются closers - остановка фоновых воркеров и хранилища. Возвращает
+// ошибку, если запросы не успели завершиться.
+func gracefulShutdown(server *http.Server, health *Health, drainDelay, timeout time.Duration, closers ...func()) error {
+	health.Drain()
+	if drainDelay > 0 {
+		log.Printf("shutting down: draining for %v", drainDelay)
+		time.Sleep(drainDelay)
+	}
+	log.Printf("shutting down: waiting up to %v for in-flight requests", timeout)
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	err := server.Shutdown(ctx)
+	if err != nil {
+		log.Printf("shutdown: in-flight requests did not finish: %v", err)
+		server.Close()
+	}
+	for _, c := range closers {
+		c()
+	}
+	log.Println("server stopped")
+	return err
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/gob"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// probe выполняет проверку h и возвращает код ответа и тело.
+func probe(h http.HandlerFunc, method string) (int, string) {
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest(method, "/", nil))
+	return rec.Code, rec.Body.String()
+}
+
+func TestHealth(t *testing.T) {
+	s := openTestInmem(t, t.TempDir())
+	health := NewHealth(s)
+
+	code, body := probe(health.Live, http.MethodGet)
+	assert.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"result":"ok"}`, body)
+	code, body = probe(health.Readiness, http.MethodGet)
+	assert.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"result":"ready"}`, body)
+	code, _ = probe(health.Readiness, http.MethodPost)
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+
+	// остановленный воркер сохранения - хранилище не готово, но сервер жив
+	s.Close()
+	code, body = probe(health.Readiness, http.MethodGet)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, body, "repoSaver is not running")
+	code, _ = probe(health.Live, http.MethodGet)
+	assert.Equal(t, http.StatusOK, code)
+
+	// хранилище без проверки готовности готово всегда, пока сервер не останавливается
+	health = NewHealth(newTestStorage())
+	assert.NoError(t, health.Ready())
+	health.Drain()
+	assert.ErrorIs(t, health.Ready(), errShuttingDown)
+
+	db, err := NewSQLEventStorage(filepath.Join(t.TempDir(), "events.db"))
+	require.NoError(t, err)
+	assert.NoError(t, db.Ready())
+	db.Close()
+	assert.Error(t, db.Ready())
+}
+
+// startServer запускает server на свободном порту и возвращает адрес.
+func startServer(t *testing.T, server *http.Server) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(ln)
+	return "http://" + ln.Addr().String()
+}
+
+// TestGracefulShutdown проверяет порядок остановки: готовность снимается сразу,
+// начатый запрос завершается и успевает записать событие, и только потом
+// останавливается repoSaver и данные сохраняются в снимок.
+func TestGracefulShutdown(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestInmem(t, dir)
+	health := NewHealth(s)
+	e := Event{ID: uuid.New(), UserID: uuid.New(), When: mustTime(t, "03.01.2022 10:00"), What: "в полёте"}
+
+	started, release := make(chan struct{}), make(chan struct{})
+	router := http.NewServeMux()
+	router.HandleFunc("/readyz", health.Readiness)
+	router.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		if err := s.Add(e); err != nil {
+			returnStorageError(w, "slow", err)
+			return
+		}
+		returnJSONResult(w, "slow", "saved", http.StatusOK)
+	})
+	server := &http.Server{Handler: router}
+	addr := startServer(t, server)
+	// без keep-alive клиент не открывает запасных соединений: сервер ждал бы
+	// соединение без запроса (StateNew) до 5 секунд
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+	resp, err := client.Get(addr + "/readyz")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	slow := make(chan *http.Response, 1)
+	go func() {
+		resp, err := client.Get(addr + "/slow")
+		assert.NoError(t, err)
+		slow <- resp
+	}()
+	<-started
+
+	var closed []string
+	done := make(chan error, 1)
+	go func() {
+		done <- gracefulShutdown(server, health, 0, 5*time.Second,
+			func() { closed = append(closed, "workers") },
+			func() { closed = append(closed, "storage"); s.Close() })
+	}()
+
+	// готовность снята, но запрос ещё выполняется, и хранилище не закрыто
+	require.Eventually(t, func() bool { return health.Ready() != nil }, time.Second, time.Millisecond)
+	assert.ErrorIs(t, health.Ready(), errShuttingDown)
+	select {
+	case err := <-done:
+		t.Fatalf("shutdown finished before the in-flight request: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.NoError(t, s.Ready())
+
+	close(release)
+	resp = <-slow
+	require.NotNil(t, resp)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, <-done)
+	assert.Equal(t, []string{"workers", "storage"}, closed)
+
+	// новые соединения не принимаются
+	_, err = client.Get(addr + "/readyz")
+	assert.Error(t, err)
+
+	// событие сохранено в снимок, журнал очищен
+	assert.Error(t, s.Ready())
+	info, err := os.Stat(filepath.Join(dir, "events.wal"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), info.Size())
+	f, err := os.Open(filepath.Join(dir, "events.gob"))
+	require.NoError(t, err)
+	defer f.Close()
+	var repo map[uuid.UUID]Event
+	require.NoError(t, gob.NewDecoder(f).Decode(&repo))
+	assert.Equal(t, e.What, repo[e.ID].What)
+}
+
+// TestGracefulShutdownDrainDelay проверяет, что после снятия готовности сервер
+// ещё drainDelay принимает запросы и отвечает 503 на /readyz, а не отказывает
+// в соединении.
+func TestGracefulShutdownDrainDelay(t *testing.T) {
+	s := openTestInmem(t, t.TempDir())
+	health := NewHealth(s)
+	router := http.NewServeMux()
+	router.HandleFunc("/readyz", health.Readiness)
+	server := &http.Server{Handler: router}
+	addr := startServer(t, server)
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+	const drainDelay = 500 * time.Millisecond
+	done := make(chan error, 1)
+	go func() {
+		done <- gracefulShutdown(server, health, drainDelay, 5*time.Second, s.Close)
+	}()
+	require.Eventually(t, func() bool { return health.Ready() != nil }, time.Second, time.Millisecond)
+	resp, err := client.Get(addr + "/readyz")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	require.NoError(t, <-done)
+	_, err = client.Get(addr + "/readyz")
+	assert.Error(t, err)
+}
+
+// TestGracefulShutdownTimeout проверяет, что запросы, не завершившиеся за отведённое
+// время (зависший обработчик), прерываются, а хранилище всё равно закрывается.
+func TestGracefulShutdownTimeout(t *testing.T) {
+	s := openTestInmem(t, t.TempDir())
+	health := NewHealth(s)
+	started, finished := make(chan struct{}), make(chan struct{})
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		close(started)
+		<-r.Context().Done()
+		close(finished)
+	})}
+	addr := startServer(t, server)
+	go func() {
+		// клиент читает ответ, пока сервер не закроет соединение
+		resp, err := http.Get(addr)
+		if err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	}()
+	<-started
+
+	begin := time.Now()
+	err := gracefulShutdown(server, health, 0, 100*time.Millisecond, s.Close)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(begin), 5*time.Second)
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the hanging request was not cancelled")
+	}
+	assert.Error(t, s.Ready())
+	assert.ErrorIs(t, health.Ready(), errShuttingDown)
+}
+
+// TestGracefulShutdownStream проверяет, что открытые потоки /events/stream не
+// задерживают остановку: лента закрывается в RegisterOnShutdown, и сервер
+// останавливается без ошибки задолго до истечения времени ожидания.
+func TestGracefulShutdownStream(t *testing.T) {
+	s := openTestInmem(t, t.TempDir())
+	health := NewHealth(s)
+	feed := NewChangeFeed(defaultJournalSize)
+	server := &http.Server{Handler: http.HandlerFunc(NewStreamAPI(feed).Stream)}
+	server.RegisterOnShutdown(feed.Close)
+	addr := startServer(t, server)
+
+	resp, err := http.Get(addr + "/events/stream?user_id=" + uuid.NewString())
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	finished := make(chan struct{})
+	go func() {
+		// клиент читает поток, пока сервер не закроет его
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		close(finished)
+	}()
+
+	const timeout = 10 * time.Second
+	begin := time.Now()
+	require.NoError(t, gracefulShutdown(server, health, 0, timeout, s.Close))
+	assert.Less(t, time.Since(begin), timeout/5)
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("the stream was not closed")
+	}
+	// подписка после закрытия ленты сразу завершается
+	changes, _ := feed.Subscribe(uuid.New(), 0)
+	_, ok := <-changes
+	assert.False(t, ok)
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Версии событий и история изменений. Каждое изменение события увеличивает его
+// версию (Event.Version), а хранилище отклоняет запись, основанную на устаревшей
+// версии (ErrVersionConflict), поэтому одновременные изменения не затирают друг
+// друга. Клиент может передать ожидаемую версию явно: параметром version или
+// заголовком If-Match. Кто, когда и что изменил, записывается в журнал
+// EventHistory, доступный через GET /event_history.
+
+// versionETag возвращает ETag версии события.
+func versionETag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+// checkVersion проверяет ожидаемую версию события из параметра version или
+// заголовка If-Match (если они переданы) и отвечает 409, если событие уже изменено.
+// Функция обрабатывает и логирует возникшие ошибки.
+func checkVersion(w http.ResponseWriter, r *http.Request, logHeader string, e Event) bool {
+	if queryVersion := r.FormValue("version"); queryVersion != "" {
+		version, err := strconv.ParseUint(queryVersion, 10, 64)
+		if err != nil {
+			returnError(w, logHeader, fmt.Sprintf("incorrect version: %v", err), http.StatusBadRequest)
+			return false
+		}
+		if version != e.Version {
+			returnError(w, logHeader, fmt.Sprintf("%v: current version %d", ErrVersionConflict, e.Version), http.StatusConflict)
+			return false
+		}
+	}
+	if match := r.Header.Get("If-Match"); match != "" && !etagMatches(match, versionETag(e.Version)) {
+		returnError(w, logHeader, fmt.Sprintf("%v: current version %d", ErrVersionConflict, e.Version), http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+// FieldChange - изменение поля события: значения до и после в JSON
+// (old нет у созданного события).
+type FieldChange struct {
+	Field string          `json:"field"`
+	Old   json.RawMessage `json:"old,omitempty"`
+	New   json.RawMessage `json:"new,omitempty"`
+}
+
+// HistoryEntry - запись истории изменений события.
+type HistoryEntry struct {
+	EventID uuid.UUID `json:"event_id"`
+	// Version - версия события после изменения (для удаления - последняя версия).
+	Version uint64     `json:"version"`
+	Action  ChangeType `json:"action"`
+	// UserID - автор изменения.
+	UserID  uuid.UUID     `json:"user_id"`
+	At      time.Time     `json:"at"`
+	Changes []FieldChange `json:"changes,omitempty"`
+}
+
+// historyRecord - запись файла истории: запись и пользователи, которым она видна
+// (организатор и участники события до и после изменения).
+type historyRecord struct {
+	HistoryEntry
+	Users []uuid.UUID `json:"users"`
+}
+
+// historySkipFields - поля JSON события, не попадающие в историю: неизменяемые,
+// служебные и вычисляемые.
+var historySkipFields = map[string]bool{
+	"ID": true, "Version": true, "ModifiedBy": true, "DeletedAt": true, "Local": true, "End": true,
+}
+
+// diffEvents возвращает изменившиеся поля события (old == nil - событие создано).
+func diffEvents(old *Event, e Event) ([]FieldChange, error) {
+	fields := func(e Event) (map[string]json.RawMessage, error) {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return nil, err
+		}
+		m := make(map[string]json.RawMessage)
+		return m, json.Unmarshal(data, &m)
+	}
+	before := make(map[string]json.RawMessage)
+	if old != nil {
+		var err error
+		if before, err = fields(*old); err != nil {
+			return nil, err
+		}
+	}
+	after, err := fields(e)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(after))
+	seen := make(map[string]bool)
+	for _, m := range []map[string]json.RawMessage{before, after} {
+		for name := range m {
+			if !seen[name] && !historySkipFields[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	changes := make([]FieldChange, 0)
+	for _, name := range names {
+		if !bytes.Equal(before[name], after[name]) {
+			changes = append(changes, FieldChange{Field: name, Old: before[name], New: after[name]})
+		}
+	}
+	return changes, nil
+}
+
+// EventHistory - журнал изменений событий. Записи только дописываются в файл
+// (по одной записи JSON на строку) и сбрасываются на диск; недописанная последняя
+// строка (после аварийного завершения) при открытии отбрасывается.
+type EventHistory struct {
+	mu *sync.RWMutex
+	// f - файл журнала (nil - записи хранятся только в памяти).
+	f walFile
+	// size - смещение конца последней записи, успешно сброшенной на диск.
+	size int64
+	// err - ошибка, после которой не удалось вернуть файл к size; журнал
+	// не принимает новых записей, чтобы они не оказались после недописанной строки.
+	err     error
+	entries map[uuid.UUID][]historyRecord
+}
+
+// OpenEventHistory открывает журнал истории в файле path (создавая его при необходимости)
+// и читает имеющиеся записи. С пустым path записи не сохраняются на диск.
+func OpenEventHistory(path string) (*EventHistory, error) {
+	h := &EventHistory{mu: &sync.RWMutex{}, entries: make(map[uuid.UUID][]historyRecord)}
+	if path == "" {
+		return h, nil
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("eventHistory: %w", err)
+	}
+	size, err := h.read(f)
+	if err != nil {
+		log.Printf("eventHistory: %s: discarding damaged tail at offset %d: %v", path, size, err)
+		if err := f.Truncate(size); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("eventHistory: %w", err)
+		}
+	}
+	if _, err := f.Seek(size, io.SeekStart); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("eventHistory: %w", err)
+	}
+	h.f = f
+	h.size = size
+	return h, nil
+}
+
+// read читает записи журнала и возвращает смещение конца последней целой записи.
+func (h *EventHistory) read(r io.Reader) (int64, error) {
+	br := bufio.NewReader(r)
+	var offset int64
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				return offset, errors.New("truncated record")
+			}
+			return offset, nil
+		}
+		if err != nil {
+			return offset, err
+		}
+		var rec historyRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return offset, fmt.Errorf("could not decode record: %w", err)
+		}
+		h.entries[rec.EventID] = append(h.entries[rec.EventID], rec)
+		offset += int64(len(line))
+	}
+}
+
+// append дописывает запись в журнал. Если запись не удалось записать или сбросить
+// на диск, файл обрезается до предыдущей записи: иначе при следующем открытии
+// недописанная строка отрезала бы и все записи после неё.
+func (h *EventHistory) append(rec historyRecord) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.f != nil {
+		if h.err != nil {
+			return fmt.Errorf("eventHistory: history is unusable after a failed write: %w", h.err)
+		}
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		data = append(data, '\n')
+		if _, err := h.f.Write(data); err != nil {
+			return h.rollback(fmt.Errorf("eventHistory: write failed: %w", err))
+		}
+		if err := h.f.Sync(); err != nil {
+			return h.rollback(fmt.Errorf("eventHistory: sync failed: %w", err))
+		}
+		h.size += int64(len(data))
+	}
+	h.entries[rec.EventID] = append(h.entries[rec.EventID], rec)
+	return nil
+}
+
+// rollback обрезает файл журнала до конца последней целой записи после ошибки err
+// и возвращает err. Если обрезать не удалось, журнал перестаёт принимать записи.
+func (h *EventHistory) rollback(err error) error {
+	terr := h.f.Truncate(h.size)
+	if terr == nil {
+		_, terr = h.f.Seek(h.size, io.SeekStart)
+	}
+	if terr != nil {
+		log.Printf("eventHistory: could not discard a failed record: %v", terr)
+		h.err = err
+	}
+	return err
+}
+
+// Get возвращает историю события в порядке изменений. Если записей нет,
+// возвращается ErrEventNotFound.
+func (h *EventHistory) Get(eventID uuid.UUID) ([]HistoryEntry, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	records := h.entries[eventID]
+	if len(records) == 0 {
+		return nil, ErrEventNotFound
+	}
+	result := make([]HistoryEntry, 0, len(records))
+	for _, rec := range records {
+		result = append(result, rec.HistoryEntry)
+	}
+	return result, nil
+}
+
+// visibleTo проверяет, касалось ли последнее изменение события пользователя,
+// прошедшего проверку allowed.
+func (h *EventHistory) visibleTo(eventID uuid.UUID, allowed func(uuid.UUID) bool) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	records := h.entries[eventID]
+	if len(records) == 0 {
+		return false
+	}
+	for _, id := range records[len(records)-1].Users {
+		if allowed(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// Close закрывает файл журнала.
+func (h *EventHistory) Close() {
+	if h.f == nil {
+		return
+	}
+	if err := h.f.Close(); err != nil {
+		log.Printf("eventHistory: could not close the file: %v", err)
+	}
+}
+
+var (
+	_ TxStorage       = (*HistoryEventStorage)(nil)
+	_ TrashStorage    = (*HistoryEventStorage)(nil)
+	_ ReplicaStorage  = (*HistoryEventStorage)(nil)
+	_ ReminderStorage = (*HistoryEventStorage)(nil)
+)
+
+// HistoryEventStorage записывает в EventHistory изменения, сделанные через Add,
+// Update, Delete и Restore хранилища. Автор изменения берётся из Event.ModifiedBy
+// (если не задан - организатор); удалить и восстановить событие может только
+// организатор, поэтому автором удаления и восстановления считается он.
+type HistoryEventStorage struct {
+	EventStorage
+	history *EventHistory
+	// mu упорядочивает изменения: порядок записей совпадает с порядком записи событий.
+	mu  *sync.Mutex
+	now func() time.Time
+	// effects - записи истории, отложенные до фиксации транзакции (см. Tx).
+	effects *txEffects
+}
+
+// NewHistoryEventStorage создаёт хранилище, записывающее историю изменений s в history.
+func NewHistoryEventStorage(s EventStorage, history *EventHistory) *HistoryEventStorage {
+	return &HistoryEventStorage{EventStorage: s, history: history, mu: &sync.Mutex{}, now: time.Now}
+}
+
+// record записывает изменение события в историю. Изменение к этому моменту
+// уже сохранено, поэтому ошибка записи только логируется.
+func (s *HistoryEventStorage) record(action ChangeType, old *Event, e Event) {
+	rec := historyRecord{HistoryEntry: HistoryEntry{
+		EventID: e.ID,
+		Version: e.Version,
+		Action:  action,
+		UserID:  e.ModifiedBy,
+		At:      s.now().UTC(),
+	}}
+	if rec.UserID == uuid.Nil {
+		rec.UserID = e.UserID
+	}
+	var err error
+	switch action {
+	case ChangeDeleted, ChangeRestored:
+		rec.UserID = e.UserID
+		rec.Users = eventUsers(e)
+	case ChangeCreated:
+		rec.Changes, err = diffEvents(nil, e)
+		rec.Users = eventUsers(e)
+	default:
+		rec.Changes, err = diffEvents(old, e)
+		rec.Users = eventUsers(*old, e)
+	}
+	if err == nil {
+		err = s.history.append(rec)
+	}
+	if err != nil {
+		log.Printf("historyEventStorage: ERROR: could not record %s of event %v: %v", action, e.ID, err)
+	}
+}
+
+// Add добавляет событие и записывает его создание в историю.
+func (s *HistoryEventStorage) Add(e Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.EventStorage.Add(e); err != nil {
+		return err
+	}
+	s.effects.after(func() { s.record(ChangeCreated, nil, e) })
+	return nil
+}
+
+// Update перезаписывает событие и записывает в историю изменившиеся поля.
+func (s *HistoryEventStorage) Update(e Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, err := s.EventStorage.Get(e.ID)
+	if err != nil {
+		return err
+	}
+	if err := s.EventStorage.Update(e); err != nil {
+		return err
+	}
+	s.effects.after(func() { s.record(ChangeUpdated, &old, e) })
+	return nil
+}
+
+// Delete удаляет событие и записывает удаление в историю.
+func (s *HistoryEventStorage) Delete(eventID uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, err := s.EventStorage.Get(eventID)
+	if err != nil {
+		return err
+	}
+	if err := s.EventStorage.Delete(eventID); err != nil {
+		return err
+	}
+	s.effects.after(func() { s.record(ChangeDeleted, nil, old) })
+	return nil
+}
+
+// Trash возвращает события корзины (см. TrashStorage).
+func (s *HistoryEventStorage) Trash(userID uuid.UUID) ([]Event, error) {
+	ts, err := trashStorage(s.EventStorage)
+	if err != nil {
+		return nil, err
+	}
+	return ts.Trash(userID)
+}
+
+// GetDeleted возвращает событие из корзины (см. TrashStorage).
+func (s *HistoryEventStorage) GetDeleted(eventID uuid.UUID) (Event, error) {
+	ts, err := trashStorage(s.EventStorage)
+	if err != nil {
+		return Event{}, err
+	}
+	return ts.GetDeleted(eventID)
+}
+
+// Purge окончательно удаляет события из корзины (см. TrashStorage).
+func (s *HistoryEventStorage) Purge(before time.Time) (int, error) {
+	ts, err := trashStorage(s.EventStorage)
+	if err != nil {
+		return 0, err
+	}
+	return ts.Purge(before)
+}
+
+// Restore возвращает событие из корзины и записывает восстановление в историю.
+func (s *HistoryEventStorage) Restore(eventID uuid.UUID) error {
+	ts, err := trashStorage(s.EventStorage)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, err := ts.GetDeleted(eventID)
+	if err != nil {
+		return err
+	}
+	if err := ts.Restore(eventID); err != nil {
+		return err
+	}
+	s.effects.after(func() { s.record(ChangeRestored, nil, e) })
+	return nil
+}
+
+// Tx выполняет fn в транзакции хранилища (см. TxStorage); изменения транзакции
+// записываются в историю после её фиксации.
+func (s *HistoryEventStorage) Tx(fn func(EventStorage) error) error {
+	if s.effects != nil {
+		return fn(s) // вложенная транзакция - часть внешней
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return txWithEffects(s.EventStorage, func(tx EventStorage, effects *txEffects) EventStorage {
+		return &HistoryEventStorage{EventStorage: tx, history: s.history, mu: &sync.Mutex{}, now: s.now, effects: effects}
+	}, fn)
+}
+
+// Replicate применяет изменения ведущего узла (см. ReplicaStorage). В историю
+// они не записываются: её ведёт ведущий, и ведомый передаёт ему запросы истории.
+func (s *HistoryEventStorage) Replicate(b ReplicationBatch) ([]ReplicatedChange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return replicate(s.EventStorage, b)
+}
+
+// GetWithReminders выбирает события с напоминаниями (см. ReminderStorage).
+func (s *HistoryEventStorage) GetWithReminders(from, to time.Time) ([]Event, error) {
+	return remindingEvents(s.EventStorage, from, to)
+}
+
+// HistoryAPI отдаёт историю изменений событий.
+type HistoryAPI struct {
+	history *EventHistory
+}
+
+// NewHistoryAPI создаёт обработчик истории изменений из журнала history.
+func NewHistoryAPI(history *EventHistory) *HistoryAPI {
+	return &HistoryAPI{history: history}
+}
+
+// EventHistory возвращает историю изменений события (в том числе удалённого):
+// версию, вид изменения (created, updated, deleted), автора, время и
+// изменившиеся поля со значениями до и после. Историю видят организатор
+// и участники события.
+//
+// GET /event_history
+// параметр:
+// *event_id
+func (a HistoryAPI) EventHistory(w http.ResponseWriter, r *http.Request) {
+	const logHeader = "eventHistory"
+	if r.Method != http.MethodGet {
+		returnError(w, logHeader, "", http.StatusMethodNotAllowed)
+		return
+	}
+	queryEventID := strings.TrimSpace(r.FormValue("event_id"))
+	if queryEventID == "" {
+		returnError(w, logHeader, "missing parameter: event_id", http.StatusBadRequest)
+		return
+	}
+	eventID, err := uuid.Parse(queryEventID)
+	if err != nil {
+		returnError(w, logHeader, fmt.Sprintf("incorrect event ID: %v", err), http.StatusBadRequest)
+		return
+	}
+	entries, err := a.history.Get(eventID)
+	if err != nil {
+		returnStorageError(w, logHeader, err)
+		return
+	}
+	if !a.history.visibleTo(eventID, func(userID uuid.UUID) bool { return authorized(r, userID) }) {
+		returnError(w, logHeader, "access denied", http.StatusForbidden)
+		return
+	}
+	returnJSONResult(w, logHeader, entries, http.StatusOK)
+}
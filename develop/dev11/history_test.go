@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffEvents(t *testing.T) {
+	old := Event{ID: uuid.New(), UserID: uuid.New(), When: mustTime(t, "03.01.2022 10:00"), What: "Встреча", Version: 1}
+	e := old
+	e.Where = "Офис"
+	e.Duration = time.Hour
+	e.Version = 2
+	changes, err := diffEvents(&old, e)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(changes))
+	assert.Equal(t, FieldChange{Field: "Duration", New: json.RawMessage("3600000000000")}, changes[0])
+	assert.Equal(t, FieldChange{Field: "Where", Old: json.RawMessage(`""`), New: json.RawMessage(`"Офис"`)}, changes[1])
+
+	changes, err = diffEvents(&e, e)
+	require.NoError(t, err)
+	assert.Empty(t, changes)
+	changes, err = diffEvents(nil, old)
+	require.NoError(t, err)
+	for _, c := range changes {
+		assert.Empty(t, c.Old)
+		assert.NotEqual(t, "ID", c.Field)
+	}
+}
+
+func TestHistoryEventStorage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	history, err := OpenEventHistory(path)
+	require.NoError(t, err)
+	s := NewHistoryEventStorage(newTestStorage(), history)
+	organizer, alice := uuid.New(), uuid.New()
+
+	e := Event{ID: uuid.New(), UserID: organizer, When: mustTime(t, "03.01.2022 10:00"), What: "Встреча", Version: 1,
+		Attendees: []Attendee{{UserID: alice, Status: RSVPNeedsAction}}}
+	require.NoError(t, s.Add(e))
+	require.NoError(t, e.Respond(alice, RSVPAccepted))
+	e.Version++
+	e.ModifiedBy = alice
+	require.NoError(t, s.Update(e))
+	// неудачные изменения в историю не попадают
+	assert.ErrorIs(t, s.Update(e), ErrVersionConflict)
+	require.NoError(t, s.Delete(e.ID))
+
+	entries, err := history.Get(e.ID)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(entries))
+	assert.Equal(t, ChangeCreated, entries[0].Action)
+	assert.Equal(t, uint64(1), entries[0].Version)
+	assert.Equal(t, organizer, entries[0].UserID)
+	assert.NotEmpty(t, entries[0].Changes)
+	assert.Equal(t, ChangeUpdated, entries[1].Action)
+	assert.Equal(t, uint64(2), entries[1].Version)
+	assert.Equal(t, alice, entries[1].UserID)
+	require.Equal(t, 1, len(entries[1].Changes))
+	assert.Equal(t, "Attendees", entries[1].Changes[0].Field)
+	assert.Contains(t, string(entries[1].Changes[0].New), string(RSVPAccepted))
+	assert.Equal(t, ChangeDeleted, entries[2].Action)
+	assert.Equal(t, organizer, entries[2].UserID)
+	_, err = history.Get(uuid.New())
+	assert.ErrorIs(t, err, ErrEventNotFound)
+	history.Close()
+
+	// недописанная запись отбрасывается, остальные читаются заново
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"event_id":"`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	history, err = OpenEventHistory(path)
+	require.NoError(t, err)
+	reopened, err := history.Get(e.ID)
+	require.NoError(t, err)
+	require.Equal(t, len(entries), len(reopened))
+	for i := range entries {
+		assert.True(t, entries[i].At.Equal(reopened[i].At))
+		reopened[i].At = entries[i].At
+	}
+	assert.Equal(t, entries, reopened)
+	other := Event{ID: uuid.New(), UserID: organizer, When: mustTime(t, "04.01.2022 10:00"), Version: 1}
+	require.NoError(t, NewHistoryEventStorage(newTestStorage(), history).Add(other))
+	history.Close()
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, 4, strings.Count(string(data), "\n"))
+}
+
+// TestHistoryFailedAppend проверяет, что запись, которую не удалось записать
+// или сбросить на диск, не мешает прочитать следующие после перезапуска.
+func TestHistoryFailedAppend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	history, err := OpenEventHistory(path)
+	require.NoError(t, err)
+	file := &failingFile{File: history.f.(*os.File), failWrite: -1}
+	history.f = file
+	s := NewHistoryEventStorage(newTestStorage(), history)
+	userID := uuid.New()
+	event := func(what string) Event {
+		return Event{ID: uuid.New(), UserID: userID, When: mustTime(t, "03.01.2022 10:00"), What: what, Version: 1}
+	}
+	e1, e2, e3, e4, e5 := event("первое"), event("не записано"), event("после ошибки записи"),
+		event("не сброшено"), event("после ошибки сброса")
+	require.NoError(t, s.Add(e1))
+	file.failWrite = 10
+	require.NoError(t, s.Add(e2))
+	file.failWrite = -1
+	require.NoError(t, s.Add(e3))
+	file.failSync = true
+	require.NoError(t, s.Add(e4))
+	file.failSync = false
+	require.NoError(t, s.Add(e5))
+	history.Close()
+
+	history, err = OpenEventHistory(path)
+	require.NoError(t, err)
+	defer history.Close()
+	for _, e := range []Event{e1, e3, e5} {
+		_, err := history.Get(e.ID)
+		assert.NoError(t, err, e.What)
+	}
+	for _, e := range []Event{e2, e4} {
+		_, err := history.Get(e.ID)
+		assert.ErrorIs(t, err, ErrEventNotFound, e.What)
+	}
+}
+
+func TestVersionPreconditions(t *testing.T) {
+	history, err := OpenEventHistory("")
+	require.NoError(t, err)
+	storage := NewHistoryEventStorage(newTestStorage(), history)
+	api := NewCalendar(storage)
+	userID := uuid.New()
+	rec := doForm(api.CreateEvent, http.MethodPost, "/create_event", url.Values{
+		"user_id": {userID.String()}, "date": {"03.01.2022"}, "description": {"Встреча"},
+	})
+	require.Equal(t, http.StatusCreated, rec.Code)
+	events, err := storage.GetByUser(userID)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(events))
+	eventID := events[0].ID.String()
+	assert.Equal(t, uint64(1), events[0].Version)
+	assert.Equal(t, userID, events[0].ModifiedBy)
+
+	// без ожидаемой версии изменение проходит; ETag - новая версия
+	rec = doForm(api.UpdateEvent, http.MethodPost, "/update_event", url.Values{"event_id": {eventID}, "place": {"Офис"}})
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `"2"`, rec.Header().Get("ETag"))
+	rec = doForm(api.UpdateEvent, http.MethodPost, "/update_event", url.Values{"event_id": {eventID}, "place": {"Дом"}, "version": {"1"}})
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	rec = doForm(api.UpdateEvent, http.MethodPost, "/update_event", url.Values{"event_id": {eventID}, "version": {"two"}})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = doForm(api.UpdateEvent, http.MethodPost, "/update_event", url.Values{"event_id": {eventID}, "place": {"Дом"}, "version": {"2"}})
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	form := url.Values{"event_id": {eventID}}
+	del := func(ifMatch string) int {
+		req := httptest.NewRequest(http.MethodPost, "/delete_event", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("If-Match", ifMatch)
+		rec := httptest.NewRecorder()
+		api.DeleteEvent(rec, req)
+		return rec.Code
+	}
+	assert.Equal(t, http.StatusConflict, del(`"2"`))
+	assert.Equal(t, http.StatusNoContent, del(`"1", "3"`))
+
+	// история доступна организатору и после удаления
+	historyAPI := NewHistoryAPI(history)
+	req := httptest.NewRequest(http.MethodGet, "/event_history?event_id="+eventID, nil)
+	rec = httptest.NewRecorder()
+	historyAPI.EventHistory(rec, req.WithContext(context.WithValue(req.Context(), subjectKey{}, userID)))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var res struct {
+		Result []HistoryEntry
+	}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&res))
+	require.Equal(t, 4, len(res.Result))
+	assert.Equal(t, ChangeUpdated, res.Result[2].Action)
+	assert.Equal(t, uint64(3), res.Result[2].Version)
+	assert.Equal(t, `"Офис"`, string(res.Result[2].Changes[0].Old))
+	assert.Equal(t, `"Дом"`, string(res.Result[2].Changes[0].New))
+
+	rec = httptest.NewRecorder()
+	historyAPI.EventHistory(rec, req.WithContext(context.WithValue(req.Context(), subjectKey{}, uuid.New())))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	rec = doForm(historyAPI.EventHistory, http.MethodGet, "/event_history", url.Values{"event_id": {uuid.New().String()}})
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	rec = doForm(historyAPI.EventHistory, http.MethodGet, "/event_history", url.Values{})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
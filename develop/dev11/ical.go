@@ -0,0 +1,625 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+// Реализация подмножества формата iCalendar (RFC 5545), достаточного для обмена
+// событиями с Thunderbird/Outlook: VCALENDAR с компонентами VEVENT и свойствами
+// UID, DTSTART (в т.ч. с параметром TZID), DTEND, DURATION, SUMMARY, LOCATION,
+// RRULE и EXDATE. Для каждого использованного TZID экспорт описывает часовой пояс
+// компонентом VTIMEZONE; при импорте TZID считается именем пояса из базы IANA.
+
+const (
+	icsProdID = "-//go-advanced-tasks//dev11 calendar//RU"
+	// максимальная длина строки iCalendar в октетах (без CRLF).
+	icsLineLimit = 75
+	// форматы даты и времени iCalendar.
+	icsDateTimeUTC = "20060102T150405Z"
+	icsDateTime    = "20060102T150405"
+	icsDate        = "20060102"
+	// на сколько лет вперёд от текущего момента описываются переходы часового
+	// пояса для повторяющихся событий без даты окончания.
+	icsZoneYears = 10
+)
+
+// icsUIDNamespace - пространство имён для получения UUID события из UID,
+// который не является UUID (например, созданного другим календарём).
+var icsUIDNamespace = uuid.MustParse("6f1b2c1e-6a44-4a53-9d5e-0b6f7d9c1a10")
+
+// ErrInvalidICS - ошибка разбора файла iCalendar.
+var ErrInvalidICS = errors.New("invalid iCalendar data")
+
+// ICSEntry - событие, прочитанное из компонента VEVENT.
+type ICSEntry struct {
+	// Item - порядковый номер VEVENT в файле (с нуля).
+	Item  int
+	UID   string
+	Event Event
+}
+
+// ICSItemError - ошибка импорта отдельного компонента VEVENT.
+type ICSItemError struct {
+	// Item - порядковый номер VEVENT в файле (с нуля).
+	Item int `json:"item"`
+	// UID - идентификатор события из файла (если удалось прочитать).
+	UID   string `json:"uid,omitempty"`
+	Error string `json:"error"`
+}
+
+// EncodeICS записывает события в формате VCALENDAR.
+func EncodeICS(w io.Writer, events []Event) error {
+	bw := bufio.NewWriter(w)
+	line := func(name, value string) {
+		writeICSLine(bw, name+":"+value)
+	}
+	line("BEGIN", "VCALENDAR")
+	line("VERSION", "2.0")
+	line("PRODID", icsProdID)
+	line("CALSCALE", "GREGORIAN")
+	now := time.Now()
+	names, zones := collectICSZones(events, now)
+	for _, name := range names {
+		writeVTimezone(bw, name, zones[name])
+	}
+	stamp := now.UTC().Format(icsDateTimeUTC)
+	for _, e := range events {
+		line("BEGIN", "VEVENT")
+		line("UID", e.ID.String())
+		line("DTSTAMP", stamp)
+		writeICSTime(bw, "DTSTART", e.When, e.TZ)
+		if e.Duration > 0 {
+			line("DURATION", formatICSDuration(e.Duration))
+		}
+		if e.What != "" {
+			line("SUMMARY", escapeICSText(e.What))
+		}
+		if e.Where != "" {
+			line("LOCATION", escapeICSText(e.Where))
+		}
+		if e.Recurrence != nil {
+			line("RRULE", e.Recurrence.String())
+		}
+		for _, ex := range e.ExDates {
+			writeICSTime(bw, "EXDATE", ex, e.TZ)
+		}
+		line("END", "VEVENT")
+	}
+	line("END", "VCALENDAR")
+	return bw.Flush()
+}
+
+// writeICSLine записывает строку, разбивая её на части не длиннее 75 октетов
+// (folding): каждая следующая часть начинается с пробела. Многобайтные
+// символы UTF-8 не разрываются.
+func writeICSLine(w *bufio.Writer, s string) {
+	limit := icsLineLimit
+	for len(s) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		w.WriteString(s[:cut])
+		w.WriteString("\r\n ")
+		s = s[cut:]
+		// с учётом пробела в начале строки продолжения
+		limit = icsLineLimit - 1
+	}
+	w.WriteString(s)
+	w.WriteString("\r\n")
+}
+
+// writeICSTime записывает свойство типа DATE-TIME. Для событий с часовым поясом
+// время записывается как местное с параметром TZID, чтобы повторения
+// разворачивались с учётом перехода на летнее время; иначе - в UTC.
+func writeICSTime(w *bufio.Writer, name string, t time.Time, tz string) {
+	loc := icsLocation(tz)
+	if loc == nil {
+		writeICSLine(w, name+":"+t.UTC().Format(icsDateTimeUTC))
+		return
+	}
+	writeICSLine(w, name+";TZID="+tz+":"+t.In(loc).Format(icsDateTime))
+}
+
+// icsLocation возвращает часовой пояс tz, если время в нём записывается с
+// параметром TZID, и nil, если время записывается в UTC.
+func icsLocation(tz string) *time.Location {
+	loc, err := loadLocation(tz)
+	if err != nil || loc == time.UTC {
+		return nil
+	}
+	return loc
+}
+
+// icsZone - часовой пояс событий и промежуток времени, для которого
+// компонент VTIMEZONE должен описывать его смещения.
+type icsZone struct {
+	loc      *time.Location
+	from, to time.Time
+}
+
+// collectICSZones возвращает имена (в порядке первого использования) и промежутки
+// часовых поясов событий. Промежуток покрывает начало, окончание и исключённые
+// даты событий; для повторяющихся событий - до UNTIL, а без него - на
+// icsZoneYears лет вперёд от now.
+func collectICSZones(events []Event, now time.Time) ([]string, map[string]*icsZone) {
+	names := make([]string, 0)
+	zones := make(map[string]*icsZone)
+	for _, e := range events {
+		loc := icsLocation(e.TZ)
+		if loc == nil {
+			continue
+		}
+		end := e.When.Add(e.Duration)
+		for _, ex := range e.ExDates {
+			if ex.After(end) {
+				end = ex
+			}
+		}
+		if r := e.Recurrence; r != nil {
+			until := r.Until
+			if until.IsZero() {
+				until = now.AddDate(icsZoneYears, 0, 0)
+			}
+			if until.After(end) {
+				end = until
+			}
+		}
+		z, ok := zones[e.TZ]
+		if !ok {
+			names = append(names, e.TZ)
+			zones[e.TZ] = &icsZone{loc: loc, from: e.When, to: end}
+			continue
+		}
+		if e.When.Before(z.from) {
+			z.from = e.When
+		}
+		if end.After(z.to) {
+			z.to = end
+		}
+	}
+	return names, zones
+}
+
+// writeVTimezone записывает компонент VTIMEZONE для пояса tzid. Первое описание
+// задаёт смещение с начала года, в котором начинается промежуток z, следующие -
+// каждый переход (летнее/зимнее время) до конца промежутка. Переходы ищутся
+// по базе часовых поясов Go, поэтому описываются явными датами, без RRULE.
+func writeVTimezone(w *bufio.Writer, tzid string, z *icsZone) {
+	line := func(name, value string) {
+		writeICSLine(w, name+":"+value)
+	}
+	observance := func(start time.Time, offsetFrom int) {
+		kind := "STANDARD"
+		if start.IsDST() {
+			kind = "DAYLIGHT"
+		}
+		abbr, offset := start.Zone()
+		line("BEGIN", kind)
+		// DTSTART - местное время перед переходом, то есть со смещением TZOFFSETFROM
+		line("DTSTART", start.UTC().Add(time.Duration(offsetFrom)*time.Second).Format(icsDateTime))
+		line("TZOFFSETFROM", formatICSOffset(offsetFrom))
+		line("TZOFFSETTO", formatICSOffset(offset))
+		line("TZNAME", abbr)
+		line("END", kind)
+	}
+	line("BEGIN", "VTIMEZONE")
+	line("TZID", tzid)
+	start := time.Date(z.from.In(z.loc).Year(), time.January, 1, 0, 0, 0, 0, z.loc)
+	_, offset := start.Zone()
+	observance(start, offset)
+	for t := start; t.Before(z.to); {
+		next := t.AddDate(0, 0, 7)
+		if sameICSZone(t, next) {
+			t = next
+			continue
+		}
+		// переход внутри недели: ищем его с точностью до секунды
+		lo, hi := t.Unix(), next.Unix()
+		for hi-lo > 1 {
+			mid := (lo + hi) / 2
+			if sameICSZone(t, time.Unix(mid, 0).In(z.loc)) {
+				lo = mid
+			} else {
+				hi = mid
+			}
+		}
+		_, offset := t.Zone()
+		t = time.Unix(hi, 0).In(z.loc)
+		observance(t, offset)
+	}
+	line("END", "VTIMEZONE")
+}
+
+// sameICSZone сообщает, действуют ли в моменты a и b одни и те же смещение и
+// обозначение часового пояса.
+func sameICSZone(a, b time.Time) bool {
+	aName, aOffset := a.Zone()
+	bName, bOffset := b.Zone()
+	return aName == bName && aOffset == bOffset
+}
+
+// formatICSOffset форматирует смещение от UTC в секундах как значение UTC-OFFSET
+// (+HHMM или +HHMMSS).
+func formatICSOffset(offset int) string {
+	sign := "+"
+	if offset < 0 {
+		sign = "-"
+		offset = -offset
+	}
+	s := fmt.Sprintf("%s%02d%02d", sign, offset/3600, offset/60%60)
+	if offset%60 != 0 {
+		s += fmt.Sprintf("%02d", offset%60)
+	}
+	return s
+}
+
+// escapeICSText экранирует значение типа TEXT.
+func escapeICSText(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+	return r.Replace(s)
+}
+
+// unescapeICSText восстанавливает экранированное значение типа TEXT.
+func unescapeICSText(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	sb := strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i == len(s)-1 {
+			sb.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n', 'N':
+			sb.WriteByte('\n')
+		default:
+			// \\ \; \, и любые другие экранированные символы
+			sb.WriteByte(s[i])
+		}
+	}
+	return sb.String()
+}
+
+// icsProperty - разобранная строка содержимого iCalendar (content line).
+type icsProperty struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+// parseICSProperty разбирает строку вида NAME;PARAM=VALUE;...:VALUE.
+// Двоеточия и точки с запятой внутри параметров в кавычках не являются разделителями.
+func parseICSProperty(line string) (icsProperty, error) {
+	p := icsProperty{Params: make(map[string]string)}
+	inQuotes := false
+	start := 0
+	var fields []string
+	valueAt := -1
+	for i := 0; i < len(line) && valueAt < 0; i++ {
+		switch c := line[i]; {
+		case c == '"':
+			inQuotes = !inQuotes
+		case inQuotes:
+		case c == ';':
+			fields = append(fields, line[start:i])
+			start = i + 1
+		case c == ':':
+			fields = append(fields, line[start:i])
+			valueAt = i + 1
+		}
+	}
+	if valueAt < 0 || len(fields) == 0 || fields[0] == "" {
+		return p, fmt.Errorf("%w: malformed line %q", ErrInvalidICS, line)
+	}
+	p.Name = strings.ToUpper(fields[0])
+	p.Value = line[valueAt:]
+	for _, f := range fields[1:] {
+		k, v, _ := strings.Cut(f, "=")
+		p.Params[strings.ToUpper(k)] = strings.Trim(v, `"`)
+	}
+	return p, nil
+}
+
+// unfoldICS читает строки iCalendar, склеивая перенесённые (folded) строки.
+func unfoldICS(r io.Reader) ([]string, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	lines := make([]string, 0)
+	for sc.Scan() {
+		l := strings.TrimSuffix(sc.Text(), "\r")
+		if len(l) > 0 && (l[0] == ' ' || l[0] == '\t') && len(lines) > 0 {
+			lines[len(lines)-1] += l[1:]
+			continue
+		}
+		if l == "" {
+			continue
+		}
+		lines = append(lines, l)
+	}
+	return lines, sc.Err()
+}
+
+// parseICSTime разбирает значение DATE или DATE-TIME с учётом параметров
+// TZID и VALUE=DATE. Время без TZID и без суффикса Z (floating) считается UTC.
+func parseICSTime(value string, params map[string]string) (time.Time, error) {
+	loc := time.UTC
+	if tzid, ok := params["TZID"]; ok {
+		l, err := loadLocation(tzid)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("unknown TZID %q", tzid)
+		}
+		loc = l
+	}
+	switch {
+	case params["VALUE"] == "DATE" || len(value) == len(icsDate):
+		return time.ParseInLocation(icsDate, value, loc)
+	case strings.HasSuffix(value, "Z"):
+		return time.Parse(icsDateTimeUTC, value)
+	default:
+		return time.ParseInLocation(icsDateTime, value, loc)
+	}
+}
+
+// formatICSDuration записывает длительность в формате DURATION (например PT1H30M, P1DT2H).
+func formatICSDuration(d time.Duration) string {
+	sb := strings.Builder{}
+	sb.WriteString("P")
+	if days := d / (24 * time.Hour); days > 0 {
+		fmt.Fprintf(&sb, "%dD", days)
+		d -= days * 24 * time.Hour
+	}
+	if d == 0 {
+		if sb.Len() == 1 {
+			return "PT0S"
+		}
+		return sb.String()
+	}
+	sb.WriteString("T")
+	for _, u := range []struct {
+		unit   time.Duration
+		suffix string
+	}{{time.Hour, "H"}, {time.Minute, "M"}, {time.Second, "S"}} {
+		if n := d / u.unit; n > 0 {
+			fmt.Fprintf(&sb, "%d%s", n, u.suffix)
+			d -= n * u.unit
+		}
+	}
+	return sb.String()
+}
+
+// parseICSDuration разбирает значение типа DURATION: P[n]W или P[n]D[T[n]H[n]M[n]S].
+// Отрицательные длительности не поддерживаются.
+func parseICSDuration(s string) (time.Duration, error) {
+	rest, ok := strings.CutPrefix(strings.TrimPrefix(s, "+"), "P")
+	if !ok || rest == "" {
+		return 0, fmt.Errorf("incorrect duration %q", s)
+	}
+	var d time.Duration
+	inTime := false
+	units := map[bool]map[byte]time.Duration{
+		false: {'W': 7 * 24 * time.Hour, 'D': 24 * time.Hour},
+		true:  {'H': time.Hour, 'M': time.Minute, 'S': time.Second},
+	}
+	num := ""
+	parsed := false
+	for i := 0; i < len(rest); i++ {
+		ch := rest[i]
+		switch {
+		case ch >= '0' && ch <= '9':
+			num += string(ch)
+		case ch == 'T' && !inTime && num == "":
+			inTime = true
+		default:
+			unit, ok := units[inTime][ch]
+			if !ok || num == "" {
+				return 0, fmt.Errorf("incorrect duration %q", s)
+			}
+			n, err := strconv.Atoi(num)
+			if err != nil {
+				return 0, fmt.Errorf("incorrect duration %q", s)
+			}
+			d += time.Duration(n) * unit
+			num = ""
+			parsed = true
+		}
+	}
+	if num != "" || !parsed {
+		return 0, fmt.Errorf("incorrect duration %q", s)
+	}
+	return d, nil
+}
+
+// DecodeICS разбирает файл iCalendar и возвращает события из компонентов VEVENT.
+// Компоненты, которые не удалось разобрать, пропускаются и описываются в списке
+// ошибок. Ошибка возвращается, если файл не является календарём в целом.
+// UserID у возвращаемых событий не заполняется, ID - только если UID события
+// является UUID (или UID отсутствует - тогда ID новый).
+func DecodeICS(r io.Reader) ([]ICSEntry, []ICSItemError, error) {
+	lines, err := unfoldICS(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidICS, err)
+	}
+	if len(lines) == 0 || !strings.EqualFold(lines[0], "BEGIN:VCALENDAR") {
+		return nil, nil, fmt.Errorf("%w: missing BEGIN:VCALENDAR", ErrInvalidICS)
+	}
+	entries := make([]ICSEntry, 0)
+	itemErrors := make([]ICSItemError, 0)
+	item := -1
+	var props []icsProperty
+	// depth - уровень вложенности компонентов внутри VEVENT (например, VALARM).
+	depth := 0
+	inEvent := false
+	for _, l := range lines[1:] {
+		p, err := parseICSProperty(l)
+		if err != nil {
+			if inEvent {
+				props = append(props, icsProperty{Name: "X-INVALID", Value: l})
+			}
+			continue
+		}
+		switch {
+		case p.Name == "BEGIN" && strings.EqualFold(p.Value, "VEVENT") && !inEvent:
+			inEvent = true
+			item++
+			props = props[:0]
+		case p.Name == "END" && strings.EqualFold(p.Value, "VEVENT") && inEvent && depth == 0:
+			inEvent = false
+			e, uid, err := eventFromICS(props)
+			if err != nil {
+				itemErrors = append(itemErrors, ICSItemError{Item: item, UID: uid, Error: err.Error()})
+				continue
+			}
+			entries = append(entries, ICSEntry{Item: item, UID: uid, Event: e})
+		case !inEvent:
+			// свойства календаря и прочие компоненты (VTIMEZONE, VTODO) не импортируются
+		case p.Name == "BEGIN":
+			depth++
+		case p.Name == "END":
+			depth--
+		case depth == 0:
+			props = append(props, p)
+		}
+	}
+	if inEvent {
+		itemErrors = append(itemErrors, ICSItemError{Item: item, Error: "unterminated VEVENT"})
+	}
+	return entries, itemErrors, nil
+}
+
+// eventFromICS собирает событие из свойств одного VEVENT.
+func eventFromICS(props []icsProperty) (Event, string, error) {
+	var e Event
+	var uid string
+	var hasStart bool
+	var end time.Time
+	var rrule string
+	for _, p := range props {
+		switch p.Name {
+		case "X-INVALID":
+			return e, uid, fmt.Errorf("malformed line %q", p.Value)
+		case "UID":
+			uid = p.Value
+		case "DTSTART":
+			t, err := parseICSTime(p.Value, p.Params)
+			if err != nil {
+				return e, uid, fmt.Errorf("incorrect DTSTART: %v", err)
+			}
+			e.When = t
+			e.TZ = p.Params["TZID"]
+			hasStart = true
+		case "DTEND":
+			t, err := parseICSTime(p.Value, p.Params)
+			if err != nil {
+				return e, uid, fmt.Errorf("incorrect DTEND: %v", err)
+			}
+			end = t
+		case "DURATION":
+			d, err := parseICSDuration(p.Value)
+			if err != nil {
+				return e, uid, err
+			}
+			e.Duration = d
+		case "SUMMARY":
+			e.What = unescapeICSText(p.Value)
+		case "LOCATION":
+			e.Where = unescapeICSText(p.Value)
+		case "RRULE":
+			// разбирается после DTSTART, который может идти позже
+			rrule = p.Value
+		case "EXDATE":
+			for _, v := range strings.Split(p.Value, ",") {
+				t, err := parseICSTime(v, p.Params)
+				if err != nil {
+					return e, uid, fmt.Errorf("incorrect EXDATE: %v", err)
+				}
+				e.ExDates = append(e.ExDates, t)
+			}
+		}
+	}
+	if !hasStart {
+		return e, uid, errors.New("missing DTSTART")
+	}
+	if rrule != "" {
+		r, err := ParseEventRRule(rrule, e.When)
+		if err != nil {
+			return e, uid, err
+		}
+		e.Recurrence = r
+	}
+	if !end.IsZero() {
+		e.Duration = end.Sub(e.When)
+	}
+	if err := validateDuration(e.Duration); err != nil {
+		return e, uid, err
+	}
+	switch id, err := uuid.Parse(uid); {
+	case uid == "":
+		e.ID = uuid.New()
+	case err == nil:
+		e.ID = id
+	}
+	return e, uid, nil
+}
+
+// icsEventID возвращает ID события пользователя userID для UID из файла iCalendar.
+// ID зависит от пользователя: одно и то же приглашение, импортированное
+// несколькими участниками, становится отдельным событием каждого из них.
+func icsEventID(userID uuid.UUID, uid string) uuid.UUID {
+	return uuid.NewSHA1(icsUIDNamespace, append(userID[:], uid...))
+}
+
+// ImportEvents сохраняет прочитанные из iCalendar события пользователя userID.
+// Событие, уже имеющееся в хранилище, перезаписывается новой версией, если принадлежит
+// тому же пользователю. UID, не являющийся UUID, или UUID события другого пользователя
+// (например, экспортированного организатором) превращается в ID с помощью icsEventID.
+// Возвращает количество сохранённых событий и ошибки по отдельным элементам.
+func ImportEvents(s EventStorage, userID uuid.UUID, entries []ICSEntry) (int, []ICSItemError) {
+	imported := 0
+	itemErrors := make([]ICSItemError, 0)
+	for _, entry := range entries {
+		e := entry.Event
+		if e.ID == uuid.Nil {
+			e.ID = icsEventID(userID, entry.UID)
+		} else if existing, err := getAnyEvent(s, e.ID); err == nil && existing.UserID != userID {
+			e.ID = icsEventID(userID, entry.UID)
+		}
+		e.UserID = userID
+		e.Version = 1
+		e.ModifiedBy = userID
+		err := s.Add(e)
+		if errors.Is(err, ErrEventAlreadyExists) {
+			var existing Event
+			if existing, err = s.Get(e.ID); err == nil {
+				if existing.UserID != userID {
+					err = errors.New("event with the same UID belongs to another user")
+				} else {
+					// участники и напоминания в iCalendar не разбираются
+					e.Attendees = existing.Attendees
+					e.Reminders = existing.Reminders
+					e.Version = existing.Version + 1
+					err = s.Update(e)
+				}
+			} else if errors.Is(err, ErrEventNotFound) {
+				err = errors.New("event with the same UID is in the trash")
+			}
+		}
+		if err != nil {
+			itemErrors = append(itemErrors, ICSItemError{Item: entry.Item, UID: entry.UID, Error: err.Error()})
+			continue
+		}
+		imported++
+	}
+	return imported, itemErrors
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestICSRoundTrip(t *testing.T) {
+	rule, err := ParseRRule("FREQ=WEEKLY;BYDAY=MO,FR;COUNT=4")
+	require.NoError(t, err)
+	events := []Event{
+		{
+			ID:         uuid.New(),
+			When:       mustTime(t, "03.01.2022 10:00"),
+			Where:      "Переговорная 1; этаж 2, корпус \"Б\"",
+			What:       strings.Repeat("Очень длинное описание встречи, ", 5) + "\nвторая строка\\",
+			Recurrence: rule,
+			ExDates:    []time.Time{mustTime(t, "07.01.2022 10:00")},
+			Duration:   26*time.Hour + 90*time.Minute,
+		},
+		{
+			ID:   uuid.New(),
+			When: mustTime(t, "31.12.2021 23:55"),
+		},
+	}
+	buf := &bytes.Buffer{}
+	require.NoError(t, EncodeICS(buf, events))
+
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\r\n"), "\r\n") {
+		assert.LessOrEqual(t, len(line), icsLineLimit, line)
+	}
+
+	entries, itemErrors, err := DecodeICS(buf)
+	require.NoError(t, err)
+	assert.Empty(t, itemErrors)
+	require.Equal(t, len(events), len(entries))
+	for i, entry := range entries {
+		assert.Equal(t, i, entry.Item)
+		assert.Equal(t, events[i].ID, entry.Event.ID)
+		assert.True(t, events[i].When.Equal(entry.Event.When))
+		assert.Equal(t, events[i].What, entry.Event.What)
+		assert.Equal(t, events[i].Where, entry.Event.Where)
+		assert.Equal(t, events[i].Recurrence, entry.Event.Recurrence)
+		assert.Equal(t, len(events[i].ExDates), len(entry.Event.ExDates))
+		assert.Equal(t, events[i].Duration, entry.Event.Duration)
+	}
+}
+
+// TestICSTimezone проверяет, что для каждого TZID экспорт описывает часовой
+// пояс компонентом VTIMEZONE с переходами на летнее и зимнее время.
+func TestICSTimezone(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	require.NoError(t, err)
+	rule, err := ParseRRule("FREQ=WEEKLY;UNTIL=20221231T000000Z")
+	require.NoError(t, err)
+	events := []Event{
+		{ID: uuid.New(), When: time.Date(2022, 1, 10, 9, 0, 0, 0, berlin), TZ: "Europe/Berlin", Recurrence: rule},
+		{ID: uuid.New(), When: time.Date(2022, 3, 1, 9, 0, 0, 0, berlin), TZ: "Europe/Berlin"},
+		{ID: uuid.New(), When: mustTime(t, "03.01.2022 10:00"), TZ: "Asia/Tokyo"},
+		{ID: uuid.New(), When: mustTime(t, "03.01.2022 10:00")},
+	}
+	buf := &bytes.Buffer{}
+	require.NoError(t, EncodeICS(buf, events))
+	data := buf.String()
+
+	assert.Equal(t, 2, strings.Count(data, "BEGIN:VTIMEZONE\r\n"))
+	assert.Less(t, strings.Index(data, "END:VTIMEZONE"), strings.Index(data, "BEGIN:VEVENT"))
+	assert.Contains(t, data, "BEGIN:VTIMEZONE\r\nTZID:Europe/Berlin\r\n"+
+		"BEGIN:STANDARD\r\nDTSTART:20220101T000000\r\nTZOFFSETFROM:+0100\r\nTZOFFSETTO:+0100\r\nTZNAME:CET\r\nEND:STANDARD\r\n"+
+		"BEGIN:DAYLIGHT\r\nDTSTART:20220327T020000\r\nTZOFFSETFROM:+0100\r\nTZOFFSETTO:+0200\r\nTZNAME:CEST\r\nEND:DAYLIGHT\r\n"+
+		"BEGIN:STANDARD\r\nDTSTART:20221030T030000\r\nTZOFFSETFROM:+0200\r\nTZOFFSETTO:+0100\r\nTZNAME:CET\r\nEND:STANDARD\r\n"+
+		"END:VTIMEZONE\r\n")
+	assert.Contains(t, data, "TZID:Asia/Tokyo\r\nBEGIN:STANDARD\r\nDTSTART:20220101T000000\r\nTZOFFSETFROM:+0900\r\nTZOFFSETTO:+0900\r\n")
+	assert.Contains(t, data, "DTSTART;TZID=Europe/Berlin:20220110T090000\r\n")
+
+	entries, itemErrors, err := DecodeICS(buf)
+	require.NoError(t, err)
+	assert.Empty(t, itemErrors)
+	require.Equal(t, len(events), len(entries))
+	for i, entry := range entries {
+		assert.True(t, events[i].When.Equal(entry.Event.When))
+		assert.Equal(t, events[i].TZ, entry.Event.TZ)
+	}
+	assert.Equal(t, "-0330", formatICSOffset(-3*3600-30*60))
+	assert.Equal(t, "+005328", formatICSOffset(53*60+28))
+}
+
+func TestICSDuration(t *testing.T) {
+	tt := []struct {
+		s       string
+		want    time.Duration
+		wantErr bool
+	}{
+		{s: "PT1H30M", want: 90 * time.Minute},
+		{s: "P1DT2H", want: 26 * time.Hour},
+		{s: "P2W", want: 14 * 24 * time.Hour},
+		{s: "PT45S", want: 45 * time.Second},
+		{s: "P", wantErr: true},
+		{s: "PT", wantErr: true},
+		{s: "-PT1H", wantErr: true},
+		{s: "P1H", wantErr: true},
+		{s: "PT1", wantErr: true},
+	}
+	for _, tc := range tt {
+		d, err := parseICSDuration(tc.s)
+		if tc.wantErr {
+			assert.Error(t, err, tc.s)
+			continue
+		}
+		require.NoError(t, err, tc.s)
+		assert.Equal(t, tc.want, d, tc.s)
+		assert.Equal(t, tc.want, mustICSDuration(t, formatICSDuration(d)), tc.s)
+	}
+}
+
+// mustICSDuration - разбор длительности iCalendar для тестов.
+func mustICSDuration(t *testing.T, s string) time.Duration {
+	d, err := parseICSDuration(s)
+	require.NoError(t, err)
+	return d
+}
+
+func TestDecodeICS(t *testing.T) {
+	const data = "BEGIN:VCALENDAR\r\n" +
+		"VERSION:2.0\r\n" +
+		"BEGIN:VTIMEZONE\r\nTZID:Europe/Berlin\r\nEND:VTIMEZONE\r\n" +
+		// TZID, перенос строки и экранирование
+		"BEGIN:VEVENT\r\n" +
+		"UID:meeting-1@example.com\r\n" +
+		"DTSTART;TZID=\"Europe/Berlin\":20220110T090000\r\n" +
+		"SUMMARY:Планёрка\\, обсуж\r\n дение релиза\r\n" +
+		"BEGIN:VALARM\r\nACTION:DISPLAY\r\nSUMMARY:напоминание\r\nEND:VALARM\r\n" +
+		"END:VEVENT\r\n" +
+		// нет DTSTART
+		"BEGIN:VEVENT\r\n" +
+		"UID:broken-1\r\n" +
+		"SUMMARY:без даты\r\n" +
+		"END:VEVENT\r\n" +
+		// некорректное правило повторения
+		"BEGIN:VEVENT\r\n" +
+		"UID:broken-2\r\n" +
+		"DTSTART:20220110T090000Z\r\n" +
+		"RRULE:FREQ=HOURLY\r\n" +
+		"END:VEVENT\r\n" +
+		// весь день
+		"BEGIN:VEVENT\r\n" +
+		"DTSTART;VALUE=DATE:20220301\r\n" +
+		"LOCATION:Клуб 9х9\r\n" +
+		"END:VEVENT\r\n" +
+		"END:VCALENDAR\r\n"
+
+	entries, itemErrors, err := DecodeICS(strings.NewReader(data))
+	require.NoError(t, err)
+	require.Equal(t, 2, len(entries))
+
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	require.NoError(t, err)
+	assert.Equal(t, 0, entries[0].Item)
+	assert.Equal(t, "meeting-1@example.com", entries[0].UID)
+	assert.Equal(t, uuid.Nil, entries[0].Event.ID)
+	assert.True(t, time.Date(2022, 1, 10, 9, 0, 0, 0, berlin).Equal(entries[0].Event.When))
+	assert.Equal(t, "Планёрка, обсуждение релиза", entries[0].Event.What)
+	assert.Equal(t, "Europe/Berlin", entries[0].Event.TZ)
+
+	assert.Equal(t, 3, entries[1].Item)
+	assert.Equal(t, "Клуб 9х9", entries[1].Event.Where)
+	assert.True(t, mustTime(t, "01.03.2022 00:00").Equal(entries[1].Event.When))
+
+	require.Equal(t, 2, len(itemErrors))
+	assert.Equal(t, ICSItemError{Item: 1, UID: "broken-1", Error: "missing DTSTART"}, itemErrors[0])
+	assert.Equal(t, 2, itemErrors[1].Item)
+	assert.Equal(t, "broken-2", itemErrors[1].UID)
+
+	_, _, err = DecodeICS(strings.NewReader("hello"))
+	assert.ErrorIs(t, err, ErrInvalidICS)
+}
+
+func TestICSHandlers(t *testing.T) {
+	storage := newTestStorage()
+	api := NewCalendar(storage)
+	userID := uuid.New()
+	otherID := uuid.New()
+	foreign := Event{ID: uuid.New(), UserID: otherID, When: mustTime(t, "01.01.2022 10:00")}
+	require.NoError(t, storage.Add(foreign))
+
+	data := "BEGIN:VCALENDAR\r\n" +
+		"BEGIN:VEVENT\r\nUID:standup\r\nDTSTART:20220103T100000Z\r\nSUMMARY:Стендап\r\nRRULE:FREQ=DAILY;COUNT=5\r\nEND:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\nUID:" + foreign.ID.String() + "\r\nDTSTART:20220104T100000Z\r\nEND:VEVENT\r\n" +
+		"END:VCALENDAR\r\n"
+
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	require.NoError(t, mw.WriteField("user_id", userID.String()))
+	fw, err := mw.CreateFormFile("file", "calendar.ics")
+	require.NoError(t, err)
+	fw.Write([]byte(data))
+	require.NoError(t, mw.Close())
+
+	req := httptest.NewRequest(http.MethodPost, "/import_ics", body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rec := httptest.NewRecorder()
+	api.ImportICS(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var res struct {
+		Result struct {
+			Imported int
+			Errors   []ICSItemError
+		}
+	}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&res))
+	// событие другого пользователя с тем же UID не перезаписывается,
+	// а импортируется как отдельное событие
+	assert.Equal(t, 2, res.Result.Imported)
+	assert.Equal(t, 0, len(res.Result.Errors))
+	stored, err := storage.Get(foreign.ID)
+	require.NoError(t, err)
+	assert.Equal(t, otherID, stored.UserID)
+	_, err = storage.Get(icsEventID(userID, foreign.ID.String()))
+	assert.NoError(t, err)
+
+	// повторный импорт телом text/calendar перезаписывает событие
+	req = httptest.NewRequest(http.MethodPost, "/import_ics?user_id="+userID.String(), strings.NewReader(data))
+	req.Header.Set("Content-Type", "text/calendar")
+	rec = httptest.NewRecorder()
+	api.ImportICS(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	events, err := storage.GetByUser(userID)
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(events))
+
+	req = httptest.NewRequest(http.MethodGet, fmt.Sprintf("/export.ics?user_id=%s", userID), nil)
+	rec = httptest.NewRecorder()
+	api.ExportICS(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Header().Get("Content-Type"), "text/calendar")
+	exported := rec.Body.String()
+	assert.Contains(t, exported, "SUMMARY:Стендап\r\n")
+	assert.Contains(t, exported, "RRULE:FREQ=DAILY;COUNT=5\r\n")
+	assert.NotContains(t, exported, foreign.ID.String())
+
+	req = httptest.NewRequest(http.MethodPost, "/import_ics?user_id="+userID.String(), strings.NewReader("not a calendar"))
+	req.Header.Set("Content-Type", "text/calendar")
+	rec = httptest.NewRecorder()
+	api.ImportICS(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+// TestImportSharedInvitation проверяет, что одно и то же приглашение импортируют
+// все участники, а повторный импорт собственного экспорта не создаёт копий.
+func TestImportSharedInvitation(t *testing.T) {
+	storage := newTestStorage()
+	alice, bob := uuid.New(), uuid.New()
+	invite := "BEGIN:VCALENDAR\r\n" +
+		"BEGIN:VEVENT\r\nUID:sync-42@example.com\r\nDTSTART:20220110T090000Z\r\nSUMMARY:Созвон\r\nEND:VEVENT\r\n" +
+		"END:VCALENDAR\r\n"
+	for _, userID := range []uuid.UUID{alice, bob, alice} {
+		entries, _, err := DecodeICS(strings.NewReader(invite))
+		require.NoError(t, err)
+		imported, itemErrors := ImportEvents(storage, userID, entries)
+		assert.Equal(t, 1, imported)
+		assert.Empty(t, itemErrors)
+	}
+	for _, userID := range []uuid.UUID{alice, bob} {
+		events, err := storage.GetByUser(userID)
+		require.NoError(t, err)
+		require.Equal(t, 1, len(events))
+		assert.Equal(t, icsEventID(userID, "sync-42@example.com"), events[0].ID)
+	}
+
+	buf := &bytes.Buffer{}
+	events, err := storage.GetByUser(bob)
+	require.NoError(t, err)
+	require.NoError(t, EncodeICS(buf, events))
+	entries, _, err := DecodeICS(buf)
+	require.NoError(t, err)
+	imported, itemErrors := ImportEvents(storage, bob, entries)
+	assert.Equal(t, 1, imported)
+	assert.Empty(t, itemErrors)
+	reimported, err := storage.GetByUser(bob)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(reimported))
+	assert.Equal(t, events[0].ID, reimported[0].ID)
+	assert.Equal(t, events[0].Version+1, reimported[0].Version)
+}
+
+// TestImportKeepsAttendeesAndReminders проверяет, что повторный импорт
+// собственного экспорта не теряет участников и напоминания.
+func TestImportKeepsAttendeesAndReminders(t *testing.T) {
+	storage := newTestStorage()
+	alice, bob := uuid.New(), uuid.New()
+	e := Event{
+		ID: uuid.New(), UserID: alice, When: mustTime(t, "10.01.2022 09:00"), What: "Созвон",
+		Reminders: []time.Duration{15 * time.Minute},
+		Attendees: []Attendee{{UserID: bob, Status: RSVPAccepted}},
+		Version:   1,
+	}
+	require.NoError(t, storage.Add(e))
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, EncodeICS(buf, []Event{e}))
+	entries, _, err := DecodeICS(buf)
+	require.NoError(t, err)
+	imported, itemErrors := ImportEvents(storage, alice, entries)
+	assert.Equal(t, 1, imported)
+	assert.Empty(t, itemErrors)
+
+	stored, err := storage.Get(e.ID)
+	require.NoError(t, err)
+	assert.Equal(t, e.Version+1, stored.Version)
+	assert.Equal(t, e.Reminders, stored.Reminders)
+	assert.Equal(t, e.Attendees, stored.Attendees)
+}
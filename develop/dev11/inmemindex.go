@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// indexStripes - число полос индекса; у каждой полосы своя блокировка.
+	indexStripes = 64
+	// skipListMaxLevel - наибольшая высота узла списка с пропусками
+	// (при skipListP = 1/4 достаточно для 4^16 элементов).
+	skipListMaxLevel = 16
+	// skipListP - вероятность того, что узел поднимается на следующий уровень.
+	skipListP = 0.25
+)
+
+// eventIndex - индекс событий InmemEventStorage для выборок по диапазону дат.
+// Для каждого пользователя хранятся события, организатором или участником
+// которых он является: однократные - в списке с пропусками, упорядоченном по
+// началу, повторяющиеся - отдельно (их обычно немного, и конец серии с COUNT
+// заранее не известен). Поэтому выборка за период стоит O(log n + k), где n -
+// число событий пользователя, а k - число найденных.
+//
+// Пользователи распределены по полосам (lock striping): запросы разных
+// пользователей не ждут друг друга, а изменение события блокирует только
+// полосы его организатора и участников. В корзине события не индексируются.
+//
+// Отдельно хранятся события с напоминаниями: планировщик напоминаний выбирает
+// их за период без перебора событий всех пользователей.
+type eventIndex struct {
+	stripes [indexStripes]indexStripe
+	// reminding - события с напоминаниями; защищены remindingMu.
+	remindingMu sync.RWMutex
+	reminding   *userIndex
+}
+
+// indexStripe - полоса индекса: события пользователей, попавших в неё.
+type indexStripe struct {
+	mu    sync.RWMutex
+	users map[uuid.UUID]*userIndex
+}
+
+// userIndex - события пользователя в индексе.
+type userIndex struct {
+	// single - однократные события, упорядоченные по началу и ID.
+	single *skipList
+	// series - повторяющиеся события по ID.
+	series map[uuid.UUID]Event
+}
+
+// newEventIndex создаёт пустой индекс.
+func newEventIndex() *eventIndex {
+	idx := &eventIndex{reminding: newUserIndex()}
+	for i := range idx.stripes {
+		idx.stripes[i].users = make(map[uuid.UUID]*userIndex)
+	}
+	return idx
+}
+
+func newUserIndex() *userIndex {
+	return &userIndex{single: newSkipList(), series: make(map[uuid.UUID]Event)}
+}
+
+// stripe возвращает полосу пользователя.
+func (idx *eventIndex) stripe(userID uuid.UUID) *indexStripe {
+	h := fnv.New32a()
+	h.Write(userID[:])
+	return &idx.stripes[h.Sum32()%indexStripes]
+}
+
+// update переводит индекс от прежнего состояния события old к новому e
+// (nil - события нет). Изменения одного пользователя применяются под одной
+// блокировкой, поэтому запрос не застанет событие удалённым, но ещё не добавленным.
+func (idx *eventIndex) update(old, e *Event) {
+	if old != nil && old.trashed() {
+		old = nil
+	}
+	if e != nil && e.trashed() {
+		e = nil
+	}
+	for _, userID := range indexUsers(old, e) {
+		st := idx.stripe(userID)
+		st.mu.Lock()
+		ui := st.users[userID]
+		if ui == nil {
+			ui = newUserIndex()
+			st.users[userID] = ui
+		}
+		if old != nil && old.involves(userID) {
+			ui.remove(*old)
+		}
+		if e != nil && e.involves(userID) {
+			ui.add(*e)
+		}
+		if ui.single.len == 0 && len(ui.series) == 0 {
+			delete(st.users, userID)
+		}
+		st.mu.Unlock()
+	}
+	if (old != nil && len(old.Reminders) > 0) || (e != nil && len(e.Reminders) > 0) {
+		idx.remindingMu.Lock()
+		if old != nil && len(old.Reminders) > 0 {
+			idx.reminding.remove(*old)
+		}
+		if e != nil && len(e.Reminders) > 0 {
+			idx.reminding.add(*e)
+		}
+		idx.remindingMu.Unlock()
+	}
+}
+
+// indexUsers возвращает организаторов и участников событий без повторов.
+func indexUsers(events ...*Event) []uuid.UUID {
+	seen := make(map[uuid.UUID]bool)
+	result := make([]uuid.UUID, 0)
+	for _, e := range events {
+		if e == nil {
+			continue
+		}
+		for _, id := range append([]uuid.UUID{e.UserID}, attendeeIDs(e.Attendees)...) {
+			if !seen[id] {
+				seen[id] = true
+				result = append(result, id)
+			}
+		}
+	}
+	return result
+}
+
+// occurrences возвращает вхождения событий пользователя, начинающиеся в отрезке
+// [from, to], кроме событий из skip (изменённых в незафиксированной транзакции).
+// Порядок вхождений не определён.
+func (idx *eventIndex) occurrences(userID uuid.UUID, from, to time.Time, skip map[uuid.UUID]*Event) []Event {
+	st := idx.stripe(userID)
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	result := make([]Event, 0)
+	ui := st.users[userID]
+	if ui == nil {
+		return result
+	}
+	ui.each(from, to, func(e Event) {
+		if _, ok := skip[e.ID]; !ok {
+			result = append(result, e.Expand(from, to)...)
+		}
+	})
+	return result
+}
+
+// remindingEvents возвращает события с напоминаниями, у которых могут быть
+// вхождения, начинающиеся в отрезке [from, to] (повторяющиеся - одним элементом),
+// кроме событий из skip. Порядок событий не определён.
+func (idx *eventIndex) remindingEvents(from, to time.Time, skip map[uuid.UUID]*Event) []Event {
+	idx.remindingMu.RLock()
+	defer idx.remindingMu.RUnlock()
+	result := make([]Event, 0)
+	idx.reminding.each(from, to, func(e Event) {
+		if _, ok := skip[e.ID]; !ok {
+			result = append(result, e)
+		}
+	})
+	return result
+}
+
+// each вызывает fn для событий, у которых могут быть вхождения в отрезке [from, to]:
+// однократных событий, начинающихся в нём, и серий, начавшихся не позже конца
+// отрезка и не закончившихся до его начала.
+func (ui *userIndex) each(from, to time.Time, fn func(Event)) {
+	ui.single.ascend(from, to, fn)
+	for _, e := range ui.series {
+		if e.When.After(to) || (!e.Recurrence.Until.IsZero() && e.Recurrence.Until.Before(from)) {
+			continue
+		}
+		fn(e)
+	}
+}
+
+func (ui *userIndex) add(e Event) {
+	if e.Recurrence != nil {
+		ui.series[e.ID] = e
+		return
+	}
+	ui.single.insert(e)
+}
+
+func (ui *userIndex) remove(e Event) {
+	if e.Recurrence != nil {
+		delete(ui.series, e.ID)
+		return
+	}
+	ui.single.delete(e.When, e.ID)
+}
+
+// skipList - список с пропусками событий, упорядоченный по началу и ID.
+// Не потокобезопасен: доступ защищается блокировкой полосы индекса.
+type skipList struct {
+	head  skipNode
+	level int
+	len   int
+}
+
+// skipNode - узел списка; next[i] - следующий узел на уровне i.
+type skipNode struct {
+	event Event
+	next  []*skipNode
+}
+
+func newSkipList() *skipList {
+	return &skipList{head: skipNode{next: make([]*skipNode, skipListMaxLevel)}, level: 1}
+}
+
+// keyLess сравнивает ключ события с ключом (when, id). ID сравниваются побайтно,
+// что совпадает с порядком их строкового представления в sortOccurrences.
+func keyLess(e Event, when time.Time, id uuid.UUID) bool {
+	if !e.When.Equal(when) {
+		return e.When.Before(when)
+	}
+	return bytes.Compare(e.ID[:], id[:]) < 0
+}
+
+// seek находит на каждом уровне последний узел с ключом меньше (when, id).
+func (l *skipList) seek(when time.Time, id uuid.UUID, update *[skipListMaxLevel]*skipNode) *skipNode {
+	x := &l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && keyLess(x.next[i].event, when, id) {
+			x = x.next[i]
+		}
+		if update != nil {
+			update[i] = x
+		}
+	}
+	return x
+}
+
+// insert добавляет событие либо заменяет событие с тем же ключом.
+func (l *skipList) insert(e Event) {
+	var update [skipListMaxLevel]*skipNode
+	x := l.seek(e.When, e.ID, &update).next[0]
+	if x != nil && x.event.ID == e.ID && x.event.When.Equal(e.When) {
+		x.event = e
+		return
+	}
+	level := 1
+	for level < skipListMaxLevel && rand.Float64() < skipListP {
+		level++
+	}
+	for i := l.level; i < level; i++ {
+		update[i] = &l.head
+	}
+	if level > l.level {
+		l.level = level
+	}
+	n := &skipNode{event: e, next: make([]*skipNode, level)}
+	for i := 0; i < level; i++ {
+		n.next[i] = update[i].next[i]
+		update[i].next[i] = n
+	}
+	l.len++
+}
+
+// delete удаляет событие с ключом (when, id), если оно есть.
+func (l *skipList) delete(when time.Time, id uuid.UUID) {
+	var update [skipListMaxLevel]*skipNode
+	x := l.seek(when, id, &update).next[0]
+	if x == nil || x.event.ID != id || !x.event.When.Equal(when) {
+		return
+	}
+	for i := 0; i < len(x.next); i++ {
+		update[i].next[i] = x.next[i]
+	}
+	for l.level > 1 && l.head.next[l.level-1] == nil {
+		l.level--
+	}
+	l.len--
+}
+
+// ascend вызывает fn для событий, начинающихся в отрезке [from, to], по порядку.
+func (l *skipList) ascend(from, to time.Time, fn func(Event)) {
+	for x := l.seek(from, uuid.Nil, nil).next[0]; x != nil && !x.event.When.After(to); x = x.next[0] {
+		fn(x.event)
+	}
+}
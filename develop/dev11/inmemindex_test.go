@@ -0,0 +1,336 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// scanRange - выборка за период полным перебором repo, как до появления индекса.
+// Служит эталоном в тестах и точкой отсчёта в бенчмарках.
+func scanRange(s *InmemEventStorage, userID uuid.UUID, from, to time.Time) []Event {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	result := make([]Event, 0)
+	for _, event := range s.repo {
+		if event.involves(userID) && !event.trashed() {
+			result = append(result, event.Expand(from, to)...)
+		}
+	}
+	sortOccurrences(result)
+	return result
+}
+
+// randomEvent создаёт событие одного из пользователей users в течение 60 дней
+// от base; часть событий повторяется, у части есть приглашённые.
+func randomEvent(rnd *rand.Rand, users []uuid.UUID, base time.Time) Event {
+	e := Event{
+		ID:     uuid.New(),
+		UserID: users[rnd.Intn(len(users))],
+		When:   base.Add(time.Duration(rnd.Intn(60*24)) * time.Hour),
+	}
+	switch rnd.Intn(10) {
+	case 0:
+		e.Recurrence = &Recurrence{Freq: Daily, Interval: 1, Count: 1 + rnd.Intn(10)}
+	case 1:
+		e.Recurrence = &Recurrence{Freq: Weekly, Interval: 1, Until: e.When.AddDate(0, 0, rnd.Intn(30))}
+	}
+	for i := rnd.Intn(3); i > 0; i-- {
+		if id := users[rnd.Intn(len(users))]; id != e.UserID {
+			e.Attendees = append(e.Attendees, Attendee{UserID: id, Status: RSVPNeedsAction})
+		}
+	}
+	return e
+}
+
+// assertIndexMatchesScan сверяет выборки по индексу с полным перебором.
+func assertIndexMatchesScan(t *testing.T, s *InmemEventStorage, rnd *rand.Rand, users []uuid.UUID, base time.Time) {
+	for _, userID := range users {
+		for i := 0; i < 5; i++ {
+			from := base.Add(time.Duration(rnd.Intn(70*24)-5*24) * time.Hour)
+			to := from.Add(time.Duration(rnd.Intn(20*24)) * time.Hour)
+			got, err := s.GetRange(userID, from, to)
+			require.NoError(t, err)
+			assert.Equal(t, scanRange(s, userID, from, to), got)
+		}
+	}
+}
+
+func TestSkipList(t *testing.T) {
+	base := mustTime(t, "01.03.2022 00:00")
+	l := newSkipList()
+	events := make([]Event, 0)
+	for i := 0; i < 500; i++ {
+		// по два события на каждый момент, чтобы проверить порядок по ID
+		e := Event{ID: uuid.New(), When: base.Add(time.Duration(i/2) * time.Hour)}
+		events = append(events, e)
+		l.insert(e)
+	}
+	assert.Equal(t, 500, l.len)
+
+	// повторная вставка заменяет событие
+	events[101].What = "изменено"
+	l.insert(events[101])
+	assert.Equal(t, 500, l.len)
+
+	for i := 0; i < len(events); i += 3 {
+		l.delete(events[i].When, events[i].ID)
+	}
+	// удаление отсутствующего ключа ничего не меняет
+	l.delete(base, uuid.Nil)
+	l.delete(events[0].When, events[0].ID)
+
+	want := make([]Event, 0)
+	for i, e := range events {
+		if i%3 != 0 && !e.When.Before(base.Add(50*time.Hour)) && !e.When.After(base.Add(100*time.Hour)) {
+			want = append(want, e)
+		}
+	}
+	sortOccurrences(want)
+	got := make([]Event, 0)
+	l.ascend(base.Add(50*time.Hour), base.Add(100*time.Hour), func(e Event) {
+		got = append(got, e)
+	})
+	assert.Equal(t, want, got)
+	assert.Equal(t, 500-167, l.len)
+}
+
+func TestEventIndex(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	base := mustTime(t, "01.03.2022 00:00")
+	users := make([]uuid.UUID, 20)
+	for i := range users {
+		users[i] = uuid.New()
+	}
+	s := newTestStorage()
+	ids := make([]uuid.UUID, 0)
+	for i := 0; i < 2000; i++ {
+		e := randomEvent(rnd, users, base)
+		require.NoError(t, s.Add(e))
+		ids = append(ids, e.ID)
+	}
+	assertIndexMatchesScan(t, s, rnd, users, base)
+
+	// изменения переносят события между пользователями, моментами и видами
+	for i := 0; i < 2000; i++ {
+		id := ids[rnd.Intn(len(ids))]
+		switch rnd.Intn(4) {
+		case 0:
+			require.NoError(t, ignoreNotFound(s.Delete(id)))
+		case 1:
+			require.NoError(t, ignoreNotFound(s.Restore(id)))
+		default:
+			current, err := s.Get(id)
+			if errors.Is(err, ErrEventNotFound) {
+				continue
+			}
+			require.NoError(t, err)
+			e := randomEvent(rnd, users, base)
+			e.ID, e.Version = id, current.Version+1
+			require.NoError(t, s.Update(e))
+		}
+	}
+	assertIndexMatchesScan(t, s, rnd, users, base)
+
+	// очистка корзины удаляет события, которых в индексе уже нет
+	_, err := s.Purge(time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	assertIndexMatchesScan(t, s, rnd, users, base)
+}
+
+// ignoreNotFound пропускает ErrEventNotFound: в случайной последовательности
+// операций событие может быть уже удалено или ещё не удалено.
+func ignoreNotFound(err error) error {
+	if errors.Is(err, ErrEventNotFound) {
+		return nil
+	}
+	return err
+}
+
+func TestEventIndexRecovery(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	base := mustTime(t, "01.03.2022 00:00")
+	users := []uuid.UUID{uuid.New(), uuid.New(), uuid.New()}
+	dir := t.TempDir()
+	s := openTestInmem(t, dir)
+	for i := 0; i < 100; i++ {
+		require.NoError(t, s.Add(randomEvent(rnd, users, base)))
+	}
+	s.saveRepo()
+	for i := 0; i < 100; i++ {
+		require.NoError(t, s.Add(randomEvent(rnd, users, base)))
+	}
+	crash(s)
+
+	// индекс строится по снимку и журналу
+	s = openTestInmem(t, dir)
+	defer s.Close()
+	all, err := s.GetRange(users[0], base.AddDate(-1, 0, 0), base.AddDate(1, 0, 0))
+	require.NoError(t, err)
+	assert.NotEmpty(t, all)
+	assertIndexMatchesScan(t, s, rnd, users, base)
+}
+
+func TestEventIndexTx(t *testing.T) {
+	userID := uuid.New()
+	s := newTestStorage()
+	e1 := Event{ID: uuid.New(), UserID: userID, When: mustTime(t, "03.03.2022 10:00")}
+	e2 := Event{ID: uuid.New(), UserID: userID, When: mustTime(t, "04.03.2022 10:00")}
+	require.NoError(t, s.Add(e1))
+	from, to := mustTime(t, "01.03.2022 00:00"), mustTime(t, "31.03.2022 00:00")
+	moved := e1
+	moved.When, moved.Version = mustTime(t, "05.03.2022 10:00"), e1.Version+1
+
+	errRollback := errors.New("rollback")
+	err := s.Tx(func(tx EventStorage) error {
+		require.NoError(t, tx.Add(e2))
+		require.NoError(t, tx.Update(moved))
+		// транзакция видит свои изменения, индекс - нет
+		got, err := tx.GetRange(userID, from, to)
+		require.NoError(t, err)
+		assert.Equal(t, []Event{e2, moved}, got)
+		assert.Equal(t, []Event{e1}, s.index.occurrences(userID, from, to, nil))
+		return errRollback
+	})
+	assert.ErrorIs(t, err, errRollback)
+	got, err := s.GetRange(userID, from, to)
+	require.NoError(t, err)
+	assert.Equal(t, []Event{e1}, got)
+
+	require.NoError(t, s.Tx(func(tx EventStorage) error {
+		require.NoError(t, tx.Add(e2))
+		require.NoError(t, tx.Update(moved))
+		return tx.Delete(e2.ID)
+	}))
+	got, err = s.GetRange(userID, from, to)
+	require.NoError(t, err)
+	assert.Equal(t, []Event{moved}, got)
+	assert.Equal(t, scanRange(s, userID, from, to), got)
+}
+
+func TestEventIndexConcurrent(t *testing.T) {
+	base := mustTime(t, "01.03.2022 00:00")
+	users := make([]uuid.UUID, 8)
+	for i := range users {
+		users[i] = uuid.New()
+	}
+	s := newTestStorage()
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(2)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for i := 0; i < 200; i++ {
+				e := randomEvent(rnd, users, base)
+				assert.NoError(t, s.Add(e))
+				e.When, e.Version = e.When.Add(time.Hour), e.Version+1
+				assert.NoError(t, s.Update(e))
+			}
+		}(int64(w))
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for i := 0; i < 200; i++ {
+				_, err := s.GetForWeek(users[rnd.Intn(len(users))], base.AddDate(0, 0, rnd.Intn(60)))
+				assert.NoError(t, err)
+			}
+		}(int64(w))
+	}
+	wg.Wait()
+	assertIndexMatchesScan(t, s, rand.New(rand.NewSource(3)), users, base)
+}
+
+// benchStorages кеширует заполненные хранилища бенчмарков по числу событий.
+var benchStorages = make(map[int]*InmemEventStorage)
+
+// benchStorage возвращает хранилище из n событий 1000 пользователей за год;
+// каждое двадцатое событие повторяется.
+func benchStorage(n int) (*InmemEventStorage, []uuid.UUID, time.Time) {
+	rnd := rand.New(rand.NewSource(int64(n)))
+	base := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	users := make([]uuid.UUID, 1000)
+	for i := range users {
+		users[i] = uuid.NewSHA1(uuid.Nil, []byte(fmt.Sprint(i)))
+	}
+	if s, ok := benchStorages[n]; ok {
+		return s, users, base
+	}
+	s := newTestStorage()
+	for i := 0; i < n; i++ {
+		e := Event{
+			ID:     uuid.New(),
+			UserID: users[rnd.Intn(len(users))],
+			When:   base.Add(time.Duration(rnd.Intn(365*24*60)) * time.Minute),
+		}
+		if i%20 == 0 {
+			e.Recurrence = &Recurrence{Freq: Weekly, Interval: 1, Count: 10}
+		}
+		s.repo[e.ID] = e
+		s.index.update(nil, &e)
+	}
+	benchStorages[n] = s
+	return s, users, base
+}
+
+// BenchmarkGetRange сравнивает выборку за день и за месяц по индексу с полным
+// перебором repo на 10^5 и 10^6 событий.
+func BenchmarkGetRange(b *testing.B) {
+	for _, n := range []int{100000, 1000000} {
+		for _, period := range []struct {
+			name string
+			d    time.Duration
+		}{{"day", 24 * time.Hour}, {"month", 30 * 24 * time.Hour}} {
+			s, users, base := benchStorage(n)
+			b.Run(fmt.Sprintf("n=%d/%s/scan", n, period.name), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					from := base.AddDate(0, 0, i%300)
+					scanRange(s, users[i%len(users)], from, from.Add(period.d))
+				}
+			})
+			b.Run(fmt.Sprintf("n=%d/%s/index", n, period.name), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					from := base.AddDate(0, 0, i%300)
+					_, _ = s.GetRange(users[i%len(users)], from, from.Add(period.d))
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkGetRangeParallel - выборки за неделю вперемешку с изменениями
+// (одно на десять запросов) из нескольких горутин на 10^5 событий.
+func BenchmarkGetRangeParallel(b *testing.B) {
+	s, users, base := benchStorage(100000)
+	ids := make([]uuid.UUID, 0, len(s.repo))
+	for id := range s.repo {
+		ids = append(ids, id)
+	}
+	var seed int64
+	var seedMu sync.Mutex
+	b.RunParallel(func(pb *testing.PB) {
+		seedMu.Lock()
+		seed++
+		rnd := rand.New(rand.NewSource(seed))
+		seedMu.Unlock()
+		for i := 0; pb.Next(); i++ {
+			if i%10 == 0 {
+				e, err := s.Get(ids[rnd.Intn(len(ids))])
+				if err == nil {
+					e.Version++
+					_ = s.Update(e)
+				}
+				continue
+			}
+			from := base.AddDate(0, 0, rnd.Intn(300))
+			_, _ = s.GetForWeek(users[rnd.Intn(len(users))], from)
+		}
+	})
+}
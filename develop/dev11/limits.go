@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultMaxBodyBytes - максимальный размер тела запроса по умолчанию.
+	defaultMaxBodyBytes = 1 << 20
+	// bucketSweepInterval - как часто удаляются корзины клиентов, успевшие
+	// снова наполниться до burst.
+	bucketSweepInterval = 10 * time.Minute
+)
+
+// tokenBucket - корзина жетонов одного клиента.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter ограничивает частоту запросов по алгоритму token bucket: у каждого
+// клиента есть корзина на burst жетонов, пополняемая со скоростью rate жетонов
+// в секунду; запрос забирает жетон, а при пустой корзине отклоняется с кодом
+// 429 и заголовком Retry-After. Клиент определяется функцией key; запросы
+// с пустым ключом не ограничиваются.
+type RateLimiter struct {
+	mu      *sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+	key     func(*http.Request) string
+	// lastSweep - время последней очистки неактивных корзин.
+	lastSweep time.Time
+	// now - источник текущего времени (подменяется в тестах).
+	now func() time.Time
+}
+
+// NewRateLimiter создаёт ограничитель с ключом клиента key. До вызова Configure
+// запросы не ограничиваются.
+func NewRateLimiter(key func(*http.Request) string) *RateLimiter {
+	return &RateLimiter{
+		mu:      &sync.Mutex{},
+		buckets: make(map[string]*tokenBucket),
+		key:     key,
+		now:     time.Now,
+	}
+}
+
+// Configure задаёт скорость пополнения (запросов в секунду) и размер корзины
+// (при перезагрузке настроек). Нулевая скорость отключает ограничение.
+// Корзины клиентов сохраняются: перезагрузка не пополняет их, а при уменьшении
+// размера лишние жетоны отбрасываются.
+func (l *RateLimiter) Configure(rate float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if rate == l.rate && float64(burst) == l.burst {
+		return
+	}
+	if l.rate <= 0 || rate <= 0 {
+		// ограничение включается или выключается: прежние корзины не нужны
+		l.buckets = make(map[string]*tokenBucket)
+		l.rate, l.burst = rate, float64(burst)
+		return
+	}
+	now := l.now()
+	for _, b := range l.buckets {
+		// жетоны, накопленные при прежней скорости, учитываются до смены настроек
+		b.tokens = math.Min(float64(burst), math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate))
+		b.last = now
+	}
+	l.rate, l.burst = rate, float64(burst)
+}
+
+// allow забирает жетон из корзины клиента key. Если жетонов нет, возвращает
+// время до появления следующего.
+func (l *RateLimiter) allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return true, 0
+	}
+	now := l.now()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep удаляет корзины клиентов, которые с последнего запроса снова наполнились
+// до burst: такая корзина ничем не отличается от новой. Корзина, пополняющаяся
+// медленно (burst/rate больше bucketSweepInterval), остаётся, иначе клиент
+// получил бы полную корзину раньше времени.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < bucketSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Middleware пропускает к next запросы клиентов, не превысивших ограничение.
+func (l *RateLimiter) Middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const logHeader = "rateLimit"
+		key := l.key(r)
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if ok, wait := l.allow(key); !ok {
+			seconds := int(math.Ceil(wait.Seconds()))
+			if seconds < 1 {
+				seconds = 1
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			returnError(w, logHeader, fmt.Sprintf("rate limit exceeded for %s", key), http.StatusTooManyRequests)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// clientIP - ключ ограничителя по IP-адресу клиента.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// requestUser - ключ ограничителя по аутентифицированному пользователю.
+// Если аутентификация выключена, ключ пустой.
+func requestUser(r *http.Request) string {
+	subject, ok := requestSubject(r)
+	if !ok {
+		return ""
+	}
+	return subject.String()
+}
+
+// BodyLimiter ограничивает размер тела запроса. Запрос с заведомо большим
+// телом (по Content-Length) отклоняется с кодом 413, а чтение тела сверх
+// ограничения завершается ошибкой.
+type BodyLimiter struct {
+	mu       *sync.RWMutex
+	maxBytes int64
+}
+
+// NewBodyLimiter создаёт ограничитель размера тела в maxBytes байт.
+func NewBodyLimiter(maxBytes int64) *BodyLimiter {
+	l := &BodyLimiter{mu: &sync.RWMutex{}}
+	l.Configure(maxBytes)
+	return l
+}
+
+// Configure меняет максимальный размер тела (при перезагрузке настроек).
+// Ноль отключает ограничение.
+func (l *BodyLimiter) Configure(maxBytes int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.maxBytes = maxBytes
+}
+
+// Middleware ограничивает размер тела запросов к next. Тело формы
+// (application/x-www-form-urlencoded) разбирается сразу, чтобы слишком большая
+// форма отклонялась с кодом 413, а не выглядела как форма без параметров.
+func (l *BodyLimiter) Middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const logHeader = "bodyLimit"
+		l.mu.RLock()
+		maxBytes := l.maxBytes
+		l.mu.RUnlock()
+		if maxBytes <= 0 {
+			next(w, r)
+			return
+		}
+		if r.ContentLength > maxBytes {
+			returnError(w, logHeader, fmt.Sprintf("request body exceeds %d bytes", maxBytes), http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+		if err := r.ParseForm(); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				returnError(w, logHeader, fmt.Sprintf("request body exceeds %d bytes", maxBytes), http.StatusRequestEntityTooLarge)
+				return
+			}
+			returnError(w, logHeader, fmt.Sprintf("incorrect request: %v", err), http.StatusBadRequest)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiterBucket(t *testing.T) {
+	now := time.Date(2022, 1, 3, 10, 0, 0, 0, time.UTC)
+	l := NewRateLimiter(clientIP)
+	l.now = func() time.Time { return now }
+
+	// без настройки ограничения нет
+	for i := 0; i < 100; i++ {
+		ok, _ := l.allow("a")
+		require.True(t, ok)
+	}
+
+	l.Configure(2, 3)
+	for i := 0; i < 3; i++ {
+		ok, _ := l.allow("a")
+		require.True(t, ok)
+	}
+	ok, wait := l.allow("a")
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+	// у другого клиента своя корзина
+	ok, _ = l.allow("b")
+	assert.True(t, ok)
+
+	// за полсекунды накапливается один жетон, но не больше burst за долгое время
+	now = now.Add(500 * time.Millisecond)
+	ok, _ = l.allow("a")
+	assert.True(t, ok)
+	ok, _ = l.allow("a")
+	assert.False(t, ok)
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		ok, _ := l.allow("a")
+		require.True(t, ok)
+	}
+	ok, _ = l.allow("a")
+	assert.False(t, ok)
+
+	// перезагрузка с теми же настройками не пополняет корзины,
+	// а уменьшение размера отбрасывает лишние жетоны
+	l.Configure(2, 3)
+	ok, _ = l.allow("a")
+	assert.False(t, ok)
+	now = now.Add(time.Second)
+	l.Configure(2, 1)
+	ok, _ = l.allow("a")
+	assert.True(t, ok)
+	ok, _ = l.allow("a")
+	assert.False(t, ok)
+	l.Configure(2, 3)
+	ok, _ = l.allow("a")
+	assert.False(t, ok)
+
+	// снова наполнившиеся корзины удаляются
+	now = now.Add(bucketSweepInterval)
+	l.allow("c")
+	assert.Equal(t, 1, len(l.buckets))
+
+	// медленно пополняемая корзина не удаляется, пока не наполнится
+	l.Configure(0.01, 10)
+	for i := 0; i < 10; i++ {
+		ok, _ := l.allow("d")
+		require.True(t, ok)
+	}
+	now = now.Add(bucketSweepInterval)
+	ok, _ = l.allow("c")
+	assert.True(t, ok)
+	ok, _ = l.allow("d")
+	assert.True(t, ok) // за 600 секунд накопилось 6 жетонов
+	for i := 0; i < 5; i++ {
+		ok, _ := l.allow("d")
+		require.True(t, ok)
+	}
+	ok, _ = l.allow("d")
+	assert.False(t, ok)
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	auth := NewAuthenticator([]byte("secret"), time.Hour)
+	ipLimiter := NewRateLimiter(clientIP)
+	ipLimiter.Configure(0.5, 4)
+	userLimiter := NewRateLimiter(requestUser)
+	userLimiter.Configure(0.5, 2)
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) }
+	server := httptest.NewServer(ipLimiter.Middleware(auth.Middleware(userLimiter.Middleware(ok))))
+	defer server.Close()
+
+	get := func(token string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		require.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+	alice, _, err := auth.IssueToken(uuid.New())
+	require.NoError(t, err)
+	bob, _, err := auth.IssueToken(uuid.New())
+	require.NoError(t, err)
+
+	// у каждого пользователя своя корзина, а общий IP ограничен отдельно
+	assert.Equal(t, http.StatusNoContent, get(alice).StatusCode)
+	assert.Equal(t, http.StatusNoContent, get(alice).StatusCode)
+	resp := get(alice)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "2", resp.Header.Get("Retry-After"))
+	assert.Equal(t, http.StatusNoContent, get(bob).StatusCode)
+	resp = get(bob)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "2", resp.Header.Get("Retry-After"))
+	// жетоны IP израсходованы - отказ даже без токена
+	resp = get("")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+
+	// перезагрузка настроек с нулевой скоростью снимает ограничение
+	ipLimiter.Configure(0, 0)
+	userLimiter.Configure(0, 0)
+	assert.Equal(t, http.StatusNoContent, get(alice).StatusCode)
+}
+
+func TestBodyLimiter(t *testing.T) {
+	limiter := NewBodyLimiter(64)
+	var description string
+	server := httptest.NewServer(limiter.Middleware(func(w http.ResponseWriter, r *http.Request) {
+		description = r.FormValue("description")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	post := func(form url.Values, chunked bool) int {
+		body := strings.NewReader(form.Encode())
+		req, err := http.NewRequest(http.MethodPost, server.URL, body)
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if chunked {
+			// длина тела заранее неизвестна - ограничение срабатывает при чтении
+			req.ContentLength = -1
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusNoContent, post(url.Values{"description": {"Встреча"}}, false))
+	assert.Equal(t, "Встреча", description)
+	long := url.Values{"description": {strings.Repeat("x", 100)}}
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post(long, false))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post(long, true))
+
+	limiter.Configure(0)
+	assert.Equal(t, http.StatusNoContent, post(long, true))
+	assert.Equal(t, long.Get("description"), description)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets - верхние границы корзин гистограммы длительности запросов (секунды).
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metricMethods - методы, которые попадают в метку method как есть; остальные
+// учитываются как OTHER, чтобы клиент не мог создавать сколько угодно рядов.
+var metricMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPost: true, http.MethodPut: true,
+	http.MethodPatch: true, http.MethodDelete: true, http.MethodOptions: true,
+	"PROPFIND": true, "REPORT": true,
+}
+
+// requestKey - метки счётчика запросов.
+type requestKey struct {
+	route, method string
+	status        int
+}
+
+// histogram - гистограмма длительности запросов одного маршрута.
+// counts[i] - количество наблюдений, попавших в корзину i (не накопительно).
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// Metrics собирает счётчики и гистограммы длительности HTTP-запросов
+// и выводит их в текстовом формате Prometheus.
+type Metrics struct {
+	mu        sync.Mutex
+	requests  map[requestKey]uint64
+	latencies map[string]*histogram
+}
+
+// NewMetrics создаёт пустой набор метрик.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests:  make(map[requestKey]uint64),
+		latencies: make(map[string]*histogram),
+	}
+}
+
+// Observe учитывает обработанный запрос. Методы вне metricMethods учитываются как OTHER.
+func (m *Metrics) Observe(route, method string, status int, elapsed time.Duration) {
+	if !metricMethods[method] {
+		method = "OTHER"
+	}
+	seconds := elapsed.Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[requestKey{route: route, method: method, status: status}]++
+	h, ok := m.latencies[route]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.latencies[route] = h
+	}
+	// наблюдения больше последней границы учитываются только в +Inf (count)
+	if i := sort.SearchFloat64s(latencyBuckets, seconds); i < len(latencyBuckets) {
+		h.counts[i]++
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// ServeHTTP выводит метрики в текстовом формате Prometheus (GET /metrics).
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		returnError(w, "metrics", "", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	m.write(bw)
+	bw.Flush()
+}
+
+// write выводит метрики в текстовом формате Prometheus. Серии упорядочены по меткам.
+func (m *Metrics) write(w *bufio.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.status < b.status
+	})
+	fmt.Fprintln(w, "# HELP calendar_http_requests_total Total number of HTTP requests by route, method and status.")
+	fmt.Fprintln(w, "# TYPE calendar_http_requests_total counter")
+	for _, k := range keys {
+		fmt.Fprintf(w, "calendar_http_requests_total{route=%s,method=%s,status=\"%d\"} %d\n",
+			quoteLabel(k.route), quoteLabel(k.method), k.status, m.requests[k])
+	}
+
+	routes := make([]string, 0, len(m.latencies))
+	for route := range m.latencies {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	fmt.Fprintln(w, "# HELP calendar_http_request_duration_seconds HTTP request latency by route.")
+	fmt.Fprintln(w, "# TYPE calendar_http_request_duration_seconds histogram")
+	for _, route := range routes {
+		h := m.latencies[route]
+		label := quoteLabel(route)
+		var cumulative uint64
+		for i, le := range latencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "calendar_http_request_duration_seconds_bucket{route=%s,le=\"%s\"} %d\n",
+				label, strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(w, "calendar_http_request_duration_seconds_bucket{route=%s,le=\"+Inf\"} %d\n", label, h.count)
+		fmt.Fprintf(w, "calendar_http_request_duration_seconds_sum{route=%s} %s\n",
+			label, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "calendar_http_request_duration_seconds_count{route=%s} %d\n", label, h.count)
+	}
+}
+
+// labelEscaper экранирует значение метки по правилам текстового формата Prometheus.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// quoteLabel возвращает значение метки в кавычках.
+func quoteLabel(s string) string {
+	return `"` + labelEscaper.Replace(s) + `"`
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	m := NewMetrics()
+	m.Observe("/create_event", http.MethodPost, http.StatusCreated, 3*time.Millisecond)
+	m.Observe("/create_event", http.MethodPost, http.StatusCreated, 20*time.Millisecond)
+	m.Observe("/create_event", http.MethodPost, http.StatusBadRequest, time.Millisecond)
+	m.Observe(`/we"ird`, http.MethodGet, http.StatusOK, 30*time.Second)
+	// произвольные методы не создают новых рядов
+	m.Observe("/noop", "FOO1", http.StatusMethodNotAllowed, time.Millisecond)
+	m.Observe("/noop", "FOO2", http.StatusMethodNotAllowed, time.Millisecond)
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Header().Get("Content-Type"), "text/plain; version=0.0.4")
+	body := rec.Body.String()
+
+	expected := []string{
+		"# TYPE calendar_http_requests_total counter",
+		`calendar_http_requests_total{route="/create_event",method="POST",status="201"} 2`,
+		`calendar_http_requests_total{route="/create_event",method="POST",status="400"} 1`,
+		`calendar_http_requests_total{route="/we\"ird",method="GET",status="200"} 1`,
+		`calendar_http_requests_total{route="/noop",method="OTHER",status="405"} 2`,
+		"# TYPE calendar_http_request_duration_seconds histogram",
+		`calendar_http_request_duration_seconds_bucket{route="/create_event",le="0.001"} 1`,
+		`calendar_http_request_duration_seconds_bucket{route="/create_event",le="0.005"} 2`,
+		`calendar_http_request_duration_seconds_bucket{route="/create_event",le="0.025"} 3`,
+		`calendar_http_request_duration_seconds_bucket{route="/create_event",le="+Inf"} 3`,
+		`calendar_http_request_duration_seconds_sum{route="/create_event"} 0.024`,
+		`calendar_http_request_duration_seconds_count{route="/create_event"} 3`,
+		`calendar_http_request_duration_seconds_bucket{route="/we\"ird",le="10"} 0`,
+		`calendar_http_request_duration_seconds_bucket{route="/we\"ird",le="+Inf"} 1`,
+	}
+	for _, line := range expected {
+		assert.Contains(t, body, line+"\n")
+	}
+	// серии выводятся в порядке меток
+	assert.Less(t, strings.Index(body, `status="201"`), strings.Index(body, `status="400"`))
+	assert.NotContains(t, body, "FOO")
+
+	rec = httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/metrics", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
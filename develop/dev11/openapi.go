@@ -0,0 +1,24 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// openAPISpec - описание HTTP API в формате OpenAPI 3 (openapi.json).
+// Ответы обработчиков сверяются с ним в тестах (см. openapi_test.go).
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// ServeOpenAPI отдаёт описание API в формате OpenAPI 3.
+//
+// GET /openapi.json
+func ServeOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		returnError(w, "openAPI", "", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
@@ -0,0 +1,719 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// openAPI - разобранный openapi.json с проверкой запросов и ответов по нему.
+// Поддерживается подмножество JSON Schema, которое используется в описании:
+// $ref, type, nullable, enum, format, pattern, properties, required,
+// additionalProperties, items, minItems, maxItems, minimum, maximum.
+type openAPI struct {
+	doc map[string]interface{}
+	// paths - шаблоны путей и соответствующие им регулярные выражения.
+	paths map[string]*regexp.Regexp
+}
+
+func loadOpenAPI(t *testing.T) *openAPI {
+	spec := &openAPI{paths: make(map[string]*regexp.Regexp)}
+	require.NoError(t, json.Unmarshal(openAPISpec, &spec.doc))
+	for path := range spec.object(spec.doc, "paths") {
+		pattern := regexp.QuoteMeta(path)
+		pattern = regexp.MustCompile(`\\\{[a-z_]+\\\}`).ReplaceAllString(pattern, `[^/]+`)
+		spec.paths[path] = regexp.MustCompile("^" + pattern + "$")
+	}
+	return spec
+}
+
+// object возвращает вложенный объект документа по ключам (nil, если его нет).
+func (s *openAPI) object(node interface{}, keys ...string) map[string]interface{} {
+	for _, k := range keys {
+		m, _ := s.resolve(node).(map[string]interface{})
+		node = m[k]
+	}
+	m, _ := s.resolve(node).(map[string]interface{})
+	return m
+}
+
+// resolve заменяет узел {"$ref": "#/..."} узлом, на который он ссылается.
+func (s *openAPI) resolve(node interface{}) interface{} {
+	for {
+		m, ok := node.(map[string]interface{})
+		if !ok {
+			return node
+		}
+		ref, ok := m["$ref"].(string)
+		if !ok {
+			return node
+		}
+		node = s.doc
+		for _, k := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+			node = node.(map[string]interface{})[k]
+		}
+	}
+}
+
+// operation находит шаблон пути и описание операции запроса.
+func (s *openAPI) operation(method, path string) (string, map[string]interface{}, error) {
+	for template, re := range s.paths {
+		if re.MatchString(path) {
+			op := s.object(s.doc, "paths", template, strings.ToLower(method))
+			if op == nil {
+				return "", nil, fmt.Errorf("%s %s: method is not described", method, template)
+			}
+			return template, op, nil
+		}
+	}
+	return "", nil, fmt.Errorf("%s %s: path is not described", method, path)
+}
+
+// parameters возвращает параметры операции (в том числе общие для пути) по месту и имени.
+func (s *openAPI) parameters(template string, op map[string]interface{}) map[string]map[string]interface{} {
+	result := make(map[string]map[string]interface{})
+	for _, list := range []interface{}{s.object(s.doc, "paths", template)["parameters"], op["parameters"]} {
+		items, _ := list.([]interface{})
+		for _, item := range items {
+			p := s.object(item)
+			result[p["in"].(string)+":"+p["name"].(string)] = p
+		}
+	}
+	return result
+}
+
+// checkRequest проверяет, что запрос описан: все параметры запроса и поля формы
+// документированы, а тип содержимого тела указан в описании. Для корректных
+// запросов (strict) проверяются также обязательные параметры и значения.
+func (s *openAPI) checkRequest(r *http.Request, body []byte, strict bool) error {
+	template, op, err := s.operation(r.Method, r.URL.Path)
+	if err != nil {
+		return err
+	}
+	params := s.parameters(template, op)
+	query := r.URL.Query()
+	for name, values := range query {
+		p, ok := params["query:"+name]
+		if !ok {
+			return fmt.Errorf("%s %s: query parameter %q is not described", r.Method, template, name)
+		}
+		if strict {
+			if err := s.validateParam(p["schema"], values[0], name); err != nil {
+				return err
+			}
+		}
+	}
+	for key, p := range params {
+		if p["required"] == true && p["in"] == "query" && strict && !query.Has(p["name"].(string)) {
+			return fmt.Errorf("%s %s: required parameter %q is missing", r.Method, template, key)
+		}
+	}
+
+	if len(body) == 0 {
+		if rb := s.object(op, "requestBody"); rb != nil && rb["required"] == true {
+			return fmt.Errorf("%s %s: request body is required", r.Method, template)
+		}
+		return nil
+	}
+	mediaType, mediaParams, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return fmt.Errorf("%s %s: %v", r.Method, template, err)
+	}
+	content := s.object(op, "requestBody", "content", mediaType)
+	if content == nil {
+		if !strict {
+			return nil // неподдерживаемый тип содержимого проверяется обработчиком
+		}
+		return fmt.Errorf("%s %s: request content type %q is not described", r.Method, template, mediaType)
+	}
+	schema := s.object(content, "schema")
+	var fields url.Values
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		if fields, err = url.ParseQuery(string(body)); err != nil {
+			return err
+		}
+	case "multipart/form-data":
+		form, err := multipart.NewReader(bytes.NewReader(body), mediaParams["boundary"]).ReadForm(1 << 20)
+		if err != nil {
+			return err
+		}
+		fields = url.Values(form.Value)
+		for name := range form.File {
+			fields.Set(name, "")
+		}
+	default:
+		if !strict || !strings.HasSuffix(mediaType, "json") {
+			return nil
+		}
+		var v interface{}
+		if err := json.Unmarshal(body, &v); err != nil {
+			return err
+		}
+		return s.validate(schema, v, "request")
+	}
+	properties := s.object(schema, "properties")
+	for name, values := range fields {
+		p, ok := properties[name]
+		if !ok {
+			return fmt.Errorf("%s %s: form field %q is not described", r.Method, template, name)
+		}
+		if strict && mediaType != "multipart/form-data" {
+			if err := s.validateParam(p, values[0], name); err != nil {
+				return err
+			}
+		}
+	}
+	if strict {
+		required, _ := schema["required"].([]interface{})
+		for _, name := range required {
+			if _, ok := fields[name.(string)]; !ok && !query.Has(name.(string)) {
+				return fmt.Errorf("%s %s: required field %q is missing", r.Method, template, name)
+			}
+		}
+	}
+	return nil
+}
+
+// validateParam проверяет строковое значение параметра или поля формы.
+func (s *openAPI) validateParam(schema interface{}, value, name string) error {
+	switch s.object(schema)["type"] {
+	case "integer":
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		return s.validate(schema, float64(n), name)
+	case "boolean":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		return s.validate(schema, b, name)
+	}
+	return s.validate(schema, value, name)
+}
+
+// checkResponse проверяет, что код ответа описан для операции, тип содержимого
+// указан в описании ответа, а JSON-тело соответствует схеме.
+func (s *openAPI) checkResponse(r *http.Request, rec *httptest.ResponseRecorder) error {
+	template, op, err := s.operation(r.Method, r.URL.Path)
+	if err != nil {
+		return err
+	}
+	resp := s.object(op, "responses", strconv.Itoa(rec.Code))
+	if resp == nil {
+		return fmt.Errorf("%s %s: status %d is not described", r.Method, template, rec.Code)
+	}
+	// сервер отбрасывает тело ответов 204 и 304
+	if rec.Code == http.StatusNoContent || rec.Code == http.StatusNotModified {
+		return nil
+	}
+	content := s.object(resp, "content")
+	if content == nil {
+		if rec.Body.Len() > 0 {
+			return fmt.Errorf("%s %s %d: unexpected body %q", r.Method, template, rec.Code, rec.Body.String())
+		}
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+	if err != nil {
+		return fmt.Errorf("%s %s %d: %v", r.Method, template, rec.Code, err)
+	}
+	media, ok := content[mediaType]
+	if !ok {
+		return fmt.Errorf("%s %s %d: content type %q is not described", r.Method, template, rec.Code, mediaType)
+	}
+	if mediaType != "application/json" {
+		return nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &v); err != nil {
+		return fmt.Errorf("%s %s %d: %v", r.Method, template, rec.Code, err)
+	}
+	if err := s.validate(s.object(media, "schema"), v, "response"); err != nil {
+		return fmt.Errorf("%s %s %d: %v", r.Method, template, rec.Code, err)
+	}
+	return nil
+}
+
+// validate проверяет значение JSON v по схеме; path - положение значения для сообщений.
+func (s *openAPI) validate(node, v interface{}, path string) error {
+	schema := s.object(node)
+	if schema == nil {
+		return nil
+	}
+	if v == nil {
+		if schema["nullable"] == true || schema["type"] == nil {
+			return nil
+		}
+		return fmt.Errorf("%s: null is not allowed", path)
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			found = found || e == v
+		}
+		if !found {
+			return fmt.Errorf("%s: %v is not one of %v", path, v, enum)
+		}
+	}
+	switch schema["type"] {
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: %v is not an object", path, v)
+		}
+		required, _ := schema["required"].([]interface{})
+		for _, name := range required {
+			if _, ok := obj[name.(string)]; !ok {
+				return fmt.Errorf("%s: required property %q is missing", path, name)
+			}
+		}
+		properties := s.object(schema, "properties")
+		names := make([]string, 0, len(obj))
+		for name := range obj {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			p, ok := properties[name]
+			if !ok {
+				if schema["additionalProperties"] == false {
+					return fmt.Errorf("%s: property %q is not described", path, name)
+				}
+				continue
+			}
+			if err := s.validate(p, obj[name], path+"."+name); err != nil {
+				return err
+			}
+		}
+	case "array":
+		arr, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: %v is not an array", path, v)
+		}
+		if min, ok := schema["minItems"].(float64); ok && float64(len(arr)) < min {
+			return fmt.Errorf("%s: fewer than %v items", path, min)
+		}
+		if max, ok := schema["maxItems"].(float64); ok && float64(len(arr)) > max {
+			return fmt.Errorf("%s: more than %v items", path, max)
+		}
+		for i, item := range arr {
+			if err := s.validate(schema["items"], item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("%s: %v is not a string", path, v)
+		}
+		if pattern, ok := schema["pattern"].(string); ok && !regexp.MustCompile(pattern).MatchString(str) {
+			return fmt.Errorf("%s: %q does not match %s", path, str, pattern)
+		}
+		var err error
+		switch schema["format"] {
+		case "uuid":
+			_, err = uuid.Parse(str)
+		case "date-time":
+			_, err = time.Parse(time.RFC3339, str)
+		case "date":
+			_, err = time.Parse("2006-01-02", str)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %q is not a %s: %v", path, str, schema["format"], err)
+		}
+	case "integer", "number":
+		n, ok := v.(float64)
+		if !ok || (schema["type"] == "integer" && n != float64(int64(n))) {
+			return fmt.Errorf("%s: %v is not an %s", path, v, schema["type"])
+		}
+		if min, ok := schema["minimum"].(float64); ok && n < min {
+			return fmt.Errorf("%s: %v is less than %v", path, n, min)
+		}
+		if max, ok := schema["maximum"].(float64); ok && n > max {
+			return fmt.Errorf("%s: %v is greater than %v", path, n, max)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("%s: %v is not a boolean", path, v)
+		}
+	}
+	return nil
+}
+
+// specClient выполняет запросы к маршрутам сервера и сверяет их с описанием API.
+type specClient struct {
+	t       *testing.T
+	spec    *openAPI
+	handler http.Handler
+	// token - токен доступа для следующих запросов (пустой - без аутентификации).
+	token string
+	// covered - выполненные операции ("METHOD шаблон").
+	covered map[string]bool
+}
+
+// do выполняет запрос, проверяет код ответа want и соответствие запроса
+// и ответа описанию. header - пары "имя", "значение".
+func (c *specClient) do(method, target, contentType string, body []byte, want int, header ...string) *httptest.ResponseRecorder {
+	c.t.Helper()
+	req := httptest.NewRequest(method, target, bytes.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	return c.serve(req, body, want)
+}
+
+func (c *specClient) serve(req *http.Request, body []byte, want int) *httptest.ResponseRecorder {
+	c.t.Helper()
+	require.NoError(c.t, c.spec.checkRequest(req, body, want < http.StatusBadRequest))
+	rec := httptest.NewRecorder()
+	c.handler.ServeHTTP(rec, req)
+	require.Equal(c.t, want, rec.Code, "%s %s: %s", req.Method, req.URL, rec.Body.String())
+	require.NoError(c.t, c.spec.checkResponse(req, rec))
+	template, _, _ := c.spec.operation(req.Method, req.URL.Path)
+	c.covered[req.Method+" "+template] = true
+	return rec
+}
+
+// get выполняет GET с параметрами в query string.
+func (c *specClient) get(path string, params url.Values, want int) *httptest.ResponseRecorder {
+	c.t.Helper()
+	if len(params) > 0 {
+		path += "?" + params.Encode()
+	}
+	return c.do(http.MethodGet, path, "", nil, want)
+}
+
+// post выполняет POST с параметрами в теле application/x-www-form-urlencoded.
+func (c *specClient) post(path string, form url.Values, want int, header ...string) *httptest.ResponseRecorder {
+	c.t.Helper()
+	return c.do(http.MethodPost, path, "application/x-www-form-urlencoded", []byte(form.Encode()), want, header...)
+}
+
+// json выполняет запрос с JSON-телом body.
+func (c *specClient) json(method, path, body string, want int, header ...string) *httptest.ResponseRecorder {
+	c.t.Helper()
+	return c.do(method, path, "application/json", []byte(body), want, header...)
+}
+
+// result декодирует поле result ответа в v.
+func result(t *testing.T, rec *httptest.ResponseRecorder, v interface{}) {
+	var res struct {
+		Result json.RawMessage `json:"result"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	require.NoError(t, json.Unmarshal(res.Result, v))
+}
+
+func TestOpenAPISpec(t *testing.T) {
+	spec := loadOpenAPI(t)
+	assert.Equal(t, "3.0.3", spec.doc["openapi"])
+
+	// все ссылки описания разрешаются
+	var walk func(node interface{})
+	walk = func(node interface{}) {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			if ref, ok := n["$ref"].(string); ok {
+				assert.NotPanics(t, func() { assert.NotNil(t, spec.resolve(n), ref) }, ref)
+				return
+			}
+			for _, v := range n {
+				walk(v)
+			}
+		case []interface{}:
+			for _, v := range n {
+				walk(v)
+			}
+		}
+	}
+	walk(spec.doc)
+
+	// все маршруты сервера описаны
+	routes := calendarRoutes(NewCalendar(newTestStorage()), NewChangeFeed(0), &EventHistory{})
+	for route := range routes {
+		found := false
+		for path := range spec.paths {
+			found = found || path == route || strings.HasPrefix(path, route) && strings.HasSuffix(route, "/")
+		}
+		assert.True(t, found, "route %s is not described", route)
+	}
+
+	rec := httptest.NewRecorder()
+	ServeOpenAPI(rec, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	assert.JSONEq(t, string(openAPISpec), rec.Body.String())
+}
+
+// TestOpenAPIResponses выполняет запросы ко всем описанным операциям через
+// маршрутизатор с теми же обработчиками и middleware, что и у сервера, и сверяет
+// запросы и ответы с openapi.json.
+func TestOpenAPIResponses(t *testing.T) {
+	users, err := OpenFileUserStore(t.TempDir() + "/users.json")
+	require.NoError(t, err)
+	users.cost = bcrypt.MinCost
+	aliceID, err := users.AddUser("alice", "wonderland")
+	require.NoError(t, err)
+	bobID, err := users.AddUser("bob", "builder")
+	require.NoError(t, err)
+	auth := NewAuthenticator([]byte("secret"), time.Hour)
+	history, err := OpenEventHistory("")
+	require.NoError(t, err)
+	feed := NewChangeFeed(16)
+	backend := newTestStorage()
+	storage, err := NewIndexedEventStorage(NewFeedEventStorage(NewHistoryEventStorage(backend, history), feed))
+	require.NoError(t, err)
+	const secret = "replication-secret"
+	leader := NewReplicationLeader(backend, 16, secret)
+
+	bodyLimiter := NewBodyLimiter(1 << 16)
+	router := http.NewServeMux()
+	for route, h := range calendarRoutes(NewCalendar(storage), feed, history) {
+		router.Handle(route, bodyLimiter.Middleware(auth.Middleware(h)))
+	}
+	router.Handle("/login", bodyLimiter.Middleware(NewLoginAPI(users, auth).Login))
+	router.Handle("/metrics", NewMetrics())
+	router.HandleFunc("/openapi.json", ServeOpenAPI)
+	health := NewHealth(storage)
+	router.HandleFunc("/healthz", health.Live)
+	router.HandleFunc("/readyz", health.Readiness)
+	router.HandleFunc("/replication/snapshot", leader.Snapshot)
+	router.HandleFunc("/replication/log", leader.Log)
+	router.Handle(calDAVPrefix, auth.BasicMiddleware(users, NewCalDAV(storage).ServeHTTP))
+	router.HandleFunc("/.well-known/caldav", wellKnownCalDAV)
+
+	c := &specClient{t: t, spec: loadOpenAPI(t), handler: router, covered: make(map[string]bool)}
+	alice, bob := aliceID.String(), bobID.String()
+
+	// служебные маршруты и вход
+	c.get("/openapi.json", nil, http.StatusOK)
+	c.get("/metrics", nil, http.StatusOK)
+	c.get("/healthz", nil, http.StatusOK)
+	c.get("/readyz", nil, http.StatusOK)
+	c.get("/.well-known/caldav", nil, http.StatusMovedPermanently)
+	c.post("/login", url.Values{"username": {"bob"}}, http.StatusBadRequest)
+	c.post("/login", url.Values{"username": {"bob"}, "password": {"wonderland"}}, http.StatusUnauthorized)
+	var token struct {
+		Token string `json:"token"`
+	}
+	result(t, c.post("/login", url.Values{"username": {"bob"}, "password": {"builder"}}, http.StatusOK), &token)
+	bobToken := token.Token
+	result(t, c.post("/login", url.Values{"username": {"alice"}, "password": {"wonderland"}}, http.StatusOK), &token)
+	c.get("/trash", url.Values{"user_id": {alice}}, http.StatusUnauthorized)
+	c.token = token.Token
+
+	// API первой версии
+	event := url.Values{
+		"user_id": {alice}, "date": {"07.03.2022"}, "time": {"10:00"}, "place": {"офис"},
+		"description": {"планёрка"}, "rrule": {"FREQ=WEEKLY;COUNT=4"}, "exdate": {"21.03.2022"},
+		"tz": {"Europe/Moscow"}, "duration": {"1h"}, "remind": {"15m"}, "attendees": {bob},
+	}
+	c.post("/create_event", event, http.StatusCreated)
+	c.post("/create_event", url.Values{"user_id": {alice}}, http.StatusBadRequest)
+	c.post("/create_event", url.Values{"user_id": {bob}, "date": {"07.03.2022"}}, http.StatusForbidden)
+	c.post("/create_event", url.Values{"user_id": {alice}, "date": {"07.03.2022"}, "time": {"10:30"},
+		"tz": {"Europe/Moscow"}, "allow_overlap": {"false"}}, http.StatusServiceUnavailable)
+	c.post("/create_event", url.Values{"user_id": {alice}, "date": {"07.03.2022"},
+		"description": {strings.Repeat("x", 1<<16)}}, http.StatusRequestEntityTooLarge)
+
+	day := url.Values{"user_id": {alice}, "date": {"07.03.2022"}, "tz": {"Europe/Moscow"}}
+	var events []Event
+	result(t, c.get("/events_for_day", day, http.StatusOK), &events)
+	require.Len(t, events, 1)
+	eventID := events[0].ID.String()
+	day.Set("align", "calendar")
+	c.get("/events_for_day", day, http.StatusOK)
+	c.get("/events_for_week", day, http.StatusOK)
+	c.get("/events_for_month", day, http.StatusOK)
+	c.get("/events_for_month", url.Values{"user_id": {alice}, "date": {"2022-03-07"}}, http.StatusBadRequest)
+	c.get("/events_for_week", url.Values{"user_id": {bob}, "date": {"07.03.2022"}}, http.StatusForbidden)
+
+	c.post("/update_event", url.Values{"event_id": {eventID}, "place": {"переговорная"}, "version": {"1"}}, http.StatusOK)
+	c.post("/update_event", url.Values{"event_id": {eventID}, "place": {"офис"}}, http.StatusConflict, "If-Match", `"1"`)
+	c.post("/update_event", url.Values{"event_id": {uuid.NewString()}}, http.StatusNotFound)
+	c.post("/invite", url.Values{"event_id": {eventID}, "attendees": {uuid.NewString()}}, http.StatusOK)
+	c.post("/invite", url.Values{"event_id": {eventID}}, http.StatusBadRequest)
+
+	c.token = bobToken
+	c.get("/invitations", url.Values{"user_id": {bob}}, http.StatusOK)
+	c.post("/rsvp", url.Values{"event_id": {eventID}, "user_id": {bob}, "status": {"accepted"}}, http.StatusOK)
+	c.post("/rsvp", url.Values{"event_id": {eventID}, "user_id": {bob}, "status": {"maybe"}}, http.StatusBadRequest)
+	c.post("/delete_event", url.Values{"event_id": {eventID}}, http.StatusForbidden)
+	c.token = token.Token
+
+	period := url.Values{"user_id": {alice}, "from": {"01.03.2022"}, "to": {"31.03.2022 23:59"}, "tz": {"Europe/Moscow"}}
+	c.get("/free_busy", period, http.StatusOK)
+	c.get("/free_busy", url.Values{"user_id": {alice}, "from": {"01.03.2022"}}, http.StatusBadRequest)
+	c.get("/agenda", url.Values{"user_id": {alice}, "from": {"06.03.2022"}, "to": {"08.03.2022"}, "group_by": {"day"}}, http.StatusOK)
+	c.get("/agenda", url.Values{"user_id": {alice}, "from": {"06.03.2022"}, "to": {"08.03.2022"}, "group_by": {"week"}}, http.StatusBadRequest)
+	period.Set("q", "планёрка")
+	period.Set("limit", "1")
+	c.get("/search_events", period, http.StatusOK)
+	c.get("/search_events", url.Values{"user_id": {alice}, "limit": {"1000"}}, http.StatusBadRequest)
+	c.get("/event_history", url.Values{"event_id": {eventID}}, http.StatusOK)
+	c.get("/event_history", url.Values{"event_id": {uuid.NewString()}}, http.StatusNotFound)
+
+	// iCalendar
+	ics := c.get("/export.ics", url.Values{"user_id": {alice}}, http.StatusOK).Body.Bytes()
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	require.NoError(t, mw.WriteField("user_id", alice))
+	fw, err := mw.CreateFormFile("file", "calendar.ics")
+	require.NoError(t, err)
+	_, err = fw.Write(ics)
+	require.NoError(t, err)
+	require.NoError(t, mw.Close())
+	c.do(http.MethodPost, "/import_ics", mw.FormDataContentType(), form.Bytes(), http.StatusOK)
+	c.do(http.MethodPost, "/import_ics?user_id="+alice, "text/calendar", []byte("BEGIN:VEVENT\r\n"), http.StatusBadRequest)
+	c.do(http.MethodPost, "/import_ics?user_id="+alice, "text/calendar", ics, http.StatusOK)
+
+	// корзина
+	c.post("/delete_event", url.Values{"event_id": {eventID}, "version": {"2"}}, http.StatusConflict)
+	c.post("/delete_event", url.Values{"event_id": {eventID}}, http.StatusNoContent)
+	c.get("/trash", url.Values{"user_id": {alice}}, http.StatusOK)
+	c.post("/restore_event", url.Values{"event_id": {eventID}}, http.StatusOK)
+	c.post("/restore_event", url.Values{"event_id": {eventID}}, http.StatusNotFound)
+
+	// пакеты
+	batch := fmt.Sprintf(`[{"op":"create","event":{"user_id":%q,"when":"2022-04-01T10:00:00Z","what":"пакет"}},`+
+		`{"op":"update","id":%q,"event":{"what":"изменено в пакете"}}]`, alice, eventID)
+	c.json(http.MethodPost, "/batch", batch, http.StatusOK)
+	c.json(http.MethodPost, "/batch", fmt.Sprintf(`[{"op":"delete","id":%q,"version":1}]`, eventID), http.StatusConflict)
+	c.json(http.MethodPost, "/batch", `[]`, http.StatusBadRequest)
+	c.do(http.MethodPost, "/batch", "text/plain", []byte(`[]`), http.StatusUnsupportedMediaType)
+
+	// API v2
+	v2 := "/api/v2/users/" + alice + "/events"
+	var created eventV2
+	require.NoError(t, json.Unmarshal(c.json(http.MethodPost, v2+"?allow_overlap=false",
+		`{"when":"2022-05-01T10:00:00+03:00","tz":"Europe/Moscow","duration":"30m","reminders":["10m"],`+
+			`"attendees":[{"user_id":"`+bob+`"}]}`, http.StatusCreated).Body.Bytes(), &created))
+	one := v2 + "/" + created.ID.String()
+	c.json(http.MethodPost, v2, `{"id":"`+created.ID.String()+`","when":"2022-05-02T10:00:00Z"}`, http.StatusConflict)
+	c.json(http.MethodPost, v2, `{"when":"вчера"}`, http.StatusBadRequest)
+	c.json(http.MethodPost, "/api/v2/users/"+bob+"/events", `{"when":"2022-05-02T10:00:00Z"}`, http.StatusForbidden)
+	c.get(v2, nil, http.StatusOK)
+	c.get(v2, url.Values{"from": {"2022-05-01T00:00:00Z"}, "to": {"2022-06-01T00:00:00Z"}}, http.StatusOK)
+	c.get(v2, url.Values{"from": {"2022-05-01T00:00:00Z"}}, http.StatusBadRequest)
+	c.get(one, nil, http.StatusOK)
+	c.get(v2+"/"+uuid.NewString(), nil, http.StatusNotFound)
+	c.do(http.MethodPatch, one, "application/merge-patch+json", []byte(`{"what":"ретро","duration":null}`), http.StatusOK, "If-Match", `"1"`)
+	c.do(http.MethodPatch, one, "application/merge-patch+json", []byte(`{"what":"ретро"}`), http.StatusPreconditionFailed, "If-Match", `"1"`)
+	c.do(http.MethodPatch, one, "application/merge-patch+json", []byte(`{"id":null}`), http.StatusBadRequest)
+	c.do(http.MethodDelete, one, "", nil, http.StatusPreconditionFailed, "If-Match", `"1"`)
+	c.do(http.MethodDelete, one, "", nil, http.StatusNoContent)
+
+	// поток изменений: клиент отключается сразу после подключения
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest(http.MethodGet, "/events/stream?user_id="+alice+"&last_event_id=1", nil).WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	c.serve(req, nil, http.StatusOK)
+	c.do(http.MethodGet, "/events/stream?user_id="+alice, "", nil, http.StatusBadRequest, "Last-Event-ID", "x")
+
+	// CalDAV
+	calDAVEvent := fmt.Sprintf("/caldav/calendars/%s/default/%s.ics", alice, uuid.NewString())
+	vevent := fmt.Sprintf(testVEvent, "caldav", "20220601", "20220601", "синхронизация")
+	c.do(http.MethodOptions, "/caldav/", "", nil, http.StatusOK)
+	c.do(http.MethodPut, calDAVEvent, "text/calendar", []byte(vevent), http.StatusCreated, "If-None-Match", "*")
+	c.do(http.MethodPut, calDAVEvent, "text/calendar", []byte(vevent), http.StatusNoContent)
+	c.do(http.MethodPut, calDAVEvent, "text/calendar", []byte("BEGIN:VCALENDAR\r\nEND:VCALENDAR\r\n"), http.StatusBadRequest)
+	etag := c.do(http.MethodGet, calDAVEvent, "", nil, http.StatusOK).Header().Get("ETag")
+	c.do(http.MethodGet, calDAVEvent, "", nil, http.StatusNotModified, "If-None-Match", etag)
+	c.do(http.MethodDelete, calDAVEvent, "", nil, http.StatusNoContent)
+	c.do(http.MethodGet, calDAVEvent, "", nil, http.StatusNotFound)
+	c.do(http.MethodGet, fmt.Sprintf("/caldav/calendars/%s/default/%s.ics", bob, uuid.NewString()), "", nil, http.StatusForbidden)
+
+	// репликация: снимок содержит и события в корзине; поток журнала после
+	// остановки ведущего отдаёт накопленные записи и завершается
+	c.get("/replication/snapshot", nil, http.StatusUnauthorized)
+	c.do(http.MethodGet, "/replication/snapshot", "", nil, http.StatusOK, headerReplicationSecret, secret)
+	c.do(http.MethodGet, "/replication/log?epoch=x&after=0", "", nil, http.StatusUnauthorized)
+	c.do(http.MethodGet, "/replication/log?epoch=x&after=first", "", nil, http.StatusBadRequest, headerReplicationSecret, secret)
+	c.do(http.MethodGet, "/replication/log?epoch=x&after=0", "", nil, http.StatusGone, headerReplicationSecret, secret)
+	epoch, seq := leader.log.position()
+	leader.Close()
+	stream := c.do(http.MethodGet, fmt.Sprintf("/replication/log?epoch=%s&after=%d", epoch, seq-1), "", nil, http.StatusOK, headerReplicationSecret, secret)
+	assert.Equal(t, 1, strings.Count(stream.Body.String(), "\n"))
+
+	// остановка сервера снимает готовность
+	health.Drain()
+	c.get("/readyz", nil, http.StatusServiceUnavailable)
+	c.get("/healthz", nil, http.StatusOK)
+
+	// каждая описанная операция проверена хотя бы одним запросом
+	for path, item := range c.spec.object(c.spec.doc, "paths") {
+		for method := range item.(map[string]interface{}) {
+			if method == "parameters" {
+				continue
+			}
+			assert.True(t, c.covered[strings.ToUpper(method)+" "+path], "%s %s is not exercised", strings.ToUpper(method), path)
+		}
+	}
+}
+
+// TestOpenAPIValidator проверяет, что валидатор отклоняет ответы, расходящиеся с описанием.
+func TestOpenAPIValidator(t *testing.T) {
+	spec := loadOpenAPI(t)
+	check := func(method, path string, status int, contentType, body string) error {
+		rec := httptest.NewRecorder()
+		rec.Header().Set("Content-Type", contentType)
+		rec.WriteHeader(status)
+		io.WriteString(rec, body)
+		return spec.checkResponse(httptest.NewRequest(method, path, nil), rec)
+	}
+	id := uuid.NewString()
+	assert.NoError(t, check(http.MethodGet, "/trash", http.StatusOK, "application/json", `{"result":[]}`))
+	assert.NoError(t, check(http.MethodGet, "/trash", http.StatusOK, "application/json",
+		`{"result":[{"ID":"`+id+`","UserID":"`+id+`","When":"2022-01-01T10:00:00Z","Local":"2022-01-01T13:00:00+03:00","Where":"","What":"","Version":1}]}`))
+
+	tests := []struct {
+		name, method, path string
+		status             int
+		contentType, body  string
+	}{
+		{"undescribed path", http.MethodGet, "/unknown", http.StatusOK, "application/json", `{}`},
+		{"undescribed method", http.MethodDelete, "/trash", http.StatusOK, "application/json", `{}`},
+		{"undescribed status", http.MethodGet, "/trash", http.StatusTeapot, "application/json", `{}`},
+		{"undescribed content type", http.MethodGet, "/trash", http.StatusOK, "text/plain", `{}`},
+		{"missing envelope", http.MethodGet, "/trash", http.StatusOK, "application/json", `[]`},
+		{"extra property", http.MethodGet, "/trash", http.StatusBadRequest, "application/json", `{"error":"x","code":1}`},
+		{"wrong type", http.MethodGet, "/trash", http.StatusOK, "application/json", `{"result":{}}`},
+		{"bad format", http.MethodGet, "/trash", http.StatusOK, "application/json",
+			`{"result":[{"ID":"1","UserID":"` + id + `","When":"2022-01-01T10:00:00Z","Local":"","Where":"","What":"","Version":1}]}`},
+		{"not in enum", http.MethodPost, "/invite", http.StatusOK, "application/json", `{"result":[{"UserID":"` + id + `","Status":"maybe"}]}`},
+		{"unexpected body", http.MethodOptions, "/caldav/", http.StatusOK, "text/plain", `ok`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Error(t, check(test.method, test.path, test.status, test.contentType, test.body))
+		})
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Frequency - частота повторения события (часть FREQ правила RRULE).
+type Frequency string
+
+// Поддерживаемые частоты повторения.
+const (
+	Daily   Frequency = "DAILY"
+	Weekly  Frequency = "WEEKLY"
+	Monthly Frequency = "MONTHLY"
+)
+
+// Recurrence - правило повторения события. Поддерживается подмножество
+// RRULE из RFC 5545: FREQ (DAILY/WEEKLY/MONTHLY), INTERVAL, BYDAY (без
+// порядковых номеров), COUNT и UNTIL. Неделя начинается с понедельника (WKST=MO).
+type Recurrence struct {
+	Freq Frequency
+	// Interval - шаг повторения в единицах Freq (по умолчанию 1).
+	Interval int
+	// ByDay - дни недели, в которые происходит событие (для WEEKLY и MONTHLY).
+	ByDay []time.Weekday
+	// Count - максимальное количество вхождений (0 - без ограничения).
+	Count int
+	// Until - момент, после которого вхождений нет (включительно; нулевое значение - без ограничения).
+	Until time.Time
+}
+
+const (
+	// maxRRuleCount - наибольшее допустимое значение COUNT.
+	maxRRuleCount = 10000
+	// maxRRuleYears - на сколько лет после начала события может отстоять UNTIL.
+	// Вместе с maxRRuleCount ограничивает число вхождений серии с концом,
+	// которые приходится разворачивать (проверка пересечений, экспорт).
+	maxRRuleYears = 30
+)
+
+// ErrInvalidRRule - ошибка разбора правила повторения.
+var ErrInvalidRRule = errors.New("invalid recurrence rule")
+
+// коды дней недели в RRULE.
+var weekdayCodes = map[string]time.Weekday{
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+	"SU": time.Sunday,
+}
+
+// форматы UNTIL, допустимые в RRULE.
+var untilLayouts = []string{"20060102T150405Z", "20060102T150405", "20060102"}
+
+// ParseEventRRule разбирает правило повторения события, начинающегося в start.
+// UNTIL без "Z" (дата или местное время) трактуется в часовом поясе start,
+// как требует RFC 5545. Кроме проверок ParseRRule, UNTIL не может отстоять
+// от start больше чем на maxRRuleYears лет.
+func ParseEventRRule(s string, start time.Time) (*Recurrence, error) {
+	r, err := parseRRule(s, start.Location())
+	if err != nil {
+		return nil, err
+	}
+	if !r.Until.IsZero() && r.Until.After(start.AddDate(maxRRuleYears, 0, 0)) {
+		return nil, fmt.Errorf("%w: UNTIL must be within %d years after the start", ErrInvalidRRule, maxRRuleYears)
+	}
+	return r, nil
+}
+
+// ParseRRule разбирает правило повторения вида "FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,WE;COUNT=10".
+// Префикс "RRULE:" допускается. COUNT не может превышать maxRRuleCount.
+// UNTIL без "Z" трактуется в UTC; для правил событий используется ParseEventRRule.
+func ParseRRule(s string) (*Recurrence, error) {
+	return parseRRule(s, time.UTC)
+}
+
+// parseRRule разбирает правило, трактуя UNTIL без "Z" в часовом поясе loc.
+func parseRRule(s string, loc *time.Location) (*Recurrence, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "RRULE:")
+	r := &Recurrence{Interval: 1}
+	for _, part := range strings.Split(s, ";") {
+		if part == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("%w: malformed part %q", ErrInvalidRRule, part)
+		}
+		switch strings.ToUpper(key) {
+		case "FREQ":
+			switch f := Frequency(strings.ToUpper(value)); f {
+			case Daily, Weekly, Monthly:
+				r.Freq = f
+			default:
+				return nil, fmt.Errorf("%w: unsupported FREQ %q", ErrInvalidRRule, value)
+			}
+		case "INTERVAL":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("%w: INTERVAL must be a positive integer", ErrInvalidRRule)
+			}
+			r.Interval = n
+		case "COUNT":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("%w: COUNT must be a positive integer", ErrInvalidRRule)
+			}
+			if n > maxRRuleCount {
+				return nil, fmt.Errorf("%w: COUNT must not exceed %d", ErrInvalidRRule, maxRRuleCount)
+			}
+			r.Count = n
+		case "UNTIL":
+			until, err := parseUntil(value, loc)
+			if err != nil {
+				return nil, fmt.Errorf("%w: UNTIL %q", ErrInvalidRRule, value)
+			}
+			r.Until = until
+		case "BYDAY":
+			for _, code := range strings.Split(value, ",") {
+				wd, ok := weekdayCodes[strings.ToUpper(code)]
+				if !ok {
+					return nil, fmt.Errorf("%w: unsupported BYDAY value %q", ErrInvalidRRule, code)
+				}
+				r.ByDay = append(r.ByDay, wd)
+			}
+		case "WKST":
+			if strings.ToUpper(value) != "MO" {
+				return nil, fmt.Errorf("%w: only WKST=MO is supported", ErrInvalidRRule)
+			}
+		default:
+			return nil, fmt.Errorf("%w: unsupported part %q", ErrInvalidRRule, key)
+		}
+	}
+	if r.Freq == "" {
+		return nil, fmt.Errorf("%w: missing FREQ", ErrInvalidRRule)
+	}
+	if r.Count > 0 && !r.Until.IsZero() {
+		return nil, fmt.Errorf("%w: COUNT and UNTIL are mutually exclusive", ErrInvalidRRule)
+	}
+	if r.Freq == Daily && len(r.ByDay) > 0 {
+		return nil, fmt.Errorf("%w: BYDAY is not supported with FREQ=DAILY", ErrInvalidRRule)
+	}
+	return r, nil
+}
+
+// parseUntil разбирает значение UNTIL в одном из допустимых форматов.
+// Местное время (без "Z") трактуется в часовом поясе loc, а дата -
+// как конец этого дня в loc: по RFC 5545 UNTIL-дата включает весь день.
+func parseUntil(s string, loc *time.Location) (time.Time, error) {
+	var err error
+	for _, layout := range untilLayouts {
+		var t time.Time
+		if t, err = time.ParseInLocation(layout, s, loc); err == nil {
+			if len(s) == len(untilLayouts[2]) {
+				t = t.AddDate(0, 0, 1).Add(-time.Second)
+			}
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// String возвращает правило в формате RRULE (без префикса "RRULE:").
+func (r Recurrence) String() string {
+	parts := []string{"FREQ=" + string(r.Freq)}
+	if r.Interval > 1 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(r.Interval))
+	}
+	if len(r.ByDay) > 0 {
+		codes := make([]string, 0, len(r.ByDay))
+		for _, wd := range r.ByDay {
+			codes = append(codes, strings.ToUpper(wd.String()[:2]))
+		}
+		parts = append(parts, "BYDAY="+strings.Join(codes, ","))
+	}
+	if r.Count > 0 {
+		parts = append(parts, "COUNT="+strconv.Itoa(r.Count))
+	}
+	if !r.Until.IsZero() {
+		parts = append(parts, "UNTIL="+r.Until.UTC().Format(untilLayouts[0]))
+	}
+	return strings.Join(parts, ";")
+}
+
+// MarshalText сериализует правило в строку RRULE (используется в JSON).
+func (r Recurrence) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// UnmarshalText разбирает правило из строки RRULE.
+func (r *Recurrence) UnmarshalText(text []byte) error {
+	parsed, err := ParseRRule(string(text))
+	if err != nil {
+		return err
+	}
+	*r = *parsed
+	return nil
+}
+
+// Occurrences возвращает отсортированные моменты начала вхождений события
+// в отрезке [from, to]. Для однократного события это When, если он попадает в отрезок.
+// Исключённые даты (ExDates) не возвращаются, но учитываются в COUNT,
+// как того требует RFC 5545.
+func (e Event) Occurrences(from, to time.Time) []time.Time {
+	result := make([]time.Time, 0)
+	e.eachOccurrence(from, to, func(t time.Time) bool {
+		result = append(result, t)
+		return true
+	})
+	return result
+}
+
+// eachOccurrence вызывает yield для моментов начала вхождений события в отрезке
+// [from, to] в хронологическом порядке, пока yield возвращает true. В отличие
+// от Occurrences, вхождения не накапливаются.
+func (e Event) eachOccurrence(from, to time.Time, yield func(time.Time) bool) {
+	inRange := func(t time.Time) bool {
+		return !t.Before(from) && !t.After(to)
+	}
+	if e.Recurrence == nil {
+		if inRange(e.When) {
+			yield(e.When)
+		}
+		return
+	}
+	// серия разворачивается по местному времени часового пояса события
+	e.Recurrence.iterate(e.When.In(e.Location()), func(t time.Time) bool {
+		if t.After(to) {
+			return false
+		}
+		if inRange(t) && !e.isExcluded(t) {
+			return yield(t)
+		}
+		return true
+	})
+}
+
+// Expand возвращает вхождения события в отрезке [from, to] в виде копий события,
+// у которых When равен моменту начала вхождения. ID у всех вхождений общий.
+func (e Event) Expand(from, to time.Time) []Event {
+	occurrences := e.Occurrences(from, to)
+	result := make([]Event, 0, len(occurrences))
+	for _, t := range occurrences {
+		occurrence := e
+		occurrence.When = t
+		result = append(result, occurrence)
+	}
+	return result
+}
+
+// isExcluded проверяет, входит ли момент в список исключённых дат события.
+func (e Event) isExcluded(t time.Time) bool {
+	for _, ex := range e.ExDates {
+		if ex.Equal(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// iterate последовательно вызывает yield для каждого вхождения серии, начинающейся
+// в момент start, пока yield возвращает true и не исчерпаны COUNT/UNTIL.
+func (r Recurrence) iterate(start time.Time, yield func(time.Time) bool) {
+	interval := r.Interval
+	if interval < 1 {
+		interval = 1
+	}
+	days := r.ByDay
+	if len(days) == 0 && r.Freq == Weekly {
+		days = []time.Weekday{start.Weekday()}
+	}
+	// emit учитывает ограничения COUNT и UNTIL; false - серия закончилась.
+	emitted := 0
+	emit := func(t time.Time) bool {
+		if t.Before(start) {
+			return true
+		}
+		if !r.Until.IsZero() && t.After(r.Until) {
+			return false
+		}
+		if r.Count > 0 && emitted >= r.Count {
+			return false
+		}
+		emitted++
+		return yield(t)
+	}
+	y, m, d := start.Date()
+	hh, mm, ss := start.Clock()
+	at := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, hh, mm, ss, start.Nanosecond(), start.Location())
+	}
+
+	switch r.Freq {
+	case Daily:
+		for n := 0; ; n += interval {
+			if !emit(at(y, m, d+n)) {
+				return
+			}
+		}
+	case Weekly:
+		// смещение от понедельника недели, в которую попадает start
+		monday := d - (int(start.Weekday())+6)%7
+		offsets := weekdayOffsets(days)
+		for n := 0; ; n += interval * 7 {
+			for _, off := range offsets {
+				if !emit(at(y, m, monday+n+off)) {
+					return
+				}
+			}
+		}
+	case Monthly:
+		for n := 0; ; n += interval {
+			first := time.Date(y, m+time.Month(n), 1, 0, 0, 0, 0, start.Location())
+			year, month := first.Year(), first.Month()
+			if len(r.ByDay) == 0 {
+				// месяцы, в которых нет такого числа (например, 31), пропускаются
+				t := at(year, month, d)
+				if t.Month() != month {
+					continue
+				}
+				if !emit(t) {
+					return
+				}
+				continue
+			}
+			for day := 1; day <= daysIn(year, month); day++ {
+				t := at(year, month, day)
+				if !containsWeekday(r.ByDay, t.Weekday()) {
+					continue
+				}
+				if !emit(t) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// weekdayOffsets переводит дни недели в отсортированные смещения от понедельника.
+func weekdayOffsets(days []time.Weekday) []int {
+	offsets := make([]int, 0, len(days))
+	seen := make(map[int]bool, len(days))
+	for _, wd := range days {
+		off := (int(wd) + 6) % 7
+		if !seen[off] {
+			seen[off] = true
+			offsets = append(offsets, off)
+		}
+	}
+	sort.Ints(offsets)
+	return offsets
+}
+
+// containsWeekday проверяет наличие дня недели в списке.
+func containsWeekday(days []time.Weekday, wd time.Weekday) bool {
+	for _, d := range days {
+		if d == wd {
+			return true
+		}
+	}
+	return false
+}
+
+// daysIn возвращает количество дней в месяце.
+func daysIn(year int, month time.Month) int {
+	return time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
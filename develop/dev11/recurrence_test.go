@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestStorage создаёт хранилище в памяти без воркера, сохраняющего данные в файл.
+func newTestStorage() *InmemEventStorage {
+	return &InmemEventStorage{
+		mu:    &sync.RWMutex{},
+		repo:  make(map[uuid.UUID]Event),
+		index: newEventIndex(),
+	}
+}
+
+// mustTime - разбор момента в формате "02.01.2006 15:04" для тестов.
+func mustTime(t *testing.T, s string) time.Time {
+	res, err := time.Parse("02.01.2006 15:04", s)
+	require.NoError(t, err)
+	return res
+}
+
+func TestParseRRule(t *testing.T) {
+	tt := []struct {
+		rule    string
+		want    string
+		wantErr bool
+	}{
+		{rule: "FREQ=DAILY", want: "FREQ=DAILY"},
+		{rule: "RRULE:FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,WE;COUNT=10", want: "FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,WE;COUNT=10"},
+		{rule: "freq=monthly;until=20220301", want: "FREQ=MONTHLY;UNTIL=20220301T235959Z"},
+		{rule: "FREQ=WEEKLY;WKST=MO;UNTIL=20220301T101500Z", want: "FREQ=WEEKLY;UNTIL=20220301T101500Z"},
+		{rule: "FREQ=YEARLY", wantErr: true},
+		{rule: "INTERVAL=2", wantErr: true},
+		{rule: "FREQ=DAILY;INTERVAL=0", wantErr: true},
+		{rule: "FREQ=DAILY;COUNT=2;UNTIL=20220301", wantErr: true},
+		{rule: "FREQ=WEEKLY;BYDAY=1MO", wantErr: true},
+		{rule: "FREQ=DAILY;BYDAY=MO", wantErr: true},
+		{rule: "FREQ=DAILY;BYHOUR=10", wantErr: true},
+		{rule: "FREQ", wantErr: true},
+		{rule: "FREQ=DAILY;COUNT=10000", want: "FREQ=DAILY;COUNT=10000"},
+		{rule: "FREQ=DAILY;COUNT=10001", wantErr: true},
+	}
+	for i, tc := range tt {
+		t.Run(fmt.Sprintf("#%d", i), func(t *testing.T) {
+			r, err := ParseRRule(tc.rule)
+			if tc.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidRRule)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, r.String())
+		})
+	}
+}
+
+func TestParseEventRRule(t *testing.T) {
+	start := mustTime(t, "03.01.2022 10:00")
+
+	r, err := ParseEventRRule("FREQ=DAILY;UNTIL=20511231", start)
+	require.NoError(t, err)
+	assert.Equal(t, 2051, r.Until.Year())
+
+	_, err = ParseEventRRule("FREQ=DAILY;UNTIL=20520104", start)
+	assert.ErrorIs(t, err, ErrInvalidRRule)
+	_, err = ParseEventRRule("FREQ=DAILY;UNTIL=99991231", start)
+	assert.ErrorIs(t, err, ErrInvalidRRule)
+	_, err = ParseEventRRule("FREQ=DAILY;COUNT=100000", start)
+	assert.ErrorIs(t, err, ErrInvalidRRule)
+
+	// UNTIL без "Z" трактуется в часовом поясе события, дата включает весь день
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	require.NoError(t, err)
+	e := Event{When: time.Date(2022, 3, 20, 9, 0, 0, 0, berlin), TZ: "Europe/Berlin"}
+	from, to := e.When, e.When.AddDate(0, 1, 0)
+
+	e.Recurrence, err = ParseEventRRule("FREQ=DAILY;UNTIL=20220325", e.When)
+	require.NoError(t, err)
+	occ := e.Occurrences(from, to)
+	require.Len(t, occ, 6)
+	assert.Equal(t, time.Date(2022, 3, 25, 9, 0, 0, 0, berlin), occ[5])
+
+	e.Recurrence, err = ParseEventRRule("FREQ=DAILY;UNTIL=20220325T083000", e.When)
+	require.NoError(t, err)
+	assert.Len(t, e.Occurrences(from, to), 5)
+}
+
+func TestOccurrences(t *testing.T) {
+	tt := []struct {
+		start   string
+		rule    string
+		exDates []string
+		from    string
+		to      string
+		want    []string
+	}{
+		{
+			// однократное событие
+			start: "03.01.2022 10:00",
+			from:  "01.01.2022 00:00",
+			to:    "08.01.2022 00:00",
+			want:  []string{"03.01.2022 10:00"},
+		},
+		{
+			start: "03.01.2022 10:00",
+			rule:  "FREQ=DAILY;COUNT=3",
+			from:  "01.01.2022 00:00",
+			to:    "31.01.2022 00:00",
+			want:  []string{"03.01.2022 10:00", "04.01.2022 10:00", "05.01.2022 10:00"},
+		},
+		{
+			// исключённая дата учитывается в COUNT
+			start:   "03.01.2022 10:00",
+			rule:    "FREQ=DAILY;INTERVAL=2;COUNT=3",
+			exDates: []string{"05.01.2022 10:00"},
+			from:    "01.01.2022 00:00",
+			to:      "31.01.2022 00:00",
+			want:    []string{"03.01.2022 10:00", "07.01.2022 10:00"},
+		},
+		{
+			// 05.01.2022 - среда: вхождение в понедельник этой недели раньше начала серии
+			start: "05.01.2022 09:30",
+			rule:  "FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,WE,FR",
+			from:  "01.01.2022 00:00",
+			to:    "20.01.2022 00:00",
+			want:  []string{"05.01.2022 09:30", "07.01.2022 09:30", "17.01.2022 09:30", "19.01.2022 09:30"},
+		},
+		{
+			// без BYDAY используется день недели начала серии
+			start: "03.01.2022 08:00",
+			rule:  "FREQ=WEEKLY;UNTIL=20220117T080000Z",
+			from:  "10.01.2022 00:00",
+			to:    "31.01.2022 00:00",
+			want:  []string{"10.01.2022 08:00", "17.01.2022 08:00"},
+		},
+		{
+			// месяцы без 31-го числа пропускаются
+			start: "31.01.2022 12:00",
+			rule:  "FREQ=MONTHLY;COUNT=3",
+			from:  "01.01.2022 00:00",
+			to:    "31.12.2022 00:00",
+			want:  []string{"31.01.2022 12:00", "31.03.2022 12:00", "31.05.2022 12:00"},
+		},
+		{
+			start: "01.02.2022 18:00",
+			rule:  "FREQ=MONTHLY;BYDAY=TU",
+			from:  "01.02.2022 00:00",
+			to:    "28.02.2022 23:59",
+			want:  []string{"01.02.2022 18:00", "08.02.2022 18:00", "15.02.2022 18:00", "22.02.2022 18:00"},
+		},
+		{
+			// отрезок запроса целиком до начала серии
+			start: "01.02.2022 18:00",
+			rule:  "FREQ=DAILY",
+			from:  "01.01.2022 00:00",
+			to:    "31.01.2022 00:00",
+			want:  []string{},
+		},
+	}
+	for i, tc := range tt {
+		t.Run(fmt.Sprintf("#%d", i), func(t *testing.T) {
+			e := Event{When: mustTime(t, tc.start)}
+			if tc.rule != "" {
+				r, err := ParseRRule(tc.rule)
+				require.NoError(t, err)
+				e.Recurrence = r
+			}
+			for _, ex := range tc.exDates {
+				e.ExDates = append(e.ExDates, mustTime(t, ex))
+			}
+			got := make([]string, 0)
+			for _, occ := range e.Occurrences(mustTime(t, tc.from), mustTime(t, tc.to)) {
+				got = append(got, occ.Format("02.01.2006 15:04"))
+			}
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestRecurringEventHandlers(t *testing.T) {
+	storage := newTestStorage()
+	api := NewCalendar(storage)
+	userID := uuid.New().String()
+
+	form := url.Values{
+		"user_id":     {userID},
+		"date":        {"03.01.2022"},
+		"time":        {"10:00"},
+		"description": {"Стендап"},
+		"rrule":       {"FREQ=WEEKLY;BYDAY=MO,WE,FR"},
+		"exdate":      {"07.01.2022"},
+		"remind":      {"15m"},
+	}
+	req := httptest.NewRequest(http.MethodPost, "/create_event", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	api.CreateEvent(rec, req)
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	events, err := storage.GetForWeek(uuid.MustParse(userID), mustTime(t, "03.01.2022 00:00"))
+	require.NoError(t, err)
+	// пн 03.01 и ср 05.01 (пт 07.01 исключена)
+	assert.Equal(t, 2, len(events))
+
+	for _, rule := range []string{"FREQ=FORTNIGHTLY", "FREQ=DAILY;UNTIL=99991231"} {
+		form.Set("rrule", rule)
+		req = httptest.NewRequest(http.MethodPost, "/create_event", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec = httptest.NewRecorder()
+		api.CreateEvent(rec, req)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, rule)
+	}
+
+	// пустые rrule, exdate и remind очищают поля события
+	rec = doForm(api.UpdateEvent, http.MethodPost, "/update_event", url.Values{
+		"event_id": {events[0].ID.String()}, "rrule": {""}, "exdate": {""}, "remind": {""},
+	})
+	require.Equal(t, http.StatusOK, rec.Code)
+	e, err := storage.Get(events[0].ID)
+	require.NoError(t, err)
+	assert.Nil(t, e.Recurrence)
+	assert.Empty(t, e.ExDates)
+	assert.Empty(t, e.Reminders)
+}
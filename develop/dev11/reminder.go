@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// maxReminderOffset - максимальное время напоминания до начала события.
+	maxReminderOffset = 31 * 24 * time.Hour
+	// maxReminders - максимальное количество напоминаний у события.
+	maxReminders = 10
+	// reminderMaxAttempts - количество попыток доставки напоминания, после
+	// которого оно считается недоставленным и больше не отправляется.
+	reminderMaxAttempts = 5
+	// reminderTimeout - время на одну попытку доставки.
+	reminderTimeout = 10 * time.Second
+	// defaultReminderInterval - период проверки наступивших напоминаний.
+	defaultReminderInterval = 30 * time.Second
+)
+
+// parseReminders разбирает список напоминаний через запятую: время до начала события
+// в формате time.ParseDuration, дополнительно допускаются дни (1d, 2d).
+func parseReminders(list string) ([]time.Duration, error) {
+	result := make([]time.Duration, 0)
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		d, err := parseReminderOffset(item)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, d)
+	}
+	return normalizeReminders(result)
+}
+
+// parseReminderOffset разбирает одно напоминание: 15m, 1h30m, 1d.
+func parseReminderOffset(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid reminder %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid reminder %q", s)
+	}
+	return d, nil
+}
+
+// formatReminderOffset выводит напоминание в формате, который принимает parseReminderOffset.
+func formatReminderOffset(d time.Duration) string {
+	const day = 24 * time.Hour
+	if d%day == 0 {
+		return strconv.Itoa(int(d/day)) + "d"
+	}
+	return d.String()
+}
+
+// normalizeReminders проверяет напоминания, удаляет повторы и сортирует по возрастанию.
+func normalizeReminders(offsets []time.Duration) ([]time.Duration, error) {
+	if len(offsets) > maxReminders {
+		return nil, fmt.Errorf("too many reminders (max %d)", maxReminders)
+	}
+	seen := make(map[time.Duration]bool, len(offsets))
+	result := make([]time.Duration, 0, len(offsets))
+	for _, d := range offsets {
+		if d <= 0 || d > maxReminderOffset {
+			return nil, fmt.Errorf("reminder must be between 0 and %v before the event", maxReminderOffset)
+		}
+		if !seen[d] {
+			seen[d] = true
+			result = append(result, d)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result, nil
+}
+
+// Reminder - напоминание о вхождении события.
+type Reminder struct {
+	// Key - уникальный ключ напоминания (событие, вхождение, время до начала).
+	// Получатель может использовать его для отбрасывания повторов.
+	Key     string        `json:"key"`
+	EventID uuid.UUID     `json:"event_id"`
+	UserID  uuid.UUID     `json:"user_id"`
+	What    string        `json:"what,omitempty"`
+	Where   string        `json:"where,omitempty"`
+	Start   time.Time     `json:"start"`
+	Before  time.Duration `json:"before"`
+	FireAt  time.Time     `json:"fire_at"`
+}
+
+// reminderKey возвращает ключ напоминания за before до вхождения, начинающегося в start.
+func reminderKey(eventID uuid.UUID, start time.Time, before time.Duration) string {
+	return fmt.Sprintf("%s/%d/%s", eventID, start.Unix(), formatReminderOffset(before))
+}
+
+// Notifier доставляет напоминания пользователям.
+type Notifier interface {
+	// Notify доставляет напоминание. Ошибка означает, что доставка не удалась
+	// и её нужно повторить.
+	Notify(ctx context.Context, r Reminder) error
+}
+
+// LogNotifier - имплементация Notifier, записывающая напоминания в лог.
+type LogNotifier struct {
+	Logger *log.Logger
+}
+
+func (n LogNotifier) Notify(_ context.Context, r Reminder) error {
+	logger := n.Logger
+	if logger == nil {
+		logger = log.Default()
+	}
+	logger.Printf("reminder: user %s, event %s %q at %s (in %s)",
+		r.UserID, r.EventID, r.What, r.Start.Format(time.RFC3339), formatReminderOffset(r.Before))
+	return nil
+}
+
+// WebhookNotifier - имплементация Notifier, отправляющая напоминание POST-запросом
+// с JSON-телом на адрес URL. Ключ напоминания передаётся в заголовке Idempotency-Key.
+type WebhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+func (n WebhookNotifier) Notify(ctx context.Context, r Reminder) error {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", r.Key)
+	client := n.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// ReminderStorage - хранилище, умеющее выбирать события с напоминаниями за период.
+// Без него планировщик просматривает все события хранилища при каждой проверке.
+type ReminderStorage interface {
+	EventStorage
+	// GetWithReminders возвращает события с напоминаниями, у которых могут быть
+	// вхождения, начинающиеся в отрезке [from, to]. Повторяющееся событие
+	// возвращается одним элементом.
+	GetWithReminders(from, to time.Time) ([]Event, error)
+}
+
+// remindingEvents возвращает события хранилища s с напоминаниями, у которых могут
+// быть вхождения в отрезке [from, to]: через ReminderStorage, если хранилище его
+// реализует, иначе перебором всех событий.
+func remindingEvents(s EventStorage, from, to time.Time) ([]Event, error) {
+	if rs, ok := s.(ReminderStorage); ok {
+		return rs.GetWithReminders(from, to)
+	}
+	events, err := s.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]Event, 0)
+	for _, e := range events {
+		if len(e.Reminders) > 0 {
+			result = append(result, e)
+		}
+	}
+	return result, nil
+}
+
+// reminderState - сохраняемое состояние планировщика. Все напоминания со временем
+// срабатывания не позже Watermark уже обработаны; Sent - обработанные напоминания
+// с более поздним временем срабатывания (ключ - время срабатывания).
+type reminderState struct {
+	Watermark time.Time            `json:"watermark"`
+	Sent      map[string]time.Time `json:"sent,omitempty"`
+}
+
+// ReminderScheduler периодически находит наступившие напоминания и доставляет их
+// через Notifier. Каждое напоминание доставляется один раз: после успешной доставки
+// его ключ записывается в файл состояния, поэтому после перезапуска оно не
+// повторяется, а напоминания, наступившие во время простоя, досылаются (если
+// событие ещё не началось). Повтор возможен только при сбое между доставкой и записью
+// состояния; на этот случай получатель может отбрасывать повторы по ключу.
+type ReminderScheduler struct {
+	storage   EventStorage
+	notifier  Notifier
+	statePath string
+	interval  time.Duration
+
+	// mu защищает state и attempts; доставка идёт без блокировки.
+	mu       sync.Mutex
+	state    reminderState
+	attempts map[string]int
+	// now - источник текущего времени (подменяется в тестах).
+	now func() time.Time
+
+	// ctx отменяется в Close и прерывает идущую доставку.
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewReminderScheduler создаёт планировщик и загружает его состояние из файла statePath.
+// При первом запуске (файла нет) напоминания отсчитываются от текущего момента.
+func NewReminderScheduler(storage EventStorage, notifier Notifier, statePath string, interval time.Duration) (*ReminderScheduler, error) {
+	if interval <= 0 {
+		interval = defaultReminderInterval
+	}
+	s := &ReminderScheduler{
+		storage:   storage,
+		notifier:  notifier,
+		statePath: statePath,
+		interval:  interval,
+		attempts:  make(map[string]int),
+		now:       time.Now,
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	data, err := os.ReadFile(statePath)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		// Watermark будет установлен при первой проверке
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(data, &s.state); err != nil {
+			return nil, fmt.Errorf("reminderScheduler: could not parse %s: %w", statePath, err)
+		}
+	}
+	if s.state.Sent == nil {
+		s.state.Sent = make(map[string]time.Time)
+	}
+	return s, nil
+}
+
+// Start запускает фоновую проверку напоминаний.
+func (s *ReminderScheduler) Start() {
+	s.wg.Add(1)
+	go s.run()
+}
+
+// Close останавливает проверку напоминаний, прерывает идущую доставку и дожидается
+// завершения. Прерванное напоминание доставляется после следующего запуска.
+func (s *ReminderScheduler) Close() {
+	s.cancel()
+	s.wg.Wait()
+	log.Println("reminderScheduler stopped")
+}
+
+func (s *ReminderScheduler) run() {
+	defer s.wg.Done()
+	log.Println("reminderScheduler: started")
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.tick()
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// tick доставляет напоминания, наступившие после Watermark, и сдвигает Watermark.
+// Если какое-то напоминание доставить не удалось, Watermark не сдвигается дальше
+// момента его срабатывания, и напоминание повторяется при следующей проверке.
+// Напоминания доставляются без блокировки mu, поэтому Close не ждёт медленного
+// получателя, а прерывает доставку.
+func (s *ReminderScheduler) tick() {
+	s.mu.Lock()
+	now := s.now()
+	if s.state.Watermark.IsZero() {
+		s.state.Watermark = now
+		s.saveState()
+		s.mu.Unlock()
+		return
+	}
+	since := s.state.Watermark
+	s.mu.Unlock()
+	if !now.After(since) {
+		return
+	}
+	due, err := s.dueReminders(since, now)
+	if err != nil {
+		log.Printf("reminderScheduler: %v", err)
+		return
+	}
+	watermark := now
+	for _, r := range due {
+		if now.After(r.Start) {
+			// событие уже началось - напоминать поздно
+			continue
+		}
+		s.mu.Lock()
+		_, sent := s.state.Sent[r.Key]
+		s.mu.Unlock()
+		if sent {
+			continue
+		}
+		err := s.deliver(r)
+		if err != nil && s.ctx.Err() != nil {
+			// планировщик останавливается: напоминание и следующие за ним
+			// доставляются после перезапуска, попытка не засчитывается
+			if r.FireAt.Before(watermark) {
+				watermark = r.FireAt.Add(-time.Nanosecond)
+			}
+			break
+		}
+		s.mu.Lock()
+		if err != nil {
+			s.attempts[r.Key]++
+			if s.attempts[r.Key] < reminderMaxAttempts {
+				log.Printf("reminderScheduler: delivery of %s failed (attempt %d): %v", r.Key, s.attempts[r.Key], err)
+				if r.FireAt.Before(watermark) {
+					watermark = r.FireAt.Add(-time.Nanosecond)
+				}
+				s.mu.Unlock()
+				continue
+			}
+			log.Printf("reminderScheduler: giving up on %s after %d attempts: %v", r.Key, s.attempts[r.Key], err)
+		}
+		delete(s.attempts, r.Key)
+		s.state.Sent[r.Key] = r.FireAt
+		s.saveState()
+		s.mu.Unlock()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state.Watermark = watermark
+	for key, fireAt := range s.state.Sent {
+		if !fireAt.After(watermark) {
+			delete(s.state.Sent, key)
+		}
+	}
+	s.saveState()
+}
+
+// deliver доставляет напоминание с ограничением времени на попытку.
+// Доставка прерывается при остановке планировщика.
+func (s *ReminderScheduler) deliver(r Reminder) error {
+	ctx, cancel := context.WithTimeout(s.ctx, reminderTimeout)
+	defer cancel()
+	return s.notifier.Notify(ctx, r)
+}
+
+// dueReminders возвращает напоминания со временем срабатывания в (since, now],
+// упорядоченные по времени срабатывания и ключу. Из хранилища выбираются только события
+// с вхождениями в (since, now+maxReminderOffset].
+func (s *ReminderScheduler) dueReminders(since, now time.Time) ([]Reminder, error) {
+	events, err := remindingEvents(s.storage, since, now.Add(maxReminderOffset))
+	if err != nil {
+		return nil, err
+	}
+	result := make([]Reminder, 0)
+	for _, e := range events {
+		for _, before := range e.Reminders {
+			// срабатывание в (since, now] <=> начало вхождения в (since+before, now+before]
+			for _, start := range e.Occurrences(since.Add(before+time.Nanosecond), now.Add(before)) {
+				result = append(result, Reminder{
+					Key:     reminderKey(e.ID, start, before),
+					EventID: e.ID,
+					UserID:  e.UserID,
+					What:    e.What,
+					Where:   e.Where,
+					Start:   start,
+					Before:  before,
+					FireAt:  start.Add(-before),
+				})
+			}
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].FireAt.Equal(result[j].FireAt) {
+			return result[i].FireAt.Before(result[j].FireAt)
+		}
+		return result[i].Key < result[j].Key
+	})
+	return result, nil
+}
+
+// saveState атомарно записывает состояние планировщика в файл.
+func (s *ReminderScheduler) saveState() {
+	err := writeFileAtomic(s.statePath, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(s.state)
+	})
+	if err != nil {
+		log.Printf("reminderScheduler: could not save state: %v", err)
+	}
+}
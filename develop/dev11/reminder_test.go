@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingNotifier запоминает доставленные напоминания; пока fail != nil, доставка не удаётся.
+type recordingNotifier struct {
+	mu   sync.Mutex
+	sent []Reminder
+	fail error
+}
+
+func (n *recordingNotifier) Notify(_ context.Context, r Reminder) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.fail != nil {
+		return n.fail
+	}
+	n.sent = append(n.sent, r)
+	return nil
+}
+
+func (n *recordingNotifier) keys() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	keys := make([]string, 0, len(n.sent))
+	for _, r := range n.sent {
+		keys = append(keys, r.Key)
+	}
+	return keys
+}
+
+func TestParseReminders(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected []time.Duration
+		err      bool
+	}{
+		{"15m", []time.Duration{15 * time.Minute}, false},
+		{"1d, 15m,1h,15m", []time.Duration{15 * time.Minute, time.Hour, 24 * time.Hour}, false},
+		{"1h30m", []time.Duration{90 * time.Minute}, false},
+		{"", []time.Duration{}, false},
+		{"0m", nil, true},
+		{"-5m", nil, true},
+		{"40d", nil, true},
+		{"xd", nil, true},
+		{"soon", nil, true},
+		{"1m,2m,3m,4m,5m,6m,7m,8m,9m,10m,11m", nil, true},
+	}
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("#%d", i), func(t *testing.T) {
+			got, err := parseReminders(test.in)
+			if test.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, got)
+		})
+	}
+	assert.Equal(t, "1d", formatReminderOffset(24*time.Hour))
+	assert.Equal(t, "1h30m0s", formatReminderOffset(90*time.Minute))
+}
+
+func TestReminderScheduler(t *testing.T) {
+	storage := newTestStorage()
+	statePath := filepath.Join(t.TempDir(), "reminders.json")
+	daily, err := ParseRRule("FREQ=DAILY;COUNT=3")
+	require.NoError(t, err)
+	meeting := Event{ID: uuid.New(), UserID: uuid.New(), When: mustTime(t, "03.01.2022 10:00"),
+		What: "Планёрка", Reminders: []time.Duration{15 * time.Minute, time.Hour}}
+	standup := Event{ID: uuid.New(), UserID: uuid.New(), When: mustTime(t, "03.01.2022 09:00"),
+		Recurrence: daily, Reminders: []time.Duration{10 * time.Minute}}
+	require.NoError(t, storage.Add(meeting))
+	require.NoError(t, storage.Add(standup))
+
+	now := mustTime(t, "03.01.2022 08:00")
+	notifier := &recordingNotifier{}
+	open := func() *ReminderScheduler {
+		s, err := NewReminderScheduler(storage, notifier, statePath, time.Minute)
+		require.NoError(t, err)
+		s.now = func() time.Time { return now }
+		return s
+	}
+	// первый запуск: отсчёт от текущего момента
+	s := open()
+	s.tick()
+	assert.Empty(t, notifier.keys())
+
+	now = mustTime(t, "03.01.2022 09:00")
+	s.tick()
+	// 08:50 - стендап, 09:00 - за час до планёрки
+	assert.Equal(t, []string{
+		reminderKey(standup.ID, mustTime(t, "03.01.2022 09:00"), 10*time.Minute),
+		reminderKey(meeting.ID, mustTime(t, "03.01.2022 10:00"), time.Hour),
+	}, notifier.keys())
+
+	// повторная проверка и перезапуск не повторяют напоминания
+	s.tick()
+	s = open()
+	s.tick()
+	assert.Equal(t, 2, len(notifier.keys()))
+
+	// доставка не удаётся: напоминание повторяется при следующей проверке,
+	// в том числе после перезапуска
+	notifier.fail = errors.New("webhook is down")
+	now = mustTime(t, "03.01.2022 09:50")
+	s.tick()
+	s = open()
+	notifier.fail = nil
+	s.tick()
+	assert.Equal(t, reminderKey(meeting.ID, mustTime(t, "03.01.2022 10:00"), 15*time.Minute), notifier.keys()[2])
+
+	// простой: пропущенные напоминания досылаются, если событие ещё не началось
+	now = mustTime(t, "04.01.2022 08:55")
+	s = open()
+	s.tick()
+	assert.Equal(t, 4, len(notifier.keys()))
+	// напоминание о событии, которое уже началось, не отправляется
+	now = mustTime(t, "05.01.2022 09:01")
+	s.tick()
+	assert.Equal(t, 4, len(notifier.keys()))
+
+	// после исчерпания попыток напоминание больше не отправляется
+	lunch := Event{ID: uuid.New(), UserID: uuid.New(), When: mustTime(t, "05.01.2022 13:00"),
+		Reminders: []time.Duration{time.Hour}}
+	require.NoError(t, storage.Add(lunch))
+	notifier.fail = errors.New("webhook is down")
+	now = mustTime(t, "05.01.2022 12:00")
+	for i := 0; i < reminderMaxAttempts; i++ {
+		s.tick()
+	}
+	notifier.fail = nil
+	now = mustTime(t, "05.01.2022 12:30")
+	s.tick()
+	assert.Equal(t, 4, len(notifier.keys()))
+	assert.True(t, now.Equal(s.state.Watermark))
+	assert.Empty(t, s.state.Sent)
+}
+
+// blockingNotifier не доставляет напоминания, пока доставку не прервут.
+type blockingNotifier struct {
+	started chan Reminder
+}
+
+func (n blockingNotifier) Notify(ctx context.Context, r Reminder) error {
+	n.started <- r
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestReminderSchedulerClose(t *testing.T) {
+	storage := newTestStorage()
+	statePath := filepath.Join(t.TempDir(), "reminders.json")
+	meeting := Event{ID: uuid.New(), UserID: uuid.New(), When: mustTime(t, "03.01.2022 10:00"),
+		Reminders: []time.Duration{time.Hour}}
+	require.NoError(t, storage.Add(meeting))
+
+	notifier := blockingNotifier{started: make(chan Reminder, 1)}
+	s, err := NewReminderScheduler(storage, notifier, statePath, time.Millisecond)
+	require.NoError(t, err)
+	now := mustTime(t, "03.01.2022 08:00")
+	s.now = func() time.Time { return now }
+	s.tick()
+	now = mustTime(t, "03.01.2022 09:30")
+	s.Start()
+	r := <-notifier.started
+	assert.Equal(t, meeting.ID, r.EventID)
+
+	// Close прерывает доставку, а не ждёт истечения reminderTimeout
+	start := time.Now()
+	s.Close()
+	assert.Less(t, time.Since(start), reminderTimeout/2)
+	assert.True(t, s.state.Watermark.Before(r.FireAt))
+
+	// прерванное напоминание доставляется после перезапуска
+	recorder := &recordingNotifier{}
+	s, err = NewReminderScheduler(storage, recorder, statePath, time.Minute)
+	require.NoError(t, err)
+	s.now = func() time.Time { return now }
+	s.tick()
+	assert.Equal(t, []string{r.Key}, recorder.keys())
+}
+
+// testReminderStorage проверяет выборку событий с напоминаниями за период.
+func testReminderStorage(t *testing.T, s ReminderStorage) {
+	weekly, err := ParseRRule("FREQ=WEEKLY")
+	require.NoError(t, err)
+	finished, err := ParseRRule("FREQ=DAILY;UNTIL=20220105T000000Z")
+	require.NoError(t, err)
+	remind := []time.Duration{time.Hour}
+	inside := Event{ID: uuid.New(), UserID: uuid.New(), When: mustTime(t, "10.01.2022 10:00"), Reminders: remind}
+	series := Event{ID: uuid.New(), UserID: uuid.New(), When: mustTime(t, "03.01.2022 09:00"),
+		Recurrence: weekly, Reminders: remind}
+	for _, e := range []Event{
+		inside,
+		series,
+		// вне отрезка
+		{ID: uuid.New(), UserID: uuid.New(), When: mustTime(t, "20.01.2022 10:00"), Reminders: remind},
+		// серия закончилась до начала отрезка
+		{ID: uuid.New(), UserID: uuid.New(), When: mustTime(t, "01.01.2022 09:00"), Recurrence: finished, Reminders: remind},
+		// без напоминаний
+		{ID: uuid.New(), UserID: uuid.New(), When: mustTime(t, "10.01.2022 12:00")},
+	} {
+		require.NoError(t, s.Add(e))
+	}
+	trashed := Event{ID: uuid.New(), UserID: uuid.New(), When: mustTime(t, "11.01.2022 10:00"), Reminders: remind}
+	require.NoError(t, s.Add(trashed))
+	require.NoError(t, s.Delete(trashed.ID))
+
+	events, err := s.GetWithReminders(mustTime(t, "08.01.2022 00:00"), mustTime(t, "15.01.2022 00:00"))
+	require.NoError(t, err)
+	ids := make([]uuid.UUID, 0, len(events))
+	for _, e := range events {
+		ids = append(ids, e.ID)
+	}
+	assert.ElementsMatch(t, []uuid.UUID{inside.ID, series.ID}, ids)
+
+	// напоминания удалены - событие больше не выбирается
+	inside.Reminders = nil
+	inside.Version++
+	require.NoError(t, s.Update(inside))
+	events, err = s.GetWithReminders(mustTime(t, "08.01.2022 00:00"), mustTime(t, "15.01.2022 00:00"))
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, series.ID, events[0].ID)
+}
+
+func TestReminderStorage(t *testing.T) {
+	t.Run("inmem", func(t *testing.T) {
+		testReminderStorage(t, newTestStorage())
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		s, err := NewSQLEventStorage(filepath.Join(t.TempDir(), "events.db"))
+		require.NoError(t, err)
+		defer s.Close()
+		testReminderStorage(t, s)
+	})
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	var (
+		got     Reminder
+		key     string
+		failing bool
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		key = r.Header.Get("Idempotency-Key")
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	start := mustTime(t, "03.01.2022 10:00")
+	r := Reminder{
+		Key:     reminderKey(uuid.New(), start, time.Hour),
+		EventID: uuid.New(),
+		What:    "Планёрка",
+		Start:   start,
+		Before:  time.Hour,
+		FireAt:  start.Add(-time.Hour),
+	}
+	n := WebhookNotifier{URL: server.URL}
+	require.NoError(t, n.Notify(context.Background(), r))
+	assert.Equal(t, r.Key, key)
+	assert.Equal(t, r.What, got.What)
+	assert.True(t, r.Start.Equal(got.Start))
+
+	failing = true
+	assert.Error(t, n.Notify(context.Background(), r))
+}
+
+func TestReminderHandlers(t *testing.T) {
+	storage := newTestStorage()
+	api := NewCalendar(storage)
+	userID := uuid.New()
+
+	rec := doForm(api.CreateEvent, http.MethodPost, "/create_event", map[string][]string{
+		"user_id": {userID.String()}, "date": {"03.01.2022"}, "time": {"10:00"}, "remind": {"1d,15m"},
+	})
+	require.Equal(t, http.StatusCreated, rec.Code)
+	events, err := storage.GetByUser(userID)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(events))
+	assert.Equal(t, []time.Duration{15 * time.Minute, 24 * time.Hour}, events[0].Reminders)
+	assert.Equal(t, []string{"15m0s", "1d"}, newEventV2(events[0]).Reminders)
+
+	rec = doForm(api.UpdateEvent, http.MethodPost, "/update_event", map[string][]string{
+		"event_id": {events[0].ID.String()}, "remind": {"-1h"},
+	})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	item := fmt.Sprintf("/api/v2/users/%s/events/%s", userID, events[0].ID)
+	rec = doJSON(api.EventsV2, http.MethodPatch, item, "application/merge-patch+json", `{"reminders": ["2h"]}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	event, err := storage.Get(events[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, []time.Duration{2 * time.Hour}, event.Reminders)
+}
@@ -0,0 +1,752 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Репликация хранилища memory между узлами. Ведущий узел (leader) нумерует
+// записи журнала упреждающей записи и хранит последние из них в памяти
+// (replicationLog). Ведомый узел (follower) получает снимок хранилища ведущего
+// (GET /replication/snapshot), затем читает поток записей после номера снимка
+// (GET /replication/log) и применяет их через ReplicaStorage, поэтому вместе с
+// событиями обновляются поисковый индекс и лента изменений ведомого. Ведомый
+// отвечает на чтение сам, а изменения (и запросы, которые обслуживает только
+// ведущий) передаёт ведущему.
+//
+// Каждый запуск ведущего начинает новую эпоху с нумерацией записей с начала.
+// Ведомый, заметивший смену эпохи или отставший больше, чем хранит журнал
+// ведущего, запрашивает снимок заново. Узлы подтверждают доступ к журналу
+// общим секретом в заголовке X-Replication-Secret.
+
+const (
+	// defaultReplicationLogSize - сколько последних записей хранит ведущий для
+	// отставших ведомых.
+	defaultReplicationLogSize = 4096
+	// replicationHeartbeat - периодичность пустых строк, поддерживающих поток журнала.
+	replicationHeartbeat = 5 * time.Second
+	// replicationTimeout - сколько ведомый ждёт данных от ведущего, прежде чем
+	// разорвать соединение и подключиться заново.
+	replicationTimeout = 3 * replicationHeartbeat
+	// replicationRetry - пауза перед повторным подключением к ведущему.
+	replicationRetry = time.Second
+	// replicationWait - сколько ведомый ждёт, пока переданное ведущему изменение
+	// дойдёт до него самого, чтобы клиент сразу увидел его при чтении.
+	replicationWait = 2 * time.Second
+
+	headerReplicationSecret = "X-Replication-Secret"
+	headerReplicationEpoch  = "X-Replication-Epoch"
+	headerReplicationSeq    = "X-Replication-Seq"
+)
+
+var (
+	// ErrReplicationNotSupported - хранилище не может быть ведомым.
+	ErrReplicationNotSupported = errors.New("replication is not supported by the storage")
+	// errReplicationGap - журнал ведущего не содержит запрошенных записей
+	// (сменилась эпоха или ведомый отстал); нужен снимок.
+	errReplicationGap = errors.New("replication log does not contain the requested records")
+)
+
+// ReplicationEntry - пронумерованная запись журнала ведущего узла.
+type ReplicationEntry struct {
+	Seq    uint64    `json:"seq"`
+	Record walRecord `json:"record"`
+}
+
+// ReplicationSnapshot - содержимое хранилища ведущего (в том числе корзина)
+// на момент записи Seq эпохи Epoch.
+type ReplicationSnapshot struct {
+	Epoch  string  `json:"epoch"`
+	Seq    uint64  `json:"seq"`
+	Events []Event `json:"events"`
+}
+
+// ReplicationBatch - изменения, полученные ведомым от ведущего: снимок
+// (Reset - всё содержимое хранилища заменяется событиями Events) либо записи
+// журнала по порядку.
+type ReplicationBatch struct {
+	Reset   bool
+	Events  []Event
+	Entries []ReplicationEntry
+}
+
+// ReplicatedChange - событие до и после применения изменения ведущего узла
+// (nil - события нет).
+type ReplicatedChange struct {
+	Before, After *Event
+}
+
+// changeType возвращает вид изменения для ленты; false - изменение не видно
+// пользователям (например, окончательное удаление из корзины).
+func (c ReplicatedChange) changeType() (ChangeType, bool) {
+	was := c.Before != nil && !c.Before.trashed()
+	is := c.After != nil && !c.After.trashed()
+	switch {
+	case was && is:
+		return ChangeUpdated, true
+	case was:
+		return ChangeDeleted, true
+	case is && c.Before != nil:
+		return ChangeRestored, true
+	case is:
+		return ChangeCreated, true
+	}
+	return "", false
+}
+
+// ReplicaStorage - хранилище, которое может быть ведомым: применяет изменения,
+// полученные от ведущего узла.
+type ReplicaStorage interface {
+	EventStorage
+	// Replicate применяет изменения ведущего без проверок (они выполнены ведущим)
+	// и возвращает изменившиеся события, чтобы обёртки хранилища обновили
+	// производные данные.
+	Replicate(b ReplicationBatch) ([]ReplicatedChange, error)
+}
+
+// replicate применяет b к хранилищу s, если оно реализует ReplicaStorage,
+// иначе возвращает ErrReplicationNotSupported.
+func replicate(s EventStorage, b ReplicationBatch) ([]ReplicatedChange, error) {
+	rs, ok := s.(ReplicaStorage)
+	if !ok {
+		return nil, ErrReplicationNotSupported
+	}
+	return rs.Replicate(b)
+}
+
+// replicationLog - журнал репликации ведущего: последние записи кольцевым буфером.
+// Нулевой указатель допустим: записи в него не попадают.
+type replicationLog struct {
+	mu    sync.Mutex
+	epoch string
+	// seq - номер последней записи; запись n хранится в entries[(n-1)%len(entries)].
+	seq     uint64
+	entries []ReplicationEntry
+	// notify закрывается (и заменяется новым) при добавлении записи.
+	notify chan struct{}
+}
+
+func newReplicationLog(size int) *replicationLog {
+	if size <= 0 {
+		size = defaultReplicationLogSize
+	}
+	return &replicationLog{
+		epoch:   uuid.NewString(),
+		entries: make([]ReplicationEntry, size),
+		notify:  make(chan struct{}),
+	}
+}
+
+// append нумерует запись и будит ожидающие потоки журнала. Вызывается под
+// блокировкой хранилища на запись, поэтому порядок записей совпадает с порядком
+// изменений.
+func (l *replicationLog) append(rec walRecord) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.seq++
+	l.entries[(l.seq-1)%uint64(len(l.entries))] = ReplicationEntry{Seq: l.seq, Record: rec}
+	close(l.notify)
+	l.notify = make(chan struct{})
+}
+
+// position возвращает эпоху и номер последней записи.
+func (l *replicationLog) position() (string, uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.epoch, l.seq
+}
+
+// since возвращает записи после after и канал, который закроется при появлении
+// следующей. Если журнал их уже не хранит, возвращается errReplicationGap.
+func (l *replicationLog) since(after uint64) ([]ReplicationEntry, <-chan struct{}, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	size := uint64(len(l.entries))
+	if after > l.seq || l.seq-after > size {
+		return nil, nil, errReplicationGap
+	}
+	result := make([]ReplicationEntry, 0, l.seq-after)
+	for n := after + 1; n <= l.seq; n++ {
+		result = append(result, l.entries[(n-1)%size])
+	}
+	return result, l.notify, nil
+}
+
+// enableReplication включает журнал репликации хранилища на size записей.
+func (s *InmemEventStorage) enableReplication(size int) *replicationLog {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.repl == nil {
+		s.repl = newReplicationLog(size)
+	}
+	return s.repl
+}
+
+// replicationSnapshot возвращает снимок хранилища и номер последней вошедшей в него записи.
+func (s *InmemEventStorage) replicationSnapshot() ReplicationSnapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	epoch, seq := s.repl.position()
+	events := make([]Event, 0, len(s.repo))
+	for _, e := range s.repo {
+		events = append(events, e)
+	}
+	return ReplicationSnapshot{Epoch: epoch, Seq: seq, Events: events}
+}
+
+// Replicate применяет изменения ведущего узла (см. ReplicaStorage). Записи журнала
+// попадают и в журнал ведомого; снимок сразу сохраняется на диск вместо журнала.
+func (s *InmemEventStorage) Replicate(b ReplicationBatch) ([]ReplicatedChange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if b.Reset {
+		return s.resetTo(b.Events), nil
+	}
+	changes := make([]ReplicatedChange, 0, len(b.Entries))
+	for _, entry := range b.Entries {
+		if err := s.log.append(entry.Record); err != nil {
+			return changes, err
+		}
+		ids := entry.Record.eventIDs()
+		before := make([]*Event, len(ids))
+		for i, id := range ids {
+			before[i] = s.lookup(id)
+		}
+		s.apply(entry.Record)
+		s.modified = true
+		for i, id := range ids {
+			after := s.lookup(id)
+			s.index.update(before[i], after)
+			changes = append(changes, ReplicatedChange{Before: before[i], After: after})
+		}
+	}
+	return changes, nil
+}
+
+// resetTo заменяет содержимое хранилища событиями events. Событие считается
+// неизменившимся, если совпадают его версия и нахождение в корзине.
+// Вызывается с захваченной блокировкой на запись.
+func (s *InmemEventStorage) resetTo(events []Event) []ReplicatedChange {
+	next := make(map[uuid.UUID]Event, len(events))
+	for _, e := range events {
+		next[e.ID] = e
+	}
+	changes := make([]ReplicatedChange, 0)
+	for id := range s.repo {
+		if _, ok := next[id]; !ok {
+			changes = append(changes, ReplicatedChange{Before: s.lookup(id)})
+		}
+	}
+	for id, e := range next {
+		old := s.lookup(id)
+		if old != nil && old.Version == e.Version && old.trashed() == e.trashed() {
+			continue
+		}
+		e := e
+		changes = append(changes, ReplicatedChange{Before: old, After: &e})
+	}
+	for _, c := range changes {
+		if c.After == nil {
+			delete(s.repo, c.Before.ID)
+		} else {
+			s.repo[c.After.ID] = *c.After
+		}
+		s.index.update(c.Before, c.After)
+	}
+	// прежний журнал к новому содержимому не относится
+	s.modified = true
+	if err := s.flush(); err != nil {
+		log.Printf("inmemEventStorage: replica: ERROR: %v", err)
+	}
+	return changes
+}
+
+// safeMethod проверяет, что метод запроса только читает данные.
+func safeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND", "REPORT":
+		return true
+	}
+	return false
+}
+
+// leaderRoutes - маршруты, которые обслуживает только ведущий узел:
+// история изменений ведётся на нём.
+var leaderRoutes = map[string]bool{"/event_history": true}
+
+// forwardToLeader проверяет, что ведомый должен передать запрос ведущему.
+func forwardToLeader(r *http.Request) bool {
+	return !safeMethod(r.Method) || leaderRoutes[r.URL.Path]
+}
+
+// ReplicationLeader отдаёт ведомым узлам снимок хранилища и поток журнала.
+type ReplicationLeader struct {
+	storage *InmemEventStorage
+	log     *replicationLog
+	secret  string
+	// done закрывается при остановке сервера: потоки журнала завершаются,
+	// не дожидаясь истечения времени на остановку.
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewReplicationLeader включает журнал репликации хранилища s на size записей.
+func NewReplicationLeader(s *InmemEventStorage, size int, secret string) *ReplicationLeader {
+	l := &ReplicationLeader{storage: s, log: s.enableReplication(size), secret: secret, done: make(chan struct{})}
+	epoch, _ := l.log.position()
+	log.Printf("replication: leader, epoch %s", epoch)
+	return l
+}
+
+// Close завершает потоки журнала.
+func (l *ReplicationLeader) Close() {
+	l.closeOnce.Do(func() { close(l.done) })
+}
+
+// trusted проверяет секрет репликации в запросе.
+func (l *ReplicationLeader) trusted(r *http.Request) bool {
+	secret := r.Header.Get(headerReplicationSecret)
+	return secret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(l.secret)) == 1
+}
+
+// Snapshot отдаёт снимок хранилища с эпохой и номером последней вошедшей в него записи.
+//
+// GET /replication/snapshot
+func (l *ReplicationLeader) Snapshot(w http.ResponseWriter, r *http.Request) {
+	const logHeader = "replicationSnapshot"
+	if r.Method != http.MethodGet {
+		returnError(w, logHeader, "", http.StatusMethodNotAllowed)
+		return
+	}
+	if !l.trusted(r) {
+		returnError(w, logHeader, "invalid replication secret", http.StatusUnauthorized)
+		return
+	}
+	returnJSONResult(w, logHeader, l.storage.replicationSnapshot(), http.StatusOK)
+}
+
+// Log отдаёт записи журнала после after по мере их появления: по записи
+// ReplicationEntry в JSON на строку (application/x-ndjson), пустые строки
+// поддерживают соединение. Если эпоха не совпадает или журнал уже не хранит
+// нужных записей, отвечает 410 - ведомому нужен снимок.
+//
+// GET /replication/log
+// параметры:
+//	- *epoch	эпоха ведущего из снимка
+//	- *after	номер последней применённой записи
+func (l *ReplicationLeader) Log(w http.ResponseWriter, r *http.Request) {
+	const logHeader = "replicationLog"
+	if r.Method != http.MethodGet {
+		returnError(w, logHeader, "", http.StatusMethodNotAllowed)
+		return
+	}
+	if !l.trusted(r) {
+		returnError(w, logHeader, "invalid replication secret", http.StatusUnauthorized)
+		return
+	}
+	after, err := strconv.ParseUint(r.FormValue("after"), 10, 64)
+	if err != nil {
+		returnError(w, logHeader, fmt.Sprintf("incorrect after: %v", err), http.StatusBadRequest)
+		return
+	}
+	if epoch, _ := l.log.position(); r.FormValue("epoch") != epoch {
+		returnError(w, logHeader, fmt.Sprintf("%v: epoch changed", errReplicationGap), http.StatusGone)
+		return
+	}
+	entries, wait, err := l.log.since(after)
+	if err != nil {
+		returnError(w, logHeader, err.Error(), http.StatusGone)
+		return
+	}
+	rc := http.NewResponseController(w)
+	// поток не ограничен по времени, в отличие от остальных ответов сервера
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && err != http.ErrNotSupported {
+		log.Printf("%s: %v", logHeader, err)
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+
+	enc := json.NewEncoder(w)
+	heartbeat := time.NewTicker(replicationHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		for _, e := range entries {
+			if err := enc.Encode(e); err != nil {
+				return
+			}
+			after = e.Seq
+		}
+		if len(entries) > 0 {
+			rc.Flush()
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-l.done:
+			return
+		case <-heartbeat.C:
+			if _, err := io.WriteString(w, "\n"); err != nil {
+				return
+			}
+			rc.Flush()
+		case <-wait:
+		}
+		if entries, wait, err = l.log.since(after); err != nil {
+			// ведомый не успевает: переподключившись, он запросит снимок
+			log.Printf("%s: follower at %d is too slow: %v", logHeader, after, err)
+			return
+		}
+	}
+}
+
+// Middleware доверяет адресу клиента из X-Forwarded-For в запросах, переданных
+// ведомыми (с секретом репликации), чтобы ограничение частоты по IP касалось
+// клиентов, а не ведомого узла. В ответ на изменения сообщается номер последней
+// записи журнала: ведомый дожидается её, и клиент сразу видит своё изменение.
+func (l *ReplicationLeader) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l.trusted(r) {
+			if ip := forwardedFor(r); ip != "" {
+				r = r.WithContext(r.Context())
+				r.RemoteAddr = net.JoinHostPort(ip, "0")
+			}
+		}
+		if !safeMethod(r.Method) {
+			w = &replicationSeqWriter{ResponseWriter: w, log: l.log}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// forwardedFor возвращает адрес клиента, добавленный ведомым последним в X-Forwarded-For.
+func forwardedFor(r *http.Request) string {
+	values := r.Header.Values("X-Forwarded-For")
+	if len(values) == 0 {
+		return ""
+	}
+	hops := strings.Split(values[len(values)-1], ",")
+	ip := strings.TrimSpace(hops[len(hops)-1])
+	if net.ParseIP(ip) == nil {
+		return ""
+	}
+	return ip
+}
+
+// replicationSeqWriter добавляет к ответу эпоху и номер последней записи журнала.
+// Ответ пишется после изменения хранилища, поэтому номер его включает.
+type replicationSeqWriter struct {
+	http.ResponseWriter
+	log         *replicationLog
+	wroteHeader bool
+}
+
+func (w *replicationSeqWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		epoch, seq := w.log.position()
+		w.Header().Set(headerReplicationEpoch, epoch)
+		w.Header().Set(headerReplicationSeq, strconv.FormatUint(seq, 10))
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *replicationSeqWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap возвращает исходный ResponseWriter (для http.ResponseController).
+func (w *replicationSeqWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Replica - воркер ведомого узла: получает снимок и журнал ведущего, применяет
+// их к хранилищу и передаёт ведущему изменения, пришедшие на ведомый.
+type Replica struct {
+	leader  *url.URL
+	secret  string
+	storage ReplicaStorage
+	client  *http.Client
+	proxy   *httputil.ReverseProxy
+	// retry - пауза перед повторным подключением (подменяется в тестах).
+	retry time.Duration
+
+	mu *sync.Mutex
+	// epoch и seq - эпоха ведущего и номер последней применённой записи;
+	// пустая эпоха - нужен снимок.
+	epoch string
+	seq   uint64
+	// ready устанавливается после применения первого снимка.
+	ready bool
+	// applied закрывается (и заменяется новым) при каждом продвижении seq.
+	applied chan struct{}
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewReplica создаёт ведомый узел ведущего leaderURL с хранилищем s.
+func NewReplica(leaderURL, secret string, s ReplicaStorage) (*Replica, error) {
+	leader, err := url.Parse(leaderURL)
+	if err != nil {
+		return nil, fmt.Errorf("replica: incorrect leader URL: %w", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &Replica{
+		leader:  leader,
+		secret:  secret,
+		storage: s,
+		client:  &http.Client{},
+		retry:   replicationRetry,
+		mu:      &sync.Mutex{},
+		applied: make(chan struct{}),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	r.proxy = httputil.NewSingleHostReverseProxy(leader)
+	director := r.proxy.Director
+	r.proxy.Director = func(req *http.Request) {
+		director(req)
+		req.Header.Set(headerReplicationSecret, secret)
+	}
+	r.proxy.ModifyResponse = r.awaitForwarded
+	r.proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		returnError(w, "replica", fmt.Sprintf("leader is unavailable: %v", err), http.StatusBadGateway)
+	}
+	return r, nil
+}
+
+// Start запускает получение изменений от ведущего.
+func (r *Replica) Start() {
+	r.wg.Add(1)
+	go r.run()
+}
+
+// Close останавливает получение изменений и дожидается его завершения.
+func (r *Replica) Close() {
+	r.cancel()
+	r.wg.Wait()
+	log.Println("replica stopped")
+}
+
+// Ready сообщает, готов ли ведомый отвечать на чтение: снимок ведущего получен.
+// Потеря связи с ведущим готовности не снимает - ведомый отвечает последними
+// полученными данными.
+func (r *Replica) Ready() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.ready {
+		return errors.New("replica: waiting for a snapshot from the leader")
+	}
+	return nil
+}
+
+// Forward передаёт ведущему изменения и запросы, которые обслуживает только он;
+// остальные запросы обрабатывает next. Аутентификацию переданных запросов
+// выполняет ведущий.
+func (r *Replica) Forward(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !forwardToLeader(req) {
+			next(w, req)
+			return
+		}
+		r.proxy.ServeHTTP(w, req)
+	}
+}
+
+// awaitForwarded дожидается, пока изменение, переданное ведущему, дойдёт до ведомого.
+func (r *Replica) awaitForwarded(resp *http.Response) error {
+	seq, err := strconv.ParseUint(resp.Header.Get(headerReplicationSeq), 10, 64)
+	if err != nil {
+		return nil
+	}
+	if !r.waitFor(resp.Header.Get(headerReplicationEpoch), seq, replicationWait) {
+		log.Printf("replica: record %d is not replicated yet, local reads may not see the change", seq)
+	}
+	return nil
+}
+
+// waitFor ждёт применения записи seq эпохи epoch не дольше timeout.
+func (r *Replica) waitFor(epoch string, seq uint64, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		r.mu.Lock()
+		done := r.epoch == epoch && r.seq >= seq
+		applied := r.applied
+		r.mu.Unlock()
+		if done {
+			return true
+		}
+		select {
+		case <-applied:
+		case <-timer.C:
+			return false
+		case <-r.ctx.Done():
+			return false
+		}
+	}
+}
+
+// position возвращает эпоху ведущего и номер последней применённой записи.
+func (r *Replica) position() (string, uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.epoch, r.seq
+}
+
+// advance запоминает применённую запись (или снимок) и будит ожидающих.
+func (r *Replica) advance(epoch string, seq uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.epoch, r.seq, r.ready = epoch, seq, true
+	close(r.applied)
+	r.applied = make(chan struct{})
+}
+
+// resync требует получить снимок заново.
+func (r *Replica) resync() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.epoch = ""
+}
+
+func (r *Replica) run() {
+	defer r.wg.Done()
+	log.Printf("replica: following %s", r.leader)
+	for {
+		err := r.follow()
+		if r.ctx.Err() != nil {
+			return
+		}
+		log.Printf("replica: %v, reconnecting in %v", err, r.retry)
+		select {
+		case <-time.After(r.retry):
+		case <-r.ctx.Done():
+			return
+		}
+	}
+}
+
+// follow получает снимок (если нужен) и применяет журнал ведущего до разрыва соединения.
+func (r *Replica) follow() error {
+	if epoch, _ := r.position(); epoch == "" {
+		if err := r.bootstrap(); err != nil {
+			return err
+		}
+	}
+	return r.stream()
+}
+
+// get выполняет запрос к ведущему с секретом репликации.
+func (r *Replica) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	u := r.leader.JoinPath(path)
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(headerReplicationSecret, r.secret)
+	return r.client.Do(req)
+}
+
+// bootstrap заменяет содержимое хранилища снимком ведущего.
+func (r *Replica) bootstrap() error {
+	resp, err := r.get(r.ctx, "/replication/snapshot", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("snapshot: leader responded %s", resp.Status)
+	}
+	var body struct {
+		Result ReplicationSnapshot `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return fmt.Errorf("snapshot: %w", err)
+	}
+	snap := body.Result
+	if _, err := r.storage.Replicate(ReplicationBatch{Reset: true, Events: snap.Events}); err != nil {
+		return fmt.Errorf("snapshot: %w", err)
+	}
+	r.advance(snap.Epoch, snap.Seq)
+	log.Printf("replica: snapshot of %d event(s) applied, epoch %s, record %d", len(snap.Events), snap.Epoch, snap.Seq)
+	return nil
+}
+
+// stream применяет записи журнала ведущего по мере их появления.
+func (r *Replica) stream() error {
+	ctx, cancel := context.WithCancel(r.ctx)
+	defer cancel()
+	epoch, seq := r.position()
+	resp, err := r.get(ctx, "/replication/log", url.Values{
+		"epoch": {epoch}, "after": {strconv.FormatUint(seq, 10)},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusGone:
+		r.resync()
+		return fmt.Errorf("%w (epoch %s, after %d)", errReplicationGap, epoch, seq)
+	default:
+		return fmt.Errorf("log: leader responded %s", resp.Status)
+	}
+	// соединение с ведущим, от которого нет даже пустых строк, разрывается
+	watchdog := time.AfterFunc(replicationTimeout, cancel)
+	defer watchdog.Stop()
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(make([]byte, 64<<10), 2*walMaxRecordSize)
+	for sc.Scan() {
+		watchdog.Reset(replicationTimeout)
+		line := bytes.TrimSpace(sc.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var entry ReplicationEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return fmt.Errorf("log: %w", err)
+		}
+		if entry.Seq != seq+1 {
+			r.resync()
+			return fmt.Errorf("log: record %d received after %d", entry.Seq, seq)
+		}
+		if _, err := r.storage.Replicate(ReplicationBatch{Entries: []ReplicationEntry{entry}}); err != nil {
+			r.resync()
+			return fmt.Errorf("log: record %d: %w", entry.Seq, err)
+		}
+		seq = entry.Seq
+		r.advance(epoch, seq)
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("log: %w", err)
+	}
+	return errors.New("log: leader closed the stream")
+}
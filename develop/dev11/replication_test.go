@@ -0,0 +1,388 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testReplicationSecret = "replication-test-secret"
+
+// testNode - узел календаря в тестах репликации: хранилище memory во временном
+// каталоге и маршруты API на loopback-сервере. Обработчик сервера можно
+// заменить, чтобы перезапустить узел на том же адресе.
+type testNode struct {
+	t       *testing.T
+	dir     string
+	server  *httptest.Server
+	backend *InmemEventStorage
+	storage *IndexedEventStorage
+	feed    *ChangeFeed
+	leader  *ReplicationLeader
+	replica *Replica
+
+	mu      sync.RWMutex
+	handler http.Handler
+}
+
+func (n *testNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n.mu.RLock()
+	h := n.handler
+	n.mu.RUnlock()
+	h.ServeHTTP(w, r)
+}
+
+// start открывает хранилище узла и собирает маршруты так же, как main
+// (без аутентификации и ограничений).
+func (n *testNode) start(role, leaderURL string) {
+	t := n.t
+	n.backend = openTestInmem(t, n.dir)
+	history, err := OpenEventHistory("")
+	require.NoError(t, err)
+	n.feed = NewChangeFeed(64)
+	n.storage, err = NewIndexedEventStorage(NewFeedEventStorage(NewHistoryEventStorage(n.backend, history), n.feed))
+	require.NoError(t, err)
+
+	forward := func(h http.HandlerFunc) http.HandlerFunc { return h }
+	var checks []ReadyChecker
+	switch role {
+	case "leader":
+		n.leader = NewReplicationLeader(n.backend, 4, testReplicationSecret)
+	case "follower":
+		n.replica, err = NewReplica(leaderURL, testReplicationSecret, n.storage)
+		require.NoError(t, err)
+		n.replica.retry = 10 * time.Millisecond
+		n.replica.Start()
+		forward = n.replica.Forward
+		checks = append(checks, n.replica)
+	}
+	router := http.NewServeMux()
+	for route, h := range calendarRoutes(NewCalendar(n.storage), n.feed, history) {
+		router.Handle(route, forward(h))
+	}
+	health := NewHealth(n.backend, checks...)
+	router.HandleFunc("/readyz", health.Readiness)
+	var handler http.Handler = router
+	if n.leader != nil {
+		router.HandleFunc("/replication/snapshot", n.leader.Snapshot)
+		router.HandleFunc("/replication/log", n.leader.Log)
+		handler = n.leader.Middleware(router)
+	}
+	n.mu.Lock()
+	n.handler = handler
+	n.mu.Unlock()
+}
+
+// stop останавливает репликацию и закрывает хранилище; сервер продолжает работать.
+func (n *testNode) stop() {
+	if n.leader != nil {
+		n.leader.Close()
+		n.leader = nil
+	}
+	if n.replica != nil {
+		n.replica.Close()
+		n.replica = nil
+	}
+	n.backend.Close()
+}
+
+// startNode запускает узел с ролью role (для follower - ведомый leader).
+func startNode(t *testing.T, role string, leader *testNode) *testNode {
+	n := &testNode{t: t, dir: t.TempDir()}
+	n.server = httptest.NewServer(n)
+	leaderURL := ""
+	if leader != nil {
+		leaderURL = leader.server.URL
+	}
+	n.start(role, leaderURL)
+	t.Cleanup(func() {
+		n.stop()
+		n.server.Close()
+	})
+	return n
+}
+
+// call выполняет запрос к узлу и возвращает код ответа и тело.
+func (n *testNode) call(method, path string, form url.Values) (int, string) {
+	n.t.Helper()
+	var req *http.Request
+	var err error
+	if method == http.MethodGet {
+		req, err = http.NewRequest(method, n.server.URL+path+"?"+form.Encode(), nil)
+	} else {
+		req, err = http.NewRequest(method, n.server.URL+path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	require.NoError(n.t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(n.t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(n.t, err)
+	return resp.StatusCode, string(body)
+}
+
+// events возвращает события пользователя за день date, полученные от узла.
+func (n *testNode) events(userID uuid.UUID, date string) []Event {
+	n.t.Helper()
+	code, body := n.call(http.MethodGet, "/events_for_day", url.Values{"user_id": {userID.String()}, "date": {date}})
+	require.Equal(n.t, http.StatusOK, code, body)
+	var res struct {
+		Result []Event `json:"result"`
+	}
+	require.NoError(n.t, json.Unmarshal([]byte(body), &res))
+	return res.Result
+}
+
+// contents возвращает версии всех событий хранилища (в корзине - со знаком минус).
+func contents(s *InmemEventStorage) map[uuid.UUID]int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	result := make(map[uuid.UUID]int64, len(s.repo))
+	for id, e := range s.repo {
+		result[id] = int64(e.Version)
+		if e.trashed() {
+			result[id] = -result[id] - 1
+		}
+	}
+	return result
+}
+
+// assertConverged проверяет, что содержимое хранилищ узлов совпадает с ведущим.
+func assertConverged(t *testing.T, leader *testNode, followers ...*testNode) {
+	t.Helper()
+	want := contents(leader.backend)
+	for _, f := range followers {
+		require.Eventually(t, func() bool {
+			return assert.ObjectsAreEqual(want, contents(f.backend))
+		}, 5*time.Second, 5*time.Millisecond)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	userID := uuid.New()
+	leader := startNode(t, "leader", nil)
+	existing := Event{ID: uuid.New(), UserID: userID, When: mustTime(t, "03.01.2022 09:00"), What: "Планёрка"}
+	require.NoError(t, leader.storage.Add(existing))
+
+	// локальные события ведомого, которых нет у ведущего, заменяются снимком
+	follower := &testNode{t: t, dir: t.TempDir()}
+	stale := openTestInmem(t, follower.dir)
+	require.NoError(t, stale.Add(Event{ID: uuid.New(), UserID: userID, When: mustTime(t, "03.01.2022 18:00"), What: "устарело"}))
+	stale.Close()
+	follower.server = httptest.NewServer(follower)
+	follower.start("follower", leader.server.URL)
+	t.Cleanup(func() {
+		follower.stop()
+		follower.server.Close()
+	})
+	require.Eventually(t, func() bool { return follower.replica.Ready() == nil }, 5*time.Second, 5*time.Millisecond)
+	code, _ := follower.call(http.MethodGet, "/readyz", nil)
+	assert.Equal(t, http.StatusOK, code)
+	events := follower.events(userID, "03.01.2022")
+	require.Len(t, events, 1)
+	assert.Equal(t, existing.ID, events[0].ID)
+
+	// изменение на ведущем доходит до ведомого и до его ленты изменений
+	changes, cancel := follower.feed.Subscribe(userID, 0)
+	defer cancel()
+	code, body := leader.call(http.MethodPost, "/create_event", url.Values{
+		"user_id": {userID.String()}, "date": {"03.01.2022"}, "time": {"12:00"}, "description": {"Стоматолог"},
+	})
+	require.Equal(t, http.StatusCreated, code, body)
+	require.Eventually(t, func() bool { return len(follower.events(userID, "03.01.2022")) == 2 }, 5*time.Second, 5*time.Millisecond)
+	select {
+	case c := <-changes:
+		assert.Equal(t, ChangeCreated, c.Type)
+		assert.Equal(t, "Стоматолог", c.Event.What)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the replicated change was not published")
+	}
+	// поисковый индекс ведомого тоже обновлён
+	code, body = follower.call(http.MethodGet, "/search_events", url.Values{"user_id": {userID.String()}, "q": {"стоматолог"}})
+	require.Equal(t, http.StatusOK, code, body)
+	assert.Contains(t, body, "Стоматолог")
+
+	// изменение, пришедшее на ведомый, выполняет ведущий, и клиент сразу видит его на ведомом
+	code, body = follower.call(http.MethodPost, "/create_event", url.Values{
+		"user_id": {userID.String()}, "date": {"04.01.2022"}, "description": {"Через ведомый"},
+	})
+	require.Equal(t, http.StatusCreated, code, body)
+	events = follower.events(userID, "04.01.2022")
+	require.Len(t, events, 1)
+	created := events[0]
+	assert.Equal(t, "Через ведомый", created.What)
+	require.Len(t, leader.events(userID, "04.01.2022"), 1)
+
+	// проверки выполняет ведущий: устаревшая версия отклоняется
+	code, body = follower.call(http.MethodPost, "/update_event", url.Values{
+		"event_id": {created.ID.String()}, "description": {"Конфликт"}, "version": {"7"},
+	})
+	assert.Equal(t, http.StatusConflict, code, body)
+
+	// удаление и транзакция через ведомый
+	code, body = follower.call(http.MethodPost, "/delete_event", url.Values{"event_id": {created.ID.String()}})
+	require.Equal(t, http.StatusNoContent, code, body)
+	assert.Empty(t, follower.events(userID, "04.01.2022"))
+	code, body = follower.call(http.MethodGet, "/trash", url.Values{"user_id": {userID.String()}})
+	require.Equal(t, http.StatusOK, code, body)
+	assert.Contains(t, body, created.ID.String())
+	batch, err := json.Marshal([]map[string]interface{}{
+		{"op": "create", "event": map[string]interface{}{"user_id": userID, "when": "2022-01-05T09:00:00Z", "what": "первое"}},
+		{"op": "create", "event": map[string]interface{}{"user_id": userID, "when": "2022-01-05T10:00:00Z", "what": "второе"}},
+	})
+	require.NoError(t, err)
+	req, err := http.NewRequest(http.MethodPost, follower.server.URL+"/batch", strings.NewReader(string(batch)))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Len(t, follower.events(userID, "05.01.2022"), 2)
+
+	// историю ведёт ведущий, ведомый передаёт ему запрос
+	code, body = follower.call(http.MethodGet, "/event_history", url.Values{"event_id": {created.ID.String()}})
+	require.Equal(t, http.StatusOK, code, body)
+	assert.Contains(t, body, `"action":"created"`)
+	assert.Contains(t, body, `"action":"deleted"`)
+
+	// ведомый, подключившийся позже, получает то же содержимое
+	late := startNode(t, "follower", leader)
+	assertConverged(t, leader, follower, late)
+
+	// данные ведомого сохраняются на диск: после перезапуска он отвечает ими,
+	// пока не получит снимок ведущего
+	follower.stop()
+	reopened := openTestInmem(t, follower.dir)
+	assert.Equal(t, contents(leader.backend), contents(reopened))
+	reopened.Close()
+}
+
+// TestReplicationLeaderRestart проверяет, что после перезапуска ведущего (новая
+// эпоха) ведомый запрашивает снимок заново и получает изменения, сделанные,
+// пока он был отключён.
+func TestReplicationLeaderRestart(t *testing.T) {
+	userID := uuid.New()
+	leader := startNode(t, "leader", nil)
+	follower := startNode(t, "follower", leader)
+	first := Event{ID: uuid.New(), UserID: userID, When: mustTime(t, "03.01.2022 09:00")}
+	require.NoError(t, leader.storage.Add(first))
+	for i := 0; i < 2; i++ {
+		require.NoError(t, leader.storage.Add(Event{ID: uuid.New(), UserID: userID, When: mustTime(t, "03.01.2022 10:00").Add(time.Duration(i) * time.Hour)}))
+	}
+	assertConverged(t, leader, follower)
+	epoch, _ := follower.replica.position()
+
+	leader.stop()
+	leader.start("leader", "")
+	// изменений больше, чем хранит журнал ведущего
+	for i := 0; i < 6; i++ {
+		require.NoError(t, leader.storage.Add(Event{ID: uuid.New(), UserID: userID, When: mustTime(t, "04.01.2022 10:00").Add(time.Duration(i) * time.Hour)}))
+	}
+	require.NoError(t, leader.storage.Delete(first.ID))
+
+	assertConverged(t, leader, follower)
+	newEpoch, _ := follower.replica.position()
+	assert.NotEqual(t, epoch, newEpoch)
+	assert.Len(t, follower.events(userID, "04.01.2022"), 6)
+	assert.Len(t, follower.events(userID, "03.01.2022"), 2)
+}
+
+// TestReplicaLeaderUnavailable проверяет ведомый без связи с ведущим: он не готов,
+// пока не получил снимок, а изменения отклоняются с кодом 502.
+func TestReplicaLeaderUnavailable(t *testing.T) {
+	gone := httptest.NewServer(http.NotFoundHandler())
+	gone.Close()
+	follower := &testNode{t: t, dir: t.TempDir()}
+	follower.server = httptest.NewServer(follower)
+	follower.start("follower", gone.URL)
+	t.Cleanup(func() {
+		follower.stop()
+		follower.server.Close()
+	})
+
+	assert.Error(t, follower.replica.Ready())
+	code, body := follower.call(http.MethodGet, "/readyz", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, body, "waiting for a snapshot")
+	code, body = follower.call(http.MethodPost, "/create_event", url.Values{"user_id": {uuid.NewString()}, "date": {"03.01.2022"}})
+	assert.Equal(t, http.StatusBadGateway, code)
+	assert.Contains(t, body, "leader is unavailable")
+}
+
+func TestReplicationLog(t *testing.T) {
+	l := newReplicationLog(3)
+	entries, wait, err := l.since(0)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	for i := 0; i < 5; i++ {
+		l.append(walRecord{Op: walDelete, ID: uuid.New()})
+	}
+	select {
+	case <-wait:
+	default:
+		t.Fatal("waiters are not notified")
+	}
+	entries, _, err = l.since(2)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	for i, e := range entries {
+		assert.Equal(t, uint64(i+3), e.Seq)
+	}
+	// журнал хранит только три последние записи
+	_, _, err = l.since(1)
+	assert.ErrorIs(t, err, errReplicationGap)
+	_, _, err = l.since(6)
+	assert.ErrorIs(t, err, errReplicationGap)
+	entries, _, err = l.since(5)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	var nilLog *replicationLog
+	assert.NotPanics(t, func() { nilLog.append(walRecord{Op: walAdd}) })
+}
+
+func TestReplicationLeaderMiddleware(t *testing.T) {
+	s := openTestInmem(t, t.TempDir())
+	defer s.Close()
+	leader := NewReplicationLeader(s, 8, testReplicationSecret)
+	var remoteAddr string
+	h := leader.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remoteAddr = r.RemoteAddr
+		require.NoError(t, s.Add(Event{ID: uuid.New(), UserID: uuid.New()}))
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	// адрес клиента из X-Forwarded-For принимается только от ведомого
+	req := httptest.NewRequest(http.MethodPost, "/create_event", nil)
+	req.RemoteAddr = "10.0.0.2:5000"
+	req.Header.Set("X-Forwarded-For", "203.0.113.7, 198.51.100.1")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, "10.0.0.2:5000", remoteAddr)
+	req.Header.Set(headerReplicationSecret, testReplicationSecret)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, "198.51.100.1:0", remoteAddr)
+
+	// ответ на изменение сообщает эпоху и номер записи, включающий это изменение
+	epoch, seq := leader.log.position()
+	assert.Equal(t, uint64(2), seq)
+	assert.Equal(t, epoch, rec.Header().Get(headerReplicationEpoch))
+	assert.Equal(t, "2", rec.Header().Get(headerReplicationSeq))
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/events_for_day", nil))
+	assert.Empty(t, rec.Header().Get(headerReplicationSeq))
+}
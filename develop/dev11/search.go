@@ -0,0 +1,543 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// defaultSearchLimit - размер страницы результатов поиска по умолчанию.
+	defaultSearchLimit = 50
+	// maxSearchLimit - максимальный размер страницы результатов поиска.
+	maxSearchLimit = 200
+)
+
+// ErrInvalidCursor - курсор страницы поиска повреждён.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// SearchQuery - параметры поиска событий пользователя.
+type SearchQuery struct {
+	// Text - слова, которые должны встречаться в описании или месте события.
+	// Слово запроса совпадает со словом события, если является его началом.
+	Text string
+	// Place - слова, которые должны встречаться в месте события.
+	Place string
+	// From и To - отрезок, в который должны попадать вхождения событий.
+	// Если отрезок задан, результатом являются вхождения, иначе - события
+	// (повторяющиеся - одним элементом).
+	From, To time.Time
+	// Limit - размер страницы (0 - defaultSearchLimit).
+	Limit int
+	// Cursor - курсор страницы из SearchResult.NextCursor (пустой - первая страница).
+	Cursor string
+}
+
+// SearchResult - страница результатов поиска, упорядоченных по началу и ID события.
+type SearchResult struct {
+	Events []Event `json:"events"`
+	// NextCursor - курсор следующей страницы (пустой, если страница последняя).
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// EventSearcher - хранилище, поддерживающее полнотекстовый поиск событий.
+type EventSearcher interface {
+	// Search возвращает страницу событий, организатором или участником которых
+	// является пользователь userID, подходящих под запрос q.
+	Search(userID uuid.UUID, q SearchQuery) (SearchResult, error)
+}
+
+// tokenize разбивает текст на слова (последовательности букв и цифр) в нижнем
+// регистре. Буква «ё» приводится к «е».
+func tokenize(s string) []string {
+	s = strings.ReplaceAll(strings.ToLower(s), "ё", "е")
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// containsTokens проверяет, что каждое слово tokens является началом какого-либо
+// слова text (так «стоматолог» находит «стоматолога»).
+func containsTokens(text string, tokens []string) bool {
+	words := tokenize(text)
+	for _, t := range tokens {
+		found := false
+		for _, w := range words {
+			if strings.HasPrefix(w, t) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+var (
+	_ TxStorage       = (*IndexedEventStorage)(nil)
+	_ TrashStorage    = (*IndexedEventStorage)(nil)
+	_ EventSearcher   = (*IndexedEventStorage)(nil)
+	_ ReplicaStorage  = (*IndexedEventStorage)(nil)
+	_ ReminderStorage = (*IndexedEventStorage)(nil)
+)
+
+// IndexedEventStorage дополняет хранилище обратным индексом слов из описания
+// и места событий. Индекс строится при создании и обновляется при каждом
+// изменении хранилища через Add, Update, Delete и Restore.
+type IndexedEventStorage struct {
+	EventStorage
+	mu *sync.RWMutex
+	// index - слова событий по пользователям: событие индексируется у организатора
+	// и у каждого участника, поэтому поиск не просматривает чужие события.
+	index map[uuid.UUID]*wordIndex
+	// indexed - пользователи и слова, под которыми проиндексировано событие.
+	indexed map[uuid.UUID]indexEntry
+	// effects - изменения индекса, отложенные до фиксации транзакции (см. Tx).
+	effects *txEffects
+}
+
+// wordIndex - слова событий одного пользователя.
+type wordIndex struct {
+	// ids - ID событий по словам.
+	ids map[string]map[uuid.UUID]struct{}
+	// words - слова из ids по возрастанию: слова с общим началом идут подряд,
+	// поэтому поиск по началу слова стоит O(log n + k).
+	words []string
+}
+
+// indexEntry - то, под чем проиндексировано событие.
+type indexEntry struct {
+	users  []uuid.UUID
+	tokens []string
+}
+
+// add добавляет событие id под словом word.
+func (w *wordIndex) add(word string, id uuid.UUID) {
+	ids, ok := w.ids[word]
+	if !ok {
+		ids = make(map[uuid.UUID]struct{})
+		w.ids[word] = ids
+		i := sort.SearchStrings(w.words, word)
+		w.words = append(w.words, "")
+		copy(w.words[i+1:], w.words[i:])
+		w.words[i] = word
+	}
+	ids[id] = struct{}{}
+}
+
+// remove удаляет событие id из-под слова word.
+func (w *wordIndex) remove(word string, id uuid.UUID) {
+	ids, ok := w.ids[word]
+	if !ok {
+		return
+	}
+	delete(ids, id)
+	if len(ids) == 0 {
+		delete(w.ids, word)
+		i := sort.SearchStrings(w.words, word)
+		w.words = append(w.words[:i], w.words[i+1:]...)
+	}
+}
+
+// withPrefix вызывает fn для ID событий каждого слова, начинающегося с prefix.
+func (w *wordIndex) withPrefix(prefix string, fn func(ids map[uuid.UUID]struct{})) {
+	for i := sort.SearchStrings(w.words, prefix); i < len(w.words) && strings.HasPrefix(w.words[i], prefix); i++ {
+		fn(w.ids[w.words[i]])
+	}
+}
+
+// NewIndexedEventStorage строит индекс по всем событиям хранилища s.
+func NewIndexedEventStorage(s EventStorage) (*IndexedEventStorage, error) {
+	is := &IndexedEventStorage{
+		EventStorage: s,
+		mu:           &sync.RWMutex{},
+		index:        make(map[uuid.UUID]*wordIndex),
+		indexed:      make(map[uuid.UUID]indexEntry),
+	}
+	events, err := s.GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("indexedEventStorage: could not build index: %w", err)
+	}
+	for _, e := range events {
+		is.indexEvent(e)
+	}
+	return is, nil
+}
+
+// Add добавляет событие в хранилище и в индекс.
+func (s *IndexedEventStorage) Add(e Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.EventStorage.Add(e); err != nil {
+		return err
+	}
+	s.effects.after(func() { s.indexEvent(e) })
+	return nil
+}
+
+// Update перезаписывает событие в хранилище и переиндексирует его.
+func (s *IndexedEventStorage) Update(e Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.EventStorage.Update(e); err != nil {
+		return err
+	}
+	s.effects.after(func() {
+		s.unindexEvent(e.ID)
+		s.indexEvent(e)
+	})
+	return nil
+}
+
+// Delete удаляет событие из хранилища и из индекса.
+func (s *IndexedEventStorage) Delete(eventID uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.EventStorage.Delete(eventID); err != nil {
+		return err
+	}
+	s.effects.after(func() { s.unindexEvent(eventID) })
+	return nil
+}
+
+// Trash возвращает события корзины (см. TrashStorage).
+func (s *IndexedEventStorage) Trash(userID uuid.UUID) ([]Event, error) {
+	ts, err := trashStorage(s.EventStorage)
+	if err != nil {
+		return nil, err
+	}
+	return ts.Trash(userID)
+}
+
+// GetDeleted возвращает событие из корзины (см. TrashStorage).
+func (s *IndexedEventStorage) GetDeleted(eventID uuid.UUID) (Event, error) {
+	ts, err := trashStorage(s.EventStorage)
+	if err != nil {
+		return Event{}, err
+	}
+	return ts.GetDeleted(eventID)
+}
+
+// Purge окончательно удаляет события из корзины (см. TrashStorage).
+func (s *IndexedEventStorage) Purge(before time.Time) (int, error) {
+	ts, err := trashStorage(s.EventStorage)
+	if err != nil {
+		return 0, err
+	}
+	return ts.Purge(before)
+}
+
+// Restore возвращает событие из корзины и снова индексирует его.
+func (s *IndexedEventStorage) Restore(eventID uuid.UUID) error {
+	ts, err := trashStorage(s.EventStorage)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := ts.Restore(eventID); err != nil {
+		return err
+	}
+	e, err := s.EventStorage.Get(eventID)
+	if err != nil {
+		return err
+	}
+	s.effects.after(func() { s.indexEvent(e) })
+	return nil
+}
+
+// Tx выполняет fn в транзакции хранилища (см. TxStorage); индекс обновляется
+// после её фиксации. Поиск внутри транзакции не видит её изменений.
+func (s *IndexedEventStorage) Tx(fn func(EventStorage) error) error {
+	if s.effects != nil {
+		return fn(s) // вложенная транзакция - часть внешней
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return txWithEffects(s.EventStorage, func(tx EventStorage, effects *txEffects) EventStorage {
+		return &IndexedEventStorage{EventStorage: tx, mu: &sync.RWMutex{}, index: s.index, indexed: s.indexed, effects: effects}
+	}, fn)
+}
+
+// Replicate применяет изменения ведущего узла (см. ReplicaStorage) и переиндексирует
+// изменившиеся события.
+func (s *IndexedEventStorage) Replicate(b ReplicationBatch) ([]ReplicatedChange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changes, err := replicate(s.EventStorage, b)
+	for _, c := range changes {
+		if c.Before != nil {
+			s.unindexEvent(c.Before.ID)
+		}
+		if c.After != nil && !c.After.trashed() {
+			s.indexEvent(*c.After)
+		}
+	}
+	return changes, err
+}
+
+// GetWithReminders выбирает события с напоминаниями (см. ReminderStorage).
+func (s *IndexedEventStorage) GetWithReminders(from, to time.Time) ([]Event, error) {
+	return remindingEvents(s.EventStorage, from, to)
+}
+
+// indexEvent добавляет слова описания и места события в индекс организатора
+// и участников.
+func (s *IndexedEventStorage) indexEvent(e Event) {
+	entry := indexEntry{users: indexUsers(&e)}
+	seen := make(map[string]bool)
+	for _, t := range tokenize(e.What + " " + e.Where) {
+		if !seen[t] {
+			seen[t] = true
+			entry.tokens = append(entry.tokens, t)
+		}
+	}
+	if len(entry.tokens) == 0 {
+		return
+	}
+	for _, userID := range entry.users {
+		w, ok := s.index[userID]
+		if !ok {
+			w = &wordIndex{ids: make(map[string]map[uuid.UUID]struct{})}
+			s.index[userID] = w
+		}
+		for _, t := range entry.tokens {
+			w.add(t, e.ID)
+		}
+	}
+	s.indexed[e.ID] = entry
+}
+
+// unindexEvent удаляет событие из индекса.
+func (s *IndexedEventStorage) unindexEvent(eventID uuid.UUID) {
+	entry := s.indexed[eventID]
+	for _, userID := range entry.users {
+		w := s.index[userID]
+		if w == nil {
+			continue
+		}
+		for _, t := range entry.tokens {
+			w.remove(t, eventID)
+		}
+		if len(w.words) == 0 {
+			delete(s.index, userID)
+		}
+	}
+	delete(s.indexed, eventID)
+}
+
+// lookup возвращает ID событий пользователя userID (в том числе тех, на которые
+// он приглашён), в которых для каждого слова tokens встречается слово,
+// начинающееся с него.
+func (s *IndexedEventStorage) lookup(userID uuid.UUID, tokens []string) []uuid.UUID {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	w := s.index[userID]
+	if w == nil {
+		return nil
+	}
+	var result map[uuid.UUID]struct{}
+	for _, t := range tokens {
+		matched := make(map[uuid.UUID]struct{})
+		w.withPrefix(t, func(ids map[uuid.UUID]struct{}) {
+			for id := range ids {
+				if _, ok := result[id]; ok || result == nil {
+					matched[id] = struct{}{}
+				}
+			}
+		})
+		if len(matched) == 0 {
+			return nil
+		}
+		result = matched
+	}
+	ids := make([]uuid.UUID, 0, len(result))
+	for id := range result {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Search ищет события пользователя: по его части индекса, если задан текст запроса,
+// иначе - среди всех событий пользователя. Поиск не зависит от регистра,
+// слова запроса сопоставляются с началом слов события.
+func (s *IndexedEventStorage) Search(userID uuid.UUID, q SearchQuery) (SearchResult, error) {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	}
+	if limit > maxSearchLimit {
+		limit = maxSearchLimit
+	}
+	afterWhen, afterID, err := decodeCursor(q.Cursor)
+	if err != nil {
+		return SearchResult{}, err
+	}
+
+	var candidates []Event
+	if tokens := tokenize(q.Text); len(tokens) > 0 {
+		for _, id := range s.lookup(userID, tokens) {
+			e, err := s.EventStorage.Get(id)
+			if errors.Is(err, ErrEventNotFound) {
+				continue // удалено после поиска по индексу
+			}
+			if err != nil {
+				return SearchResult{}, err
+			}
+			if e.involves(userID) {
+				candidates = append(candidates, e)
+			}
+		}
+	} else {
+		own, err := s.EventStorage.GetByUser(userID)
+		if err != nil {
+			return SearchResult{}, err
+		}
+		invited, err := s.EventStorage.GetByAttendee(userID)
+		if err != nil {
+			return SearchResult{}, err
+		}
+		candidates = append(own, invited...)
+	}
+
+	placeTokens := tokenize(q.Place)
+	matches := make([]Event, 0)
+	for _, e := range candidates {
+		if !containsTokens(e.Where, placeTokens) {
+			continue
+		}
+		if q.From.IsZero() && q.To.IsZero() {
+			matches = append(matches, e)
+			continue
+		}
+		matches = append(matches, e.Expand(q.From, q.To)...)
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return searchLess(matches[i].When, matches[i].ID, matches[j].When, matches[j].ID)
+	})
+
+	// пропускаем элементы до курсора включительно
+	start := 0
+	if q.Cursor != "" {
+		start = sort.Search(len(matches), func(i int) bool {
+			return searchLess(afterWhen, afterID, matches[i].When, matches[i].ID)
+		})
+	}
+	end := start + limit
+	result := SearchResult{Events: make([]Event, 0, limit)}
+	if end >= len(matches) {
+		end = len(matches)
+	} else {
+		last := matches[end-1]
+		result.NextCursor = encodeCursor(last.When, last.ID)
+	}
+	result.Events = append(result.Events, matches[start:end]...)
+	return result, nil
+}
+
+// searchLess задаёт порядок результатов поиска: по началу, затем по ID события.
+func searchLess(aWhen time.Time, aID uuid.UUID, bWhen time.Time, bID uuid.UUID) bool {
+	if !aWhen.Equal(bWhen) {
+		return aWhen.Before(bWhen)
+	}
+	return aID.String() < bID.String()
+}
+
+// encodeCursor кодирует позицию последнего элемента страницы.
+func encodeCursor(when time.Time, id uuid.UUID) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(when.UnixNano(), 10) + ":" + id.String()))
+}
+
+// decodeCursor разбирает курсор, полученный от encodeCursor. Пустой курсор допустим.
+func decodeCursor(cursor string) (time.Time, uuid.UUID, error) {
+	if cursor == "" {
+		return time.Time{}, uuid.Nil, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, uuid.Nil, ErrInvalidCursor
+	}
+	nanos, idStr, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return time.Time{}, uuid.Nil, ErrInvalidCursor
+	}
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return time.Time{}, uuid.Nil, ErrInvalidCursor
+	}
+	id, err := uuid.Parse(idStr)
+	if err != nil {
+		return time.Time{}, uuid.Nil, ErrInvalidCursor
+	}
+	return time.Unix(0, n), id, nil
+}
+
+// SearchEvents ищет события пользователя по словам в описании и месте.
+// Результаты упорядочены по началу события и разбиты на страницы; курсор
+// следующей страницы возвращается в поле next_cursor.
+//
+// GET /search_events
+// параметры (* = обязательный):
+//	- *user_id
+//	- q 			слова, которые должны встречаться в описании или месте (без учёта регистра)
+//	- place 		слова, которые должны встречаться в месте
+//	- from, to 		отрезок dd.mm.yyyy или dd.mm.yyyy hh:mm; если задан - ищутся вхождения в нём
+//	- tz 			часовой пояс IANA для from и to (по умолчанию UTC)
+//	- limit 		размер страницы (по умолчанию 50, не больше 200)
+//	- cursor 		курсор страницы из next_cursor
+func (c CalendarAPI) SearchEvents(w http.ResponseWriter, r *http.Request) {
+	const logHeader = "searchEvents"
+	if r.Method != http.MethodGet {
+		returnError(w, logHeader, "", http.StatusMethodNotAllowed)
+		return
+	}
+	searcher, ok := c.storage.(EventSearcher)
+	if !ok {
+		returnError(w, logHeader, "search is not supported by the storage", http.StatusNotImplemented)
+		return
+	}
+	userID, ok := getUserID(w, r, logHeader)
+	if !ok {
+		return // ошибки уже обработаны
+	}
+	q := SearchQuery{
+		Text:   r.FormValue("q"),
+		Place:  r.FormValue("place"),
+		Cursor: r.FormValue("cursor"),
+	}
+	if r.FormValue("from") != "" || r.FormValue("to") != "" {
+		q.From, q.To, ok = getTimeRange(w, r, logHeader)
+		if !ok {
+			return // ошибки уже обработаны
+		}
+	}
+	if queryLimit := r.FormValue("limit"); queryLimit != "" {
+		limit, err := strconv.Atoi(queryLimit)
+		if err != nil || limit <= 0 || limit > maxSearchLimit {
+			returnError(w, logHeader, fmt.Sprintf("incorrect limit: must be between 1 and %d", maxSearchLimit), http.StatusBadRequest)
+			return
+		}
+		q.Limit = limit
+	}
+	result, err := searcher.Search(userID, q)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrInvalidCursor) {
+			status = http.StatusBadRequest
+		}
+		returnError(w, logHeader, err.Error(), status)
+		return
+	}
+	returnJSONResult(w, logHeader, result, http.StatusOK)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenize(t *testing.T) {
+	assert.Empty(t, tokenize(" ,.!"))
+	assert.Equal(t, []string{"прием", "у", "dentist", "в", "10", "00"}, tokenize("Приём у DENTIST'в 10:00"))
+	assert.True(t, containsTokens("Клиника «Зубы», кабинет 5", []string{"зубы", "5"}))
+	assert.False(t, containsTokens("Клиника", []string{"кабинет"}))
+}
+
+func TestIndexedEventStorage(t *testing.T) {
+	s, err := NewIndexedEventStorage(newTestStorage())
+	require.NoError(t, err)
+	testEventStorage(t, s)
+}
+
+func TestSearch(t *testing.T) {
+	userID, otherID := uuid.New(), uuid.New()
+	backend := newTestStorage()
+	// события, добавленные до создания индекса, индексируются при создании
+	dentist := Event{ID: uuid.New(), UserID: userID, When: mustTime(t, "03.01.2022 10:00"), What: "Приём у стоматолога", Where: "Клиника на Ленина"}
+	require.NoError(t, backend.Add(dentist))
+	s, err := NewIndexedEventStorage(backend)
+	require.NoError(t, err)
+
+	weekly, err := ParseRRule("FREQ=WEEKLY;COUNT=4")
+	require.NoError(t, err)
+	events := []Event{
+		{ID: uuid.New(), UserID: userID, When: mustTime(t, "04.01.2022 09:00"), What: "Dentist checkup", Where: "Clinic"},
+		{ID: uuid.New(), UserID: userID, When: mustTime(t, "05.01.2022 09:00"), What: "Стоматолог: контроль", Recurrence: weekly},
+		{ID: uuid.New(), UserID: otherID, When: mustTime(t, "03.01.2022 12:00"), What: "Стоматолог"},
+		{ID: uuid.New(), UserID: otherID, When: mustTime(t, "06.01.2022 12:00"), What: "Стоматолог вместе",
+			Attendees: []Attendee{{UserID: userID, Status: RSVPNeedsAction}}},
+	}
+	for _, e := range events {
+		require.NoError(t, s.Add(e))
+	}
+
+	res, err := s.Search(userID, SearchQuery{Text: "СТОМАТОЛОГ"})
+	require.NoError(t, err)
+	// события пользователя и приглашение, но не чужое событие
+	require.Equal(t, 3, len(res.Events))
+	assert.Equal(t, dentist.ID, res.Events[0].ID)
+	assert.Empty(t, res.NextCursor)
+
+	res, err = s.Search(userID, SearchQuery{Text: "dentist"})
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(res.Events))
+	res, err = s.Search(userID, SearchQuery{Place: "ленина"})
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(res.Events))
+	res, err = s.Search(userID, SearchQuery{Text: "стоматолог", Place: "clinic"})
+	require.NoError(t, err)
+	assert.Empty(t, res.Events)
+
+	// с отрезком возвращаются вхождения
+	res, err = s.Search(userID, SearchQuery{Text: "контроль", From: mustTime(t, "01.01.2022 00:00"), To: mustTime(t, "31.01.2022 00:00")})
+	require.NoError(t, err)
+	assert.Equal(t, 4, len(res.Events))
+
+	// постраничный вывод
+	var pages [][]Event
+	q := SearchQuery{Text: "стоматолог", From: mustTime(t, "01.01.2022 00:00"), To: mustTime(t, "31.01.2022 00:00"), Limit: 2}
+	for {
+		res, err := s.Search(userID, q)
+		require.NoError(t, err)
+		pages = append(pages, res.Events)
+		if res.NextCursor == "" {
+			break
+		}
+		q.Cursor = res.NextCursor
+	}
+	// 1 + 4 вхождения + приглашение = 6 по 2 на странице
+	require.Equal(t, 3, len(pages))
+	for i := 1; i < len(pages); i++ {
+		assert.True(t, pages[i-1][1].When.Before(pages[i][0].When))
+	}
+	_, err = s.Search(userID, SearchQuery{Text: "стоматолог", Cursor: "garbage!"})
+	assert.ErrorIs(t, err, ErrInvalidCursor)
+
+	// индекс следует за изменениями
+	updated := events[0]
+	updated.What = "Окулист"
+	updated.Version++
+	require.NoError(t, s.Update(updated))
+	res, err = s.Search(userID, SearchQuery{Text: "dentist"})
+	require.NoError(t, err)
+	assert.Empty(t, res.Events)
+	res, err = s.Search(userID, SearchQuery{Text: "окулист"})
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(res.Events))
+	require.NoError(t, s.Delete(updated.ID))
+	res, err = s.Search(userID, SearchQuery{Text: "окулист"})
+	require.NoError(t, err)
+	assert.Empty(t, res.Events)
+	assert.NotContains(t, s.index[userID].words, "окулист")
+
+	// индекс хранит слова по пользователям: поиск не просматривает чужие события
+	assert.ElementsMatch(t, []uuid.UUID{events[2].ID, events[3].ID}, s.lookup(otherID, []string{"стомат"}))
+	assert.Equal(t, []string{"вместе", "стоматолог"}, s.index[otherID].words)
+	require.NoError(t, s.Delete(events[2].ID))
+	require.NoError(t, s.Delete(events[3].ID))
+	assert.Nil(t, s.index[otherID])
+}
+
+func TestSearchHandler(t *testing.T) {
+	s, err := NewIndexedEventStorage(newTestStorage())
+	require.NoError(t, err)
+	api := NewCalendar(s)
+	userID := uuid.New().String()
+	for _, date := range []string{"03.01.2022", "04.01.2022", "05.01.2022"} {
+		rec := doForm(api.CreateEvent, http.MethodPost, "/create_event", url.Values{
+			"user_id": {userID}, "date": {date}, "description": {"Стоматолог"}, "place": {"Клиника"},
+		})
+		require.Equal(t, http.StatusCreated, rec.Code)
+	}
+
+	rec := doForm(api.SearchEvents, http.MethodGet, "/search_events", url.Values{
+		"user_id": {userID}, "q": {"стоматолог"}, "from": {"04.01.2022"}, "to": {"10.01.2022"}, "limit": {"1"},
+	})
+	require.Equal(t, http.StatusOK, rec.Code)
+	var res struct {
+		Result struct {
+			Events     []Event `json:"events"`
+			NextCursor string  `json:"next_cursor"`
+		}
+	}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&res))
+	require.Equal(t, 1, len(res.Result.Events))
+	assert.True(t, mustTime(t, "04.01.2022 00:00").Equal(res.Result.Events[0].When))
+	require.NotEmpty(t, res.Result.NextCursor)
+
+	for _, bad := range []url.Values{
+		{"user_id": {userID}, "q": {"x"}, "limit": {"0"}},
+		{"user_id": {userID}, "q": {"x"}, "cursor": {"garbage"}},
+		{"user_id": {userID}, "q": {"x"}, "from": {"04.01.2022"}},
+		{"q": {"x"}},
+	} {
+		rec = doForm(api.SearchEvents, http.MethodGet, "/search_events", bad)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, bad)
+	}
+
+	// хранилище без индекса поиск не поддерживает
+	rec = doForm(NewCalendar(newTestStorage()).SearchEvents, http.MethodGet, "/search_events", url.Values{"user_id": {userID}})
+	assert.Equal(t, http.StatusNotImplemented, rec.Code)
+}
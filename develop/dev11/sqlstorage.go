@@ -0,0 +1,494 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	_ "modernc.org/sqlite" // драйвер SQLite на чистом Go (без cgo)
+)
+
+var (
+	_ TxStorage       = (*SQLEventStorage)(nil)
+	_ TrashStorage    = (*SQLEventStorage)(nil)
+	_ ReadyChecker    = (*SQLEventStorage)(nil)
+	_ ReminderStorage = (*SQLEventStorage)(nil)
+)
+
+// SQLEventStorage - имплементация EventStorage на встроенной базе данных SQLite.
+// Для выборки по диапазону дат используется индекс (user_id, starts_at), поэтому
+// запросы не просматривают все события. Событие целиком хранится в колонке data
+// в виде JSON, в отдельные колонки вынесены только поля, по которым идёт поиск.
+type SQLEventStorage struct {
+	db *sql.DB
+	// tx - открытая транзакция, если хранилище - её представление (см. Tx).
+	tx *sql.Tx
+}
+
+// sqlConn - общие методы *sql.DB и *sql.Tx, через которые выполняются запросы.
+type sqlConn interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// conn возвращает открытую транзакцию либо базу данных.
+func (s *SQLEventStorage) conn() sqlConn {
+	if s.tx != nil {
+		return s.tx
+	}
+	return s.db
+}
+
+// sqlMigrations - миграции схемы базы данных. Номер миграции - её индекс в срезе + 1.
+// Применённые миграции записываются в таблицу schema_migrations, поэтому новые
+// миграции добавляются только в конец списка, а существующие не изменяются.
+var sqlMigrations = []string{
+	// 1: события. starts_at - начало события (или серии) в секундах Unix,
+	// until_at - начало последнего вхождения серии (NULL - без ограничения),
+	// recurring - признак повторяющегося события.
+	`CREATE TABLE events (
+		id        TEXT PRIMARY KEY,
+		user_id   TEXT NOT NULL,
+		starts_at INTEGER NOT NULL,
+		until_at  INTEGER,
+		recurring INTEGER NOT NULL DEFAULT 0,
+		data      TEXT NOT NULL
+	)`,
+	// 2: индекс для выборок по диапазону дат и частичный индекс для серий,
+	// начавшихся до запрашиваемого диапазона.
+	`CREATE INDEX events_user_when ON events (user_id, starts_at);
+	CREATE INDEX events_user_recurring ON events (user_id, starts_at) WHERE recurring = 1`,
+	// 3: участники событий. Строки дублируют Event.Attendees из data и нужны
+	// для выборки событий, на которые приглашён пользователь.
+	`CREATE TABLE event_attendees (
+		event_id TEXT NOT NULL,
+		user_id  TEXT NOT NULL,
+		PRIMARY KEY (event_id, user_id)
+	);
+	CREATE INDEX event_attendees_user ON event_attendees (user_id)`,
+	// 4: версия события (дублирует Event.Version из data) для условного обновления.
+	`ALTER TABLE events ADD COLUMN version INTEGER NOT NULL DEFAULT 0`,
+	// 5: момент перемещения события в корзину в секундах Unix (дублирует
+	// Event.DeletedAt из data; NULL - событие не удалено) и индекс для очистки корзины.
+	`ALTER TABLE events ADD COLUMN deleted_at INTEGER;
+	CREATE INDEX events_deleted ON events (deleted_at) WHERE deleted_at IS NOT NULL`,
+	// 6: признак события с напоминаниями (дублирует непустой Event.Reminders из data)
+	// и частичный индекс для выборки планировщиком напоминаний.
+	`ALTER TABLE events ADD COLUMN reminding INTEGER NOT NULL DEFAULT 0;
+	UPDATE events SET reminding = 1 WHERE json_array_length(data, '$.Reminders') > 0;
+	CREATE INDEX events_reminding ON events (starts_at) WHERE reminding = 1`,
+}
+
+// NewSQLEventStorage открывает (или создаёт) базу данных в файле path
+// и применяет к ней недостающие миграции.
+func NewSQLEventStorage(path string) (*SQLEventStorage, error) {
+	// транзакции начинаются с BEGIN IMMEDIATE: saveEvent и /batch сначала читают,
+	// а потом пишут, и отложенная транзакция не смогла бы получить блокировку
+	// записи после чужого коммита (SQLITE_BUSY без ожидания busy_timeout)
+	dsn := fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_txlock=immediate", path)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	s := &SQLEventStorage{db: db}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("sqlEventStorage: migration failed: %w", err)
+	}
+	return s, nil
+}
+
+// migrate применяет к базе данных миграции, которые ещё не были применены.
+func (s *SQLEventStorage) migrate() error {
+	_, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at TEXT NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+	var current int
+	if err := s.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return err
+	}
+	if current > len(sqlMigrations) {
+		return fmt.Errorf("database schema version %d is newer than supported %d", current, len(sqlMigrations))
+	}
+	for version := current + 1; version <= len(sqlMigrations); version++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqlMigrations[version-1]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+		_, err = tx.Exec(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`,
+			version, time.Now().UTC().Format(time.RFC3339))
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+		log.Printf("sqlEventStorage: migration %d applied", version)
+	}
+	return nil
+}
+
+// Ready сообщает, доступна ли база данных.
+func (s *SQLEventStorage) Ready() error {
+	if err := s.db.Ping(); err != nil {
+		return fmt.Errorf("sqlEventStorage: %w", err)
+	}
+	return nil
+}
+
+// Close закрывает соединение с базой данных.
+func (s *SQLEventStorage) Close() {
+	if err := s.db.Close(); err != nil {
+		log.Printf("sqlEventStorage: could not close database: %v", err)
+		return
+	}
+	log.Println("sqlEventStorage closed")
+}
+
+// eventRow - значения колонок таблицы events для события.
+type eventRow struct {
+	startsAt  int64
+	untilAt   sql.NullInt64
+	recurring bool
+	reminding bool
+	data      []byte
+}
+
+// toRow готовит значения колонок для записи события в таблицу.
+func toRow(e Event) (eventRow, error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return eventRow{}, err
+	}
+	row := eventRow{startsAt: e.When.Unix(), reminding: len(e.Reminders) > 0, data: data}
+	switch {
+	case e.Recurrence == nil:
+		row.untilAt = sql.NullInt64{Int64: row.startsAt, Valid: true}
+	case !e.Recurrence.Until.IsZero():
+		row.recurring = true
+		row.untilAt = sql.NullInt64{Int64: e.Recurrence.Until.Unix(), Valid: true}
+	default:
+		// серия с COUNT или без ограничения: конец серии не вычисляется
+		row.recurring = true
+	}
+	return row, nil
+}
+
+func (s *SQLEventStorage) Add(e Event) error {
+	row, err := toRow(e)
+	if err != nil {
+		return err
+	}
+	return s.inTx(func(tx *sql.Tx) error {
+		// событие в корзине тоже занимает свой ID
+		res, err := tx.Exec(`INSERT INTO events (id, user_id, starts_at, until_at, recurring, reminding, version, data)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT (id) DO NOTHING`,
+			e.ID.String(), e.UserID.String(), row.startsAt, row.untilAt, row.recurring, row.reminding, int64(e.Version), row.data)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrEventAlreadyExists
+		}
+		return insertAttendees(tx, e)
+	})
+}
+
+func (s *SQLEventStorage) Update(e Event) error {
+	row, err := toRow(e)
+	if err != nil {
+		return err
+	}
+	return s.inTx(func(tx *sql.Tx) error {
+		// событие обновляется, только если его версия не изменилась после чтения
+		res, err := tx.Exec(`UPDATE events SET user_id = ?, starts_at = ?, until_at = ?, recurring = ?, reminding = ?, version = ?,
+			data = ? WHERE id = ? AND version = ? AND deleted_at IS NULL`,
+			e.UserID.String(), row.startsAt, row.untilAt, row.recurring, row.reminding, int64(e.Version), row.data,
+			e.ID.String(), int64(e.Version)-1)
+		if err != nil {
+			return err
+		}
+		if err := checkAffected(res); err == ErrEventNotFound {
+			// событие либо удалено, либо изменено другим запросом
+			var exists bool
+			err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM events WHERE id = ? AND deleted_at IS NULL)`, e.ID.String()).Scan(&exists)
+			if err != nil {
+				return err
+			}
+			if exists {
+				return ErrVersionConflict
+			}
+			return ErrEventNotFound
+		} else if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM event_attendees WHERE event_id = ?`, e.ID.String()); err != nil {
+			return err
+		}
+		return insertAttendees(tx, e)
+	})
+}
+
+// Delete перемещает событие в корзину. Строки участников сохраняются
+// до окончательного удаления события.
+func (s *SQLEventStorage) Delete(eventID uuid.UUID) error {
+	deletedAt := time.Now().UTC()
+	return s.setDeletedAt(eventID, &deletedAt)
+}
+
+func (s *SQLEventStorage) Restore(eventID uuid.UUID) error {
+	return s.setDeletedAt(eventID, nil)
+}
+
+// setDeletedAt перемещает событие в корзину (deletedAt != nil) или возвращает
+// из неё. Если событие не найдено там, откуда перемещается, возвращается ErrEventNotFound.
+func (s *SQLEventStorage) setDeletedAt(eventID uuid.UUID, deletedAt *time.Time) error {
+	trashed := "deleted_at IS NOT NULL"
+	column := sql.NullInt64{}
+	if deletedAt != nil {
+		trashed = "deleted_at IS NULL"
+		column = sql.NullInt64{Int64: deletedAt.Unix(), Valid: true}
+	}
+	return s.inTx(func(tx *sql.Tx) error {
+		var data []byte
+		err := tx.QueryRow(`SELECT data FROM events WHERE id = ? AND `+trashed, eventID.String()).Scan(&data)
+		if err == sql.ErrNoRows {
+			return ErrEventNotFound
+		}
+		if err != nil {
+			return err
+		}
+		var e Event
+		if err := json.Unmarshal(data, &e); err != nil {
+			return err
+		}
+		e.DeletedAt = deletedAt
+		if data, err = json.Marshal(e); err != nil {
+			return err
+		}
+		_, err = tx.Exec(`UPDATE events SET deleted_at = ?, data = ? WHERE id = ?`, column, data, eventID.String())
+		return err
+	})
+}
+
+// Purge окончательно удаляет события из корзины вместе со строками участников.
+func (s *SQLEventStorage) Purge(before time.Time) (int, error) {
+	var purged int
+	err := s.inTx(func(tx *sql.Tx) error {
+		err := tx.QueryRow(`SELECT COUNT(*) FROM events WHERE deleted_at < ?`, before.Unix()).Scan(&purged)
+		if err != nil {
+			return err
+		}
+		return deleteEvents(tx, `deleted_at < ?`, before.Unix())
+	})
+	if err != nil {
+		return 0, err
+	}
+	return purged, nil
+}
+
+// deleteEvents окончательно удаляет события, удовлетворяющие условию where,
+// и строки их участников.
+func deleteEvents(tx *sql.Tx, where string, args ...interface{}) error {
+	_, err := tx.Exec(`DELETE FROM event_attendees WHERE event_id IN (SELECT id FROM events WHERE `+where+`)`, args...)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM events WHERE `+where, args...)
+	return err
+}
+
+// Tx выполняет fn в транзакции базы данных (см. TxStorage).
+func (s *SQLEventStorage) Tx(fn func(EventStorage) error) error {
+	if s.tx != nil {
+		return fn(s) // вложенная транзакция - часть внешней
+	}
+	return s.inTx(func(tx *sql.Tx) error {
+		return fn(&SQLEventStorage{db: s.db, tx: tx})
+	})
+}
+
+// inTx выполняет f в транзакции: при ошибке транзакция откатывается.
+// В представлении транзакции (см. Tx) f выполняется в ней же.
+func (s *SQLEventStorage) inTx(f func(tx *sql.Tx) error) error {
+	if s.tx != nil {
+		return f(s.tx)
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertAttendees записывает участников события в таблицу event_attendees.
+func insertAttendees(tx *sql.Tx, e Event) error {
+	for _, a := range e.Attendees {
+		_, err := tx.Exec(`INSERT INTO event_attendees (event_id, user_id) VALUES (?, ?)`,
+			e.ID.String(), a.UserID.String())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkAffected возвращает ErrEventNotFound, если запрос не изменил ни одной строки.
+func checkAffected(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrEventNotFound
+	}
+	return nil
+}
+
+func (s *SQLEventStorage) Get(eventID uuid.UUID) (Event, error) {
+	var data []byte
+	err := s.conn().QueryRow(`SELECT data FROM events WHERE id = ? AND deleted_at IS NULL`, eventID.String()).Scan(&data)
+	if err == sql.ErrNoRows {
+		return Event{}, ErrEventNotFound
+	}
+	if err != nil {
+		return Event{}, err
+	}
+	var e Event
+	if err := json.Unmarshal(data, &e); err != nil {
+		return Event{}, err
+	}
+	return e, nil
+}
+
+func (s *SQLEventStorage) GetByUser(userID uuid.UUID) ([]Event, error) {
+	return s.queryEvents(`SELECT data FROM events WHERE user_id = ? AND deleted_at IS NULL ORDER BY starts_at`, userID.String())
+}
+
+func (s *SQLEventStorage) GetAll() ([]Event, error) {
+	return s.queryEvents(`SELECT data FROM events WHERE deleted_at IS NULL ORDER BY starts_at`)
+}
+
+func (s *SQLEventStorage) GetByAttendee(userID uuid.UUID) ([]Event, error) {
+	return s.queryEvents(`SELECT data FROM events
+		WHERE id IN (SELECT event_id FROM event_attendees WHERE user_id = ?) AND deleted_at IS NULL
+		ORDER BY starts_at`, userID.String())
+}
+
+func (s *SQLEventStorage) Trash(userID uuid.UUID) ([]Event, error) {
+	events, err := s.queryEvents(`SELECT data FROM events WHERE user_id = ? AND deleted_at IS NOT NULL`, userID.String())
+	if err != nil {
+		return nil, err
+	}
+	sortTrash(events)
+	return events, nil
+}
+
+func (s *SQLEventStorage) GetDeleted(eventID uuid.UUID) (Event, error) {
+	events, err := s.queryEvents(`SELECT data FROM events WHERE id = ? AND deleted_at IS NOT NULL`, eventID.String())
+	if err != nil {
+		return Event{}, err
+	}
+	if len(events) == 0 {
+		return Event{}, ErrEventNotFound
+	}
+	return events[0], nil
+}
+
+func (s *SQLEventStorage) GetByDay(userID uuid.UUID, t time.Time) ([]Event, error) {
+	return s.GetRange(userID, t, t.AddDate(0, 0, 1))
+}
+
+func (s *SQLEventStorage) GetForWeek(userID uuid.UUID, t time.Time) ([]Event, error) {
+	return s.GetRange(userID, t, t.AddDate(0, 0, 7))
+}
+
+func (s *SQLEventStorage) GetForMonth(userID uuid.UUID, t time.Time) ([]Event, error) {
+	return s.GetRange(userID, t, t.AddDate(0, 1, 0))
+}
+
+// GetRange возвращает вхождения событий пользователя (в том числе тех, на которые
+// он приглашён) в отрезке [from, to]. Однократные события выбираются по индексу в границах отрезка, повторяющиеся -
+// среди серий, начавшихся не позже конца отрезка и не закончившихся до его начала.
+// Точная проверка границ и разворачивание серий выполняются в Event.Expand.
+func (s *SQLEventStorage) GetRange(userID uuid.UUID, from, to time.Time) ([]Event, error) {
+	events, err := s.queryEvents(`
+		SELECT data FROM events
+		WHERE user_id = ? AND starts_at BETWEEN ? AND ? AND recurring = 0 AND deleted_at IS NULL
+		UNION ALL
+		SELECT data FROM events
+		WHERE user_id = ? AND starts_at <= ? AND recurring = 1 AND (until_at IS NULL OR until_at >= ?)
+			AND deleted_at IS NULL
+		UNION ALL
+		SELECT data FROM events
+		WHERE id IN (SELECT event_id FROM event_attendees WHERE user_id = ?)
+			AND starts_at <= ? AND (until_at IS NULL OR until_at >= ?) AND deleted_at IS NULL`,
+		userID.String(), from.Unix(), to.Unix(),
+		userID.String(), to.Unix(), from.Unix(),
+		userID.String(), to.Unix(), from.Unix())
+	if err != nil {
+		return nil, err
+	}
+	result := make([]Event, 0, len(events))
+	for _, e := range events {
+		result = append(result, e.Expand(from, to)...)
+	}
+	sortOccurrences(result)
+	return result, nil
+}
+
+// GetWithReminders возвращает события с напоминаниями, у которых могут быть
+// вхождения в отрезке [from, to]: однократные, начинающиеся в нём, и серии,
+// начавшиеся не позже конца отрезка и не закончившиеся до его начала. Выборка
+// идёт по частичному индексу events_reminding.
+func (s *SQLEventStorage) GetWithReminders(from, to time.Time) ([]Event, error) {
+	return s.queryEvents(`
+		SELECT data FROM events
+		WHERE reminding = 1 AND starts_at BETWEEN ? AND ? AND recurring = 0 AND deleted_at IS NULL
+		UNION ALL
+		SELECT data FROM events
+		WHERE reminding = 1 AND starts_at <= ? AND recurring = 1 AND (until_at IS NULL OR until_at >= ?)
+			AND deleted_at IS NULL`,
+		from.Unix(), to.Unix(), to.Unix(), from.Unix())
+}
+
+// queryEvents выполняет запрос, возвращающий колонку data, и декодирует события.
+func (s *SQLEventStorage) queryEvents(query string, args ...interface{}) ([]Event, error) {
+	rows, err := s.conn().Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make([]Event, 0)
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var e Event
+		if err := json.Unmarshal(data, &e); err != nil {
+			return nil, err
+		}
+		result = append(result, e)
+	}
+	return result, rows.Err()
+}
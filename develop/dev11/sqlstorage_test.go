@@ -0,0 +1,212 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testEventStorage проверяет общие для всех реализаций EventStorage свойства
+// (все они поддерживают корзину).
+func testEventStorage(t *testing.T, s TrashStorage) {
+	userID := uuid.New()
+	otherID := uuid.New()
+	daily, err := ParseRRule("FREQ=DAILY;UNTIL=20220110T235959Z")
+	require.NoError(t, err)
+	weekly, err := ParseRRule("FREQ=WEEKLY;COUNT=10")
+	require.NoError(t, err)
+	events := []Event{
+		{ID: uuid.New(), UserID: userID, When: mustTime(t, "03.01.2022 12:23"), What: "Мероприятие"},
+		{ID: uuid.New(), UserID: userID, When: mustTime(t, "01.02.2022 00:00"), What: "Февраль"},
+		{ID: uuid.New(), UserID: userID, When: mustTime(t, "01.01.2022 09:00"), Recurrence: daily},
+		{ID: uuid.New(), UserID: userID, When: mustTime(t, "01.12.2021 18:00"), Recurrence: weekly},
+		{ID: uuid.New(), UserID: otherID, When: mustTime(t, "03.01.2022 12:23"),
+			Attendees: []Attendee{{UserID: userID, Status: RSVPNeedsAction}}},
+	}
+	for _, e := range events {
+		require.NoError(t, s.Add(e))
+	}
+	assert.ErrorIs(t, s.Add(events[0]), ErrEventAlreadyExists)
+
+	got, err := s.Get(events[2].ID)
+	require.NoError(t, err)
+	assert.Equal(t, events[2].Recurrence, got.Recurrence)
+	assert.True(t, events[2].When.Equal(got.When))
+
+	all, err := s.GetByUser(userID)
+	require.NoError(t, err)
+	assert.Equal(t, 4, len(all))
+	all, err = s.GetAll()
+	require.NoError(t, err)
+	assert.Equal(t, len(events), len(all))
+
+	invited, err := s.GetByAttendee(userID)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(invited))
+	assert.Equal(t, events[4].Attendees, invited[0].Attendees)
+
+	day, err := s.GetByDay(userID, mustTime(t, "03.01.2022 00:00"))
+	require.NoError(t, err)
+	// однократное событие, вхождение ежедневной серии и приглашение
+	assert.Equal(t, 3, len(day))
+
+	week, err := s.GetForWeek(userID, mustTime(t, "03.01.2022 00:00"))
+	require.NoError(t, err)
+	// однократное, 7 ежедневных (03.01-09.01), еженедельное 05.01 и приглашение
+	assert.Equal(t, 10, len(week))
+	// вхождения упорядочены по времени начала
+	for i := 1; i < len(week); i++ {
+		assert.False(t, week[i].When.Before(week[i-1].When), "occurrence %d is out of order", i)
+	}
+
+	month, err := s.GetForMonth(userID, mustTime(t, "01.02.2022 00:00"))
+	require.NoError(t, err)
+	// событие 01.02 и еженедельная серия закончилась 02.02 (10 вхождений с 01.12)
+	assert.Equal(t, 2, len(month))
+
+	updated := events[1]
+	updated.When = mustTime(t, "04.01.2022 08:00")
+	updated.Where = "Офис"
+	updated.Version++
+	require.NoError(t, s.Update(updated))
+	got, err = s.Get(updated.ID)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), got.Version)
+	// изменение, основанное на прежней версии, отклоняется
+	stale := events[1]
+	stale.What = "Устаревшее"
+	stale.Version++
+	assert.ErrorIs(t, s.Update(stale), ErrVersionConflict)
+	got, err = s.Get(updated.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "Офис", got.Where)
+	assert.ErrorIs(t, s.Update(updated), ErrVersionConflict)
+	day, err = s.GetByDay(userID, mustTime(t, "04.01.2022 00:00"))
+	require.NoError(t, err)
+	// перенесённое событие и вхождение ежедневной серии
+	assert.Equal(t, 2, len(day))
+	assert.ErrorIs(t, s.Update(Event{ID: uuid.New()}), ErrEventNotFound)
+
+	// участника можно убрать из события
+	uninvited := events[4]
+	uninvited.Attendees = nil
+	uninvited.Version++
+	require.NoError(t, s.Update(uninvited))
+	invited, err = s.GetByAttendee(userID)
+	require.NoError(t, err)
+	assert.Empty(t, invited)
+
+	require.NoError(t, s.Delete(events[0].ID))
+	assert.ErrorIs(t, s.Delete(events[0].ID), ErrEventNotFound)
+	_, err = s.Get(events[0].ID)
+	assert.ErrorIs(t, err, ErrEventNotFound)
+
+	// удалённое событие лежит в корзине и скрыто от остальных запросов
+	trash, err := s.Trash(userID)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(trash))
+	assert.Equal(t, events[0].ID, trash[0].ID)
+	require.NotNil(t, trash[0].DeletedAt)
+	assert.WithinDuration(t, time.Now(), *trash[0].DeletedAt, time.Minute)
+	day, err = s.GetByDay(userID, mustTime(t, "03.01.2022 00:00"))
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(day))
+	all, err = s.GetAll()
+	require.NoError(t, err)
+	assert.Equal(t, len(events)-1, len(all))
+	stale = events[0]
+	stale.Version++
+	assert.ErrorIs(t, s.Update(stale), ErrEventNotFound)
+	_, err = s.GetDeleted(events[1].ID)
+	assert.ErrorIs(t, err, ErrEventNotFound)
+
+	require.NoError(t, s.Restore(events[0].ID))
+	assert.ErrorIs(t, s.Restore(events[0].ID), ErrEventNotFound)
+	got, err = s.Get(events[0].ID)
+	require.NoError(t, err)
+	assert.Nil(t, got.DeletedAt)
+	day, err = s.GetByDay(userID, mustTime(t, "03.01.2022 00:00"))
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(day))
+	trash, err = s.Trash(userID)
+	require.NoError(t, err)
+	assert.Empty(t, trash)
+
+	// пока событие лежит в корзине, его ID занят, в том числе для другого
+	// пользователя; окончательно удаляются только события, удалённые раньше
+	// заданного момента
+	require.NoError(t, s.Delete(events[0].ID))
+	require.NoError(t, s.Delete(events[2].ID))
+	replaced := events[2]
+	replaced.UserID = otherID
+	replaced.Recurrence = nil
+	replaced.What = "Заново"
+	assert.ErrorIs(t, s.Add(replaced), ErrEventAlreadyExists)
+	got, err = s.GetDeleted(events[2].ID)
+	require.NoError(t, err)
+	assert.Equal(t, userID, got.UserID)
+	n, err := s.Purge(time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+	n, err = s.Purge(time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	_, err = s.GetDeleted(events[0].ID)
+	assert.ErrorIs(t, err, ErrEventNotFound)
+	assert.ErrorIs(t, s.Restore(events[0].ID), ErrEventNotFound)
+
+	// после окончательного удаления ID свободен
+	require.NoError(t, s.Add(replaced))
+	got, err = s.Get(replaced.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "Заново", got.What)
+}
+
+func TestInmemEventStorage(t *testing.T) {
+	testEventStorage(t, newTestStorage())
+}
+
+func TestSQLEventStorage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.db")
+	s, err := NewSQLEventStorage(path)
+	require.NoError(t, err)
+	testEventStorage(t, s)
+	s.Close()
+
+	// повторное открытие: миграции не применяются заново, данные сохраняются
+	s, err = NewSQLEventStorage(path)
+	require.NoError(t, err)
+	defer s.Close()
+	var version int
+	require.NoError(t, s.db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version))
+	assert.Equal(t, len(sqlMigrations), version)
+	all, err := s.GetByUser(uuid.Nil)
+	require.NoError(t, err)
+	assert.Empty(t, all)
+	var count int
+	require.NoError(t, s.db.QueryRow(`SELECT COUNT(*) FROM events`).Scan(&count))
+	assert.Equal(t, 4, count)
+}
+
+func TestSQLEventStorageUsesIndex(t *testing.T) {
+	s, err := NewSQLEventStorage(filepath.Join(t.TempDir(), "events.db"))
+	require.NoError(t, err)
+	defer s.Close()
+	rows, err := s.db.Query(`EXPLAIN QUERY PLAN SELECT data FROM events
+		WHERE user_id = ? AND starts_at BETWEEN ? AND ? AND recurring = 0`, "u", 0, 1)
+	require.NoError(t, err)
+	defer rows.Close()
+	plan := ""
+	for rows.Next() {
+		var id, parent, notused int
+		var detail string
+		require.NoError(t, rows.Scan(&id, &parent, &notused, &detail))
+		plan += detail + "\n"
+	}
+	assert.Contains(t, plan, "events_user_when")
+	assert.NotContains(t, plan, "SCAN")
+}
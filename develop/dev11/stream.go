@@ -0,0 +1,434 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// defaultJournalSize - сколько последних изменений хранит ChangeFeed для
+	// клиентов, переподключающихся с Last-Event-ID.
+	defaultJournalSize = 1024
+	// subscriberBuffer - сколько изменений может ждать отправки одному подписчику.
+	// Подписчик, не успевающий их забирать, отключается.
+	subscriberBuffer = 64
+	// streamHeartbeat - периодичность комментариев, поддерживающих соединение SSE.
+	streamHeartbeat = 15 * time.Second
+)
+
+// ChangeType - вид изменения события.
+type ChangeType string
+
+// Виды изменений. ChangeDeleted - перемещение события в корзину, ChangeRestored -
+// возвращение из неё. ChangeReset означает, что часть изменений пропущена
+// (журнал их уже не хранит) и события нужно запросить заново.
+const (
+	ChangeCreated  ChangeType = "created"
+	ChangeUpdated  ChangeType = "updated"
+	ChangeDeleted  ChangeType = "deleted"
+	ChangeRestored ChangeType = "restored"
+	ChangeReset    ChangeType = "reset"
+)
+
+// Change - изменение события в хранилище.
+type Change struct {
+	// Seq - порядковый номер изменения (id в потоке SSE).
+	Seq     uint64     `json:"seq"`
+	Type    ChangeType `json:"type"`
+	EventID uuid.UUID  `json:"event_id"`
+	// Event - событие после изменения (nil для удаления).
+	Event *Event    `json:"event,omitempty"`
+	At    time.Time `json:"at"`
+	// users - пользователи, которых касается изменение: организатор и участники
+	// события до и после изменения.
+	users []uuid.UUID
+}
+
+// concerns проверяет, касается ли изменение пользователя userID.
+func (c Change) concerns(userID uuid.UUID) bool {
+	for _, id := range c.users {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// subscriber - получатель изменений событий одного пользователя.
+type subscriber struct {
+	userID uuid.UUID
+	ch     chan Change
+}
+
+// ChangeFeed рассылает изменения событий подписчикам и хранит ограниченный
+// журнал последних изменений. Рассылка не блокируется: подписчик с заполненным
+// буфером отключается (его канал закрывается) и может переподключиться,
+// получив пропущенное из журнала.
+type ChangeFeed struct {
+	mu *sync.Mutex
+	// journal - кольцевой буфер последних изменений; seq - номер последнего.
+	journal []Change
+	seq     uint64
+	subs    map[*subscriber]struct{}
+	// closed - лента закрыта (см. Close), новые подписчики сразу отключаются.
+	closed bool
+	now    func() time.Time
+}
+
+// NewChangeFeed создаёт ленту изменений с журналом на size записей.
+func NewChangeFeed(size int) *ChangeFeed {
+	if size <= 0 {
+		size = defaultJournalSize
+	}
+	return &ChangeFeed{
+		mu:      &sync.Mutex{},
+		journal: make([]Change, 0, size),
+		subs:    make(map[*subscriber]struct{}),
+		now:     time.Now,
+	}
+}
+
+// publish записывает изменение в журнал и рассылает его подписчикам.
+func (f *ChangeFeed) publish(typ ChangeType, eventID uuid.UUID, event *Event, users []uuid.UUID) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.seq++
+	c := Change{Seq: f.seq, Type: typ, EventID: eventID, Event: event, At: f.now().UTC(), users: users}
+	if len(f.journal) < cap(f.journal) {
+		f.journal = append(f.journal, c)
+	} else {
+		copy(f.journal, f.journal[1:])
+		f.journal[len(f.journal)-1] = c
+	}
+	for sub := range f.subs {
+		if !c.concerns(sub.userID) {
+			continue
+		}
+		select {
+		case sub.ch <- c:
+		default:
+			// медленный подписчик не должен задерживать запись в хранилище
+			delete(f.subs, sub)
+			close(sub.ch)
+			log.Printf("changeFeed: subscriber %v is too slow, disconnected", sub.userID)
+		}
+	}
+}
+
+// Close отключает всех подписчиков и не принимает новых. Вызывается при остановке
+// сервера: потоки изменений бессрочны, и без этого server.Shutdown ждал бы их
+// до истечения ShutdownTimeout.
+func (f *ChangeFeed) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	for sub := range f.subs {
+		delete(f.subs, sub)
+		close(sub.ch)
+	}
+}
+
+// Subscribe подписывает пользователя на изменения его событий. Если lastSeq > 0,
+// в канал сначала попадают изменения после lastSeq из журнала, а если журнал
+// их уже не хранит - изменение ChangeReset. Канал закрывается при отписке,
+// закрытии ленты или если подписчик не успевает забирать изменения.
+// Возвращаемая функция отменяет подписку.
+func (f *ChangeFeed) Subscribe(userID uuid.UUID, lastSeq uint64) (<-chan Change, func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sub := &subscriber{userID: userID, ch: make(chan Change, subscriberBuffer)}
+	if f.closed {
+		close(sub.ch)
+		return sub.ch, func() {}
+	}
+	if lastSeq > 0 {
+		missed := make([]Change, 0)
+		oldest := f.seq - uint64(len(f.journal)) + 1
+		if lastSeq+1 < oldest || lastSeq > f.seq {
+			missed = append(missed, Change{Seq: f.seq, Type: ChangeReset, At: f.now().UTC()})
+		} else {
+			for _, c := range f.journal {
+				if c.Seq > lastSeq && c.concerns(userID) {
+					missed = append(missed, c)
+				}
+			}
+		}
+		if len(missed) > subscriberBuffer {
+			missed = []Change{{Seq: f.seq, Type: ChangeReset, At: f.now().UTC()}}
+		}
+		for _, c := range missed {
+			sub.ch <- c
+		}
+	}
+	f.subs[sub] = struct{}{}
+	return sub.ch, func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if _, ok := f.subs[sub]; ok {
+			delete(f.subs, sub)
+			close(sub.ch)
+		}
+	}
+}
+
+// eventUsers возвращает организатора и участников событий.
+func eventUsers(events ...Event) []uuid.UUID {
+	seen := make(map[uuid.UUID]bool)
+	result := make([]uuid.UUID, 0)
+	for _, e := range events {
+		for _, id := range append([]uuid.UUID{e.UserID}, attendeeIDs(e.Attendees)...) {
+			if !seen[id] {
+				seen[id] = true
+				result = append(result, id)
+			}
+		}
+	}
+	return result
+}
+
+var (
+	_ TxStorage       = (*FeedEventStorage)(nil)
+	_ TrashStorage    = (*FeedEventStorage)(nil)
+	_ ReplicaStorage  = (*FeedEventStorage)(nil)
+	_ ReminderStorage = (*FeedEventStorage)(nil)
+)
+
+// FeedEventStorage публикует в ChangeFeed изменения, сделанные через Add,
+// Update, Delete и Restore хранилища.
+type FeedEventStorage struct {
+	EventStorage
+	feed *ChangeFeed
+	// mu упорядочивает изменения: порядок в ленте совпадает с порядком записи.
+	mu *sync.Mutex
+	// effects - публикации, отложенные до фиксации транзакции (см. Tx).
+	effects *txEffects
+}
+
+// NewFeedEventStorage создаёт хранилище, публикующее изменения s в feed.
+func NewFeedEventStorage(s EventStorage, feed *ChangeFeed) *FeedEventStorage {
+	return &FeedEventStorage{EventStorage: s, feed: feed, mu: &sync.Mutex{}}
+}
+
+// Add добавляет событие и публикует ChangeCreated.
+func (s *FeedEventStorage) Add(e Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.EventStorage.Add(e); err != nil {
+		return err
+	}
+	s.effects.after(func() { s.feed.publish(ChangeCreated, e.ID, &e, eventUsers(e)) })
+	return nil
+}
+
+// Update перезаписывает событие и публикует ChangeUpdated для пользователей
+// как прежней, так и новой версии события.
+func (s *FeedEventStorage) Update(e Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, err := s.EventStorage.Get(e.ID)
+	if err != nil {
+		return err
+	}
+	if err := s.EventStorage.Update(e); err != nil {
+		return err
+	}
+	s.effects.after(func() { s.feed.publish(ChangeUpdated, e.ID, &e, eventUsers(old, e)) })
+	return nil
+}
+
+// Delete удаляет событие и публикует ChangeDeleted.
+func (s *FeedEventStorage) Delete(eventID uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, err := s.EventStorage.Get(eventID)
+	if err != nil {
+		return err
+	}
+	if err := s.EventStorage.Delete(eventID); err != nil {
+		return err
+	}
+	s.effects.after(func() { s.feed.publish(ChangeDeleted, eventID, nil, eventUsers(old)) })
+	return nil
+}
+
+// Trash возвращает события корзины (см. TrashStorage).
+func (s *FeedEventStorage) Trash(userID uuid.UUID) ([]Event, error) {
+	ts, err := trashStorage(s.EventStorage)
+	if err != nil {
+		return nil, err
+	}
+	return ts.Trash(userID)
+}
+
+// GetDeleted возвращает событие из корзины (см. TrashStorage).
+func (s *FeedEventStorage) GetDeleted(eventID uuid.UUID) (Event, error) {
+	ts, err := trashStorage(s.EventStorage)
+	if err != nil {
+		return Event{}, err
+	}
+	return ts.GetDeleted(eventID)
+}
+
+// Purge окончательно удаляет события из корзины (см. TrashStorage).
+func (s *FeedEventStorage) Purge(before time.Time) (int, error) {
+	ts, err := trashStorage(s.EventStorage)
+	if err != nil {
+		return 0, err
+	}
+	return ts.Purge(before)
+}
+
+// Restore возвращает событие из корзины и публикует ChangeRestored.
+func (s *FeedEventStorage) Restore(eventID uuid.UUID) error {
+	ts, err := trashStorage(s.EventStorage)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, err := ts.GetDeleted(eventID)
+	if err != nil {
+		return err
+	}
+	if err := ts.Restore(eventID); err != nil {
+		return err
+	}
+	e.DeletedAt = nil
+	s.effects.after(func() { s.feed.publish(ChangeRestored, eventID, &e, eventUsers(e)) })
+	return nil
+}
+
+// Tx выполняет fn в транзакции хранилища (см. TxStorage); изменения транзакции
+// публикуются после её фиксации.
+func (s *FeedEventStorage) Tx(fn func(EventStorage) error) error {
+	if s.effects != nil {
+		return fn(s) // вложенная транзакция - часть внешней
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return txWithEffects(s.EventStorage, func(tx EventStorage, effects *txEffects) EventStorage {
+		return &FeedEventStorage{EventStorage: tx, feed: s.feed, mu: &sync.Mutex{}, effects: effects}
+	}, fn)
+}
+
+// Replicate применяет изменения ведущего узла (см. ReplicaStorage) и публикует
+// их, чтобы подписчики ведомого узла получали изменения так же, как на ведущем.
+func (s *FeedEventStorage) Replicate(b ReplicationBatch) ([]ReplicatedChange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changes, err := replicate(s.EventStorage, b)
+	for _, c := range changes {
+		typ, ok := c.changeType()
+		switch {
+		case !ok:
+		case typ == ChangeDeleted:
+			s.feed.publish(typ, c.Before.ID, nil, eventUsers(*c.Before))
+		case typ == ChangeUpdated:
+			s.feed.publish(typ, c.After.ID, c.After, eventUsers(*c.Before, *c.After))
+		default:
+			s.feed.publish(typ, c.After.ID, c.After, eventUsers(*c.After))
+		}
+	}
+	return changes, err
+}
+
+// GetWithReminders выбирает события с напоминаниями (см. ReminderStorage).
+func (s *FeedEventStorage) GetWithReminders(from, to time.Time) ([]Event, error) {
+	return remindingEvents(s.EventStorage, from, to)
+}
+
+// StreamAPI отдаёт ленту изменений событий клиентам по Server-Sent Events.
+type StreamAPI struct {
+	feed *ChangeFeed
+}
+
+// NewStreamAPI создаёт обработчик потока изменений ленты feed.
+func NewStreamAPI(feed *ChangeFeed) *StreamAPI {
+	return &StreamAPI{feed: feed}
+}
+
+// Stream отправляет изменения событий пользователя по мере их появления
+// (text/event-stream). Каждое сообщение SSE содержит id - номер изменения,
+// event - его вид (created, updated, deleted или reset) и data - JSON изменения.
+// Переподключившийся клиент передаёт номер последнего полученного изменения
+// в заголовке Last-Event-ID (или параметре last_event_id) и получает пропущенные
+// изменения; если журнал их уже не хранит, приходит reset.
+//
+// GET /events/stream
+// параметры:
+//	- *user_id
+//	- last_event_id	номер последнего полученного изменения (если нет заголовка Last-Event-ID)
+func (a StreamAPI) Stream(w http.ResponseWriter, r *http.Request) {
+	const logHeader = "eventsStream"
+	if r.Method != http.MethodGet {
+		returnError(w, logHeader, "", http.StatusMethodNotAllowed)
+		return
+	}
+	userID, ok := getUserID(w, r, logHeader)
+	if !ok {
+		return // ошибки уже обработаны
+	}
+	var lastSeq uint64
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.FormValue("last_event_id")
+	}
+	if lastID = strings.TrimSpace(lastID); lastID != "" {
+		var err error
+		if lastSeq, err = strconv.ParseUint(lastID, 10, 64); err != nil {
+			returnError(w, logHeader, fmt.Sprintf("incorrect Last-Event-ID: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	rc := http.NewResponseController(w)
+	// поток не ограничен по времени, в отличие от остальных ответов сервера
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && err != http.ErrNotSupported {
+		log.Printf("%s: %v", logHeader, err)
+	}
+
+	changes, cancel := a.feed.Subscribe(userID, lastSeq)
+	defer cancel()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		case c, ok := <-changes:
+			if !ok {
+				// отключены как медленный подписчик или при остановке сервера:
+				// клиент переподключится с Last-Event-ID
+				return
+			}
+			data, err := json.Marshal(c)
+			if err != nil {
+				log.Printf("%s: %v", logHeader, err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", c.Seq, c.Type, data); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
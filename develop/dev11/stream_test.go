@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// receive возвращает изменение из канала или проваливает тест по таймауту.
+func receive(t *testing.T, ch <-chan Change) Change {
+	t.Helper()
+	select {
+	case c, ok := <-ch:
+		require.True(t, ok, "channel closed")
+		return c
+	case <-time.After(time.Second):
+		t.Fatal("no change received")
+		return Change{}
+	}
+}
+
+func TestFeedEventStorage(t *testing.T) {
+	feed := NewChangeFeed(4)
+	s := NewFeedEventStorage(newTestStorage(), feed)
+	organizer, alice, other := uuid.New(), uuid.New(), uuid.New()
+	changes, cancel := feed.Subscribe(alice, 0)
+	defer cancel()
+	otherChanges, cancelOther := feed.Subscribe(other, 0)
+
+	e := Event{ID: uuid.New(), UserID: organizer, When: mustTime(t, "03.01.2022 10:00")}
+	require.NoError(t, s.Add(e))
+	e.Attendees = []Attendee{{UserID: alice, Status: RSVPNeedsAction}}
+	e.Version++
+	require.NoError(t, s.Update(e))
+	// участник узнаёт и о том, что его убрали из события
+	e.Attendees = nil
+	e.Version++
+	require.NoError(t, s.Update(e))
+	require.NoError(t, s.Delete(e.ID))
+	assert.ErrorIs(t, s.Delete(e.ID), ErrEventNotFound)
+
+	c := receive(t, changes)
+	assert.Equal(t, ChangeUpdated, c.Type)
+	assert.Equal(t, uint64(2), c.Seq)
+	c = receive(t, changes)
+	assert.Equal(t, ChangeUpdated, c.Type)
+	assert.Empty(t, c.Event.Attendees)
+	assert.Empty(t, changes)
+	cancelOther()
+	_, ok := <-otherChanges
+	assert.False(t, ok)
+
+	// переподключение: пропущенные изменения из журнала
+	replay, cancelReplay := feed.Subscribe(organizer, 2)
+	defer cancelReplay()
+	assert.Equal(t, uint64(3), receive(t, replay).Seq)
+	c = receive(t, replay)
+	assert.Equal(t, ChangeDeleted, c.Type)
+	assert.Nil(t, c.Event)
+
+	// журнал на 4 записи хранит изменения 3-6, изменение 2 пропущено
+	require.NoError(t, s.Add(Event{ID: uuid.New(), UserID: organizer}))
+	require.NoError(t, s.Add(Event{ID: uuid.New(), UserID: organizer}))
+	reset, cancelReset := feed.Subscribe(organizer, 1)
+	defer cancelReset()
+	c = receive(t, reset)
+	assert.Equal(t, ChangeReset, c.Type)
+	assert.Equal(t, uint64(6), c.Seq)
+}
+
+func TestChangeFeedSlowSubscriber(t *testing.T) {
+	feed := NewChangeFeed(0)
+	s := NewFeedEventStorage(newTestStorage(), feed)
+	userID := uuid.New()
+	changes, cancel := feed.Subscribe(userID, 0)
+	defer cancel()
+
+	// запись не блокируется, даже если подписчик ничего не читает
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < subscriberBuffer+10; i++ {
+			require.NoError(t, s.Add(Event{ID: uuid.New(), UserID: userID}))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("storage writes blocked by a slow subscriber")
+	}
+	n := 0
+	for range changes {
+		n++
+	}
+	assert.Equal(t, subscriberBuffer, n)
+}
+
+func TestStreamHandler(t *testing.T) {
+	feed := NewChangeFeed(0)
+	api := NewCalendar(NewFeedEventStorage(newTestStorage(), feed))
+	server := httptest.NewServer(http.HandlerFunc(NewStreamAPI(feed).Stream))
+	defer server.Close()
+	userID := uuid.New().String()
+
+	rec := doForm(NewStreamAPI(feed).Stream, http.MethodGet, "/events/stream", nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"?user_id="+userID, nil)
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	rec = doForm(api.CreateEvent, http.MethodPost, "/create_event", map[string][]string{
+		"user_id": {userID}, "date": {"03.01.2022"}, "description": {"Созвон"},
+	})
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	// сообщение SSE: id, event, data и пустая строка
+	lines := make([]string, 0, 3)
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() && sc.Text() != "" {
+		lines = append(lines, sc.Text())
+	}
+	require.Equal(t, 3, len(lines), lines)
+	assert.Equal(t, "id: 1", lines[0])
+	assert.Equal(t, "event: created", lines[1])
+	var c struct {
+		Type  ChangeType
+		Event struct{ What string }
+	}
+	require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(lines[2], "data: ")), &c))
+	assert.Equal(t, ChangeCreated, c.Type)
+	assert.Equal(t, "Созвон", c.Event.What)
+}
@@ -1,18 +1,21 @@
 package main
 
 import (
-	"context"
+	"crypto/tls"
 	"encoding/gob"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/google/uuid"
@@ -28,6 +31,22 @@ import (
 	3. Реализовать HTTP обработчики для каждого из методов API, используя вспомогательные функции и объекты доменной области.
 	4. Реализовать middleware для логирования запросов
 Методы API: POST /create_event POST /update_event POST /delete_event GET /events_for_day GET /events_for_week GET /events_for_month
+Дополнительно: GET /export.ics POST /import_ics - обмен событиями в формате iCalendar (RFC 5545),
+GET /free_busy - занятые отрезки времени пользователя, POST /login - получение токена доступа,
+GET /agenda - повестка: события за период по дням (включая дни без событий),
+POST /invite, POST /rsvp, GET /invitations - приглашения участников и ответы на них,
+GET /search_events - полнотекстовый поиск по описанию и месту событий,
+GET /events/stream - поток изменений событий пользователя (Server-Sent Events),
+GET /event_history - история изменений события (кто, когда и что изменил),
+GET /trash, POST /restore_event - корзина удалённых событий и восстановление из неё,
+POST /batch - пакет операций create/update/delete над событиями в одной транзакции (JSON),
+/caldav/ - подмножество CalDAV для синхронизации с календарными приложениями (см. CalDAVAPI),
+GET /metrics - метрики в формате Prometheus,
+GET /openapi.json - описание API в формате OpenAPI 3,
+GET /healthz, GET /readyz - проверки живости и готовности сервера для оркестратора,
+GET /replication/snapshot, GET /replication/log - снимок и журнал изменений ведущего узла для ведомых (см. Replica),
+/api/v2/users/{user_id}/events[/{event_id}] - REST API с JSON-телами запросов (см. EventsV2).
+Клиент командной строки calctl встроен в тот же исполняемый файл (см. runCalctl).
 Параметры передаются в виде www-url-form-encoded (т.е. обычные user_id=3&date=2019-09-09).
 В GET методах параметры передаются через queryString, в POST через тело запроса.
 В результате каждого запроса должен возвращаться JSON документ содержащий либо {"result": "..."} в случае успешного выполнения метода,
@@ -61,6 +80,13 @@ func NewCalendar(s EventStorage) *CalendarAPI {
 //	- time 			локальное время hh:mm
 //	- place 		место
 //	- description 	описание события
+//	- rrule 		правило повторения (RRULE, например FREQ=WEEKLY;BYDAY=MO,WE;COUNT=10)
+//	- exdate 		исключённые даты через запятую: dd.mm.yyyy или dd.mm.yyyy hh:mm
+//	- tz 			часовой пояс IANA (например Europe/Moscow), в котором заданы дата и время; по умолчанию UTC
+//	- duration 		длительность события (например 45m, 1h30m)
+//	- remind 		напоминания через запятую: за сколько до начала (например 15m,1h,1d)
+//	- allow_overlap	false - отклонить событие, пересекающееся с другими событиями пользователя (HTTP 503)
+//	- attendees 	ID приглашённых пользователей через запятую
 func (c CalendarAPI) CreateEvent(w http.ResponseWriter, r *http.Request) {
 	const logHeader = "createEvent"
 	// проверяем метод
@@ -81,14 +107,23 @@ func (c CalendarAPI) CreateEvent(w http.ResponseWriter, r *http.Request) {
 		returnError(w, logHeader, fmt.Sprintf("incorrect user ID: %v", err), http.StatusBadRequest)
 		return
 	}
+	if !authorized(r, userID) {
+		returnError(w, logHeader, "access denied", http.StatusForbidden)
+		return
+	}
 	queryDate := r.FormValue("date")
 	if queryDate == "" {
 		returnError(w, logHeader, "missing parameter: date", http.StatusBadRequest)
 		return
 	}
-	// time, place и description - необязательные параметры
+	// time, place, description и tz - необязательные параметры
+	loc, err := loadLocation(r.FormValue("tz"))
+	if err != nil {
+		returnError(w, logHeader, fmt.Sprintf("incorrect time zone: %v", err), http.StatusBadRequest)
+		return
+	}
 	queryTime := r.FormValue("time")
-	when, err := parseWhen(queryDate, queryTime)
+	when, err := parseWhen(queryDate, queryTime, loc)
 	if err != nil {
 		returnError(w, logHeader, fmt.Sprintf("incorrect date or time: %v", err), http.StatusBadRequest)
 		return
@@ -96,14 +131,62 @@ func (c CalendarAPI) CreateEvent(w http.ResponseWriter, r *http.Request) {
 	queryPlace := r.FormValue("place")
 	queryDescription := r.FormValue("description")
 	event := Event{
-		ID:     uuid.New(),
-		UserID: userID,
-		When:   when,
-		Where:  queryPlace,
-		What:   queryDescription,
+		ID:         uuid.New(),
+		UserID:     userID,
+		When:       when,
+		Where:      queryPlace,
+		What:       queryDescription,
+		TZ:         loc.String(),
+		Version:    1,
+		ModifiedBy: modifiedBy(r, userID),
+	}
+	if queryDuration := r.FormValue("duration"); queryDuration != "" {
+		event.Duration, err = parseDuration(queryDuration)
+		if err != nil {
+			returnError(w, logHeader, fmt.Sprintf("incorrect duration: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if queryRemind := r.FormValue("remind"); queryRemind != "" {
+		event.Reminders, err = parseReminders(queryRemind)
+		if err != nil {
+			returnError(w, logHeader, fmt.Sprintf("incorrect remind: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if queryRRule := r.FormValue("rrule"); queryRRule != "" {
+		event.Recurrence, err = ParseEventRRule(queryRRule, event.When)
+		if err != nil {
+			returnError(w, logHeader, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if queryExDate := r.FormValue("exdate"); queryExDate != "" {
+		event.ExDates, err = parseExDates(queryExDate, event.When)
+		if err != nil {
+			returnError(w, logHeader, fmt.Sprintf("incorrect exdate: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if queryAttendees := r.FormValue("attendees"); queryAttendees != "" {
+		ids, err := parseAttendees(queryAttendees, userID)
+		if err != nil {
+			returnError(w, logHeader, fmt.Sprintf("incorrect attendees: %v", err), http.StatusBadRequest)
+			return
+		}
+		event.Attendees = mergeAttendees(nil, ids)
+	}
+	allowOverlap, err := parseAllowOverlap(r.FormValue("allow_overlap"))
+	if err != nil {
+		returnError(w, logHeader, fmt.Sprintf("incorrect allow_overlap: %v", err), http.StatusBadRequest)
+		return
 	}
 	// вызываем метод EventStorage для сохранения события
-	if err := c.storage.Add(event); err != nil {
+	if err := saveEvent(c.storage, event, !allowOverlap, EventStorage.Add); err != nil {
+		if errors.Is(err, ErrEventOverlap) {
+			returnStorageError(w, logHeader, err)
+			return
+		}
 		status := http.StatusInternalServerError
 		if errors.Is(err, ErrEventAlreadyExists) {
 			status = http.StatusBadRequest
@@ -111,7 +194,7 @@ func (c CalendarAPI) CreateEvent(w http.ResponseWriter, r *http.Request) {
 		returnError(w, logHeader, err.Error(), status)
 		return
 	}
-	returnResult(w, "event successfully added", http.StatusCreated)
+	returnResult(w, fmt.Sprintf("event %v successfully added", event.ID), http.StatusCreated)
 	log.Printf("%s: created event %+v", logHeader, event)
 }
 
@@ -126,6 +209,21 @@ func (c CalendarAPI) CreateEvent(w http.ResponseWriter, r *http.Request) {
 //	- time 			локальное время hh:mm
 //	- place 		место
 //	- description 	описание события
+//	- rrule 		правило повторения (RRULE); пустое значение делает событие разовым
+//	- exdate 		исключённые даты через запятую (заменяют имеющиеся; пустое значение
+//					удаляет все исключения)
+//	- tz 			часовой пояс IANA; дата и время трактуются в нём (по умолчанию - в поясе события)
+//	- duration 		длительность события
+//	- remind 		напоминания через запятую (заменяют имеющиеся; пустое значение
+//					удаляет все напоминания)
+//	- allow_overlap	false - отклонить изменение, если событие пересечётся с другими (HTTP 503)
+//	- attendees 	ID участников через запятую (заменяют имеющихся, ответы остающихся
+//					участников сохраняются; пустое значение удаляет всех участников)
+//	- version 		ожидаемая версия события (или заголовок If-Match: "версия");
+//					если событие уже изменено, возвращается HTTP 409
+//
+// Изменять событие может только организатор. Новая версия события возвращается
+// в заголовке ETag.
 func (c CalendarAPI) UpdateEvent(w http.ResponseWriter, r *http.Request) {
 	const logHeader = "updateEvent"
 	// проверяем метод
@@ -157,6 +255,14 @@ func (c CalendarAPI) UpdateEvent(w http.ResponseWriter, r *http.Request) {
 		returnError(w, logHeader, err.Error(), status)
 		return
 	}
+	if !authorized(r, event.UserID) {
+		returnError(w, logHeader, "access denied", http.StatusForbidden)
+		return
+	}
+	if !checkVersion(w, r, logHeader, event) {
+		return // ошибки уже обработаны
+	}
+	actor := modifiedBy(r, event.UserID)
 
 	// если есть параметр - обновляем его
 
@@ -167,30 +273,46 @@ func (c CalendarAPI) UpdateEvent(w http.ResponseWriter, r *http.Request) {
 			returnError(w, logHeader, fmt.Sprintf("incorrect user ID: %v", err), http.StatusBadRequest)
 			return
 		}
+		// передать событие можно только самому себе
+		if !authorized(r, userID) {
+			returnError(w, logHeader, "access denied", http.StatusForbidden)
+			return
+		}
 		event.UserID = userID
 	}
 
+	// при смене часового пояса момент начала события сохраняется
+	loc := event.Location()
+	if queryTZ := r.FormValue("tz"); queryTZ != "" {
+		loc, err = loadLocation(queryTZ)
+		if err != nil {
+			returnError(w, logHeader, fmt.Sprintf("incorrect time zone: %v", err), http.StatusBadRequest)
+			return
+		}
+		event.TZ = loc.String()
+	}
 	// поскольку дата и время хранятся в одном поле типа time.Time,
-	// пытаемся смержить с имеющимися датой и временем
+	// пытаемся смержить с имеющимися датой и временем (в часовом поясе события)
 	var dateStr, timeStr string
+	localWhen := event.When.In(loc)
 	queryDate := r.FormValue("date")
 	queryDateOk := queryDate != ""
 	if !queryDateOk {
-		dateStr = event.When.Format("02.01.2006")
+		dateStr = localWhen.Format("02.01.2006")
 	} else {
 		dateStr = queryDate
 	}
 	queryTime := r.FormValue("time")
 	queryTimeOk := queryTime != ""
 	if !queryTimeOk {
-		timeStr = event.When.Format("15:04")
+		timeStr = localWhen.Format("15:04")
 	} else {
 		timeStr = queryTime
 	}
 	// если был передан хотя бы один параметр - обновляем поле, предварительно "срастив"
 	// дату с временем.
 	if queryDateOk || queryTimeOk {
-		when, err := parseWhen(dateStr, timeStr)
+		when, err := parseWhen(dateStr, timeStr, loc)
 		if err != nil {
 			returnError(w, logHeader, fmt.Sprintf("incorrect date or time: %v", err), http.StatusBadRequest)
 			return
@@ -205,21 +327,81 @@ func (c CalendarAPI) UpdateEvent(w http.ResponseWriter, r *http.Request) {
 	if queryDescription != "" {
 		event.What = queryDescription
 	}
+	if queryDuration := r.FormValue("duration"); queryDuration != "" {
+		event.Duration, err = parseDuration(queryDuration)
+		if err != nil {
+			returnError(w, logHeader, fmt.Sprintf("incorrect duration: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	// напоминания, правило повторения и исключения заменяются, если параметр
+	// передан (в том числе пустым)
+	if _, ok := r.Form["remind"]; ok {
+		event.Reminders, err = parseReminders(r.FormValue("remind"))
+		if err != nil {
+			returnError(w, logHeader, fmt.Sprintf("incorrect remind: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if _, ok := r.Form["rrule"]; ok {
+		event.Recurrence = nil
+		if queryRRule := r.FormValue("rrule"); queryRRule != "" {
+			event.Recurrence, err = ParseEventRRule(queryRRule, event.When)
+			if err != nil {
+				returnError(w, logHeader, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	if _, ok := r.Form["exdate"]; ok {
+		event.ExDates, err = parseExDates(r.FormValue("exdate"), event.When.In(loc))
+		if err != nil {
+			returnError(w, logHeader, fmt.Sprintf("incorrect exdate: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	// участники заменяются, если параметр передан (в том числе пустым)
+	ids := attendeeIDs(event.Attendees)
+	if _, ok := r.Form["attendees"]; ok {
+		ids, err = parseAttendees(r.FormValue("attendees"), event.UserID)
+		if err != nil {
+			returnError(w, logHeader, fmt.Sprintf("incorrect attendees: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	// организатор мог смениться
+	if err := validateAttendees(ids, event.UserID); err != nil {
+		returnError(w, logHeader, fmt.Sprintf("incorrect attendees: %v", err), http.StatusBadRequest)
+		return
+	}
+	event.Attendees = mergeAttendees(event.Attendees, ids)
 
-	// вызываем метод EventStorage
-	if err := c.storage.Update(event); err != nil {
-		returnError(w, logHeader, err.Error(), http.StatusInternalServerError)
+	allowOverlap, err := parseAllowOverlap(r.FormValue("allow_overlap"))
+	if err != nil {
+		returnError(w, logHeader, fmt.Sprintf("incorrect allow_overlap: %v", err), http.StatusBadRequest)
 		return
 	}
+
+	// вызываем метод EventStorage; если событие изменили после чтения, версия не совпадёт
+	event.Version++
+	event.ModifiedBy = actor
+	if err := saveEvent(c.storage, event, !allowOverlap, EventStorage.Update); err != nil {
+		returnStorageError(w, logHeader, err)
+		return
+	}
+	w.Header().Set("ETag", versionETag(event.Version))
 	returnResult(w, "event successfully updated", http.StatusOK)
 	log.Printf("%s: updated event %+v", logHeader, event)
 }
 
-// DeleteEvent удаляет ищет событие с переданным ID и удаляет его.
+// DeleteEvent удаляет ищет событие с переданным ID и удаляет его
+// (перемещает в корзину, см. Trash и RestoreEvent).
+// Удалить событие может только организатор.
 //
 // POST /delete_event
-// параметр:
+// параметры:
 // *event_id
+// version - ожидаемая версия события (или заголовок If-Match), как в /update_event
 func (c CalendarAPI) DeleteEvent(w http.ResponseWriter, r *http.Request) {
 	const logHeader = "deleteEvent"
 	// проверяем метод (думаю, в это м случае правильнее было бы использовать http метод DELETE)
@@ -241,6 +423,20 @@ func (c CalendarAPI) DeleteEvent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// проверяем, что событие принадлежит пользователю
+	event, err := c.storage.Get(eventID)
+	if err != nil {
+		returnStorageError(w, logHeader, err)
+		return
+	}
+	if !authorized(r, event.UserID) {
+		returnError(w, logHeader, "access denied", http.StatusForbidden)
+		return
+	}
+	if !checkVersion(w, r, logHeader, event) {
+		return // ошибки уже обработаны
+	}
+
 	// вызываем метод EventStorage
 	if err := c.storage.Delete(eventID); err != nil {
 		status := http.StatusInternalServerError
@@ -260,6 +456,7 @@ func (c CalendarAPI) DeleteEvent(w http.ResponseWriter, r *http.Request) {
 // параметры:
 // *user_id
 // *date
+// align - calendar: только события, начинающиеся в эти сутки (без полуночи следующих)
 func (c CalendarAPI) GetDayEvents(w http.ResponseWriter, r *http.Request) {
 	const logHeader = "getDayEvents"
 	// проверяем метод и получаем параметры
@@ -267,7 +464,17 @@ func (c CalendarAPI) GetDayEvents(w http.ResponseWriter, r *http.Request) {
 	if !ok {
 		return // ошибки уже обработаны
 	}
-	events, err := c.storage.GetByDay(userID, day)
+	calendar, ok := getAlign(w, r, logHeader)
+	if !ok {
+		return // ошибки уже обработаны
+	}
+	var events []Event
+	var err error
+	if calendar {
+		events, err = getPeriod(c.storage, userID, day, day.AddDate(0, 0, 1))
+	} else {
+		events, err = c.storage.GetByDay(userID, day)
+	}
 	if err != nil {
 		returnError(w, logHeader, err.Error(), http.StatusInternalServerError)
 		return
@@ -280,6 +487,7 @@ func (c CalendarAPI) GetDayEvents(w http.ResponseWriter, r *http.Request) {
 // параметры:
 // *user_id
 // *date
+// align - calendar: события недели ISO 8601 (с понедельника), в которую входит date
 func (c CalendarAPI) GetWeekEvents(w http.ResponseWriter, r *http.Request) {
 	const logHeader = "getWeekEvents"
 
@@ -288,7 +496,18 @@ func (c CalendarAPI) GetWeekEvents(w http.ResponseWriter, r *http.Request) {
 	if !ok {
 		return // ошибки уже обработаны
 	}
-	events, err := c.storage.GetForWeek(userID, week)
+	calendar, ok := getAlign(w, r, logHeader)
+	if !ok {
+		return // ошибки уже обработаны
+	}
+	var events []Event
+	var err error
+	if calendar {
+		from, to := calendarWeek(week)
+		events, err = getPeriod(c.storage, userID, from, to)
+	} else {
+		events, err = c.storage.GetForWeek(userID, week)
+	}
 	if err != nil {
 		returnError(w, logHeader, err.Error(), http.StatusInternalServerError)
 		return
@@ -302,13 +521,25 @@ func (c CalendarAPI) GetWeekEvents(w http.ResponseWriter, r *http.Request) {
 // параметры:
 // *user_id
 // *date
+// align - calendar: события календарного месяца (с 1-го числа), в который входит date
 func (c CalendarAPI) GetMonthEvents(w http.ResponseWriter, r *http.Request) {
 	const logHeader = "getMonthEvents"
 	userID, month, ok := getEventParams(w, r, logHeader)
 	if !ok {
 		return // ошибки уже обработаны
 	}
-	events, err := c.storage.GetForMonth(userID, month)
+	calendar, ok := getAlign(w, r, logHeader)
+	if !ok {
+		return // ошибки уже обработаны
+	}
+	var events []Event
+	var err error
+	if calendar {
+		from, to := calendarMonth(month)
+		events, err = getPeriod(c.storage, userID, from, to)
+	} else {
+		events, err = c.storage.GetForMonth(userID, month)
+	}
 	if err != nil {
 		returnError(w, logHeader, err.Error(), http.StatusInternalServerError)
 		return
@@ -316,25 +547,177 @@ func (c CalendarAPI) GetMonthEvents(w http.ResponseWriter, r *http.Request) {
 	returnEvents(w, logHeader, events)
 }
 
-// getEventParams - проверка метода (должен быть GET) и извлечение из запроса параметров
-// для обработчиков /events_for_day, /events_for_week, /events_for_month
-// Функция обрабатывает и логирует возникшие ошибки.
+// ExportICS выгружает все события пользователя в формате iCalendar (.ics).
+//
+// GET /export.ics
+// параметр:
+// *user_id
+func (c CalendarAPI) ExportICS(w http.ResponseWriter, r *http.Request) {
+	const logHeader = "exportICS"
+	if r.Method != http.MethodGet {
+		returnError(w, logHeader, "", http.StatusMethodNotAllowed)
+		return
+	}
+	userID, ok := getUserID(w, r, logHeader)
+	if !ok {
+		return // ошибки уже обработаны
+	}
+	events, err := c.storage.GetByUser(userID)
+	if err != nil {
+		returnError(w, logHeader, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="calendar.ics"`)
+	if err := EncodeICS(w, events); err != nil {
+		log.Printf("%s: %v", logHeader, err)
+	}
+}
+
+// ImportICS импортирует события из файла iCalendar. Файл передаётся полем file
+// формы multipart/form-data, либо телом запроса с Content-Type text/calendar.
+// В ответе возвращается количество импортированных событий и ошибки по
+// элементам, которые импортировать не удалось.
+//
+// POST /import_ics
 // параметры:
+//	- *user_id		ID пользователя, которому будут принадлежать события
+//	- *file 		файл .ics
+func (c CalendarAPI) ImportICS(w http.ResponseWriter, r *http.Request) {
+	const logHeader = "importICS"
+	if r.Method != http.MethodPost {
+		returnError(w, logHeader, "", http.StatusMethodNotAllowed)
+		return
+	}
+	defer r.Body.Close()
+
+	var body io.Reader = r.Body
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "text/calendar") {
+		f, _, err := r.FormFile("file")
+		if err != nil {
+			returnError(w, logHeader, fmt.Sprintf("missing parameter: file: %v", err), http.StatusBadRequest)
+			return
+		}
+		defer f.Close()
+		body = f
+	}
+	userID, ok := getUserID(w, r, logHeader)
+	if !ok {
+		return // ошибки уже обработаны
+	}
+	entries, itemErrors, err := DecodeICS(body)
+	if err != nil {
+		returnError(w, logHeader, err.Error(), http.StatusBadRequest)
+		return
+	}
+	imported, importErrors := ImportEvents(c.storage, userID, entries)
+	res := struct {
+		Imported int            `json:"imported"`
+		Errors   []ICSItemError `json:"errors"`
+	}{
+		Imported: imported,
+		Errors:   append(itemErrors, importErrors...),
+	}
+	returnJSONResult(w, logHeader, res, http.StatusOK)
+	log.Printf("%s: imported %d event(s), %d error(s)", logHeader, res.Imported, len(res.Errors))
+}
+
+// FreeBusy возвращает занятые отрезки времени пользователя: вхождения событий
+// с длительностью, объединённые при пересечении.
+//
+// GET /free_busy
+// параметры (* = обязательный):
 //	- *user_id
-//	- *date
-func getEventParams(w http.ResponseWriter, r *http.Request, logHeader string) (uuid.UUID, time.Time, bool) {
+//	- *from 		начало отрезка: dd.mm.yyyy или dd.mm.yyyy hh:mm
+//	- *to 			конец отрезка: dd.mm.yyyy или dd.mm.yyyy hh:mm
+//	- tz 			часовой пояс IANA для from и to (по умолчанию UTC)
+func (c CalendarAPI) FreeBusy(w http.ResponseWriter, r *http.Request) {
+	const logHeader = "freeBusy"
 	if r.Method != http.MethodGet {
 		returnError(w, logHeader, "", http.StatusMethodNotAllowed)
-		return uuid.Nil, time.Time{}, false
+		return
+	}
+	userID, ok := getUserID(w, r, logHeader)
+	if !ok {
+		return // ошибки уже обработаны
+	}
+	from, to, ok := getTimeRange(w, r, logHeader)
+	if !ok {
+		return // ошибки уже обработаны
+	}
+	busy, err := FreeBusy(c.storage, userID, from, to)
+	if err != nil {
+		returnError(w, logHeader, err.Error(), http.StatusInternalServerError)
+		return
 	}
+	returnJSONResult(w, logHeader, busy, http.StatusOK)
+}
+
+// getTimeRange извлекает из запроса обязательные параметры from и to
+// (dd.mm.yyyy или dd.mm.yyyy hh:mm) в часовом поясе из параметра tz.
+// Функция обрабатывает и логирует возникшие ошибки.
+func getTimeRange(w http.ResponseWriter, r *http.Request, logHeader string) (time.Time, time.Time, bool) {
+	loc, err := loadLocation(r.FormValue("tz"))
+	if err != nil {
+		returnError(w, logHeader, fmt.Sprintf("incorrect time zone: %v", err), http.StatusBadRequest)
+		return time.Time{}, time.Time{}, false
+	}
+	var bounds [2]time.Time
+	for i, name := range []string{"from", "to"} {
+		value := r.FormValue(name)
+		if value == "" {
+			returnError(w, logHeader, "missing parameter: "+name, http.StatusBadRequest)
+			return time.Time{}, time.Time{}, false
+		}
+		dateStr, timeStr, _ := strings.Cut(value, " ")
+		bounds[i], err = parseWhen(dateStr, timeStr, loc)
+		if err != nil {
+			returnError(w, logHeader, fmt.Sprintf("incorrect %s: %v", name, err), http.StatusBadRequest)
+			return time.Time{}, time.Time{}, false
+		}
+	}
+	if !bounds[0].Before(bounds[1]) {
+		returnError(w, logHeader, "from must be before to", http.StatusBadRequest)
+		return time.Time{}, time.Time{}, false
+	}
+	return bounds[0], bounds[1], true
+}
+
+// getUserID извлекает из запроса обязательный параметр user_id и проверяет,
+// что он принадлежит аутентифицированному пользователю.
+// Функция обрабатывает и логирует возникшие ошибки.
+func getUserID(w http.ResponseWriter, r *http.Request, logHeader string) (uuid.UUID, bool) {
 	userIDstr := r.FormValue("user_id")
 	if userIDstr == "" {
 		returnError(w, logHeader, "missing parameter: user_id", http.StatusBadRequest)
-		return uuid.Nil, time.Time{}, false
+		return uuid.Nil, false
 	}
 	userID, err := uuid.Parse(userIDstr)
 	if err != nil {
 		returnError(w, logHeader, fmt.Sprintf("incorrect user ID: %v", err), http.StatusBadRequest)
+		return uuid.Nil, false
+	}
+	if !authorized(r, userID) {
+		returnError(w, logHeader, "access denied", http.StatusForbidden)
+		return uuid.Nil, false
+	}
+	return userID, true
+}
+
+// getEventParams - проверка метода (должен быть GET) и извлечение из запроса параметров
+// для обработчиков /events_for_day, /events_for_week, /events_for_month
+// Функция обрабатывает и логирует возникшие ошибки.
+// параметры:
+//	- *user_id
+//	- *date
+//	- tz 		часовой пояс IANA, в котором отсчитываются сутки (по умолчанию UTC)
+func getEventParams(w http.ResponseWriter, r *http.Request, logHeader string) (uuid.UUID, time.Time, bool) {
+	if r.Method != http.MethodGet {
+		returnError(w, logHeader, "", http.StatusMethodNotAllowed)
+		return uuid.Nil, time.Time{}, false
+	}
+	userID, ok := getUserID(w, r, logHeader)
+	if !ok {
 		return uuid.Nil, time.Time{}, false
 	}
 	dateStr := r.FormValue("date")
@@ -342,7 +725,12 @@ func getEventParams(w http.ResponseWriter, r *http.Request, logHeader string) (u
 		returnError(w, logHeader, "missing parameter: date", http.StatusBadRequest)
 		return uuid.Nil, time.Time{}, false
 	}
-	t, err := time.Parse("02.01.2006", dateStr)
+	loc, err := loadLocation(r.FormValue("tz"))
+	if err != nil {
+		returnError(w, logHeader, fmt.Sprintf("incorrect time zone: %v", err), http.StatusBadRequest)
+		return uuid.Nil, time.Time{}, false
+	}
+	t, err := time.ParseInLocation("02.01.2006", dateStr, loc)
 	if err != nil {
 		returnError(w, logHeader, fmt.Sprintf("incorrect date format: %s", dateStr), http.StatusBadRequest)
 		return uuid.Nil, time.Time{}, false
@@ -350,10 +738,11 @@ func getEventParams(w http.ResponseWriter, r *http.Request, logHeader string) (u
 	return userID, t, true
 }
 
-// parseWhen конвертирует дату и время (последнее - при наличии) в переменную типа time.Time.
+// parseWhen конвертирует дату и время (последнее - при наличии), заданные
+// в часовом поясе loc, в переменную типа time.Time.
 // формат даты: "02.01.2006"
 // формат времени "15:04"
-func parseWhen(dateStr, timeStr string) (time.Time, error) {
+func parseWhen(dateStr, timeStr string, loc *time.Location) (time.Time, error) {
 	var layout, str string
 	if len(timeStr) > 0 {
 		// если есть время, присовокупляем его
@@ -363,19 +752,102 @@ func parseWhen(dateStr, timeStr string) (time.Time, error) {
 		layout = "02.01.2006"
 		str = dateStr
 	}
-	result, err := time.Parse(layout, str)
+	result, err := time.ParseInLocation(layout, str, loc)
 	if err != nil {
 		return time.Time{}, err
 	}
 	return result, nil
 }
 
+// parseExDates разбирает список исключённых дат, разделённых запятыми.
+// Даты трактуются в часовом поясе start. Если время не указано, берётся
+// время начала события start.
+func parseExDates(list string, start time.Time) ([]time.Time, error) {
+	result := make([]time.Time, 0)
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		dateStr, timeStr, _ := strings.Cut(item, " ")
+		if timeStr == "" {
+			timeStr = start.Format("15:04")
+		}
+		t, err := parseWhen(dateStr, timeStr, start.Location())
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, t)
+	}
+	return result, nil
+}
+
+// parseDuration разбирает длительность события в формате time.ParseDuration.
+func parseDuration(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	return d, validateDuration(d)
+}
+
+// parseAllowOverlap разбирает параметр allow_overlap (по умолчанию пересечения разрешены).
+func parseAllowOverlap(s string) (bool, error) {
+	if s == "" {
+		return true, nil
+	}
+	return strconv.ParseBool(s)
+}
+
+// locations - кэш часовых поясов: time.LoadLocation при каждом вызове читает базу tzdata.
+var locations sync.Map
+
+// loadLocation возвращает часовой пояс IANA с именем name (пустое имя - UTC).
+func loadLocation(name string) (*time.Location, error) {
+	if name == "" {
+		return time.UTC, nil
+	}
+	if loc, ok := locations.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locations.Store(name, loc)
+	return loc, nil
+}
+
+// returnStorageError записывает ошибку бизнес-логики или хранилища, выбирая
+// статус-код по её типу: ошибки бизнес-логики - 503, отсутствие события - 404,
+// пользователь не приглашён - 403, конфликт версий - 409, хранилище без
+// корзины - 501, остальные - 500.
+func returnStorageError(w http.ResponseWriter, logHeader string, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrEventOverlap):
+		status = http.StatusServiceUnavailable
+	case errors.Is(err, ErrEventNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrNotInvited):
+		status = http.StatusForbidden
+	case errors.Is(err, ErrVersionConflict):
+		status = http.StatusConflict
+	case errors.Is(err, ErrTrashNotSupported):
+		status = http.StatusNotImplemented
+	}
+	returnError(w, logHeader, err.Error(), status)
+}
+
 // returnResult устанавливает требуемый статус-код в заголовке ответа
 // и записывает в тело ответа JSON со строкой результата.
 func returnResult(w http.ResponseWriter, result string, status int) {
+	body, _ := json.Marshal(struct {
+		Result string `json:"result"`
+	}{Result: result})
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
-	fmt.Fprintf(w, `{"result": %s}`, result)
+	w.Write(body)
 }
 
 // returnError логирует возникшую ошибку и записывает её в тело ответа,
@@ -385,49 +857,37 @@ func returnError(w http.ResponseWriter, logHeader, err string, status int) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("X-Content-Type-Options", "nosniff")
 	w.WriteHeader(status)
-	if err == "" {
-		fmt.Fprintf(w, `{"error": "%s"}`, http.StatusText(status))
-		return
+	message := http.StatusText(status)
+	if err != "" {
+		message += ": " + err
 	}
-	fmt.Fprintf(w, `{"error": "%s: %s"}`, http.StatusText(status), err)
+	// сообщение экранируется: в нём могут быть кавычки из разбираемых параметров
+	body, _ := json.Marshal(struct {
+		Error string `json:"error"`
+	}{Error: message})
+	w.Write(body)
 }
 
 // returnEvents устанавливает статус 200 OK и записывает в тело ответа
 // JSON с массивом найденных событий (может быть пустым).
 func returnEvents(w http.ResponseWriter, logHeader string, events []Event) {
+	returnJSONResult(w, logHeader, events, http.StatusOK)
+}
+
+// returnJSONResult устанавливает требуемый статус-код и записывает в тело ответа
+// JSON вида {"result": v}.
+func returnJSONResult(w http.ResponseWriter, logHeader string, v interface{}, status int) {
 	type result struct {
-		Result []Event `json:"result"`
+		Result interface{} `json:"result"`
 	}
-	w.Header().Set("Content-Type", "application/json")
-	res := result{Result: events}
-	if err := json.NewEncoder(w).Encode(res); err != nil {
+	body, err := json.Marshal(result{Result: v})
+	if err != nil {
 		returnError(w, logHeader, err.Error(), http.StatusInternalServerError)
 		return
 	}
-}
-
-// LoggerMiddleware логирует информацию о всех http-запросах.
-func LoggerMiddleware(next http.HandlerFunc) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		defer next.ServeHTTP(w, r)
-		sb := strings.Builder{}
-		sb.WriteString(fmt.Sprintf("Request %s %s from %q\n", r.Method, r.RequestURI, r.RemoteAddr))
-		sb.WriteString("Header:\n")
-		for k, v := range r.Header {
-			sb.WriteString(fmt.Sprintf("\t%s: %q\n", k, v))
-		}
-		sb.WriteString("FormValues:\n")
-		if err := r.ParseForm(); err != nil {
-			sb.WriteString(fmt.Sprintf("could not parse form: %s", err))
-			log.Println("\t", sb.String())
-			return
-		}
-		for k, v := range r.Form {
-			sb.WriteString(fmt.Sprintf("%s: %q\n", k, v))
-		}
-		log.Println(sb.String())
-		return
-	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
 }
 
 // Event - событие в календаре.
@@ -443,24 +903,101 @@ type Event struct {
 	When  time.Time
 	Where string
 	What  string
+
+	// Recurrence - правило повторения (nil для однократного события).
+	Recurrence *Recurrence `json:",omitempty"`
+	// ExDates - моменты начала вхождений, исключённых из серии.
+	ExDates []time.Time `json:",omitempty"`
+	// TZ - часовой пояс IANA, в котором задано событие. Повторения
+	// разворачиваются по местному времени этого пояса (с учётом перехода на летнее время).
+	TZ string `json:",omitempty"`
+	// Duration - длительность события (0 - событие без длительности).
+	Duration time.Duration `json:",omitempty"`
+	// Reminders - за сколько до начала каждого вхождения напомнить о событии
+	// (по возрастанию, без повторов).
+	Reminders []time.Duration `json:",omitempty"`
+	// Attendees - приглашённые участники и их ответы. Изменять и удалять
+	// событие может только организатор (UserID).
+	Attendees []Attendee `json:",omitempty"`
+	// Version - номер версии события: 1 при создании, каждое изменение
+	// увеличивает его на единицу (см. EventStorage.Update).
+	Version uint64
+	// ModifiedBy - пользователь, последним создавший или изменивший событие.
+	ModifiedBy uuid.UUID `json:",omitempty"`
+	// DeletedAt - момент перемещения события в корзину (nil - событие не удалено).
+	DeletedAt *time.Time `json:",omitempty"`
+}
+
+// Location возвращает часовой пояс события (UTC, если пояс не задан или неизвестен).
+func (e Event) Location() *time.Location {
+	loc, err := loadLocation(e.TZ)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// MarshalJSON сериализует событие: момент начала When выводится в UTC,
+// а в поле Local - местное время события в его часовом поясе.
+// Для событий с длительностью добавляется момент окончания End (в UTC).
+func (e Event) MarshalJSON() ([]byte, error) {
+	// event - тот же набор полей без метода MarshalJSON
+	type event Event
+	var end *time.Time
+	if e.Duration > 0 {
+		t := e.End().UTC()
+		end = &t
+	}
+	return json.Marshal(struct {
+		event
+		When  time.Time
+		Local string
+		End   *time.Time `json:",omitempty"`
+	}{
+		event: event(e),
+		When:  e.When.UTC(),
+		Local: e.When.In(e.Location()).Format(time.RFC3339),
+		End:   end,
+	})
 }
 
 // EventStorage - интерфейс хранилища событий в календаре
 type EventStorage interface {
 	// Add добавляет событие в хранилище. Если в хранилище уже имеется
 	// событие с ID равным переданному - возвращается ошибка ErrEventAlreadyExists.
+	// Событие в корзине тоже занимает свой ID, пока оно не удалено окончательно:
+	// иначе его мог бы заменить другой пользователь, знающий ID.
 	Add(Event) error
 	// Update перезаписывает событие с переданным ID, если оно есть в хранилище.
-	// В случае отсутствия возвращается ErrEventNotFound.
+	// В случае отсутствия возвращается ErrEventNotFound. Версия переданного события
+	// должна быть на единицу больше версии хранимого, иначе (событие успели изменить
+	// после чтения) возвращается ErrVersionConflict.
 	Update(Event) error
-	// Delete удаляет из хранилища событие с данным ID.
-	// В случае отсутствия возвращается ErrEventNotFound.
+	// Delete удаляет событие с данным ID; хранилище с корзиной (TrashStorage)
+	// перемещает его туда: событие получает отметку DeletedAt и скрывается от всех
+	// методов, кроме методов TrashStorage. В случае отсутствия возвращается ErrEventNotFound.
 	Delete(uuid.UUID) error
 	// Get возвращает событие с данным ID.
 	// В случае отсутствия возвращается ErrEventNotFound.
 	Get(uuid.UUID) (Event, error)
+	// GetByUser возвращает все события пользователя с данным userID (повторяющиеся
+	// события - одним элементом). В случае отсутствия событий возвращается пустой массив.
+	GetByUser(userID uuid.UUID) ([]Event, error)
+	// GetAll возвращает все события хранилища (повторяющиеся события - одним элементом).
+	GetAll() ([]Event, error)
+	// GetByAttendee возвращает все события, на которые приглашён пользователь с данным
+	// userID (повторяющиеся события - одним элементом). В случае отсутствия событий
+	// возвращается пустой массив.
+	GetByAttendee(userID uuid.UUID) ([]Event, error)
+	// GetRange возвращает вхождения событий, организатором или участником которых
+	// является пользователь с данным userID, начинающиеся в отрезке [from, to]
+	// (границы включаются), в хронологическом порядке. Методы GetByDay, GetForWeek и GetForMonth также
+	// возвращают события, на которые пользователь приглашён. В случае отсутствия
+	// событий возвращается пустой массив.
+	GetRange(userID uuid.UUID, from, to time.Time) ([]Event, error)
 	// GetByDay возвращает все события пользователя с данным userID за сутки от
-	// переданного момента. В случае отсутствия событий возвращается пустой массив.
+	// переданного момента. Повторяющиеся события возвращаются отдельным элементом
+	// на каждое вхождение. В случае отсутствия событий возвращается пустой массив.
 	GetByDay(userID uuid.UUID, t time.Time) ([]Event, error)
 	// GetForWeek возвращает все события пользователя с данным userID за неделю от
 	// переданного момента. В случае отсутствия событий возвращается пустой массив.
@@ -474,57 +1011,130 @@ type EventStorage interface {
 var (
 	ErrEventAlreadyExists = errors.New("event already exists")
 	ErrEventNotFound      = errors.New("event not found")
+	ErrVersionConflict    = errors.New("event has been modified concurrently")
 )
 
-var _ EventStorage = (*InmemEventStorage)(nil)
+var (
+	_ TxStorage       = (*InmemEventStorage)(nil)
+	_ TrashStorage    = (*InmemEventStorage)(nil)
+	_ ReadyChecker    = (*InmemEventStorage)(nil)
+	_ ReplicaStorage  = (*InmemEventStorage)(nil)
+	_ ReminderStorage = (*InmemEventStorage)(nil)
+)
 
 // InmemEventStorage - имплементация EventStorage.
-// Хранилище расположено в оперативной памяти. Периодически все данные
-// сохраняются в файле (при наличии изменений).
+// Хранилище расположено в оперативной памяти. Каждое изменение записывается
+// в журнал упреждающей записи (WAL) до возврата из метода, а периодически
+// (при наличии изменений) все данные сохраняются в файл-снимок, после чего
+// журнал очищается. Выборки по диапазону дат (GetRange, GetByDay, GetForWeek,
+// GetForMonth) идут по индексу пользователя (см. eventIndex) и не захватывают
+// общую блокировку mu.
 type InmemEventStorage struct {
 	mu *sync.RWMutex
 	// repo является хранилищем событий
 	repo map[uuid.UUID]Event
+	// index - события пользователей, упорядоченные по началу; обновляется
+	// после repo, изменения транзакции попадают в него при фиксации.
+	index *eventIndex
 	// modified устанавливается, когда данные в хранилище обновляются и
 	// их необходимо сохранить на диск.
 	modified bool
+	// snapshotPath - файл, в котором сохраняется снимок repo.
+	snapshotPath string
+	// flushInterval - периодичность сохранения снимка.
+	flushInterval time.Duration
+	// log - журнал изменений, ещё не попавших в снимок.
+	log *eventLog
 	// stopCh - канал, закрытие которого останавливает repoSaver.
 	stopCh chan struct{}
-	wg     *sync.WaitGroup
+	// saverDone закрывается, когда repoSaver завершает работу.
+	saverDone chan struct{}
+	wg        *sync.WaitGroup
+	// tx - открытая транзакция, если хранилище - её представление (см. Tx).
+	tx *inmemTx
+	// repl - журнал репликации, если узел ведущий (см. ReplicationLeader).
+	repl *replicationLog
 }
 
 const (
 	// имя файла, в котором сохраняется repo.
 	persistentStorageFile = "event_storage.gob"
+	// имя файла журнала упреждающей записи.
+	persistentLogFile = "event_storage.wal"
 	// интервал, с периодичностью которого происходят попытки
 	// сохранения данных.
 	storageFlushInterval = time.Second * 5
 )
 
-// NewInmemEventStorage создаёт новое хранилище и запускает воркер, сохраняющий изменения в файл.
+// NewInmemEventStorage создаёт новое хранилище с файлами по умолчанию и запускает воркер,
+// сохраняющий изменения в файл.
 func NewInmemEventStorage() (*InmemEventStorage, error) {
+	return OpenInmemEventStorage(persistentStorageFile, persistentLogFile, storageFlushInterval)
+}
+
+// OpenInmemEventStorage создаёт хранилище, восстанавливая данные из снимка snapshotPath
+// и журнала walPath, и запускает воркер, сохраняющий снимок каждые flushInterval.
+func OpenInmemEventStorage(snapshotPath, walPath string, flushInterval time.Duration) (*InmemEventStorage, error) {
 	s := &InmemEventStorage{
-		mu:     &sync.RWMutex{},
-		repo:   make(map[uuid.UUID]Event),
-		stopCh: make(chan struct{}, 1),
-		wg:     &sync.WaitGroup{},
+		mu:            &sync.RWMutex{},
+		repo:          make(map[uuid.UUID]Event),
+		snapshotPath:  snapshotPath,
+		flushInterval: flushInterval,
+		stopCh:        make(chan struct{}, 1),
+		saverDone:     make(chan struct{}),
+		wg:            &sync.WaitGroup{},
 	}
 
 	if err := s.readStorageFile(); err != nil {
-		log.Printf("inmemEventStorage: could not open file %s: %s", persistentStorageFile, err)
+		if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("inmemEventStorage: could not read snapshot %s: %w", snapshotPath, err)
+		}
+		log.Printf("inmemEventStorage: no snapshot file %s, starting empty", snapshotPath)
 	} else {
 		log.Printf("inmemEventStorage: %d entrie(s) successfully read from the file", len(s.repo))
 	}
+	wal, records, err := openEventLog(walPath)
+	if err != nil {
+		return nil, fmt.Errorf("inmemEventStorage: could not open log %s: %w", walPath, err)
+	}
+	s.log = wal
+	// применение журнала идемпотентно: записи, уже попавшие в снимок, дают тот же результат
+	for _, rec := range records {
+		s.apply(rec)
+	}
+	if len(records) > 0 {
+		s.modified = true
+		log.Printf("inmemEventStorage: %d record(s) replayed from the log", len(records))
+	}
+	s.index = newEventIndex()
+	for _, e := range s.repo {
+		e := e
+		s.index.update(nil, &e)
+	}
 	s.wg.Add(1)
 	go s.repoSaver()
 
 	return s, nil
 }
 
+// apply применяет к repo запись журнала.
+func (s *InmemEventStorage) apply(rec walRecord) {
+	switch rec.Op {
+	case walAdd, walUpdate:
+		s.repo[rec.Event.ID] = rec.Event
+	case walDelete:
+		delete(s.repo, rec.ID)
+	case walBatch:
+		for _, r := range rec.Batch {
+			s.apply(r)
+		}
+	}
+}
+
 // repoSaver - воркер, сохраняющий данные хранилища в файл с заданной периодичностью.
 func (s *InmemEventStorage) repoSaver() {
 	log.Println("inmemEventStorage: persistent repository saver started")
-	flushTick := time.NewTicker(storageFlushInterval)
+	flushTick := time.NewTicker(s.flushInterval)
 	for {
 		select {
 		case <-flushTick.C:
@@ -534,31 +1144,61 @@ func (s *InmemEventStorage) repoSaver() {
 			flushTick.Stop()
 			s.saveRepo() // сохраняем данные
 			log.Println("inmemEventStorage: repoSaver stopped")
+			close(s.saverDone)
 			s.wg.Done()
 			return
 		}
 	}
 }
 
-// saveRepo сохраняет (при наличии изменений) содержимое хранилища в gob-файл.
+// saveRepo сохраняет (при наличии изменений) содержимое хранилища в gob-файл
+// и очищает журнал. Снимок пишется во временный файл и атомарно заменяет прежний.
+// Блокировка на чтение исключает запись в хранилище (и в журнал) на время сохранения.
 func (s *InmemEventStorage) saveRepo() {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	if !s.modified {
+	// неисправный журнал восстанавливается очисткой, даже если данные не менялись
+	if !s.modified && s.log.failure() == nil {
 		return
 	}
-	f, err := os.Create(persistentStorageFile)
-	if err != nil {
-		log.Printf("inmemEventStorage: repoSaver: ERROR: could not save data to the file: %v", err)
+	if err := s.flush(); err != nil {
+		log.Printf("inmemEventStorage: repoSaver: ERROR: %v", err)
 		return
 	}
-	defer f.Close()
-	if err := gob.NewEncoder(f).Encode(s.repo); err != nil {
-		log.Printf("inmemEventStorage: repoSaver: ERROR: could not save data to the file: %v", err)
-		return
+	log.Println("inmemEventStorage: repoSaver: data successfully saved to the file")
+}
+
+// flush сохраняет снимок repo и очищает журнал. Вызывается с захваченной блокировкой.
+func (s *InmemEventStorage) flush() error {
+	err := writeFileAtomic(s.snapshotPath, func(w io.Writer) error {
+		return gob.NewEncoder(w).Encode(s.repo)
+	})
+	if err != nil {
+		return fmt.Errorf("could not save data to the file: %w", err)
+	}
+	// сбой здесь не приводит к потере данных: журнал будет применён повторно
+	if err := s.log.reset(); err != nil {
+		return fmt.Errorf("could not reset the log: %w", err)
 	}
 	s.modified = false
-	log.Println("inmemEventStorage: repoSaver: data successfully saved to the file")
+	return nil
+}
+
+// Ready сообщает, готово ли хранилище: данные загружены при открытии, поэтому
+// достаточно, чтобы работал воркер repoSaver, сохраняющий их на диск, и журнал
+// принимал записи.
+func (s *InmemEventStorage) Ready() error {
+	select {
+	case <-s.saverDone:
+		return errors.New("inmemEventStorage: repoSaver is not running")
+	default:
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if err := s.log.failure(); err != nil {
+		return fmt.Errorf("inmemEventStorage: %w", err)
+	}
+	return nil
 }
 
 // Close закрывает хранилище и останавливает воркер repoSaver.
@@ -568,16 +1208,20 @@ func (s *InmemEventStorage) Close() {
 	}
 	close(s.stopCh)
 	s.wg.Wait()
+	if err := s.log.close(); err != nil {
+		log.Printf("inmemEventStorage: could not close the log: %v", err)
+	}
 	s.repo = nil
 	log.Println("inmemEventStorage closed")
 }
 
 // readStorageFile читает содержимое хранилища из gob-файла.
 func (s *InmemEventStorage) readStorageFile() error {
-	f, err := os.Open(persistentStorageFile)
+	f, err := os.Open(s.snapshotPath)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 	if err := gob.NewDecoder(f).Decode(&s.repo); err != nil {
 		return err
 	}
@@ -591,120 +1235,606 @@ func (s *InmemEventStorage) Add(e Event) error {
 	if _, ok := s.repo[e.ID]; ok {
 		return ErrEventAlreadyExists
 	}
-	s.repo[e.ID] = e
-	s.modified = true
-	return nil
+	return s.write(walRecord{Op: walAdd, Event: e})
 }
 
 func (s *InmemEventStorage) Update(e Event) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if _, ok := s.repo[e.ID]; !ok {
+	current, ok := s.repo[e.ID]
+	if !ok || current.trashed() {
 		return ErrEventNotFound
 	}
-	s.repo[e.ID] = e
-	s.modified = true
-	return nil
+	if e.Version != current.Version+1 {
+		return ErrVersionConflict
+	}
+	return s.put(e)
 }
 
+// Delete перемещает событие в корзину: в журнал и в снимок попадает событие
+// с отметкой DeletedAt.
 func (s *InmemEventStorage) Delete(eventID uuid.UUID) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if _, ok := s.repo[eventID]; !ok {
+	event, ok := s.repo[eventID]
+	if !ok || event.trashed() {
 		return ErrEventNotFound
 	}
-	delete(s.repo, eventID)
+	deletedAt := time.Now().UTC()
+	event.DeletedAt = &deletedAt
+	return s.put(event)
+}
+
+// put записывает изменённое событие в журнал и в хранилище.
+// Вызывается с захваченной блокировкой на запись.
+func (s *InmemEventStorage) put(e Event) error {
+	return s.write(walRecord{Op: walUpdate, Event: e})
+}
+
+// write записывает изменение в журнал и применяет его к repo и индексу. В транзакции
+// запись в журнал и индекс откладывается до фиксации. Вызывается с захваченной
+// блокировкой на запись.
+func (s *InmemEventStorage) write(rec walRecord) error {
+	if s.tx != nil {
+		s.tx.save(s.repo, rec)
+		s.apply(rec)
+		return nil
+	}
+	if err := s.log.append(rec); err != nil {
+		return err
+	}
+	s.repl.append(rec)
+	id := rec.eventID()
+	old := s.lookup(id)
+	s.apply(rec)
 	s.modified = true
+	s.index.update(old, s.lookup(id))
 	return nil
 }
 
+// lookup возвращает копию события из repo либо nil, если его нет.
+func (s *InmemEventStorage) lookup(id uuid.UUID) *Event {
+	e, ok := s.repo[id]
+	if !ok {
+		return nil
+	}
+	return &e
+}
+
 func (s *InmemEventStorage) Get(eventID uuid.UUID) (Event, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	event, ok := s.repo[eventID]
-	if !ok {
+	if !ok || event.trashed() {
 		return Event{}, ErrEventNotFound
 	}
 	return event, nil
 }
 
-func (s *InmemEventStorage) GetByDay(userID uuid.UUID, t time.Time) ([]Event, error) {
+func (s *InmemEventStorage) GetByUser(userID uuid.UUID) ([]Event, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	result := make([]Event, 0)
 	for _, event := range s.repo {
-		if event.UserID == userID &&
-			event.When.Sub(t) >= 0 &&
-			t.AddDate(0, 0, 1).Sub(event.When) >= 0 {
+		if event.UserID == userID && !event.trashed() {
 			result = append(result, event)
 		}
 	}
 	return result, nil
 }
 
-func (s *InmemEventStorage) GetForWeek(userID uuid.UUID, t time.Time) ([]Event, error) {
+func (s *InmemEventStorage) GetAll() ([]Event, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	result := make([]Event, 0, len(s.repo))
+	for _, event := range s.repo {
+		if !event.trashed() {
+			result = append(result, event)
+		}
+	}
+	return result, nil
+}
+
+func (s *InmemEventStorage) GetByAttendee(userID uuid.UUID) ([]Event, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	result := make([]Event, 0)
 	for _, event := range s.repo {
-		if event.UserID == userID &&
-			event.When.Sub(t) >= 0 &&
-			t.AddDate(0, 0, 7).Sub(event.When) >= 0 {
+		if event.attendee(userID) >= 0 && !event.trashed() {
 			result = append(result, event)
 		}
 	}
 	return result, nil
 }
 
+func (s *InmemEventStorage) GetByDay(userID uuid.UUID, t time.Time) ([]Event, error) {
+	return s.GetRange(userID, t, t.AddDate(0, 0, 1))
+}
+
+func (s *InmemEventStorage) GetForWeek(userID uuid.UUID, t time.Time) ([]Event, error) {
+	return s.GetRange(userID, t, t.AddDate(0, 0, 7))
+}
+
 func (s *InmemEventStorage) GetForMonth(userID uuid.UUID, t time.Time) ([]Event, error) {
+	return s.GetRange(userID, t, t.AddDate(0, 1, 0))
+}
+
+// GetRange возвращает вхождения событий пользователя (в том числе тех, на которые
+// он приглашён) в отрезке [from, to] по времени начала. Повторяющиеся события
+// разворачиваются в отдельные вхождения. Выборка идёт по индексу под блокировкой
+// полосы пользователя; в транзакции изменённые ею события берутся из repo.
+func (s *InmemEventStorage) GetRange(userID uuid.UUID, from, to time.Time) ([]Event, error) {
+	if s.tx == nil {
+		result := s.index.occurrences(userID, from, to, nil)
+		sortOccurrences(result)
+		return result, nil
+	}
+	result := s.index.occurrences(userID, from, to, s.tx.undo)
+	for id := range s.tx.undo {
+		if event, ok := s.repo[id]; ok && event.involves(userID) && !event.trashed() {
+			result = append(result, event.Expand(from, to)...)
+		}
+	}
+	sortOccurrences(result)
+	return result, nil
+}
+
+// GetWithReminders возвращает события с напоминаниями, у которых могут быть
+// вхождения в отрезке [from, to]. События выбираются по индексу, без перебора
+// событий всех пользователей.
+func (s *InmemEventStorage) GetWithReminders(from, to time.Time) ([]Event, error) {
+	if s.tx == nil {
+		return s.index.remindingEvents(from, to, nil), nil
+	}
+	result := s.index.remindingEvents(from, to, s.tx.undo)
+	for id := range s.tx.undo {
+		if event, ok := s.repo[id]; ok && len(event.Reminders) > 0 && !event.trashed() {
+			result = append(result, event)
+		}
+	}
+	return result, nil
+}
+
+func (s *InmemEventStorage) Trash(userID uuid.UUID) ([]Event, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	result := make([]Event, 0)
 	for _, event := range s.repo {
-		if event.UserID == userID &&
-			event.When.Sub(t) >= 0 &&
-			t.AddDate(0, 1, 0).Sub(event.When) >= 0 {
+		if event.UserID == userID && event.trashed() {
 			result = append(result, event)
 		}
 	}
+	sortTrash(result)
 	return result, nil
 }
 
+func (s *InmemEventStorage) GetDeleted(eventID uuid.UUID) (Event, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	event, ok := s.repo[eventID]
+	if !ok || !event.trashed() {
+		return Event{}, ErrEventNotFound
+	}
+	return event, nil
+}
+
+func (s *InmemEventStorage) Restore(eventID uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	event, ok := s.repo[eventID]
+	if !ok || !event.trashed() {
+		return ErrEventNotFound
+	}
+	event.DeletedAt = nil
+	return s.put(event)
+}
+
+// Purge окончательно удаляет события из корзины; в журнал записывается операция delete.
+func (s *InmemEventStorage) Purge(before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	purged := 0
+	for id, event := range s.repo {
+		if !event.trashed() || !event.DeletedAt.Before(before) {
+			continue
+		}
+		if err := s.write(walRecord{Op: walDelete, ID: id}); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// Tx выполняет fn в транзакции (см. TxStorage). Блокировка на запись
+// удерживается всю транзакцию; изменения сразу применяются к repo, а в журнал
+// попадают одной записью batch при фиксации. При ошибке repo восстанавливается.
+func (s *InmemEventStorage) Tx(fn func(EventStorage) error) error {
+	if s.tx != nil {
+		return fn(s) // вложенная транзакция - часть внешней
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tx := &inmemTx{undo: make(map[uuid.UUID]*Event)}
+	view := &InmemEventStorage{mu: &sync.RWMutex{}, repo: s.repo, index: s.index, tx: tx}
+	if err := fn(view); err != nil {
+		tx.rollback(s.repo)
+		return err
+	}
+	if len(tx.records) == 0 {
+		return nil
+	}
+	batch := walRecord{Op: walBatch, Batch: tx.records}
+	if err := s.log.append(batch); err != nil {
+		tx.rollback(s.repo)
+		return err
+	}
+	s.repl.append(batch)
+	s.modified = true
+	for id, old := range tx.undo {
+		s.index.update(old, s.lookup(id))
+	}
+	return nil
+}
+
+// inmemTx - записи журнала и прежние состояния событий, изменённых в транзакции.
+type inmemTx struct {
+	records []walRecord
+	// undo - события до первого изменения в транзакции (nil - события не было).
+	undo map[uuid.UUID]*Event
+}
+
+// save запоминает запись журнала и прежнее состояние изменяемого ею события.
+func (tx *inmemTx) save(repo map[uuid.UUID]Event, rec walRecord) {
+	tx.records = append(tx.records, rec)
+	id := rec.eventID()
+	if _, ok := tx.undo[id]; ok {
+		return
+	}
+	if e, ok := repo[id]; ok {
+		tx.undo[id] = &e
+	} else {
+		tx.undo[id] = nil
+	}
+}
+
+// rollback возвращает repo к состоянию до транзакции.
+func (tx *inmemTx) rollback(repo map[uuid.UUID]Event) {
+	for id, e := range tx.undo {
+		if e == nil {
+			delete(repo, id)
+		} else {
+			repo[id] = *e
+		}
+	}
+}
+
+// openStorage создаёт хранилище событий выбранного типа:
+// memory - InmemEventStorage, sqlite - SQLEventStorage в файле dbPath.
+// Возвращаемая функция закрывает хранилище.
+func openStorage(cfg Config) (EventStorage, func(), error) {
+	path, walPath := cfg.storagePaths()
+	switch cfg.Storage.Backend {
+	case "memory":
+		s, err := OpenInmemEventStorage(path, walPath, time.Duration(cfg.Storage.FlushInterval))
+		if err != nil {
+			return nil, nil, err
+		}
+		return s, s.Close, nil
+	case "sqlite":
+		s, err := NewSQLEventStorage(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return s, s.Close, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown storage type %q (want memory or sqlite)", cfg.Storage.Backend)
+	}
+}
+
+// loadConfig читает настройки из файла и окружения, применяет явно заданные
+// флаги командной строки и проверяет результат.
+func loadConfig(path string, flags func(*Config)) (Config, error) {
+	cfg, err := LoadConfig(path, os.LookupEnv)
+	if err != nil {
+		return Config{}, err
+	}
+	flags(&cfg)
+	if err := cfg.Validate(); err != nil {
+		return Config{}, fmt.Errorf("invalid config:\n%w", err)
+	}
+	return cfg, nil
+}
+
+// calendarRoutes возвращает обработчики маршрутов API, требующих аутентификации
+// (маршрут в терминах http.ServeMux). Все маршруты описаны в openapi.json.
+func calendarRoutes(api *CalendarAPI, feed *ChangeFeed, history *EventHistory) map[string]http.HandlerFunc {
+	return map[string]http.HandlerFunc{
+		"/create_event":     api.CreateEvent,
+		"/update_event":     api.UpdateEvent,
+		"/delete_event":     api.DeleteEvent,
+		"/batch":            api.Batch,
+		"/trash":            api.Trash,
+		"/restore_event":    api.RestoreEvent,
+		"/events_for_day":   api.GetDayEvents,
+		"/events_for_week":  api.GetWeekEvents,
+		"/events_for_month": api.GetMonthEvents,
+		"/export.ics":       api.ExportICS,
+		"/import_ics":       api.ImportICS,
+		"/free_busy":        api.FreeBusy,
+		"/agenda":           api.Agenda,
+		"/invite":           api.Invite,
+		"/rsvp":             api.RSVP,
+		"/invitations":      api.GetInvitations,
+		"/search_events":    api.SearchEvents,
+		"/events/stream":    NewStreamAPI(feed).Stream,
+		"/event_history":    NewHistoryAPI(history).EventHistory,
+		apiV2Prefix:         api.EventsV2,
+	}
+}
+
 func main() {
-	port := flag.String("p", "8080", "port")
+	// под именем calctl (или с первым аргументом calctl) работаем клиентом API
+	if args, ok := calctlArgs(os.Args); ok {
+		os.Exit(runCalctl(args, os.Stdout, os.Stderr))
+	}
+	configPath := flag.String("config", os.Getenv("CALENDAR_CONFIG"), "config file (.yaml, .yml or .json; env CALENDAR_CONFIG)")
+	port := flag.String("p", "8080", "port (overrides listen from the config)")
+	storageKind := flag.String("storage", "memory", "storage backend: memory or sqlite")
+	dbPath := flag.String("db", "event_storage.db", "database file for the sqlite storage")
+	historyPath := flag.String("history", "event_history.jsonl", "event change history file")
+	trashRetention := flag.Duration("trash-retention", defaultTrashRetention, "how long deleted events stay in the trash; 0 keeps them forever")
+	usersPath := flag.String("users", "users.json", "user accounts file for /login")
+	jwtSecret := flag.String("jwt-secret", "", "HMAC secret for access tokens; required unless -insecure-no-auth is given")
+	insecureNoAuth := flag.Bool("insecure-no-auth", false, "disable authentication: anyone can read and change any user's events")
+	tokenTTL := flag.Duration("token-ttl", defaultTokenTTL, "access token lifetime")
+	addUser := flag.String("add-user", "", "create an account given as username:password and exit")
+	remindersPath := flag.String("reminders-state", "reminders.json", "reminder scheduler state file")
+	webhookURL := flag.String("webhook", "", "URL to POST reminders to; empty logs reminders instead")
+	reminderInterval := flag.Duration("reminder-interval", defaultReminderInterval, "how often to check for due reminders")
+	redactFields := flag.String("log-redact", defaultRedactedFields, "comma-separated query parameters hidden in the access log")
 	flag.Parse()
+
+	// флаги переопределяют настройки, только если заданы явно
+	flags := func(cfg *Config) {
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "p":
+				cfg.Listen = ":" + *port
+			case "storage":
+				cfg.Storage.Backend = *storageKind
+			case "db":
+				cfg.Storage.Path = *dbPath
+			case "history":
+				cfg.Storage.HistoryFile = *historyPath
+			case "trash-retention":
+				cfg.Storage.TrashRetention = Duration(*trashRetention)
+			case "users":
+				cfg.Auth.UsersFile = *usersPath
+			case "jwt-secret":
+				cfg.Auth.JWTSecret = *jwtSecret
+			case "insecure-no-auth":
+				cfg.Auth.InsecureNoAuth = *insecureNoAuth
+			case "token-ttl":
+				cfg.Auth.TokenTTL = Duration(*tokenTTL)
+			case "reminders-state":
+				cfg.Reminders.StateFile = *remindersPath
+			case "webhook":
+				cfg.Reminders.WebhookURL = *webhookURL
+			case "reminder-interval":
+				cfg.Reminders.Interval = Duration(*reminderInterval)
+			case "log-redact":
+				cfg.LogRedact = strings.Split(*redactFields, ",")
+			}
+		})
+	}
+	cfg, err := loadConfig(*configPath, flags)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	users, err := OpenFileUserStore(cfg.Auth.UsersFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *addUser != "" {
+		username, password, _ := strings.Cut(*addUser, ":")
+		userID, err := users.AddUser(username, password)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("user %q created, user_id %s\n", username, userID)
+		return
+	}
+	var auth *Authenticator
+	if cfg.Auth.JWTSecret != "" {
+		auth = NewAuthenticator([]byte(cfg.Auth.JWTSecret), time.Duration(cfg.Auth.TokenTTL))
+	} else {
+		log.Println("WARNING: authentication is disabled (insecure_no_auth): anyone can access any user's events")
+	}
+
+	// воркеры и хранилища останавливаются после завершения запросов
+	// в порядке, обратном запуску
+	var closers []func()
+	onShutdown := func(c func()) {
+		closers = append([]func(){c}, closers...)
+	}
+
 	// запускаем storage
-	storage, err := NewInmemEventStorage()
+	backend, closeStorage, err := openStorage(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	onShutdown(closeStorage)
+	// ведущий нумерует изменения с самого начала, до запуска воркеров, пишущих в хранилище
+	var leader *ReplicationLeader
+	if cfg.Replication.Role == "leader" {
+		inmem, ok := backend.(*InmemEventStorage)
+		if !ok {
+			log.Fatal("replication requires the memory backend")
+		}
+		leader = NewReplicationLeader(inmem, cfg.Replication.LogSize, cfg.Replication.Secret)
+	}
+	history, err := OpenEventHistory(cfg.Storage.HistoryFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	onShutdown(history.Close)
+	// изменения записываются в историю и публикуются в ленту для /events/stream,
+	// поиск работает поверх
+	feed := NewChangeFeed(defaultJournalSize)
+	storage, err := NewIndexedEventStorage(NewFeedEventStorage(NewHistoryEventStorage(backend, history), feed))
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer storage.Close()
 
-	// устанавливаем роутер и прописываем маршруты
+	// ведомый получает изменения от ведущего и передаёт ему запросы на изменение
+	forward := func(h http.HandlerFunc) http.HandlerFunc { return h }
+	var readyChecks []ReadyChecker
+	if cfg.Replication.Role == "follower" {
+		replica, err := NewReplica(cfg.Replication.LeaderURL, cfg.Replication.Secret, storage)
+		if err != nil {
+			log.Fatal(err)
+		}
+		replica.Start()
+		onShutdown(replica.Close)
+		forward = replica.Forward
+		readyChecks = append(readyChecks, replica)
+	}
+	health := NewHealth(backend, readyChecks...)
+
+	// напоминания и очистку корзины выполняет только ведущий (или единственный) узел
+	if cfg.Replication.Role != "follower" {
+		// запускаем напоминания
+		var notifier Notifier = LogNotifier{}
+		if cfg.Reminders.WebhookURL != "" {
+			notifier = WebhookNotifier{URL: cfg.Reminders.WebhookURL, Client: &http.Client{Timeout: reminderTimeout}}
+		}
+		reminders, err := NewReminderScheduler(storage, notifier, cfg.Reminders.StateFile, time.Duration(cfg.Reminders.Interval))
+		if err != nil {
+			log.Fatal(err)
+		}
+		reminders.Start()
+		onShutdown(reminders.Close)
+
+		// запускаем очистку корзины
+		if retention := time.Duration(cfg.Storage.TrashRetention); retention > 0 {
+			purger := NewTrashPurger(storage, retention, trashPurgeInterval)
+			purger.Start()
+			onShutdown(purger.Close)
+		}
+	}
+
+	// устанавливаем роутер и прописываем маршруты;
+	// все маршруты, кроме /login, /metrics, /openapi.json, /healthz и /readyz,
+	// требуют токен (если аутентификация включена)
 	api := NewCalendar(storage)
+	metrics := NewMetrics()
+	accessLog := NewAccessLogger(os.Stdout, nil, metrics)
+	level, _ := ParseLogLevel(cfg.LogLevel) // уровень проверен в Validate
+	accessLog.Configure(level, cfg.LogRedact)
+	// ограничения частоты: по IP - до аутентификации, по пользователю - после неё
+	ipLimiter := NewRateLimiter(clientIP)
+	ipLimiter.Configure(cfg.Limits.IPRate, cfg.Limits.IPBurst)
+	userLimiter := NewRateLimiter(requestUser)
+	userLimiter.Configure(cfg.Limits.UserRate, cfg.Limits.UserBurst)
+	bodyLimiter := NewBodyLimiter(int64(cfg.Limits.MaxBodyBytes))
+	limit := func(h http.HandlerFunc) http.HandlerFunc {
+		return ipLimiter.Middleware(bodyLimiter.Middleware(h))
+	}
 	router := http.NewServeMux()
-	router.Handle("/create_event", LoggerMiddleware(api.CreateEvent))
-	router.Handle("/update_event", LoggerMiddleware(api.UpdateEvent))
-	router.Handle("/delete_event", LoggerMiddleware(api.DeleteEvent))
-	router.Handle("/events_for_day", LoggerMiddleware(api.GetDayEvents))
-	router.Handle("/events_for_week", LoggerMiddleware(api.GetWeekEvents))
-	router.Handle("/events_for_month", LoggerMiddleware(api.GetMonthEvents))
+	handle := func(route string, h http.HandlerFunc) {
+		router.Handle(route, accessLog.Middleware(route, limit(forward(auth.Middleware(userLimiter.Middleware(h))))))
+	}
+	for route, h := range calendarRoutes(api, feed, history) {
+		handle(route, h)
+	}
+	if auth != nil {
+		router.Handle("/login", accessLog.Middleware("/login", limit(forward(NewLoginAPI(users, auth).Login))))
+	}
+	router.Handle("/metrics", accessLog.Middleware("/metrics", metrics.ServeHTTP))
+	router.Handle("/openapi.json", accessLog.Middleware("/openapi.json", ServeOpenAPI))
+	// проверки оркестратора не ограничиваются по частоте
+	router.Handle("/healthz", accessLog.Middleware("/healthz", health.Live))
+	router.Handle("/readyz", accessLog.Middleware("/readyz", health.Readiness))
+	if leader != nil {
+		// ведомые узлы подтверждают доступ секретом репликации
+		router.Handle("/replication/snapshot", accessLog.Middleware("/replication/snapshot", leader.Snapshot))
+		router.Handle("/replication/log", accessLog.Middleware("/replication/log", leader.Log))
+	}
+	// клиенты CalDAV могут аутентифицироваться именем и паролем
+	router.Handle(calDAVPrefix, accessLog.Middleware(calDAVPrefix,
+		limit(forward(auth.BasicMiddleware(users, userLimiter.Middleware(NewCalDAV(storage).ServeHTTP))))))
+	router.Handle("/.well-known/caldav", accessLog.Middleware("/.well-known/caldav", wellKnownCalDAV))
 
 	// устанавливаем http-сервер
 	server := http.Server{
-		Addr:    ":" + *port,
-		Handler: router,
+		Addr:         cfg.Listen,
+		Handler:      router,
+		ReadTimeout:  time.Duration(cfg.ReadTimeout),
+		WriteTimeout: time.Duration(cfg.WriteTimeout),
+		IdleTimeout:  time.Duration(cfg.IdleTimeout),
+	}
+	// потоки изменений бессрочны: при остановке их нужно закрыть, иначе
+	// server.Shutdown будет ждать их до истечения ShutdownTimeout
+	server.RegisterOnShutdown(feed.Close)
+	if leader != nil {
+		server.Handler = leader.Middleware(router)
+		server.RegisterOnShutdown(leader.Close)
+	}
+	certs := &certReloader{}
+	useTLS := cfg.TLS.CertFile != ""
+	if useTLS {
+		if err := certs.load(cfg.TLS.CertFile, cfg.TLS.KeyFile); err != nil {
+			log.Fatal(err)
+		}
+		server.TLSConfig = &tls.Config{GetCertificate: certs.getCertificate, MinVersion: tls.VersionTLS12}
 	}
 	go func() {
-		if err := server.ListenAndServe(); err != nil {
+		var err error
+		if useTLS {
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			log.Println(err)
 		}
 	}()
 	log.Printf("Listening at %s...", server.Addr)
 
-	// подписываемся на сигнал завершения и ждём
+	// по SIGHUP перечитываем настройки и применяем те, что можно менять на ходу
+	sigHup := make(chan os.Signal, 1)
+	signal.Notify(sigHup, syscall.SIGHUP)
+	go func() {
+		for range sigHup {
+			newCfg, err := loadConfig(*configPath, flags)
+			if err != nil {
+				log.Printf("config reload failed, keeping the current settings: %v", err)
+				continue
+			}
+			level, _ := ParseLogLevel(newCfg.LogLevel)
+			accessLog.Configure(level, newCfg.LogRedact)
+			ipLimiter.Configure(newCfg.Limits.IPRate, newCfg.Limits.IPBurst)
+			userLimiter.Configure(newCfg.Limits.UserRate, newCfg.Limits.UserBurst)
+			bodyLimiter.Configure(int64(newCfg.Limits.MaxBodyBytes))
+			if useTLS && newCfg.TLS.CertFile != "" {
+				if err := certs.load(newCfg.TLS.CertFile, newCfg.TLS.KeyFile); err != nil {
+					log.Printf("config reload: could not load TLS certificate: %v", err)
+				}
+			}
+			if fields := newCfg.restartRequired(cfg); len(fields) > 0 {
+				log.Printf("config reload: changes to %s take effect after restart", strings.Join(fields, ", "))
+			}
+			log.Println("config reloaded")
+		}
+	}()
+
+	// подписываемся на сигнал завершения и ждём; SIGKILL перехватить нельзя
 	sigTerm := make(chan os.Signal, 1)
-	signal.Notify(sigTerm, os.Interrupt, os.Kill)
+	signal.Notify(sigTerm, os.Interrupt, syscall.SIGTERM)
 	<-sigTerm
-	server.Shutdown(context.Background())
+	if err := gracefulShutdown(&server, health, time.Duration(cfg.ShutdownDrainDelay), time.Duration(cfg.ShutdownTimeout), closers...); err != nil {
+		os.Exit(1)
+	}
 }
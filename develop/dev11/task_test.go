@@ -3,9 +3,12 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -25,12 +28,35 @@ type respBody struct {
 // end-to end test
 func TestCalendar(t *testing.T) {
 	//запускаем сервис
+	// end-to-end тест обращается к API без токенов
+	t.Setenv("CALENDAR_INSECURE_NO_AUTH", "true")
 	go main() // не знаю, так вообще делается?
+	// перед тем как слушать порт, main открывает хранилище, и первые запросы
+	// без ожидания могли прийти раньше, чем сервер запустится
+	waitForServer(t, "localhost:8080")
 	t.Run("Create", tCreate)
 	t.Run("Update", tGetAndUpdate)
 	t.Run("Get", tGet)
 	t.Run("Delete", tDelete)
+	// кроме снимка main создаёт в текущем каталоге журнал и историю изменений;
+	// удаляем всё, чтобы следующий запуск начинал с пустого хранилища
 	os.Remove(persistentStorageFile)
+	os.Remove(persistentLogFile)
+	os.Remove(DefaultConfig().Storage.HistoryFile)
+}
+
+// waitForServer ждёт, пока запущенный в горутине сервер начнёт принимать соединения.
+func waitForServer(t *testing.T, addr string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("server at %s did not start", addr)
 }
 
 func tCreate(t *testing.T) {
@@ -242,4 +268,119 @@ func tDelete(t *testing.T) {
 	require.NoError(t, err)
 	resp.Body.Close()
 	assert.Equal(t, 0, len(res.Result))
-}
\ No newline at end of file
+}
+
+// doForm выполняет запрос к обработчику: для GET параметры передаются в query string,
+// для POST - в теле запроса.
+func doForm(h http.HandlerFunc, method, path string, form url.Values) *httptest.ResponseRecorder {
+	var req *http.Request
+	if method == http.MethodGet {
+		req = httptest.NewRequest(method, path+"?"+form.Encode(), nil)
+	} else {
+		req = httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	rec := httptest.NewRecorder()
+	h(rec, req)
+	return rec
+}
+
+func TestTimeZones(t *testing.T) {
+	api := NewCalendar(newTestStorage())
+	userID := uuid.New().String()
+
+	rec := doForm(api.CreateEvent, http.MethodPost, "/create_event", url.Values{
+		"user_id": {userID}, "date": {"10.03.2022"}, "time": {"00:30"}, "tz": {"Europe/Moscow"},
+	})
+	require.Equal(t, http.StatusCreated, rec.Code)
+	rec = doForm(api.CreateEvent, http.MethodPost, "/create_event", url.Values{
+		"user_id": {userID}, "date": {"10.03.2022"}, "tz": {"Mars/Olympus"},
+	})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// сутки отсчитываются в часовом поясе запроса
+	tt := []struct {
+		date    string
+		tz      string
+		wantLen int
+	}{
+		{date: "10.03.2022", tz: "Europe/Moscow", wantLen: 1},
+		{date: "10.03.2022", tz: "", wantLen: 0},
+		{date: "09.03.2022", tz: "", wantLen: 1},
+		{date: "09.03.2022", tz: "Europe/Berlin", wantLen: 1},
+		{date: "09.03.2022", tz: "Asia/Vladivostok", wantLen: 0},
+	}
+	for i, tc := range tt {
+		t.Run(fmt.Sprintf("#%d", i), func(t *testing.T) {
+			rec := doForm(api.GetDayEvents, http.MethodGet, "/events_for_day", url.Values{
+				"user_id": {userID}, "date": {tc.date}, "tz": {tc.tz},
+			})
+			require.Equal(t, http.StatusOK, rec.Code)
+			var res struct{ Result []map[string]interface{} }
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&res))
+			require.Equal(t, tc.wantLen, len(res.Result))
+			if tc.wantLen > 0 {
+				assert.Equal(t, "2022-03-09T21:30:00Z", res.Result[0]["When"])
+				assert.Equal(t, "2022-03-10T00:30:00+03:00", res.Result[0]["Local"])
+				assert.Equal(t, "Europe/Moscow", res.Result[0]["TZ"])
+			}
+		})
+	}
+}
+
+func TestTimeZonesDST(t *testing.T) {
+	storage := newTestStorage()
+	api := NewCalendar(storage)
+	userID := uuid.New().String()
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	require.NoError(t, err)
+
+	// еженедельная встреча в 09:00 по Берлину; 27.03.2022 - переход на летнее время
+	rec := doForm(api.CreateEvent, http.MethodPost, "/create_event", url.Values{
+		"user_id": {userID}, "date": {"21.03.2022"}, "time": {"09:00"}, "tz": {"Europe/Berlin"},
+		"rrule": {"FREQ=WEEKLY;COUNT=3"},
+	})
+	require.Equal(t, http.StatusCreated, rec.Code)
+	// 27.03.2022 в Берлине длится 23 часа
+	rec = doForm(api.CreateEvent, http.MethodPost, "/create_event", url.Values{
+		"user_id": {userID}, "date": {"27.03.2022"}, "time": {"23:30"}, "tz": {"Europe/Berlin"},
+	})
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	from := time.Date(2022, 3, 21, 0, 0, 0, 0, berlin)
+	events, err := storage.GetForMonth(uuid.MustParse(userID), from)
+	require.NoError(t, err)
+	local := make([]string, 0)
+	for _, e := range events {
+		local = append(local, e.When.In(berlin).Format("02.01 15:04 MST"))
+	}
+	assert.ElementsMatch(t, []string{"21.03 09:00 CET", "28.03 09:00 CEST", "04.04 09:00 CEST", "27.03 23:30 CEST"}, local)
+
+	rec = doForm(api.GetDayEvents, http.MethodGet, "/events_for_day", url.Values{
+		"user_id": {userID}, "date": {"28.03.2022"}, "tz": {"Europe/Berlin"},
+	})
+	require.Equal(t, http.StatusOK, rec.Code)
+	var res respBody
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&res))
+	require.Equal(t, 1, len(res.Result))
+	assert.Equal(t, time.Date(2022, 3, 28, 7, 0, 0, 0, time.UTC), res.Result[0].When)
+
+	// смена пояса без даты и времени сохраняет момент начала
+	eventID := res.Result[0].ID.String()
+	rec = doForm(api.UpdateEvent, http.MethodPost, "/update_event", url.Values{
+		"event_id": {eventID}, "tz": {"Europe/Moscow"},
+	})
+	require.Equal(t, http.StatusOK, rec.Code)
+	e, err := storage.Get(res.Result[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, "Europe/Moscow", e.TZ)
+	assert.True(t, e.When.Equal(time.Date(2022, 3, 21, 8, 0, 0, 0, time.UTC)))
+	// время трактуется в поясе события
+	rec = doForm(api.UpdateEvent, http.MethodPost, "/update_event", url.Values{
+		"event_id": {eventID}, "time": {"12:00"},
+	})
+	require.Equal(t, http.StatusOK, rec.Code)
+	e, err = storage.Get(res.Result[0].ID)
+	require.NoError(t, err)
+	assert.True(t, e.When.Equal(time.Date(2022, 3, 21, 9, 0, 0, 0, time.UTC)))
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// defaultTrashRetention - сколько удалённые события хранятся в корзине по умолчанию.
+	defaultTrashRetention = 30 * 24 * time.Hour
+	// trashPurgeInterval - периодичность очистки корзины.
+	trashPurgeInterval = time.Hour
+)
+
+// trashed проверяет, находится ли событие в корзине.
+func (e Event) trashed() bool {
+	return e.DeletedAt != nil
+}
+
+// TrashStorage - хранилище с корзиной: Delete перемещает событие в корзину,
+// откуда его можно восстановить, пока оно не удалено окончательно.
+type TrashStorage interface {
+	EventStorage
+	// Trash возвращает события пользователя с данным userID, находящиеся в корзине,
+	// в порядке удаления. В случае отсутствия событий возвращается пустой массив.
+	Trash(userID uuid.UUID) ([]Event, error)
+	// GetDeleted возвращает событие с данным ID из корзины.
+	// Если в корзине его нет, возвращается ErrEventNotFound.
+	GetDeleted(uuid.UUID) (Event, error)
+	// Restore возвращает событие с данным ID из корзины.
+	// Если в корзине его нет, возвращается ErrEventNotFound.
+	Restore(uuid.UUID) error
+	// Purge окончательно удаляет события, перемещённые в корзину раньше before,
+	// и возвращает их количество.
+	Purge(before time.Time) (int, error)
+}
+
+// ErrTrashNotSupported - хранилище не поддерживает корзину.
+var ErrTrashNotSupported = errors.New("trash is not supported by the storage")
+
+// trashStorage возвращает s как TrashStorage, если оно её реализует,
+// иначе ErrTrashNotSupported.
+func trashStorage(s EventStorage) (TrashStorage, error) {
+	ts, ok := s.(TrashStorage)
+	if !ok {
+		return nil, ErrTrashNotSupported
+	}
+	return ts, nil
+}
+
+// getAnyEvent возвращает событие с данным ID, в том числе из корзины
+// (если хранилище её поддерживает).
+func getAnyEvent(s EventStorage, eventID uuid.UUID) (Event, error) {
+	e, err := s.Get(eventID)
+	if ts, ok := s.(TrashStorage); ok && errors.Is(err, ErrEventNotFound) {
+		return ts.GetDeleted(eventID)
+	}
+	return e, err
+}
+
+// sortTrash упорядочивает события корзины по времени удаления.
+func sortTrash(events []Event) {
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].DeletedAt.Before(*events[j].DeletedAt)
+	})
+}
+
+// Trash возвращает события пользователя, находящиеся в корзине, в порядке удаления.
+// Время удаления - в поле DeletedAt.
+//
+// GET /trash
+// параметры:
+// *user_id
+func (c CalendarAPI) Trash(w http.ResponseWriter, r *http.Request) {
+	const logHeader = "trash"
+	if r.Method != http.MethodGet {
+		returnError(w, logHeader, "", http.StatusMethodNotAllowed)
+		return
+	}
+	userID, ok := getUserID(w, r, logHeader)
+	if !ok {
+		return // ошибки уже обработаны
+	}
+	ts, err := trashStorage(c.storage)
+	if err != nil {
+		returnStorageError(w, logHeader, err)
+		return
+	}
+	events, err := ts.Trash(userID)
+	if err != nil {
+		returnStorageError(w, logHeader, err)
+		return
+	}
+	returnEvents(w, logHeader, events)
+}
+
+// RestoreEvent возвращает событие из корзины. Восстановить событие может только
+// организатор; пересечение с другими событиями не проверяется.
+//
+// POST /restore_event
+// параметры:
+// *event_id
+func (c CalendarAPI) RestoreEvent(w http.ResponseWriter, r *http.Request) {
+	const logHeader = "restoreEvent"
+	if r.Method != http.MethodPost {
+		returnError(w, logHeader, "", http.StatusMethodNotAllowed)
+		return
+	}
+	defer r.Body.Close()
+
+	queryEventID := r.FormValue("event_id")
+	if queryEventID == "" {
+		returnError(w, logHeader, "missing parameter: event_id", http.StatusBadRequest)
+		return
+	}
+	eventID, err := uuid.Parse(queryEventID)
+	if err != nil {
+		returnError(w, logHeader, fmt.Sprintf("incorrect event ID: %v", err), http.StatusBadRequest)
+		return
+	}
+	ts, err := trashStorage(c.storage)
+	if err != nil {
+		returnStorageError(w, logHeader, err)
+		return
+	}
+	event, err := ts.GetDeleted(eventID)
+	if err != nil {
+		returnStorageError(w, logHeader, err)
+		return
+	}
+	if !authorized(r, event.UserID) {
+		returnError(w, logHeader, "access denied", http.StatusForbidden)
+		return
+	}
+	if err := ts.Restore(eventID); err != nil {
+		returnStorageError(w, logHeader, err)
+		return
+	}
+	returnResult(w, fmt.Sprintf("event %v successfully restored", eventID), http.StatusOK)
+	log.Printf("%s: restored event %v", logHeader, eventID)
+}
+
+// TrashPurger периодически окончательно удаляет события, пролежавшие в корзине
+// дольше срока хранения.
+type TrashPurger struct {
+	storage   EventStorage
+	retention time.Duration
+	interval  time.Duration
+	// now - источник текущего времени (подменяется в тестах).
+	now func() time.Time
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewTrashPurger создаёт очистку корзины хранилища storage со сроком хранения retention.
+func NewTrashPurger(storage EventStorage, retention, interval time.Duration) *TrashPurger {
+	return &TrashPurger{
+		storage:   storage,
+		retention: retention,
+		interval:  interval,
+		now:       time.Now,
+		stopCh:    make(chan struct{}),
+	}
+}
+
+// Start запускает фоновую очистку корзины. Первая очистка выполняется сразу:
+// за время простоя сервера срок хранения части событий мог истечь. Если
+// хранилище не поддерживает корзину, очистка не запускается.
+func (p *TrashPurger) Start() {
+	if _, err := trashStorage(p.storage); err != nil {
+		log.Printf("trashPurger: %v, purging is disabled", err)
+		return
+	}
+	p.wg.Add(1)
+	go p.run()
+}
+
+// Close останавливает очистку корзины и дожидается её завершения.
+func (p *TrashPurger) Close() {
+	close(p.stopCh)
+	p.wg.Wait()
+	log.Println("trashPurger stopped")
+}
+
+func (p *TrashPurger) run() {
+	defer p.wg.Done()
+	log.Printf("trashPurger: started, retention %v", p.retention)
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		p.purge()
+		select {
+		case <-ticker.C:
+		case <-p.stopCh:
+			return
+		}
+	}
+}
+
+// purge окончательно удаляет события, удалённые раньше, чем retention назад.
+func (p *TrashPurger) purge() {
+	ts, err := trashStorage(p.storage)
+	if err != nil {
+		log.Printf("trashPurger: ERROR: %v", err)
+		return
+	}
+	n, err := ts.Purge(p.now().Add(-p.retention))
+	if err != nil {
+		log.Printf("trashPurger: ERROR: %v", err)
+	}
+	if n > 0 {
+		log.Printf("trashPurger: purged %d event(s)", n)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrashHandlers(t *testing.T) {
+	storage := newTestStorage()
+	api := NewCalendar(storage)
+	userID := uuid.New()
+	e := Event{ID: uuid.New(), UserID: userID, When: mustTime(t, "03.01.2022 10:00"), What: "Встреча", Version: 1}
+	require.NoError(t, storage.Add(e))
+
+	trash := func() []Event {
+		rec := doForm(api.Trash, http.MethodGet, "/trash", url.Values{"user_id": {userID.String()}})
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var res respBody
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&res))
+		return res.Result
+	}
+	assert.Empty(t, trash())
+
+	rec := doForm(api.DeleteEvent, http.MethodPost, "/delete_event", url.Values{"event_id": {e.ID.String()}})
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	deleted := trash()
+	require.Equal(t, 1, len(deleted))
+	assert.Equal(t, e.ID, deleted[0].ID)
+	require.NotNil(t, deleted[0].DeletedAt)
+	rec = doForm(api.GetDayEvents, http.MethodGet, "/events_for_day", url.Values{"user_id": {userID.String()}, "date": {"03.01.2022"}})
+	require.Equal(t, http.StatusOK, rec.Code)
+	var res respBody
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&res))
+	assert.Empty(t, res.Result)
+
+	rec = doForm(api.RestoreEvent, http.MethodPost, "/restore_event", url.Values{"event_id": {e.ID.String()}})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Contains(t, rec.Body.String(), "successfully restored")
+	assert.Empty(t, trash())
+	got, err := storage.Get(e.ID)
+	require.NoError(t, err)
+	assert.Nil(t, got.DeletedAt)
+	assert.Equal(t, e.Version, got.Version)
+
+	// восстановить можно только событие из корзины
+	rec = doForm(api.RestoreEvent, http.MethodPost, "/restore_event", url.Values{"event_id": {e.ID.String()}})
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	rec = doForm(api.RestoreEvent, http.MethodPost, "/restore_event", url.Values{"event_id": {"garbage"}})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = doForm(api.RestoreEvent, http.MethodPost, "/restore_event", url.Values{})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = doForm(api.RestoreEvent, http.MethodGet, "/restore_event", url.Values{"event_id": {e.ID.String()}})
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	rec = doForm(api.Trash, http.MethodPost, "/trash", url.Values{"user_id": {userID.String()}})
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
+
+func TestTrashAccess(t *testing.T) {
+	storage := newTestStorage()
+	api := NewCalendar(storage)
+	auth := NewAuthenticator([]byte("secret"), time.Hour)
+	aliceID, bobID := uuid.New(), uuid.New()
+	bobEvent := Event{ID: uuid.New(), UserID: bobID, When: mustTime(t, "03.01.2022 10:00"), Version: 1}
+	require.NoError(t, storage.Add(bobEvent))
+	require.NoError(t, storage.Delete(bobEvent.ID))
+	token, _, err := auth.IssueToken(aliceID)
+	require.NoError(t, err)
+
+	// do выполняет запрос через middleware от имени Алисы
+	do := func(h http.HandlerFunc, method, path string, form url.Values) int {
+		var req *http.Request
+		if method == http.MethodGet {
+			req = httptest.NewRequest(method, path+"?"+form.Encode(), nil)
+		} else {
+			req = httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		auth.Middleware(h)(rec, req)
+		return rec.Code
+	}
+	assert.Equal(t, http.StatusForbidden, do(api.Trash, http.MethodGet, "/trash", url.Values{"user_id": {bobID.String()}}))
+	assert.Equal(t, http.StatusOK, do(api.Trash, http.MethodGet, "/trash", url.Values{"user_id": {aliceID.String()}}))
+	assert.Equal(t, http.StatusForbidden, do(api.RestoreEvent, http.MethodPost, "/restore_event", url.Values{"event_id": {bobEvent.ID.String()}}))
+
+	// Алиса знает ID события Боба, но не может занять его, пока событие в корзине
+	req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/api/v2/users/%s/events", aliceID),
+		strings.NewReader(fmt.Sprintf(`{"id": %q, "when": "2022-01-05T10:00:00Z"}`, bobEvent.ID)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	auth.Middleware(api.EventsV2)(rec, req)
+	assert.Equal(t, http.StatusConflict, rec.Code, rec.Body.String())
+	// импорт с UID, совпадающим с ID события Боба, создаёт отдельное событие Алисы
+	imported, itemErrors := ImportEvents(storage, aliceID, []ICSEntry{{UID: bobEvent.ID.String(),
+		Event: Event{ID: bobEvent.ID, When: mustTime(t, "05.01.2022 10:00")}}})
+	assert.Equal(t, 1, imported)
+	assert.Empty(t, itemErrors)
+	_, err = storage.Get(icsEventID(aliceID, bobEvent.ID.String()))
+	assert.NoError(t, err)
+
+	// событие Боба осталось в корзине, и Боб может его восстановить
+	got, err := storage.GetDeleted(bobEvent.ID)
+	require.NoError(t, err)
+	assert.Equal(t, bobID, got.UserID)
+	assert.NoError(t, storage.Restore(bobEvent.ID))
+}
+
+func TestTrashPurger(t *testing.T) {
+	storage := newTestStorage()
+	userID := uuid.New()
+	old := Event{ID: uuid.New(), UserID: userID, When: mustTime(t, "03.01.2022 10:00")}
+	recent := Event{ID: uuid.New(), UserID: userID, When: mustTime(t, "04.01.2022 10:00")}
+	require.NoError(t, storage.Add(old))
+	require.NoError(t, storage.Add(recent))
+	require.NoError(t, storage.Delete(old.ID))
+	require.NoError(t, storage.Delete(recent.ID))
+	// событие old удалено 40 дней назад
+	deletedAt := time.Now().AddDate(0, 0, -40)
+	old.DeletedAt = &deletedAt
+	storage.repo[old.ID] = old
+
+	p := NewTrashPurger(storage, defaultTrashRetention, time.Hour)
+	p.purge()
+	_, err := storage.GetDeleted(old.ID)
+	assert.ErrorIs(t, err, ErrEventNotFound)
+	_, err = storage.GetDeleted(recent.ID)
+	require.NoError(t, err)
+
+	// через 31 день истекает срок хранения и второго события
+	p.now = func() time.Time { return time.Now().AddDate(0, 0, 31) }
+	p.Start()
+	require.Eventually(t, func() bool {
+		trash, err := storage.Trash(userID)
+		return err == nil && len(trash) == 0
+	}, time.Second, 10*time.Millisecond)
+	p.Close()
+}
+
+// noTrashStorage - хранилище без корзины: методы TrashStorage скрыты.
+type noTrashStorage struct {
+	EventStorage
+}
+
+func TestTrashNotSupported(t *testing.T) {
+	storage := noTrashStorage{newTestStorage()}
+	api := NewCalendar(storage)
+	rec := doForm(api.Trash, http.MethodGet, "/trash", url.Values{"user_id": {uuid.NewString()}})
+	assert.Equal(t, http.StatusNotImplemented, rec.Code)
+	rec = doForm(api.RestoreEvent, http.MethodPost, "/restore_event", url.Values{"event_id": {uuid.NewString()}})
+	assert.Equal(t, http.StatusNotImplemented, rec.Code)
+
+	// обёртки хранилища реализуют TrashStorage, но передают отсутствие корзины
+	indexed, err := NewIndexedEventStorage(storage)
+	require.NoError(t, err)
+	rec = doForm(NewCalendar(indexed).Trash, http.MethodGet, "/trash", url.Values{"user_id": {uuid.NewString()}})
+	assert.Equal(t, http.StatusNotImplemented, rec.Code)
+	assert.ErrorIs(t, indexed.Restore(uuid.New()), ErrTrashNotSupported)
+
+	// очистка корзины не запускается
+	p := NewTrashPurger(storage, defaultTrashRetention, time.Hour)
+	p.Start()
+	p.Close()
+}
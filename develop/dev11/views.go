@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// alignCalendar - значение параметра align: календарные сутки, неделя
+	// с понедельника (ISO 8601) и месяц с 1-го числа.
+	alignCalendar = "calendar"
+	// maxAgendaDays - наибольшая длина периода /agenda в днях.
+	maxAgendaDays = 366
+)
+
+// sortOccurrences упорядочивает вхождения событий по времени начала
+// (при совпадении - по ID события).
+func sortOccurrences(events []Event) {
+	sort.Slice(events, func(i, j int) bool {
+		if !events[i].When.Equal(events[j].When) {
+			return events[i].When.Before(events[j].When)
+		}
+		return events[i].ID.String() < events[j].ID.String()
+	})
+}
+
+// startOfDay возвращает начало суток, содержащих t, в часовом поясе t.
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// calendarWeek возвращает границы [начало, конец) недели ISO 8601 (с понедельника),
+// содержащей t, в часовом поясе t.
+func calendarWeek(t time.Time) (time.Time, time.Time) {
+	// воскресенье - седьмой день недели ISO
+	offset := (int(t.Weekday()) + 6) % 7
+	start := startOfDay(t).AddDate(0, 0, -offset)
+	return start, start.AddDate(0, 0, 7)
+}
+
+// calendarMonth возвращает границы [начало, конец) календарного месяца,
+// содержащего t, в часовом поясе t.
+func calendarMonth(t time.Time) (time.Time, time.Time) {
+	y, m, _ := t.Date()
+	start := time.Date(y, m, 1, 0, 0, 0, 0, t.Location())
+	return start, start.AddDate(0, 1, 0)
+}
+
+// getAlign извлекает из запроса необязательный параметр align и возвращает true
+// для календарного выравнивания (align=calendar).
+// Функция обрабатывает и логирует возникшие ошибки.
+func getAlign(w http.ResponseWriter, r *http.Request, logHeader string) (bool, bool) {
+	switch align := r.FormValue("align"); align {
+	case "":
+		return false, true
+	case alignCalendar:
+		return true, true
+	default:
+		returnError(w, logHeader, fmt.Sprintf("incorrect align: %q (want %q)", align, alignCalendar), http.StatusBadRequest)
+		return false, false
+	}
+}
+
+// getPeriod возвращает вхождения событий пользователя, начинающиеся в полуоткрытом
+// отрезке [from, to): вхождения на его правой границе относятся к следующему периоду.
+func getPeriod(s EventStorage, userID uuid.UUID, from, to time.Time) ([]Event, error) {
+	events, err := s.GetRange(userID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	result := events[:0]
+	for _, e := range events {
+		if e.When.Before(to) {
+			result = append(result, e)
+		}
+	}
+	return result, nil
+}
+
+// AgendaDay - события одних суток в повестке /agenda.
+type AgendaDay struct {
+	// Date - дата в формате yyyy-mm-dd в часовом поясе запроса.
+	Date string `json:"date"`
+	// Weekday - день недели (Monday, ...).
+	Weekday string  `json:"weekday"`
+	Events  []Event `json:"events"`
+}
+
+// buildAgenda раскладывает вхождения по суткам периода [from, to) в часовом поясе
+// loc; сутки без событий тоже включаются. from - начало первых суток.
+func buildAgenda(events []Event, from, to time.Time, loc *time.Location) []AgendaDay {
+	days := make([]AgendaDay, 0)
+	index := make(map[string]int)
+	for day := from; day.Before(to); day = day.AddDate(0, 0, 1) {
+		date := day.Format("2006-01-02")
+		index[date] = len(days)
+		days = append(days, AgendaDay{Date: date, Weekday: day.Weekday().String(), Events: make([]Event, 0)})
+	}
+	for _, e := range events {
+		if i, ok := index[e.When.In(loc).Format("2006-01-02")]; ok {
+			days[i].Events = append(days[i].Events, e)
+		}
+	}
+	return days
+}
+
+// Agenda возвращает повестку пользователя: вхождения событий за период,
+// сгруппированные по суткам (включая сутки без событий) в хронологическом порядке.
+// Событие относится к суткам, в которые оно начинается.
+//
+// GET /agenda
+// параметры (* = обязательный):
+//	- *user_id
+//	- *from 		первый день dd.mm.yyyy
+//	- *to 			последний день dd.mm.yyyy (включительно, не больше 366 дней от from)
+//	- tz 			часовой пояс IANA, в котором отсчитываются сутки (по умолчанию UTC)
+//	- group_by 		группировка; поддерживается только day (по умолчанию)
+func (c CalendarAPI) Agenda(w http.ResponseWriter, r *http.Request) {
+	const logHeader = "agenda"
+	if r.Method != http.MethodGet {
+		returnError(w, logHeader, "", http.StatusMethodNotAllowed)
+		return
+	}
+	userID, ok := getUserID(w, r, logHeader)
+	if !ok {
+		return // ошибки уже обработаны
+	}
+	if groupBy := r.FormValue("group_by"); groupBy != "" && groupBy != "day" {
+		returnError(w, logHeader, fmt.Sprintf("incorrect group_by: %q (want day)", groupBy), http.StatusBadRequest)
+		return
+	}
+	loc, err := loadLocation(r.FormValue("tz"))
+	if err != nil {
+		returnError(w, logHeader, fmt.Sprintf("incorrect time zone: %v", err), http.StatusBadRequest)
+		return
+	}
+	var bounds [2]time.Time
+	for i, name := range []string{"from", "to"} {
+		value := r.FormValue(name)
+		if value == "" {
+			returnError(w, logHeader, "missing parameter: "+name, http.StatusBadRequest)
+			return
+		}
+		bounds[i], err = time.ParseInLocation("02.01.2006", value, loc)
+		if err != nil {
+			returnError(w, logHeader, fmt.Sprintf("incorrect %s: %s", name, value), http.StatusBadRequest)
+			return
+		}
+	}
+	from, to := bounds[0], bounds[1].AddDate(0, 0, 1)
+	if !from.Before(to) {
+		returnError(w, logHeader, "from must not be after to", http.StatusBadRequest)
+		return
+	}
+	if from.AddDate(0, 0, maxAgendaDays).Before(to) {
+		returnError(w, logHeader, fmt.Sprintf("period must not exceed %d days", maxAgendaDays), http.StatusBadRequest)
+		return
+	}
+
+	events, err := getPeriod(c.storage, userID, from, to)
+	if err != nil {
+		returnError(w, logHeader, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	returnJSONResult(w, logHeader, buildAgenda(events, from, to, loc), http.StatusOK)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCalendarPeriods(t *testing.T) {
+	moscow, err := time.LoadLocation("Europe/Moscow")
+	require.NoError(t, err)
+	tests := []struct {
+		day        string
+		weekStart  string
+		monthStart string
+		monthEnd   string
+	}{
+		// понедельник, середина недели, воскресенье
+		{"03.01.2022 00:00", "03.01.2022 00:00", "01.01.2022 00:00", "01.02.2022 00:00"},
+		{"05.01.2022 15:30", "03.01.2022 00:00", "01.01.2022 00:00", "01.02.2022 00:00"},
+		{"09.01.2022 23:59", "03.01.2022 00:00", "01.01.2022 00:00", "01.02.2022 00:00"},
+		// неделя ISO переходит через границу года и месяца
+		{"01.01.2022 10:00", "27.12.2021 00:00", "01.01.2022 00:00", "01.02.2022 00:00"},
+		{"29.02.2024 10:00", "26.02.2024 00:00", "01.02.2024 00:00", "01.03.2024 00:00"},
+	}
+	for _, test := range tests {
+		day, err := time.ParseInLocation("02.01.2006 15:04", test.day, moscow)
+		require.NoError(t, err)
+		start, end := calendarWeek(day)
+		assert.Equal(t, test.weekStart, start.Format("02.01.2006 15:04"), test.day)
+		assert.Equal(t, time.Monday, start.Weekday())
+		assert.Equal(t, moscow, start.Location())
+		assert.Equal(t, start.AddDate(0, 0, 7), end)
+		start, end = calendarMonth(day)
+		assert.Equal(t, test.monthStart, start.Format("02.01.2006 15:04"), test.day)
+		assert.Equal(t, test.monthEnd, end.Format("02.01.2006 15:04"), test.day)
+	}
+}
+
+func TestAlignedViews(t *testing.T) {
+	storage := newTestStorage()
+	api := NewCalendar(storage)
+	userID := uuid.New()
+	weekly, err := ParseRRule("FREQ=WEEKLY;BYDAY=MO,FR;COUNT=6")
+	require.NoError(t, err)
+	for _, e := range []Event{
+		{UserID: userID, When: mustTime(t, "05.01.2022 12:00"), What: "Среда"},
+		{UserID: userID, When: mustTime(t, "05.01.2022 09:00"), What: "Среда утром"},
+		{UserID: userID, When: mustTime(t, "02.01.2022 18:00"), What: "Воскресенье"},
+		{UserID: userID, When: mustTime(t, "10.01.2022 00:00"), What: "Следующий понедельник"},
+		{UserID: userID, When: mustTime(t, "31.01.2022 23:00"), What: "Конец месяца"},
+		{UserID: userID, When: mustTime(t, "03.01.2022 08:00"), What: "Планёрка", Recurrence: weekly},
+	} {
+		e.ID = uuid.New()
+		e.Version = 1
+		require.NoError(t, storage.Add(e))
+	}
+
+	// get возвращает описания событий в порядке ответа
+	get := func(h http.HandlerFunc, date, align string) []string {
+		form := url.Values{"user_id": {userID.String()}, "date": {date}}
+		if align != "" {
+			form.Set("align", align)
+		}
+		rec := doForm(h, http.MethodGet, "/", form)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var res respBody
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&res))
+		what := make([]string, 0, len(res.Result))
+		for _, e := range res.Result {
+			what = append(what, e.What)
+		}
+		return what
+	}
+
+	// 7 суток от среды: вхождения в хронологическом порядке, граница включается
+	assert.Equal(t, []string{"Среда утром", "Среда", "Планёрка", "Следующий понедельник", "Планёрка"},
+		get(api.GetWeekEvents, "05.01.2022", ""))
+	// неделя ISO со среды - с понедельника 03.01 по воскресенье 09.01, без полуночи 10.01
+	assert.Equal(t, []string{"Планёрка", "Среда утром", "Среда", "Планёрка"},
+		get(api.GetWeekEvents, "05.01.2022", alignCalendar))
+	assert.Equal(t, []string{"Воскресенье"}, get(api.GetWeekEvents, "02.01.2022", alignCalendar))
+
+	// месяц от 15.01 заканчивается 15.02, календарный - 31.01
+	assert.Equal(t, []string{"Планёрка", "Планёрка", "Конец месяца"}, get(api.GetMonthEvents, "15.01.2022", ""))
+	assert.Equal(t, []string{"Воскресенье", "Планёрка", "Среда утром", "Среда", "Планёрка",
+		"Следующий понедельник", "Планёрка", "Планёрка", "Планёрка", "Планёрка", "Конец месяца"},
+		get(api.GetMonthEvents, "15.01.2022", alignCalendar))
+
+	// полночь следующих суток входит в сутки только без выравнивания
+	assert.Equal(t, []string{"Следующий понедельник"}, get(api.GetDayEvents, "09.01.2022", ""))
+	assert.Empty(t, get(api.GetDayEvents, "09.01.2022", alignCalendar))
+
+	rec := doForm(api.GetWeekEvents, http.MethodGet, "/events_for_week", url.Values{
+		"user_id": {userID.String()}, "date": {"05.01.2022"}, "align": {"iso"},
+	})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestAgenda(t *testing.T) {
+	storage := newTestStorage()
+	api := NewCalendar(storage)
+	userID := uuid.New()
+	for _, e := range []Event{
+		{UserID: userID, When: mustTime(t, "04.01.2022 12:00"), What: "Обед"},
+		{UserID: userID, When: mustTime(t, "04.01.2022 08:00"), What: "Завтрак"},
+		// 23:30 UTC - уже 5 января по московскому времени
+		{UserID: userID, When: mustTime(t, "04.01.2022 23:30"), What: "Ночной звонок"},
+		{UserID: userID, When: mustTime(t, "07.01.2022 10:00"), What: "После периода"},
+	} {
+		e.ID = uuid.New()
+		e.Version = 1
+		require.NoError(t, storage.Add(e))
+	}
+
+	agenda := func(form url.Values) []AgendaDay {
+		form.Set("user_id", userID.String())
+		rec := doForm(api.Agenda, http.MethodGet, "/agenda", form)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var res struct {
+			Result []AgendaDay
+		}
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&res))
+		return res.Result
+	}
+	what := func(day AgendaDay) []string {
+		result := make([]string, 0, len(day.Events))
+		for _, e := range day.Events {
+			result = append(result, e.What)
+		}
+		return result
+	}
+
+	days := agenda(url.Values{"from": {"03.01.2022"}, "to": {"06.01.2022"}, "group_by": {"day"}})
+	require.Equal(t, 4, len(days))
+	assert.Equal(t, AgendaDay{Date: "2022-01-03", Weekday: "Monday", Events: []Event{}}, days[0])
+	assert.Equal(t, "2022-01-04", days[1].Date)
+	assert.Equal(t, []string{"Завтрак", "Обед", "Ночной звонок"}, what(days[1]))
+	assert.Empty(t, days[2].Events)
+	assert.Equal(t, "2022-01-06", days[3].Date)
+	assert.Equal(t, "Thursday", days[3].Weekday)
+	assert.Empty(t, days[3].Events)
+
+	// сутки отсчитываются в часовом поясе tz
+	days = agenda(url.Values{"from": {"04.01.2022"}, "to": {"05.01.2022"}, "tz": {"Europe/Moscow"}})
+	require.Equal(t, 2, len(days))
+	assert.Equal(t, []string{"Завтрак", "Обед"}, what(days[0]))
+	assert.Equal(t, []string{"Ночной звонок"}, what(days[1]))
+
+	// период из одного дня
+	days = agenda(url.Values{"from": {"07.01.2022"}, "to": {"07.01.2022"}})
+	require.Equal(t, 1, len(days))
+	assert.Equal(t, []string{"После периода"}, what(days[0]))
+
+	for _, form := range []url.Values{
+		{"to": {"06.01.2022"}},
+		{"from": {"06.01.2022"}, "to": {"03.01.2022"}},
+		{"from": {"2022-01-03"}, "to": {"06.01.2022"}},
+		{"from": {"01.01.2022"}, "to": {"02.01.2023"}},
+		{"from": {"03.01.2022"}, "to": {"06.01.2022"}, "group_by": {"week"}},
+		{"from": {"03.01.2022"}, "to": {"06.01.2022"}, "tz": {"Mars/Olympus"}},
+	} {
+		form.Set("user_id", userID.String())
+		rec := doForm(api.Agenda, http.MethodGet, "/agenda", form)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, form.Encode())
+	}
+	rec := doForm(api.Agenda, http.MethodPost, "/agenda", url.Values{"user_id": {userID.String()}})
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+)
+
+// Журнал упреждающей записи (write-ahead log) для InmemEventStorage.
+// Каждое изменение хранилища дописывается в журнал и сбрасывается на диск (fsync)
+// до того, как вызов Add/Update/Delete вернёт управление. При сохранении снимка
+// журнал очищается. При запуске журнал применяется поверх последнего снимка.
+//
+// Формат записи: длина данных (4 байта, big endian), CRC32 данных (4 байта),
+// данные - запись walRecord в JSON. Повреждённый или недописанный хвост журнала
+// (например, после аварийного завершения во время записи) отбрасывается.
+
+// walOp - тип операции, записанной в журнал.
+type walOp string
+
+// Операции журнала.
+const (
+	walAdd    walOp = "add"
+	walUpdate walOp = "update"
+	walDelete walOp = "delete"
+	// walBatch - изменения транзакции (см. InmemEventStorage.Tx): записываются
+	// одной записью, поэтому после сбоя применяются либо все, либо ни одно.
+	walBatch walOp = "batch"
+)
+
+const (
+	// размер заголовка записи журнала.
+	walHeaderSize = 8
+	// максимальный размер данных записи; большее значение длины
+	// считается признаком повреждения журнала.
+	walMaxRecordSize = 16 << 20
+)
+
+// walRecord - запись журнала.
+type walRecord struct {
+	Op walOp
+	// Event - событие для операций add и update.
+	Event Event `json:",omitempty"`
+	// ID - идентификатор события для операции delete.
+	ID uuid.UUID `json:",omitempty"`
+	// Batch - записи операции batch.
+	Batch []walRecord `json:",omitempty"`
+}
+
+// eventID возвращает ID события, которое изменяет запись add, update или delete.
+func (rec walRecord) eventID() uuid.UUID {
+	if rec.Op == walDelete {
+		return rec.ID
+	}
+	return rec.Event.ID
+}
+
+// eventIDs возвращает ID событий, которые изменяет запись (для batch - все
+// события её записей без повторов).
+func (rec walRecord) eventIDs() []uuid.UUID {
+	if rec.Op != walBatch {
+		return []uuid.UUID{rec.eventID()}
+	}
+	seen := make(map[uuid.UUID]bool)
+	ids := make([]uuid.UUID, 0, len(rec.Batch))
+	for _, r := range rec.Batch {
+		for _, id := range r.eventIDs() {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+// walFile - файл журнала; *os.File или его обёртка в тестах.
+type walFile interface {
+	io.Writer
+	io.Seeker
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+// eventLog - файл журнала упреждающей записи.
+// Нулевой указатель допустим: записи в него не сохраняются.
+type eventLog struct {
+	path string
+	f    walFile
+	// size - смещение конца последней записи, успешно сброшенной на диск.
+	size int64
+	// err - ошибка, после которой не удалось вернуть файл к size; журнал
+	// не принимает новых записей, пока его не очистит reset.
+	err error
+}
+
+// openEventLog открывает журнал (создавая файл при необходимости) и возвращает
+// прочитанные из него записи. Недописанный или повреждённый хвост журнала
+// отрезается, чтобы новые записи добавлялись после последней целой записи.
+func openEventLog(path string) (*eventLog, []walRecord, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, nil, err
+	}
+	records, size, err := readEventLog(f)
+	if err != nil {
+		log.Printf("eventLog: %s: discarding damaged tail at offset %d: %v", path, size, err)
+		if err := f.Truncate(size); err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+	}
+	if _, err := f.Seek(size, io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return &eventLog{path: path, f: f, size: size}, records, nil
+}
+
+// readEventLog читает записи журнала с начала файла. Возвращает целые записи,
+// смещение конца последней целой записи и ошибку, если после неё есть
+// недописанные или повреждённые данные.
+func readEventLog(r io.Reader) ([]walRecord, int64, error) {
+	br := bufio.NewReader(r)
+	records := make([]walRecord, 0)
+	var offset int64
+	header := make([]byte, walHeaderSize)
+	for {
+		if _, err := io.ReadFull(br, header); err != nil {
+			if err == io.EOF {
+				return records, offset, nil
+			}
+			return records, offset, fmt.Errorf("truncated record header: %w", err)
+		}
+		size := binary.BigEndian.Uint32(header[:4])
+		sum := binary.BigEndian.Uint32(header[4:])
+		if size > walMaxRecordSize {
+			return records, offset, fmt.Errorf("record size %d exceeds limit", size)
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return records, offset, fmt.Errorf("truncated record: %w", err)
+		}
+		if crc32.ChecksumIEEE(data) != sum {
+			return records, offset, errors.New("checksum mismatch")
+		}
+		var rec walRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return records, offset, fmt.Errorf("could not decode record: %w", err)
+		}
+		records = append(records, rec)
+		offset += int64(walHeaderSize + len(data))
+	}
+}
+
+// append дописывает запись в журнал и сбрасывает её на диск. Если запись или
+// сброс не удались, файл обрезается до прежнего размера: иначе недописанная
+// запись оборвала бы чтение журнала при восстановлении и следующие за ней
+// подтверждённые записи были бы потеряны, а несброшенная - применилась бы,
+// хотя клиент получил ошибку.
+func (l *eventLog) append(rec walRecord) error {
+	if l == nil {
+		return nil
+	}
+	if l.err != nil {
+		return fmt.Errorf("eventLog: log is unusable after a failed write: %w", l.err)
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, walHeaderSize+len(data))
+	binary.BigEndian.PutUint32(frame[:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(data))
+	copy(frame[walHeaderSize:], data)
+	if _, err := l.f.Write(frame); err != nil {
+		return l.rollback(fmt.Errorf("eventLog: write failed: %w", err))
+	}
+	if err := l.f.Sync(); err != nil {
+		return l.rollback(fmt.Errorf("eventLog: sync failed: %w", err))
+	}
+	l.size += int64(len(frame))
+	return nil
+}
+
+// rollback обрезает журнал до конца последней целой записи после ошибки err
+// и возвращает err. Если обрезать не удалось, журнал помечается неисправным.
+func (l *eventLog) rollback(err error) error {
+	if terr := l.truncate(l.size); terr != nil {
+		log.Printf("eventLog: %s: could not discard a failed record: %v", l.path, terr)
+		l.err = err
+	}
+	return err
+}
+
+// failure возвращает ошибку, после которой журнал не принимает записей, или nil.
+func (l *eventLog) failure() error {
+	if l == nil {
+		return nil
+	}
+	return l.err
+}
+
+// truncate обрезает файл журнала до size и переносит позицию записи в конец.
+func (l *eventLog) truncate(size int64) error {
+	if err := l.f.Truncate(size); err != nil {
+		return err
+	}
+	if _, err := l.f.Seek(size, io.SeekStart); err != nil {
+		return err
+	}
+	return l.f.Sync()
+}
+
+// reset очищает журнал. Вызывается после того, как все записи журнала
+// попали в сохранённый на диск снимок хранилища.
+func (l *eventLog) reset() error {
+	if l == nil {
+		return nil
+	}
+	if err := l.truncate(0); err != nil {
+		return err
+	}
+	l.size = 0
+	l.err = nil
+	return nil
+}
+
+// close закрывает файл журнала.
+func (l *eventLog) close() error {
+	if l == nil {
+		return nil
+	}
+	return l.f.Close()
+}
+
+// writeFileAtomic записывает файл через временный файл в том же каталоге:
+// данные сбрасываются на диск, после чего временный файл атомарно
+// переименовывается в path. При сбое на любом этапе прежний файл остаётся целым.
+func writeFileAtomic(path string, write func(io.Writer) error) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	// при успешном переименовании удалять уже нечего
+	defer os.Remove(tmp.Name())
+	bw := bufio.NewWriter(tmp)
+	if err := write(bw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	// сохраняем на диск запись каталога о переименовании
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
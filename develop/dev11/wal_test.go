@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/gob"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// openTestInmem открывает хранилище с файлами во временном каталоге dir.
+// Снимок автоматически не сохраняется.
+func openTestInmem(t *testing.T, dir string) *InmemEventStorage {
+	s, err := OpenInmemEventStorage(filepath.Join(dir, "events.gob"), filepath.Join(dir, "events.wal"), time.Hour)
+	require.NoError(t, err)
+	return s
+}
+
+// crash имитирует аварийное завершение: журнал закрывается без сохранения снимка.
+func crash(s *InmemEventStorage) {
+	s.log.close()
+}
+
+func TestWALRecovery(t *testing.T) {
+	dir := t.TempDir()
+	userID := uuid.New()
+	s := openTestInmem(t, dir)
+	e1 := Event{ID: uuid.New(), UserID: userID, When: mustTime(t, "03.01.2022 10:00"), What: "первое"}
+	e2 := Event{ID: uuid.New(), UserID: userID, When: mustTime(t, "04.01.2022 10:00"), What: "второе"}
+	e3 := Event{ID: uuid.New(), UserID: userID, When: mustTime(t, "05.01.2022 10:00"), What: "третье"}
+	require.NoError(t, s.Add(e1))
+	require.NoError(t, s.Add(e2))
+	e1.What = "первое (изменено)"
+	e1.Version++
+	require.NoError(t, s.Update(e1))
+	require.NoError(t, s.Delete(e2.ID))
+	crash(s)
+
+	s = openTestInmem(t, dir)
+	got, err := s.Get(e1.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "первое (изменено)", got.What)
+	_, err = s.Get(e2.ID)
+	assert.ErrorIs(t, err, ErrEventNotFound)
+
+	// снимок очищает журнал; последующие изменения снова попадают в журнал
+	s.saveRepo()
+	info, err := os.Stat(filepath.Join(dir, "events.wal"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), info.Size())
+	require.NoError(t, s.Add(e3))
+	crash(s)
+
+	s = openTestInmem(t, dir)
+	all, err := s.GetByUser(userID)
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(all))
+	s.Close()
+
+	// после штатного закрытия журнал пуст, данные в снимке
+	info, err = os.Stat(filepath.Join(dir, "events.wal"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), info.Size())
+	s = openTestInmem(t, dir)
+	all, err = s.GetByUser(userID)
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(all))
+	s.Close()
+}
+
+func TestWALTruncatedTail(t *testing.T) {
+	dir := t.TempDir()
+	walPath := filepath.Join(dir, "events.wal")
+	s := openTestInmem(t, dir)
+	e1 := Event{ID: uuid.New(), UserID: uuid.New(), When: mustTime(t, "03.01.2022 10:00")}
+	require.NoError(t, s.Add(e1))
+	crash(s)
+	info, err := os.Stat(walPath)
+	require.NoError(t, err)
+	goodSize := info.Size()
+
+	tails := [][]byte{
+		{0, 0},                             // недописанный заголовок
+		{0, 0, 0, 100, 1, 2, 3, 4, '{'},    // недописанные данные
+		{0, 0, 0, 2, 0, 0, 0, 0, '{', '}'}, // неверная контрольная сумма
+	}
+	for _, tail := range tails {
+		f, err := os.OpenFile(walPath, os.O_APPEND|os.O_WRONLY, 0o644)
+		require.NoError(t, err)
+		_, err = f.Write(tail)
+		require.NoError(t, err)
+		f.Close()
+
+		s = openTestInmem(t, dir)
+		_, err = s.Get(e1.ID)
+		assert.NoError(t, err)
+		info, err := os.Stat(walPath)
+		require.NoError(t, err)
+		assert.Equal(t, goodSize, info.Size())
+		crash(s)
+	}
+
+	// новые записи дописываются после последней целой записи
+	s = openTestInmem(t, dir)
+	e2 := Event{ID: uuid.New(), UserID: e1.UserID, When: mustTime(t, "04.01.2022 10:00")}
+	require.NoError(t, s.Add(e2))
+	crash(s)
+	s = openTestInmem(t, dir)
+	all, err := s.GetByUser(e1.UserID)
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(all))
+	s.Close()
+}
+
+// failingFile - файл журнала, запись или сброс которого на диск завершаются ошибкой.
+type failingFile struct {
+	*os.File
+	// failWrite - сколько байт записать перед ошибкой (-1 - писать без ошибок).
+	failWrite int
+	failSync  bool
+}
+
+func (f *failingFile) Write(p []byte) (int, error) {
+	if f.failWrite >= 0 {
+		n, _ := f.File.Write(p[:f.failWrite])
+		return n, errors.New("disk full")
+	}
+	return f.File.Write(p)
+}
+
+func (f *failingFile) Sync() error {
+	if f.failSync {
+		return errors.New("i/o error")
+	}
+	return f.File.Sync()
+}
+
+// TestWALFailedAppend проверяет, что запись, которую не удалось записать или
+// сбросить на диск, не попадает в журнал и не мешает восстановить следующие.
+func TestWALFailedAppend(t *testing.T) {
+	dir := t.TempDir()
+	userID := uuid.New()
+	s := openTestInmem(t, dir)
+	file := &failingFile{File: s.log.f.(*os.File), failWrite: -1}
+	s.log.f = file
+	event := func(what string, day int) Event {
+		return Event{ID: uuid.New(), UserID: userID, When: time.Date(2022, 1, day, 10, 0, 0, 0, time.UTC), What: what}
+	}
+	e1, e2, e3, e4 := event("первое", 3), event("не записано", 4), event("не сброшено", 5), event("после ошибки", 6)
+	require.NoError(t, s.Add(e1))
+
+	// недописанная запись отрезается, журнал продолжает работать
+	file.failWrite = 10
+	assert.Error(t, s.Add(e2))
+	file.failWrite = -1
+	require.NoError(t, s.Add(e4))
+
+	// после ошибки сброса на диск журнал не принимает записей, пока его не очистит снимок
+	file.failSync = true
+	assert.Error(t, s.Add(e3))
+	file.failSync = false
+	assert.Error(t, s.Add(e3))
+	assert.Error(t, s.Ready())
+	s.saveRepo()
+	assert.NoError(t, s.Ready())
+	e5 := event("после снимка", 7)
+	require.NoError(t, s.Add(e5))
+	crash(s)
+
+	s = openTestInmem(t, dir)
+	defer s.Close()
+	all, err := s.GetByUser(userID)
+	require.NoError(t, err)
+	got := make([]string, 0, len(all))
+	for _, e := range all {
+		got = append(got, e.What)
+	}
+	assert.ElementsMatch(t, []string{e1.What, e4.What, e5.What}, got)
+}
+
+func TestWALReplayIsIdempotent(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestInmem(t, dir)
+	e := Event{ID: uuid.New(), UserID: uuid.New(), When: mustTime(t, "03.01.2022 10:00")}
+	require.NoError(t, s.Add(e))
+	e.What = "изменено"
+	e.Version++
+	require.NoError(t, s.Update(e))
+	// сбой между сохранением снимка и очисткой журнала
+	require.NoError(t, writeFileAtomic(s.snapshotPath, func(w io.Writer) error {
+		return gob.NewEncoder(w).Encode(s.repo)
+	}))
+	crash(s)
+
+	s = openTestInmem(t, dir)
+	defer s.Close()
+	got, err := s.Get(e.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "изменено", got.What)
+	all, err := s.GetByUser(e.UserID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(all))
+}
+
+func TestWALTrash(t *testing.T) {
+	dir := t.TempDir()
+	userID := uuid.New()
+	s := openTestInmem(t, dir)
+	e1 := Event{ID: uuid.New(), UserID: userID, When: mustTime(t, "03.01.2022 10:00"), What: "первое"}
+	e2 := Event{ID: uuid.New(), UserID: userID, When: mustTime(t, "04.01.2022 10:00"), What: "второе"}
+	require.NoError(t, s.Add(e1))
+	require.NoError(t, s.Add(e2))
+	require.NoError(t, s.Delete(e1.ID))
+	require.NoError(t, s.Delete(e2.ID))
+	require.NoError(t, s.Restore(e2.ID))
+	crash(s)
+
+	// корзина восстанавливается из журнала, а затем из снимка
+	s = openTestInmem(t, dir)
+	trash, err := s.Trash(userID)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(trash))
+	assert.Equal(t, e1.ID, trash[0].ID)
+	assert.NotNil(t, trash[0].DeletedAt)
+	_, err = s.Get(e2.ID)
+	require.NoError(t, err)
+	s.Close()
+
+	s = openTestInmem(t, dir)
+	trash, err = s.Trash(userID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(trash))
+	n, err := s.Purge(time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	crash(s)
+
+	s = openTestInmem(t, dir)
+	defer s.Close()
+	_, err = s.GetDeleted(e1.ID)
+	assert.ErrorIs(t, err, ErrEventNotFound)
+	all, err := s.GetByUser(userID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(all))
+}